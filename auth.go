@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// authToken is a bearer token and the user it authenticates.
+type authToken struct {
+	user  string
+	token string
+}
+
+// authTokens authenticates requests to the file storage API. When it is
+// empty, authentication is disabled and every request is anonymous.
+var authTokens []authToken
+
+// loadAuthTokens reads the token file at path. On Unix the file must not be
+// readable by group or others, like the encryption key file.
+func loadAuthTokens(path string) ([]authToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("token file %s is accessible by other users (mode %04o); restrict it to 0600", path, info.Mode().Perm())
+	}
+
+	tokens, err := parseAuthTokens(f)
+	if err != nil {
+		return nil, fmt.Errorf("token file %s: %w", path, err)
+	}
+	return tokens, nil
+}
+
+// parseAuthTokens reads a token file: one "<user> <token>" pair per line.
+// Blank lines and lines starting with '#' are ignored. A user may have
+// several tokens, but a token belongs to one user.
+func parseAuthTokens(r io.Reader) ([]authToken, error) {
+	var tokens []authToken
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"<user> <token>\"", number)
+		}
+		if seen[fields[1]] {
+			return nil, fmt.Errorf("line %d: token is already assigned", number)
+		}
+		seen[fields[1]] = true
+		tokens = append(tokens, authToken{user: fields[0], token: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens")
+	}
+	return tokens, nil
+}
+
+// authenticate returns the user the bearer token in header belongs to.
+// Every token is compared, in constant time, so the time taken does not
+// reveal how much of a token was right.
+func authenticate(header string) (string, bool) {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	user := ""
+	for _, t := range authTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) == 1 {
+			user = t.user
+		}
+	}
+	return user, user != ""
+}
+
+// authMiddleware requires a valid bearer token when authentication is
+// enabled and records the user it belongs to as the "user" value of the
+// request context, which storage quotas are charged to.
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(authTokens) == 0 {
+			next(w, r)
+			return
+		}
+
+		traceID, _ := r.Context().Value("traceID").(string)
+		user, ok := authenticate(r.Header.Get("Authorization"))
+		if !ok {
+			slog.WarnContext(r.Context(), "Rejected unauthenticated request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"traceID", traceID)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="files"`)
+			respondWithError(w, http.StatusUnauthorized, "A valid bearer token is required", traceID)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "user", user)
+		next(w, r.WithContext(ctx))
+	}
+}
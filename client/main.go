@@ -23,6 +23,7 @@ func main() {
 		user       = flag.String("user", "", "User for message operations")
 		message    = flag.String("message", "", "Message to save")
 		getLast10  = flag.Bool("get", false, "Get last 10 messages")
+		search     = flag.String("search", "", "Search messages for words, \"phrases\" and prefix* words")
 	)
 	flag.Parse()
 
@@ -35,7 +36,12 @@ func main() {
 	client := pb.NewMessageServiceClient(conn)
 	fmt.Printf("🔌 Connected to gRPC Message Service at %s\n", *serverAddr)
 
-	if *getLast10 {
+	if *search != "" {
+		err := searchMessages(client, *search)
+		if err != nil {
+			log.Fatalf("Failed to search messages: %v", err)
+		}
+	} else if *getLast10 {
 		err := getMessages(client)
 		if err != nil {
 			log.Fatalf("Failed to get messages: %v", err)
@@ -49,6 +55,7 @@ func main() {
 		fmt.Println("\n📖 gRPC Client Usage:")
 		fmt.Printf("  Save message:    go run . -user=alice -message='Hello gRPC!'\n")
 		fmt.Printf("  Get messages:    go run . -get\n")
+		fmt.Printf("  Search messages: go run . -search='hello \"staging build\" depl*'\n")
 		fmt.Printf("  Custom server:   go run . -server=localhost:50051 -get\n")
 
 		demoUser := "demo"
@@ -81,12 +88,12 @@ func saveMessage(client pb.MessageServiceClient, user, message string) error {
 
 	fmt.Printf("💾 Saving message: %s -> %s\n", user, message)
 
-	_, err := client.Save(ctx, req)
+	saved, err := client.Save(ctx, req)
 	if err != nil {
 		return fmt.Errorf("save failed: %w", err)
 	}
 
-	fmt.Printf("✅ Message saved successfully!\n")
+	fmt.Printf("✅ Message saved successfully with ID %d!\n", saved.GetId())
 	return nil
 }
 
@@ -110,11 +117,52 @@ func getMessages(client pb.MessageServiceClient) error {
 	fmt.Printf("\n📋 Last %d Messages:\n", len(messages))
 	for _, msg := range messages {
 		timestamp := msg.GetTimestamp().AsTime()
+		text := msg.GetMessage()
+		switch {
+		case msg.GetDeleted():
+			text = "🗑️  (deleted)"
+		case msg.GetEditedAt() != nil:
+			text += " (edited)"
+		}
 		fmt.Printf("  [%d] %s (%s): %s\n",
 			msg.GetId(),
 			msg.GetUser(),
 			timestamp.Format("2006-01-02 15:04:05"),
-			msg.GetMessage())
+			text)
+	}
+
+	return nil
+}
+
+func searchMessages(client pb.MessageServiceClient, query string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fmt.Printf("🔎 Searching messages for: %s\n", query)
+
+	resp, err := client.Search(ctx, &pb.SearchRequest{Query: query})
+	if err != nil {
+		return fmt.Errorf("search failed: %w", err)
+	}
+
+	hits := resp.GetHits()
+	if len(hits) == 0 {
+		fmt.Println("📭 No messages found.")
+		return nil
+	}
+
+	fmt.Printf("\n📋 %d Matching Messages:\n", len(hits))
+	for _, hit := range hits {
+		msg := hit.GetMessage()
+		timestamp := msg.GetTimestamp().AsTime()
+		fmt.Printf("  [%d] %s (%s): %s\n",
+			msg.GetId(),
+			msg.GetUser(),
+			timestamp.Format("2006-01-02 15:04:05"),
+			hit.GetSnippet())
+	}
+	if resp.GetNextCursor() != "" {
+		fmt.Println("  … more messages match; narrow the search to see them.")
 	}
 
 	return nil
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/messagestore"
+)
+
+// Formats of GET /api/messages, chosen by the format query parameter or the
+// Accept header.
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+	formatXML    = "xml"
+)
+
+// formatContentTypes is the Content-Type answered in each format.
+var formatContentTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatNDJSON: "application/x-ndjson",
+	formatXML:    "application/xml; charset=utf-8",
+}
+
+// acceptFormats maps the media types understood in an Accept header to
+// formats. Wildcards get the JSON envelope, like requests without Accept.
+var acceptFormats = map[string]string{
+	"application/json":     formatJSON,
+	"text/csv":             formatCSV,
+	"application/x-ndjson": formatNDJSON,
+	"application/ndjson":   formatNDJSON,
+	"application/xml":      formatXML,
+	"text/xml":             formatXML,
+	"application/*":        formatJSON,
+	"*/*":                  formatJSON,
+}
+
+// csvHeader names the columns of a CSV message listing.
+var csvHeader = []string{"id", "user", "message", "timestamp", "edited_at", "deleted"}
+
+// csvCell returns s as a CSV cell that spreadsheets show as text: a value
+// starting with a character that would make it a formula is prefixed
+// with '.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// errUnknownFormat and errNotAcceptable are returned by negotiateFormat when
+// no format can be chosen.
+var (
+	errUnknownFormat = errors.New("format must be 'json', 'csv', 'ndjson' or 'xml'")
+	errNotAcceptable = errors.New("none of application/json, text/csv, application/x-ndjson or application/xml is acceptable")
+)
+
+// errStreamLimit stops an NDJSON stream once limit messages are written.
+var errStreamLimit = errors.New("stream limit reached")
+
+// xmlMessages is the XML form of a page of messages.
+type xmlMessages struct {
+	XMLName    xml.Name     `xml:"messages"`
+	TraceID    string       `xml:"trace_id,attr"`
+	NextCursor string       `xml:"next_cursor,attr,omitempty"`
+	Messages   []xmlMessage `xml:"message"`
+}
+
+// xmlMessage is the XML form of a message.
+type xmlMessage struct {
+	ID        int        `xml:"id,attr"`
+	Deleted   bool       `xml:"deleted,attr,omitempty"`
+	User      string     `xml:"user"`
+	Message   string     `xml:"text"`
+	Timestamp time.Time  `xml:"timestamp"`
+	EditedAt  *time.Time `xml:"edited_at,omitempty"`
+}
+
+// xmlError is the XML form of an error response.
+type xmlError struct {
+	XMLName xml.Name `xml:"error"`
+	TraceID string   `xml:"trace_id,attr"`
+	Message string   `xml:",chardata"`
+}
+
+// negotiateFormat picks the format of a message listing: the format query
+// parameter if set, otherwise the acceptable media type with the highest
+// q value, the first listed on ties. Without either it is JSON.
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return formatJSON, errUnknownFormat
+		}
+		return format, nil
+	}
+
+	header := strings.TrimSpace(r.Header.Get("Accept"))
+	if header == "" {
+		return formatJSON, nil
+	}
+	best, bestWeight := "", 0.0
+	for _, candidate := range strings.Split(header, ",") {
+		mediaType, params, _ := strings.Cut(candidate, ";")
+		format, ok := acceptFormats[strings.ToLower(strings.TrimSpace(mediaType))]
+		if !ok {
+			continue
+		}
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				var err error
+				if weight, err = strconv.ParseFloat(q, 64); err != nil {
+					weight = 0
+				}
+			}
+		}
+		if weight > bestWeight {
+			best, bestWeight = format, weight
+		}
+	}
+	if best == "" {
+		return formatJSON, errNotAcceptable
+	}
+	return best, nil
+}
+
+// respondWithMessages answers GET /api/messages with the page of messages
+// matching query in format. NDJSON is streamed instead, see
+// streamMessagesNDJSON.
+func respondWithMessages(w http.ResponseWriter, r *http.Request, format string, query messagestore.Query, traceID string) {
+	if format == formatNDJSON {
+		streamMessagesNDJSON(w, r, query, traceID)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), "traceID", traceID)
+	page, err := messagestore.Find(ctx, messageStore, query)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read messages", "error", err, "traceID", traceID)
+		respondWithFormatError(w, format, http.StatusInternalServerError, "Failed to read messages", traceID)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Messages retrieved successfully",
+		"message_count", len(page.Messages),
+		"next_cursor", page.NextCursor,
+		"format", format,
+		"traceID", traceID)
+
+	if format == formatJSON {
+		respondWithPage(w, http.StatusOK, page.Messages, page.NextCursor, traceID)
+		return
+	}
+
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if format == formatCSV {
+		out := csv.NewWriter(w)
+		out.Write(csvHeader)
+		for _, m := range page.Messages {
+			editedAt := ""
+			if m.EditedAt != nil {
+				editedAt = m.EditedAt.Format(time.RFC3339Nano)
+			}
+			out.Write([]string{
+				strconv.Itoa(m.ID),
+				csvCell(m.User),
+				csvCell(m.Message),
+				m.Timestamp.Format(time.RFC3339Nano),
+				editedAt,
+				strconv.FormatBool(m.Deleted),
+			})
+		}
+		out.Flush()
+		return
+	}
+
+	doc := xmlMessages{TraceID: traceID, NextCursor: page.NextCursor, Messages: make([]xmlMessage, len(page.Messages))}
+	for i, m := range page.Messages {
+		doc.Messages[i] = xmlMessage{
+			ID:        m.ID,
+			Deleted:   m.Deleted,
+			User:      m.User,
+			Message:   m.Message,
+			Timestamp: m.Timestamp,
+			EditedAt:  m.EditedAt,
+		}
+	}
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(doc)
+}
+
+// streamMessagesNDJSON writes the messages matching query as one JSON object
+// per line, flushing each as it is read from the store. Unlike the other
+// formats it has no default limit and streams every match unless limit is
+// set; the next page starts after the last ID received. An error after the
+// first line is reported as a final line holding the error Response.
+func streamMessagesNDJSON(w http.ResponseWriter, r *http.Request, query messagestore.Query, traceID string) {
+	ctx := context.WithValue(r.Context(), "traceID", traceID)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	w.Header().Set("Content-Type", formatContentTypes[formatNDJSON])
+
+	written := 0
+	err := messagestore.Scan(ctx, messageStore, query, func(msg Message) error {
+		if query.Limit > 0 && written == query.Limit {
+			return errStreamLimit
+		}
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+		written++
+		rc.Flush()
+		return nil
+	})
+	if errors.Is(err, errStreamLimit) {
+		err = nil
+	}
+
+	slog.InfoContext(r.Context(), "Messages streamed",
+		"message_count", written,
+		"error", err,
+		"traceID", traceID)
+
+	if err == nil {
+		return
+	}
+	if written == 0 {
+		respondWithFormatError(w, formatNDJSON, http.StatusInternalServerError, "Failed to read messages", traceID)
+		return
+	}
+	enc.Encode(Response{Success: false, Error: "Failed to read messages", TraceID: traceID})
+}
+
+// flushWriter flushes the response after every write, so each line of a
+// stream reaches the client as soon as it is written.
+type flushWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	written int64
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	return &flushWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
+}
+
+// respondWithFormatError answers with an error in format, carrying the trace
+// ID like the JSON Response envelope does.
+func respondWithFormatError(w http.ResponseWriter, format string, statusCode int, message string, traceID string) {
+	if format == formatJSON {
+		respondWithError(w, statusCode, message, traceID)
+		return
+	}
+
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	w.WriteHeader(statusCode)
+	switch format {
+	case formatCSV:
+		out := csv.NewWriter(w)
+		out.Write([]string{"error", "trace_id"})
+		out.Write([]string{csvCell(message), csvCell(traceID)})
+		out.Flush()
+	case formatNDJSON:
+		json.NewEncoder(w).Encode(Response{Success: false, Error: message, TraceID: traceID})
+	case formatXML:
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(xmlError{TraceID: traceID, Message: message})
+	}
+}
@@ -4,8 +4,25 @@ go 1.22
 
 replace cgi.com/goLangTraining/src/pkg/storage => ./src/pkg/storage
 
+replace cgi.com/goLangTraining/src/pkg/messagestore => ./src/pkg/messagestore
+
+replace cgi.com/goLangTraining/src/pkg/message => ./src/pkg/message
+
+replace cgi.com/goLangTraining/src/pkg/envelope => ./src/pkg/envelope
+
 require (
+	cgi.com/goLangTraining/src/pkg/envelope v0.0.0-00010101000000-000000000000
+	cgi.com/goLangTraining/src/pkg/message v0.0.0-00010101000000-000000000000
+	cgi.com/goLangTraining/src/pkg/messagestore v0.0.0-00010101000000-000000000000
 	cgi.com/goLangTraining/src/pkg/storage v0.0.0-00010101000000-000000000000
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/stretchr/testify v1.11.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -5,18 +5,27 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"cgi.com/goLangTraining/src/pkg/envelope"
+	"cgi.com/goLangTraining/src/pkg/message"
+	"cgi.com/goLangTraining/src/pkg/messagestore"
 	"cgi.com/goLangTraining/src/pkg/storage"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -32,6 +41,10 @@ const (
 	messagesFileName        = "messages.txt"
 	defaultAPIVersion       = "1.0.0"
 	defaultPort             = 8080
+	defaultStorageRoot      = "data"
+	// maxMessageBodyBytes caps the body of a message create or edit; no
+	// longer message fits in a stored record anyway.
+	maxMessageBodyBytes = message.MaxLineSize
 )
 
 // WebSocket upgrader for Assignment 5
@@ -42,13 +55,13 @@ var upgrader = websocket.Upgrader{
 }
 
 // Message represents a message in our system
-type Message struct {
-	ID        int       `json:"id"`
-	User      string    `json:"user"`
-	Message   string    `json:"message"`
-	Timestamp time.Time `json:"timestamp"`
-	TraceID   string    `json:"trace_id,omitempty"`
-}
+type Message = message.Message
+
+// messageStore persists messages for every handler and CLI operation
+var messageStore messagestore.MessageStore = messagestore.NewFileStore(messagesFileName)
+
+// fileBackend stores the files served by the file storage API
+var fileBackend storage.Backend
 
 // CreateMessageRequest represents the request body for creating a message
 type CreateMessageRequest struct {
@@ -56,12 +69,20 @@ type CreateMessageRequest struct {
 	Message string `json:"message"`
 }
 
+// EditMessageRequest represents the request body for editing a message
+type EditMessageRequest struct {
+	Message string `json:"message"`
+}
+
 // Response represents a standard API response structure
 type Response struct {
 	Success bool        `json:"success"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
 	TraceID string      `json:"trace_id"`
+	// NextCursor fetches the next page of a paged listing; it is empty on
+	// the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 // HealthStatus represents the health check response structure
@@ -89,22 +110,87 @@ func main() {
 	// Parse command line flags
 	var (
 		port        = flag.Int("port", defaultPort, "Port for HTTP server")
-		user        = flag.String("user", "", "User for CLI message operations")
-		message     = flag.String("message", "", "Message for CLI operations")
-		clear       = flag.Bool("clear", false, "Clear all messages")
-		file        = flag.String("file", "example.txt", "File path for storage operations")
-		data        = flag.String("data", "", "Data to save to file")
 		cliMode     = flag.Bool("cli", false, "Run in CLI mode (no web server)")
-		storageDemo = flag.Bool("storage-demo", false, "Run storage demonstration")
+		storeConfig = messagestore.DefaultConfig(messagesFileName)
+		durability  = flag.String("storage-durability", storage.DefaultDurability.String(), "Flush level for file storage writes: 'full', 'file' or 'none'")
+		fileConfig  = storage.DefaultBackendConfig(defaultStorageRoot)
+		keyConfig   envelope.Config
+		tokensFile  = flag.String("auth-tokens-file", "", "File of '<user> <token>' lines; when set, the file storage API requires a bearer token")
+		opts        cliOptions
 	)
+	storeConfig.RegisterFlags(flag.CommandLine)
+	fileConfig.RegisterFlags(flag.CommandLine)
+	keyConfig.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&opts.user, "user", "", "User for CLI message operations")
+	flag.StringVar(&opts.message, "message", "", "Message for CLI operations")
+	flag.BoolVar(&opts.clear, "clear", false, "Clear all messages")
+	flag.StringVar(&opts.file, "file", "example.txt", "File path for storage operations")
+	flag.StringVar(&opts.data, "data", "", "Data to save to file")
+	flag.BoolVar(&opts.storageDemo, "storage-demo", false, "Run storage demonstration")
+	flag.BoolVar(&opts.fsck, "fsck", false, "Check the message log and the file storage root and report problems")
+	flag.BoolVar(&opts.repair, "repair", false, "With -fsck, repair the problems found")
+	flag.BoolVar(&opts.migrate, "migrate", false, "Repair the message log and rewrite it in the current format")
+	flag.BoolVar(&opts.reencrypt, "reencrypt", false, "Re-encrypt the message log and the file storage root under the active key")
+	flag.StringVar(&opts.export, "export", "", "Export the messages as NDJSON to this file")
+	flag.StringVar(&opts.importFrom, "import", "", "Import NDJSON messages from this file ('-' for stdin)")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "With -import, only validate the records")
 	flag.Parse()
 
+	keys, err := keyConfig.Load()
+	if err != nil {
+		slog.Error("Failed to load encryption keys", "error", err, "keyFile", keyConfig.KeyFile)
+		os.Exit(1)
+	}
+	storeConfig.Keys = keys
+	fileConfig.Keys = keys
+	opts.storage = fileConfig
+
+	if *tokensFile != "" {
+		tokens, err := loadAuthTokens(*tokensFile)
+		if err != nil {
+			slog.Error("Failed to load auth tokens", "error", err, "tokensFile", *tokensFile)
+			os.Exit(1)
+		}
+		authTokens = tokens
+	}
+
+	level, err := storage.ParseDurability(*durability)
+	if err != nil {
+		slog.Error("Invalid storage durability", "error", err)
+		os.Exit(1)
+	}
+	storage.DefaultDurability = level
+
+	store, err := storeConfig.Open()
+	if err != nil {
+		slog.Error("Failed to create message store", "error", err)
+		os.Exit(1)
+	}
+	messageStore = store
+
 	// If CLI mode is requested, handle CLI operations and exit
 	if *cliMode {
-		handleCLIOperations(*user, *message, *clear, *file, *data, *storageDemo)
+		handleCLIOperations(opts)
 		return
 	}
 
+	// Messages written while serving are indexed for search
+	messageStore = messagestore.NewSearchIndex(store)
+
+	// The segmented store is compacted in the background while serving
+	compactCtx, stopCompactor := context.WithCancel(context.Background())
+	defer stopCompactor()
+	if segments, ok := store.(*messagestore.SegmentStore); ok {
+		go segments.RunCompactor(compactCtx, storeConfig.CompactInterval)
+	}
+
+	backend, err := fileConfig.Open()
+	if err != nil {
+		slog.Error("Failed to open storage backend", "error", err, "backend", fileConfig.Kind, "storageRoot", fileConfig.Root)
+		os.Exit(1)
+	}
+	fileBackend = backend
+
 	// Default behavior: start the full web application with all features
 	startWebApplication(*port)
 }
@@ -121,24 +207,73 @@ func setupLogging() {
 	slog.SetDefault(logger)
 }
 
+// cliOptions holds the command-line flags used by CLI mode
+type cliOptions struct {
+	user        string
+	message     string
+	clear       bool
+	file        string
+	data        string
+	storageDemo bool
+	fsck        bool
+	repair      bool
+	migrate     bool
+	reencrypt   bool
+	export      string
+	importFrom  string
+	dryRun      bool
+	storage     storage.BackendConfig
+}
+
 // handleCLIOperations processes command-line operations and exits
-func handleCLIOperations(user, message string, clear bool, file, data string, storageDemo bool) {
+func handleCLIOperations(opts cliOptions) {
 	fmt.Println("=== CGI Go Training Service - CLI Mode ===")
 
 	// Handle storage demo (Assignment 2 functionality)
-	if storageDemo {
-		runStorageDemo(file, data)
+	if opts.storageDemo {
+		runStorageDemo(opts.file, opts.data)
+		return
+	}
+
+	// Handle message log and file storage maintenance
+	if opts.fsck {
+		err := migrateMessageLog(!opts.repair)
+		exitOnError(errors.Join(err, checkStorageRoot(opts.storage, opts.repair)))
+		return
+	}
+	if opts.migrate {
+		exitOnError(migrateMessageLog(false))
+		return
+	}
+	if opts.reencrypt {
+		if opts.storage.Keys == nil {
+			fmt.Println("❌ Re-encryption needs a key file: set -encryption-key-file")
+			os.Exit(1)
+		}
+		// The log goes first so the file storage is left alone if it fails
+		exitOnError(migrateMessageLog(false))
+		exitOnError(reencryptStorageRoot(opts.storage))
+		return
+	}
+
+	// Handle moving messages between environments
+	if opts.export != "" {
+		exportMessages(opts.export)
+		return
+	}
+	if opts.importFrom != "" {
+		importMessages(opts.importFrom, opts.dryRun)
 		return
 	}
 
 	// Handle message operations (Assignment 1 functionality)
-	if clear {
+	if opts.clear {
 		clearMessages()
 		return
 	}
 
-	if user != "" && message != "" {
-		addMessage(user, message)
+	if opts.user != "" && opts.message != "" {
+		addMessage(context.Background(), opts.user, opts.message)
 		printLast10Messages()
 		return
 	}
@@ -147,6 +282,12 @@ func handleCLIOperations(user, message string, clear bool, file, data string, st
 	fmt.Println("\nCLI Usage:")
 	fmt.Println("  Add message:    go run main.go -cli -user=alice -message='Hello World'")
 	fmt.Println("  Clear messages: go run main.go -cli -clear")
+	fmt.Println("  Check storage:  go run main.go -cli -fsck")
+	fmt.Println("  Repair storage: go run main.go -cli -fsck -repair")
+	fmt.Println("  Migrate log:    go run main.go -cli -migrate")
+	fmt.Println("  Re-encrypt:     go run main.go -cli -reencrypt -encryption-key-file=keys.txt")
+	fmt.Println("  Export:         go run main.go -cli -export=messages.ndjson")
+	fmt.Println("  Import:         go run main.go -cli -import=messages.ndjson [-dry-run]")
 	fmt.Println("  Storage demo:   go run main.go -cli -storage-demo")
 	fmt.Println("  Storage demo:   go run main.go -cli -storage-demo -file=test.txt -data='Custom data'")
 	fmt.Println("\nWeb Server (default):")
@@ -174,6 +315,10 @@ func startWebApplication(port int) {
 
 	// REST API routes (Assignment 3)
 	mux.HandleFunc("/api/messages", traceMiddleware(messagesAPIHandler))
+	mux.HandleFunc("/api/messages/search", traceMiddleware(searchMessagesHandler))
+	mux.HandleFunc("/api/messages/export", traceMiddleware(exportMessagesHandler))
+	mux.HandleFunc("/api/messages/import", traceMiddleware(importMessagesHandler))
+	mux.HandleFunc("/api/messages/{id}", traceMiddleware(messageResourceHandler))
 	mux.HandleFunc("/api/health", traceMiddleware(healthHandler))
 
 	// Legacy API routes for backward compatibility
@@ -181,7 +326,9 @@ func startWebApplication(port int) {
 	mux.HandleFunc("/health", traceMiddleware(healthHandler))
 
 	// File storage API routes (Assignment 2)
-	mux.HandleFunc("/api/files", traceMiddleware(fileStorageHandler))
+	mux.HandleFunc("/api/files", traceMiddleware(authMiddleware(fileStorageHandler)))
+	mux.HandleFunc("/api/files/{path...}", traceMiddleware(authMiddleware(fileResourceHandler)))
+	mux.HandleFunc("/api/usage", traceMiddleware(authMiddleware(usageHandler)))
 
 	// WebSocket routes (Assignment 5)
 	mux.HandleFunc("/ws", traceMiddleware(websocketHandler))
@@ -202,10 +349,17 @@ func startWebApplication(port int) {
 		fmt.Printf("   http://localhost:%d/                 - Home page\n", port)
 		fmt.Printf("   http://localhost:%d/web/messages     - Messages page (Assignment 4)\n", port)
 		fmt.Printf("\n🔌 REST API:\n")
-		fmt.Printf("   GET  http://localhost:%d/api/messages  - List messages (Assignment 1)\n", port)
+		fmt.Printf("   GET  http://localhost:%d/api/messages  - List messages (?limit=&cursor=&sort=&user=&since=&until=)\n", port)
 		fmt.Printf("   POST http://localhost:%d/api/messages  - Create message (Assignment 1)\n", port)
+		fmt.Printf("   GET|PATCH|DELETE http://localhost:%d/api/messages/{id} - Read, edit or delete a message\n", port)
+		fmt.Printf("   GET  http://localhost:%d/api/messages/search?q= - Full-text search (\"phrases\", prefix*)\n", port)
+		fmt.Printf("   GET  http://localhost:%d/api/messages/export - Export messages as NDJSON\n", port)
+		fmt.Printf("   POST http://localhost:%d/api/messages/import - Import NDJSON messages (?dry_run=true)\n", port)
 		fmt.Printf("   GET  http://localhost:%d/api/health    - Health check (Assignment 3)\n", port)
 		fmt.Printf("   POST http://localhost:%d/api/files     - File operations (Assignment 2)\n", port)
+		fmt.Printf("   GET  http://localhost:%d/api/files     - List files (?prefix=&glob=&limit=&cursor=)\n", port)
+		fmt.Printf("   GET|HEAD|PUT|DELETE http://localhost:%d/api/files/{path} - Raw file resources\n", port)
+		fmt.Printf("   GET  http://localhost:%d/api/usage     - Storage usage and quotas\n", port)
 		fmt.Printf("\n💡 Quick Test:\n")
 		fmt.Printf("   curl -X POST http://localhost:%d/api/messages -H 'Content-Type: application/json' -d '{\"user\":\"demo\",\"message\":\"Hello API!\"}'\n", port)
 		fmt.Printf("\n📋 CLI Operations:\n")
@@ -235,27 +389,24 @@ func startWebApplication(port int) {
 
 // Assignment 1: Message System Functions
 
-func addMessage(user, message string) error {
-	f, err := os.OpenFile(messagesFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	line := fmt.Sprintf("[%s] %s: %s\n", timestamp, user, message)
-	_, err = f.WriteString(line)
+// addMessage persists a message and returns it with its assigned ID
+func addMessage(ctx context.Context, user, message string) (Message, error) {
+	saved, err := messageStore.Append(ctx, Message{
+		User:      user,
+		Message:   message,
+		Timestamp: time.Now(),
+	})
 	if err != nil {
-		return err
+		return Message{}, err
 	}
 
-	fmt.Printf("✅ Message added: %s: %s\n", user, message)
-	return nil
+	fmt.Printf("✅ Message #%d added: %s: %s\n", saved.ID, user, message)
+	return saved, nil
 }
 
 func clearMessages() {
-	err := os.Truncate(messagesFileName, 0)
-	if err != nil && !os.IsNotExist(err) {
+	err := messageStore.Clear(context.Background())
+	if err != nil {
 		fmt.Printf("❌ Error clearing messages: %v\n", err)
 		return
 	}
@@ -263,137 +414,237 @@ func clearMessages() {
 }
 
 func printLast10Messages() {
-	f, err := os.Open(messagesFileName)
+	messages, err := messageStore.Tail(context.Background(), 10)
 	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("📭 No messages found.")
-			return
-		}
 		fmt.Printf("❌ Error reading messages: %v\n", err)
 		return
 	}
-	defer f.Close()
 
-	var lines []string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	if len(messages) == 0 {
+		fmt.Println("📭 No messages found.")
+		return
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("❌ Error scanning messages: %v\n", err)
+	fmt.Println("\n📨 Last 10 Messages:")
+	for _, m := range messages {
+		fmt.Println("  " + message.FormatLegacyLine(m))
+	}
+}
+
+// exportMessages writes every message to path as NDJSON
+func exportMessages(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("❌ Error creating export file: %v\n", err)
 		return
 	}
+	defer f.Close()
 
-	fmt.Println("\n📨 Last 10 Messages:")
-	start := 0
-	if len(lines) > 10 {
-		start = len(lines) - 10
+	n, err := messagestore.Export(context.Background(), messageStore, messagestore.Query{}, f)
+	if err == nil {
+		err = f.Close()
 	}
-	for _, line := range lines[start:] {
-		fmt.Println("  " + line)
+	if err != nil {
+		fmt.Printf("❌ Error exporting messages after %d: %v\n", n, err)
+		return
 	}
+	fmt.Printf("✅ Exported %d messages to %s\n", n, path)
 }
 
-func readMessagesForAPI(traceID string) ([]Message, error) {
-	f, err := os.Open(messagesFileName)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []Message{}, nil
+// importMessages appends the NDJSON messages in path, or stdin for "-", and
+// reports the rejected records; dryRun only validates them
+func importMessages(path string, dryRun bool) {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("❌ Error opening import file: %v\n", err)
+			return
 		}
-		return []Message{}, err
+		defer f.Close()
+		in = f
 	}
-	defer f.Close()
 
-	var messages []Message
-	scanner := bufio.NewScanner(f)
-	id := 1
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line != "" {
-			// Parse format: [timestamp] user: message
-			message := parseMessageLine(line, id, traceID)
-			if message != nil {
-				messages = append(messages, *message)
-				id++
-			}
+	report, err := messagestore.Import(context.Background(), messageStore, in, messagestore.ImportOptions{DryRun: dryRun})
+	if err != nil {
+		fmt.Printf("❌ Error importing messages after %d: %v\n", report.Imported, err)
+		return
+	}
+
+	verb := "Imported"
+	if dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("\n📥 %s %d of %d messages from %s\n", verb, report.Imported, report.Lines, path)
+	if report.Imported > 0 && !dryRun {
+		fmt.Printf("   IDs %d to %d\n", report.FirstID, report.LastID)
+	}
+	if report.Failed > 0 {
+		fmt.Printf("   %d records rejected:\n", report.Failed)
+		for _, e := range report.Errors {
+			fmt.Printf("   line %d: %s\n", e.Line, e.Error)
+		}
+		if report.Failed > len(report.Errors) {
+			fmt.Printf("   … and %d more\n", report.Failed-len(report.Errors))
 		}
 	}
+}
 
-	return messages, scanner.Err()
+// exitOnError reports err and exits with status 1 if it is not nil
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
 }
 
-// getLastMessages returns the last N messages for WebSocket (Assignment 5)
-func getLastMessages(ctx context.Context, limit int) ([]Message, error) {
-	traceID := ctx.Value("traceID").(string)
+// messageLogFileStore returns the message store if it is a single log file,
+// the only store the log maintenance commands support
+func messageLogFileStore() (*messagestore.FileStore, error) {
+	switch store := messageStore.(type) {
+	case *messagestore.FileStore:
+		return store, nil
+	case *messagestore.SegmentStore:
+		return nil, errors.New("-fsck, -migrate and -reencrypt are not supported for the segmented message store; its segments are sealed and rewritten by the compactor")
+	default:
+		return nil, errors.New("-fsck, -migrate and -reencrypt only apply to the file message store")
+	}
+}
 
-	// Read all messages first
-	allMessages, err := readMessagesForAPI(traceID)
+// migrateMessageLog checks the message log for lines the reader drops and,
+// unless dryRun is set, repairs them and rewrites the log in the current
+// format. A dry run that finds such lines reports them as an error.
+func migrateMessageLog(dryRun bool) error {
+	fileStore, err := messageLogFileStore()
 	if err != nil {
-		return []Message{}, err
+		return err
 	}
 
-	// Return last N messages
-	if len(allMessages) <= limit {
-		return allMessages, nil
+	report, err := fileStore.Migrate(context.Background(), messagestore.MigrateOptions{DryRun: dryRun})
+	if err != nil {
+		return fmt.Errorf("error migrating messages: %w", err)
 	}
 
-	startIndex := len(allMessages) - limit
-	return allMessages[startIndex:], nil
-}
-
-func parseMessageLine(line string, id int, traceID string) *Message {
-	// Simple parsing for [timestamp] user: message format
-	if len(line) < 22 { // Minimum length for timestamp + user + message
-		return nil
+	fmt.Printf("\n🔍 Scanned %d lines in %s\n", report.Lines, fileStore.Path())
+	fmt.Printf("   current: %d, converted: %d, repaired: %d, resealed: %d, quarantined: %d\n",
+		report.Current, report.Converted, report.Repaired, report.Resealed, report.Quarantined)
+	for _, issue := range report.Issues {
+		fmt.Printf("   line %d [%s: %s] %s\n", issue.Line, issue.Outcome, issue.Reason, issue.Text)
 	}
 
-	// Find end of timestamp (look for "] ")
-	timestampEnd := -1
-	for i := 0; i < len(line)-1; i++ {
-		if line[i] == ']' && line[i+1] == ' ' {
-			timestampEnd = i
-			break
+	switch {
+	case report.Rewritten:
+		fmt.Printf("✅ Log rewritten in the current format (backup: %s)\n", report.BackupPath)
+		if report.QuarantinePath != "" {
+			fmt.Printf("⚠️  Unrecoverable lines moved to %s\n", report.QuarantinePath)
 		}
+		if report.Resealed > 0 {
+			fmt.Println("⚠️  The backup still holds the records as they were; remove it once the new log is verified")
+		}
+	case dryRun && (report.Current < report.Lines):
+		fmt.Println("💡 Run with -migrate to repair and rewrite the log")
+		if len(report.Issues) > 0 {
+			return fmt.Errorf("%d message log lines need repair", len(report.Issues))
+		}
+	default:
+		fmt.Println("✅ Message log is up to date")
 	}
+	return nil
+}
 
-	if timestampEnd == -1 {
+// reencryptStorageRoot encrypts every file under the local storage root that
+// is plain or encrypted under an older key with the active key. Files it
+// could not re-encrypt are reported as an error.
+func reencryptStorageRoot(cfg storage.BackendConfig) error {
+	if cfg.Kind != "local" {
+		fmt.Printf("💡 Skipping file storage re-encryption for the %s backend\n", cfg.Kind)
 		return nil
 	}
 
-	remaining := line[timestampEnd+2:] // Skip "] "
+	root, err := storage.NewRoot(cfg.Root)
+	if err != nil {
+		return fmt.Errorf("error opening storage root: %w", err)
+	}
+	report, err := storage.NewEncryptedBackend(root, cfg.Keys).Reencrypt(context.Background())
+	if err != nil {
+		return fmt.Errorf("error re-encrypting storage root: %w", err)
+	}
 
-	// Find ": " separator
-	colonIndex := -1
-	for i := 0; i < len(remaining)-1; i++ {
-		if remaining[i] == ':' && remaining[i+1] == ' ' {
-			colonIndex = i
-			break
+	fmt.Printf("\n🔐 Checked %d files in %s\n", report.Files, root.Dir())
+	fmt.Printf("   current: %d, encrypted: %d, rotated: %d, problems: %d\n",
+		report.Current, report.Encrypted, report.Rotated, len(report.Issues))
+	for _, issue := range report.Issues {
+		if issue.Actual != "" {
+			fmt.Printf("   %s [%s] %s\n", issue.Name, issue.Problem, issue.Actual)
+		} else {
+			fmt.Printf("   %s [%s]\n", issue.Name, issue.Problem)
 		}
 	}
 
-	if colonIndex == -1 {
-		return nil
+	if len(report.Issues) > 0 {
+		fmt.Println("💡 Run -reencrypt again once the files above are fixed or no longer written to")
+		return fmt.Errorf("%d files were not re-encrypted", len(report.Issues))
 	}
+	fmt.Printf("✅ File storage is encrypted under key %q\n", cfg.Keys.ActiveKeyID())
+	return nil
+}
 
-	user := remaining[:colonIndex]
-	messageText := remaining[colonIndex+2:]
+// checkStorageRoot verifies the files under the local storage root against
+// their recorded checksums and, if repair is set, fixes what it can. Problems
+// left unfixed are reported as an error.
+func checkStorageRoot(cfg storage.BackendConfig, repair bool) error {
+	if cfg.Kind != "local" {
+		fmt.Printf("💡 Skipping file storage check for the %s backend\n", cfg.Kind)
+		return nil
+	}
 
-	// Parse timestamp
-	timestampStr := line[1:timestampEnd] // Remove [ and ]
-	timestamp, err := time.Parse("2006-01-02 15:04:05", timestampStr)
+	root, err := storage.NewRoot(cfg.Root)
+	if err != nil {
+		return fmt.Errorf("error opening storage root: %w", err)
+	}
+	report, err := root.Fsck(context.Background(), storage.FsckOptions{Repair: repair})
 	if err != nil {
-		timestamp = time.Now() // Fallback
+		return fmt.Errorf("error checking storage root: %w", err)
 	}
 
-	return &Message{
-		ID:        id,
-		User:      user,
-		Message:   messageText,
-		Timestamp: timestamp,
-		TraceID:   traceID,
+	fmt.Printf("\n🔍 Checked %d files in %s\n", report.Files, root.Dir())
+	fmt.Printf("   ok: %d, problems: %d\n", report.OK, len(report.Issues))
+	for _, issue := range report.Issues {
+		if issue.Action != "" {
+			fmt.Printf("   %s [%s] %s\n", issue.Name, issue.Problem, issue.Action)
+		} else {
+			fmt.Printf("   %s [%s]\n", issue.Name, issue.Problem)
+		}
+	}
+
+	unresolved := 0
+	for _, issue := range report.Issues {
+		if issue.Action == "" {
+			unresolved++
+		}
+	}
+	switch {
+	case len(report.Issues) == 0:
+		fmt.Println("✅ File storage is intact")
+	case unresolved == 0:
+		fmt.Println("✅ File storage repaired")
+	case repair:
+		return fmt.Errorf("%d file storage problems could not be repaired", unresolved)
+	default:
+		fmt.Println("💡 Run with -fsck -repair to record missing checksums, quarantine corrupt files and remove orphaned checksums")
+		return fmt.Errorf("%d file storage problems found", unresolved)
 	}
+	return nil
+}
+
+func readMessagesForAPI(traceID string) ([]Message, error) {
+	ctx := context.WithValue(context.Background(), "traceID", traceID)
+	return messageStore.List(ctx)
+}
+
+// getLastMessages returns the last N messages for WebSocket (Assignment 5)
+func getLastMessages(ctx context.Context, limit int) ([]Message, error) {
+	return messageStore.Tail(ctx, limit)
 }
 
 // Assignment 2: Storage Demo Function
@@ -526,10 +777,7 @@ func messagesAPIHandler(w http.ResponseWriter, r *http.Request) {
 
 func createMessageAPI(w http.ResponseWriter, r *http.Request, traceID string) {
 	var req CreateMessageRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		slog.ErrorContext(r.Context(), "Failed to decode request body", "error", err, "traceID", traceID)
-		respondWithError(w, http.StatusBadRequest, "Invalid JSON payload", traceID)
+	if !decodeMessageBody(w, r, &req, traceID) {
 		return
 	}
 
@@ -538,22 +786,14 @@ func createMessageAPI(w http.ResponseWriter, r *http.Request, traceID string) {
 		return
 	}
 
-	// Use the same message storage as CLI
-	err = addMessage(req.User, req.Message)
+	// Use the same message storage as CLI; the store assigns the ID
+	message, err := addMessage(r.Context(), req.User, req.Message)
 	if err != nil {
 		slog.ErrorContext(r.Context(), "Failed to save message", "error", err, "traceID", traceID)
-		respondWithError(w, http.StatusInternalServerError, "Failed to save message", traceID)
+		respondWithMessageError(w, err, "Failed to save message", traceID)
 		return
 	}
 
-	message := Message{
-		ID:        int(time.Now().UnixNano() / 1000000),
-		User:      req.User,
-		Message:   req.Message,
-		Timestamp: time.Now(),
-		TraceID:   traceID,
-	}
-
 	slog.InfoContext(r.Context(), "Message created successfully",
 		"user", req.User,
 		"message_id", message.ID,
@@ -562,19 +802,317 @@ func createMessageAPI(w http.ResponseWriter, r *http.Request, traceID string) {
 	respondWithSuccess(w, http.StatusCreated, message, traceID)
 }
 
+// decodeMessageBody decodes the JSON body of a message create or edit into
+// req, reading at most maxMessageBodyBytes. It answers 413 for larger
+// bodies and 400 for invalid JSON, and reports whether req was decoded.
+func decodeMessageBody(w http.ResponseWriter, r *http.Request, req interface{}, traceID string) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageBodyBytes)).Decode(req)
+	if err == nil {
+		return true
+	}
+	slog.ErrorContext(r.Context(), "Failed to decode request body", "error", err, "traceID", traceID)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), traceID)
+		return false
+	}
+	respondWithError(w, http.StatusBadRequest, "Invalid JSON payload", traceID)
+	return false
+}
+
+// getMessagesAPI answers GET /api/messages with a page of messages,
+// filtered by the user, since and until query parameters and paged with
+// limit, sort and the after, before or cursor IDs. The page is JSON unless
+// the format parameter or the Accept header asks for CSV, NDJSON or XML.
 func getMessagesAPI(w http.ResponseWriter, r *http.Request, traceID string) {
-	messages, err := readMessagesForAPI(traceID)
+	format, err := negotiateFormat(r)
+	if errors.Is(err, errNotAcceptable) {
+		respondWithError(w, http.StatusNotAcceptable, err.Error(), traceID)
+		return
+	}
 	if err != nil {
-		slog.ErrorContext(r.Context(), "Failed to read messages", "error", err, "traceID", traceID)
-		respondWithError(w, http.StatusInternalServerError, "Failed to read messages", traceID)
+		respondWithError(w, http.StatusBadRequest, err.Error(), traceID)
 		return
 	}
+	w.Header().Add("Vary", "Accept")
 
-	slog.InfoContext(r.Context(), "Messages retrieved successfully",
-		"message_count", len(messages),
+	query, err := parseMessageQuery(r.URL.Query())
+	if err != nil {
+		respondWithFormatError(w, format, http.StatusBadRequest, err.Error(), traceID)
+		return
+	}
+
+	respondWithMessages(w, r, format, query, traceID)
+}
+
+// searchMessagesHandler answers GET /api/messages/search?q= with a page of
+// the messages matching q, newest first, each with a highlighted snippet.
+// limit and cursor page through the hits like GET /api/messages.
+func searchMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	traceID, _ := r.Context().Value("traceID").(string)
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET method is allowed", traceID)
+		return
+	}
+	index, ok := messageStore.(*messagestore.SearchIndex)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Message search is not available for this message store", traceID)
+		return
+	}
+
+	values := r.URL.Query()
+	query := messagestore.SearchQuery{Text: values.Get("q")}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer", traceID)
+			return
+		}
+		query.Limit = limit
+	}
+	if value := values.Get("cursor"); value != "" {
+		before, err := messagestore.ParseCursor(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), traceID)
+			return
+		}
+		query.Before = before
+	}
+
+	ctx := context.WithValue(r.Context(), "traceID", traceID)
+	page, err := index.Search(ctx, query)
+	if errors.Is(err, messagestore.ErrEmptySearch) {
+		respondWithError(w, http.StatusBadRequest, "q must contain at least one word", traceID)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to search messages", "error", err, "traceID", traceID)
+		respondWithError(w, http.StatusInternalServerError, "Failed to search messages", traceID)
+		return
+	}
+
+	respondWithPage(w, http.StatusOK, page.Hits, page.NextCursor, traceID)
+}
+
+// exportMessagesHandler streams every message matching the user, since,
+// until, after and before query parameters as NDJSON, for
+// importMessagesHandler in another environment to read.
+func exportMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	traceID, _ := r.Context().Value("traceID").(string)
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET method is allowed", traceID)
+		return
+	}
+	query, err := parseMessageQuery(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), traceID)
+		return
+	}
+
+	w.Header().Set("Content-Type", formatContentTypes[formatNDJSON])
+	w.Header().Set("Content-Disposition", `attachment; filename="messages.ndjson"`)
+	out := newFlushWriter(w)
+	ctx := context.WithValue(r.Context(), "traceID", traceID)
+	if _, err := messagestore.Export(ctx, messageStore, query, out); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to export messages", "error", err, "traceID", traceID)
+		if out.written == 0 {
+			respondWithFormatError(w, formatNDJSON, http.StatusInternalServerError, "Failed to export messages", traceID)
+			return
+		}
+		json.NewEncoder(w).Encode(Response{Success: false, Error: "Failed to export messages", TraceID: traceID})
+	}
+}
+
+// importMessagesHandler appends the NDJSON messages in the request body,
+// keeping their users and timestamps, and reports the records it rejected by
+// line. With ?dry_run=true the records are only validated.
+func importMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	traceID, _ := r.Context().Value("traceID").(string)
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only POST method is allowed", traceID)
+		return
+	}
+	var opts messagestore.ImportOptions
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "dry_run must be true or false", traceID)
+			return
+		}
+		opts.DryRun = dryRun
+	}
+
+	ctx := context.WithValue(r.Context(), "traceID", traceID)
+	report, err := messagestore.Import(ctx, messageStore, r.Body, opts)
+	if errors.Is(err, bufio.ErrTooLong) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%v (after importing %d messages)", err, report.Imported), traceID)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to import messages", "error", err, "traceID", traceID)
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to import messages (after importing %d)", report.Imported), traceID)
+		return
+	}
+
+	respondWithSuccess(w, http.StatusOK, report, traceID)
+}
+
+// messageResourceHandler serves /api/messages/{id}: GET returns the message
+// with its edit history, PATCH replaces its text and DELETE leaves a
+// tombstone in its place. Deleted messages answer 410 Gone. With the file
+// store the deleted text stays in messages.txt; only the segmented store
+// erases it.
+func messageResourceHandler(w http.ResponseWriter, r *http.Request) {
+	traceID, _ := r.Context().Value("traceID").(string)
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Message ID must be a positive integer", traceID)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getMessageAPI(w, r, id, traceID)
+	case http.MethodPatch:
+		editMessageAPI(w, r, id, traceID)
+	case http.MethodDelete:
+		deleteMessageAPI(w, r, id, traceID)
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed", traceID)
+	}
+}
+
+func getMessageAPI(w http.ResponseWriter, r *http.Request, id int, traceID string) {
+	ctx := context.WithValue(r.Context(), "traceID", traceID)
+	message, err := messageStore.Get(ctx, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read message", "error", err, "message_id", id, "traceID", traceID)
+		respondWithMessageError(w, err, "Failed to read message", traceID)
+		return
+	}
+	if message.Deleted {
+		respondWithError(w, http.StatusGone, messagestore.ErrDeleted.Error(), traceID)
+		return
+	}
+	respondWithSuccess(w, http.StatusOK, message, traceID)
+}
+
+func editMessageAPI(w http.ResponseWriter, r *http.Request, id int, traceID string) {
+	var req EditMessageRequest
+	if !decodeMessageBody(w, r, &req, traceID) {
+		return
+	}
+	if req.Message == "" {
+		respondWithError(w, http.StatusBadRequest, "Message is required", traceID)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), "traceID", traceID)
+	message, err := messageStore.Edit(ctx, id, req.Message)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to edit message", "error", err, "message_id", id, "traceID", traceID)
+		respondWithMessageError(w, err, "Failed to edit message", traceID)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Message edited successfully",
+		"message_id", id,
+		"revisions", len(message.History),
 		"traceID", traceID)
 
-	respondWithSuccess(w, http.StatusOK, messages, traceID)
+	respondWithSuccess(w, http.StatusOK, message, traceID)
+}
+
+func deleteMessageAPI(w http.ResponseWriter, r *http.Request, id int, traceID string) {
+	ctx := context.WithValue(r.Context(), "traceID", traceID)
+	if err := messageStore.Remove(ctx, id); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete message", "error", err, "message_id", id, "traceID", traceID)
+		respondWithMessageError(w, err, "Failed to delete message", traceID)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Message deleted successfully", "message_id", id, "traceID", traceID)
+
+	respondWithSuccess(w, http.StatusOK, map[string]interface{}{
+		"message":    "Message deleted successfully",
+		"message_id": id,
+	}, traceID)
+}
+
+// parseMessageQuery reads the paging and filter parameters of GET
+// /api/messages. cursor is the next_cursor of the previous page and stands
+// for after, or before when sort is "desc".
+func parseMessageQuery(values url.Values) (messagestore.Query, error) {
+	query := messagestore.Query{User: values.Get("user")}
+
+	switch values.Get("sort") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, errors.New("sort must be 'asc' or 'desc'")
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return query, errors.New("limit must be a positive integer")
+		}
+		query.Limit = n
+	}
+
+	for _, param := range []struct {
+		name string
+		id   *int
+	}{
+		{"after", &query.After},
+		{"before", &query.Before},
+	} {
+		if value := values.Get(param.name); value != "" {
+			id, err := messagestore.ParseCursor(value)
+			if err != nil {
+				return query, fmt.Errorf("%s must be a message ID", param.name)
+			}
+			*param.id = id
+		}
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		id, err := messagestore.ParseCursor(cursor)
+		if err != nil {
+			return query, errors.New("cursor must be the next_cursor of a previous page")
+		}
+		if query.Descending {
+			query.Before = id
+		} else {
+			query.After = id
+		}
+	}
+
+	for _, param := range []struct {
+		name string
+		at   *time.Time
+	}{
+		{"since", &query.Since},
+		{"until", &query.Until},
+	} {
+		if value := values.Get(param.name); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, fmt.Errorf("%s must be an RFC 3339 time, e.g. 2026-10-16T09:00:00Z", param.name)
+			}
+			*param.at = at
+		}
+	}
+	return query, nil
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -596,15 +1134,22 @@ func fileStorageHandler(w http.ResponseWriter, r *http.Request) {
 	traceID, _ := r.Context().Value("traceID").(string)
 	w.Header().Set("Content-Type", "application/json")
 
+	if r.Method == http.MethodGet {
+		listFilesAPI(w, r, traceID)
+		return
+	}
 	if r.Method != http.MethodPost {
-		respondWithError(w, http.StatusMethodNotAllowed, "Only POST method is allowed", traceID)
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET and POST methods are allowed", traceID)
 		return
 	}
 
 	var req struct {
-		FilePath string `json:"file_path"`
-		Data     string `json:"data"`
-		Action   string `json:"action"` // "save" or "read"
+		FilePath  string `json:"file_path"`
+		Data      string `json:"data"`
+		Action    string `json:"action"`     // "save", "read", "versions", "read_version" or "restore"
+		VersionID string `json:"version_id"` // for "read_version" and "restore"
+		// ExpectedETag makes "save" conditional, like an If-Match header
+		ExpectedETag string `json:"expected_etag"`
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -627,33 +1172,564 @@ func fileStorageHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		err = storage.SaveData(ctx, req.FilePath, req.Data)
+		cond, err := writeCondition(r, req.ExpectedETag)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), traceID)
+			return
+		}
+		info, err := fileBackend.SaveIf(ctx, req.FilePath, cond, strings.NewReader(req.Data))
 		if err != nil {
 			slog.ErrorContext(ctx, "Failed to save file", "error", err, "traceID", traceID)
-			respondWithError(w, http.StatusInternalServerError, "Failed to save file", traceID)
+			respondWithStorageError(w, err, "Failed to save file", traceID)
 			return
 		}
 
+		w.Header().Set("ETag", info.ETag())
 		respondWithSuccess(w, http.StatusOK, map[string]string{
 			"message":   "File saved successfully",
 			"file_path": req.FilePath,
+			"etag":      info.ETag(),
 		}, traceID)
 
 	case "read":
-		content, err := storage.ReadData(ctx, req.FilePath)
+		// Stat before reading: if a save lands in between, the ETag is the
+		// older one and a conditional save fails instead of overwriting it
+		info, err := fileBackend.Stat(ctx, req.FilePath)
 		if err != nil {
 			slog.ErrorContext(ctx, "Failed to read file", "error", err, "traceID", traceID)
-			respondWithError(w, http.StatusInternalServerError, "Failed to read file", traceID)
+			respondWithStorageError(w, err, "Failed to read file", traceID)
+			return
+		}
+		content, err := fileBackend.ReadData(ctx, req.FilePath)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to read file", "error", err, "traceID", traceID)
+			respondWithStorageError(w, err, "Failed to read file", traceID)
 			return
 		}
 
+		etag := info.ETag()
+		w.Header().Set("ETag", etag)
 		respondWithSuccess(w, http.StatusOK, map[string]string{
 			"content":   content,
 			"file_path": req.FilePath,
+			"etag":      etag,
 		}, traceID)
 
+	case "versions":
+		versioned, ok := versionedFileBackend(w, traceID)
+		if !ok {
+			return
+		}
+		versions, err := versioned.Versions(ctx, req.FilePath)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list file versions", "error", err, "traceID", traceID)
+			respondWithStorageError(w, err, "Failed to list file versions", traceID)
+			return
+		}
+
+		respondWithSuccess(w, http.StatusOK, map[string]interface{}{
+			"file_path": req.FilePath,
+			"versions":  versions,
+		}, traceID)
+
+	case "read_version":
+		versioned, ok := versionedFileBackend(w, traceID)
+		if !ok {
+			return
+		}
+		content, err := versioned.ReadVersion(ctx, req.FilePath, req.VersionID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to read file version", "error", err, "traceID", traceID)
+			respondWithStorageError(w, err, "Failed to read file version", traceID)
+			return
+		}
+
+		respondWithSuccess(w, http.StatusOK, map[string]string{
+			"content":    content,
+			"file_path":  req.FilePath,
+			"version_id": req.VersionID,
+		}, traceID)
+
+	case "restore":
+		restoreFileVersion(w, r, req.FilePath, req.VersionID, traceID)
+
+	default:
+		respondWithError(w, http.StatusBadRequest, "action must be 'save', 'read', 'versions', 'read_version' or 'restore'", traceID)
+	}
+}
+
+// usageHandler reports the storage used by the requesting user and by every
+// top-level directory, with their quotas.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	traceID, _ := r.Context().Value("traceID").(string)
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Only GET method is allowed", traceID)
+		return
+	}
+	reporter, ok := fileBackend.(storage.UsageReporter)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Storage quotas are not enabled (start with -quota-user-bytes or another quota flag)", traceID)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(string)
+	report, err := reporter.Usage(user)
+	if errors.Is(err, storage.ErrNoQuota) {
+		respondWithError(w, http.StatusNotImplemented, "Storage quotas are not enabled (start with -quota-user-bytes or another quota flag)", traceID)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to report storage usage", traceID)
+		return
+	}
+	respondWithSuccess(w, http.StatusOK, report, traceID)
+}
+
+// versionedFileBackend returns the file backend if versioning is enabled and
+// otherwise answers the request with 501 Not Implemented.
+func versionedFileBackend(w http.ResponseWriter, traceID string) (*storage.VersionedBackend, bool) {
+	versioned, ok := fileBackend.(*storage.VersionedBackend)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "File versioning is not enabled (start with -storage-versioning)", traceID)
+	}
+	return versioned, ok
+}
+
+// restoreFileVersion makes version id the current content of name.
+func restoreFileVersion(w http.ResponseWriter, r *http.Request, name, id string, traceID string) {
+	versioned, ok := versionedFileBackend(w, traceID)
+	if !ok {
+		return
+	}
+	if err := versioned.Restore(r.Context(), name, id); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to restore file version", "error", err, "traceID", traceID)
+		respondWithStorageError(w, err, "Failed to restore file version", traceID)
+		return
+	}
+
+	respondWithSuccess(w, http.StatusOK, map[string]string{
+		"message":    "File version restored successfully",
+		"file_path":  name,
+		"version_id": id,
+	}, traceID)
+}
+
+// fileResourceHandler serves /api/files/{path...}: GET returns the raw
+// content (honouring single byte ranges), HEAD its metadata, PUT replaces it
+// with the raw request body and DELETE removes it. With versioning enabled,
+// GET ?versions lists previous versions, GET ?version=id reads one and
+// POST ?restore=id restores it.
+func fileResourceHandler(w http.ResponseWriter, r *http.Request) {
+	traceID, _ := r.Context().Value("traceID").(string)
+	w.Header().Set("Content-Type", "application/json")
+	name := r.PathValue("path")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		getFileResource(w, r, name, traceID)
+	case http.MethodPut:
+		putFileResource(w, r, name, traceID)
+	case http.MethodDelete:
+		deleteFileResource(w, r, name, traceID)
+	case http.MethodPost:
+		if !r.URL.Query().Has("restore") {
+			respondWithError(w, http.StatusBadRequest, "POST requires ?restore=<version id>", traceID)
+			return
+		}
+		restoreFileVersion(w, r, name, r.URL.Query().Get("restore"), traceID)
 	default:
-		respondWithError(w, http.StatusBadRequest, "action must be 'save' or 'read'", traceID)
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE, POST")
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed", traceID)
+	}
+}
+
+func getFileResource(w http.ResponseWriter, r *http.Request, name string, traceID string) {
+	ctx := r.Context()
+
+	query := r.URL.Query()
+	if query.Has("stat") {
+		statFileResource(w, r, name, traceID)
+		return
+	}
+
+	open := func(rng storage.ReadRange) (*storage.Stream, error) {
+		return fileBackend.OpenStream(ctx, name, rng)
+	}
+	if query.Has("versions") || query.Has("version") {
+		versioned, ok := versionedFileBackend(w, traceID)
+		if !ok {
+			return
+		}
+		if query.Has("versions") {
+			listFileVersions(w, r, versioned, name, traceID)
+			return
+		}
+		open = func(rng storage.ReadRange) (*storage.Stream, error) {
+			return versioned.OpenVersion(ctx, name, query.Get("version"), rng)
+		}
+	}
+
+	// Opening the whole file is cheap and yields the size the range is
+	// resolved against; a partial request reopens just the range below.
+	stream, err := open(storage.ReadRange{})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to open file", "error", err, "file_path", name, "traceID", traceID)
+		respondWithStorageError(w, err, "Failed to read file", traceID)
+		return
+	}
+	defer func() { stream.Close() }()
+
+	rng, partial, err := parseByteRange(r.Header.Get("Range"), stream.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", stream.Size))
+		respondWithError(w, http.StatusRequestedRangeNotSatisfiable, err.Error(), traceID)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Last-Modified", stream.ModTime.UTC().Format(http.TimeFormat))
+	gzipOpener, canGzip := fileBackend.(storage.GzipOpener)
+	if canGzip {
+		header.Set("Vary", "Accept-Encoding")
+	}
+
+	// Clients that accept gzip get compressed files as they are stored,
+	// without decompressing them first
+	var gz *storage.Stream
+	if canGzip && r.Method != http.MethodHead && !partial && !query.Has("version") && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		if s, err := gzipOpener.OpenGzip(ctx, name); err == nil && s.ModTime.Equal(stream.ModTime) {
+			gz = s
+			defer func() { gz.Close() }()
+		} else if err == nil {
+			s.Close()
+		}
+	}
+
+	if !query.Has("version") {
+		// Stat after opening, and only trust it if it describes the same
+		// content the stream is reading
+		if info, err := fileBackend.Stat(ctx, name); err == nil && info.Size == stream.Size && info.ModTime.Equal(stream.ModTime) {
+			etag := info.ETag()
+			if gz != nil {
+				etag = gzipETag(etag)
+			}
+			header.Set("ETag", etag)
+			if etagListContains(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	if r.Method == http.MethodHead {
+		header.Set("Content-Type", contentTypeFor(name))
+		header.Set("Content-Length", strconv.FormatInt(stream.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if partial {
+		stream.Close()
+		stream, err = open(rng)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to open file range", "error", err, "file_path", name, "traceID", traceID)
+			respondWithStorageError(w, err, "Failed to read file", traceID)
+			return
+		}
+	}
+
+	if gz != nil {
+		stream.Close()
+		stream = gz
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	header.Set("Content-Type", contentTypeFor(name))
+	header.Set("Content-Length", strconv.FormatInt(stream.Length, 10))
+	status := http.StatusOK
+	if partial {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", stream.Offset, stream.Offset+stream.Length-1, stream.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	// The status line is already sent, so a failure here can only be logged
+	if _, err := io.Copy(w, stream); err != nil {
+		slog.ErrorContext(ctx, "Failed to stream file", "error", err, "file_path", name, "traceID", traceID)
+	}
+}
+
+// statFileResource answers GET /api/files/{path...}?stat with the size,
+// modification time and SHA-256 checksum of the file.
+func statFileResource(w http.ResponseWriter, r *http.Request, name string, traceID string) {
+	info, err := fileBackend.Stat(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to stat file", "error", err, "file_path", name, "traceID", traceID)
+		respondWithStorageError(w, err, "Failed to stat file", traceID)
+		return
+	}
+	respondWithSuccess(w, http.StatusOK, info, traceID)
+}
+
+// listFileVersions answers GET /api/files/{path...}?versions with the
+// previous versions of the file, oldest first.
+func listFileVersions(w http.ResponseWriter, r *http.Request, versioned *storage.VersionedBackend, name string, traceID string) {
+	versions, err := versioned.Versions(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list file versions", "error", err, "file_path", name, "traceID", traceID)
+		respondWithStorageError(w, err, "Failed to list file versions", traceID)
+		return
+	}
+	respondWithSuccess(w, http.StatusOK, map[string]interface{}{
+		"file_path": name,
+		"versions":  versions,
+	}, traceID)
+}
+
+// listFilesAPI answers GET /api/files with a page of stored files, filtered
+// by the prefix and glob query parameters and paged with limit and cursor.
+func listFilesAPI(w http.ResponseWriter, r *http.Request, traceID string) {
+	query := r.URL.Query()
+	opts := storage.ListOptions{
+		Prefix: query.Get("prefix"),
+		Glob:   query.Get("glob"),
+		Cursor: query.Get("cursor"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer", traceID)
+			return
+		}
+		opts.Limit = n
+	}
+
+	page, err := fileBackend.List(r.Context(), opts)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list files", "error", err, "traceID", traceID)
+		respondWithStorageError(w, err, "Failed to list files", traceID)
+		return
+	}
+	respondWithSuccess(w, http.StatusOK, page, traceID)
+}
+
+func putFileResource(w http.ResponseWriter, r *http.Request, name string, traceID string) {
+	ctx := r.Context()
+
+	cond, err := writeCondition(r, "")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), traceID)
+		return
+	}
+
+	info, err := fileBackend.SaveIf(ctx, name, cond, r.Body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save file", "error", err, "file_path", name, "traceID", traceID)
+		respondWithStorageError(w, err, "Failed to save file", traceID)
+		return
+	}
+
+	// The save itself tells a create from a replace, so a concurrent
+	// writer cannot make both PUTs claim to have created the file
+	status := http.StatusOK
+	if info.Created {
+		status = http.StatusCreated
+	}
+	w.Header().Set("ETag", info.ETag())
+	respondWithSuccess(w, status, map[string]interface{}{
+		"message":   "File saved successfully",
+		"file_path": name,
+		"size":      info.Size,
+		"etag":      info.ETag(),
+	}, traceID)
+}
+
+func deleteFileResource(w http.ResponseWriter, r *http.Request, name string, traceID string) {
+	ctx := r.Context()
+
+	if err := fileBackend.Delete(ctx, name); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete file", "error", err, "file_path", name, "traceID", traceID)
+		respondWithStorageError(w, err, "Failed to delete file", traceID)
+		return
+	}
+
+	respondWithSuccess(w, http.StatusOK, map[string]string{
+		"message":   "File deleted successfully",
+		"file_path": name,
+	}, traceID)
+}
+
+// writeCondition builds the storage condition for a save from the If-Match
+// and If-None-Match headers and, for the JSON endpoint, an expected ETag.
+// Only a single ETag or "*" is supported in If-Match, and only "*" in
+// If-None-Match.
+func writeCondition(r *http.Request, expectedETag string) (storage.Condition, error) {
+	var cond storage.Condition
+
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch {
+	case strings.Contains(ifMatch, ","):
+		return cond, errors.New("If-Match with several ETags is not supported")
+	case ifMatch == "*":
+		cond.MustExist = true
+	default:
+		cond.ETag = ifMatch
+	}
+	if expectedETag != "" {
+		if cond.ETag != "" && cond.ETag != expectedETag {
+			return cond, errors.New("If-Match and expected_etag disagree")
+		}
+		cond.ETag = expectedETag
+	}
+
+	switch ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match")); ifNoneMatch {
+	case "":
+	case "*":
+		cond.MustNotExist = true
+	default:
+		return cond, errors.New("If-None-Match only supports * on writes")
+	}
+	return cond, nil
+}
+
+// etagListContains reports whether an If-None-Match header matches etag,
+// using the weak comparison the header calls for.
+func etagListContains(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows a gzip
+// response.
+func acceptsGzip(header string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(candidate, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// gzipETag returns the ETag of the gzip encoding of the content whose
+// identity ETag is etag. The encodings are different bytes, so they must not
+// share a strong ETag.
+func gzipETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-gzip"`
+}
+
+// errRangeNotSatisfiable is returned by parseByteRange for ranges that start
+// past the end of the file.
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// parseByteRange parses a Range header against a file of size bytes. Only a
+// single byte range is honoured; partial is false when the header is absent,
+// malformed or asks for several ranges, and the whole file should be served.
+func parseByteRange(header string, size int64) (rng storage.ReadRange, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return storage.ReadRange{}, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return storage.ReadRange{}, false, nil
+	}
+
+	if first == "" {
+		// A suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return storage.ReadRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return storage.ReadRange{}, false, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return storage.ReadRange{Offset: size - n, Length: n}, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return storage.ReadRange{}, false, nil
+	}
+	if start >= size {
+		return storage.ReadRange{}, false, errRangeNotSatisfiable
+	}
+	if last == "" {
+		return storage.ReadRange{Offset: start, Length: size - start}, true, nil
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return storage.ReadRange{}, false, nil
+	}
+	end = min(end, size-1)
+	return storage.ReadRange{Offset: start, Length: end - start + 1}, true, nil
+}
+
+// contentTypeFor guesses the media type of a stored file from its extension.
+func contentTypeFor(name string) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// respondWithStorageError maps storage errors to HTTP status codes. Paths
+// and globs that are malformed are a bad request, paths that try to leave
+// the storage root are forbidden, failed write conditions are 412, writes
+// over a quota are 413 if the file alone is too large and 507 otherwise,
+// and anything else is reported with fallback.
+func respondWithStorageError(w http.ResponseWriter, err error, fallback string, traceID string) {
+	var pathErr *storage.PathError
+	var quotaErr *storage.QuotaError
+	switch {
+	case errors.Is(err, storage.ErrPathTraversal), errors.Is(err, storage.ErrSymlinkEscape):
+		respondWithError(w, http.StatusForbidden, err.Error(), traceID)
+	case errors.As(err, &pathErr), errors.Is(err, path.ErrBadPattern):
+		respondWithError(w, http.StatusBadRequest, err.Error(), traceID)
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		respondWithError(w, http.StatusPreconditionFailed, err.Error(), traceID)
+	case errors.As(err, &quotaErr) && quotaErr.TooLarge:
+		respondWithError(w, http.StatusRequestEntityTooLarge, err.Error(), traceID)
+	case errors.As(err, &quotaErr):
+		respondWithError(w, http.StatusInsufficientStorage, err.Error(), traceID)
+	case errors.Is(err, fs.ErrNotExist):
+		respondWithError(w, http.StatusNotFound, "File not found", traceID)
+	case errors.Is(err, storage.ErrCorrupt):
+		slog.Error("Stored file failed its integrity check", "error", err, "traceID", traceID)
+		respondWithError(w, http.StatusInternalServerError, "File is corrupt", traceID)
+	default:
+		respondWithError(w, http.StatusInternalServerError, fallback, traceID)
+	}
+}
+
+// respondWithMessageError answers a failed message store operation: unknown
+// IDs are 404, deleted messages 410, messages too large to store 413 and
+// anything else is reported with fallback.
+func respondWithMessageError(w http.ResponseWriter, err error, fallback string, traceID string) {
+	switch {
+	case errors.Is(err, message.ErrRecordTooLarge):
+		respondWithError(w, http.StatusRequestEntityTooLarge, err.Error(), traceID)
+	case errors.Is(err, messagestore.ErrNotFound):
+		respondWithError(w, http.StatusNotFound, "Message not found", traceID)
+	case errors.Is(err, messagestore.ErrDeleted):
+		respondWithError(w, http.StatusGone, err.Error(), traceID)
+	default:
+		respondWithError(w, http.StatusInternalServerError, fallback, traceID)
 	}
 }
 
@@ -669,6 +1745,19 @@ func respondWithSuccess(w http.ResponseWriter, statusCode int, data interface{},
 	json.NewEncoder(w).Encode(response)
 }
 
+// respondWithPage answers with one page of a paged listing and the cursor
+// of the next page.
+func respondWithPage(w http.ResponseWriter, statusCode int, data interface{}, nextCursor string, traceID string) {
+	w.WriteHeader(statusCode)
+	response := Response{
+		Success:    true,
+		Data:       data,
+		TraceID:    traceID,
+		NextCursor: nextCursor,
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
 func respondWithError(w http.ResponseWriter, statusCode int, message string, traceID string) {
 	w.WriteHeader(statusCode)
 	response := Response{
@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/envelope"
+	"cgi.com/goLangTraining/src/pkg/message"
+	"cgi.com/goLangTraining/src/pkg/messagestore"
+	"cgi.com/goLangTraining/src/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// useMemoryStore swaps the package message store for an in-memory one for
+// the duration of a test so handlers can be exercised without touching disk.
+func useMemoryStore(t *testing.T) *messagestore.MemoryStore {
+	t.Helper()
+	previous := messageStore
+	store := messagestore.NewMemoryStore()
+	messageStore = store
+	t.Cleanup(func() { messageStore = previous })
+	return store
+}
+
+// useFileBackend points the file storage API at backend for the duration of
+// a test.
+func useFileBackend(t *testing.T, backend storage.Backend) {
+	t.Helper()
+	previous := fileBackend
+	fileBackend = backend
+	t.Cleanup(func() { fileBackend = previous })
+}
+
+// testKeys returns a keyring holding one key per ID, the last one active.
+// Keys are derived from their IDs, so the same ID always names the same key.
+func testKeys(t *testing.T, ids ...string) *envelope.Keyring {
+	t.Helper()
+	var file strings.Builder
+	for _, id := range ids {
+		sum := sha256.Sum256([]byte(id))
+		file.WriteString(id + " " + base64.StdEncoding.EncodeToString(sum[:]) + "\n")
+	}
+	keys, err := envelope.ParseKeyring(strings.NewReader(file.String()))
+	require.NoError(t, err, "Setup failed")
+	return keys
+}
+
+// useFileRoot confines the file storage API to a temporary directory for the
+// duration of a test.
+func useFileRoot(t *testing.T) *storage.Root {
+	t.Helper()
+	root, err := storage.NewRoot(t.TempDir())
+	require.NoError(t, err)
+	useFileBackend(t, root)
+	return root
+}
+
+func TestMessagesAPIHandler(t *testing.T) {
+	useMemoryStore(t)
+	handler := traceMiddleware(messagesAPIHandler)
+
+	testCases := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "create_message",
+			method:         http.MethodPost,
+			body:           `{"user":"alice","message":"Hello World"}`,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "create_message_missing_user",
+			method:         http.MethodPost,
+			body:           `{"message":"Hello World"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "create_message_invalid_json",
+			method:         http.MethodPost,
+			body:           `{`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "method_not_allowed",
+			method:         http.MethodDelete,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/api/messages", strings.NewReader(tc.body))
+			rec := httptest.NewRecorder()
+
+			handler(rec, req)
+
+			require.Equal(t, tc.expectedStatus, rec.Code, "Unexpected status: %s", rec.Body.String())
+			require.NotEmpty(t, rec.Header().Get("X-Trace-ID"), "Trace ID header should be set")
+		})
+	}
+}
+
+func TestGetMessagesAPIReadsFromStore(t *testing.T) {
+	useMemoryStore(t)
+	_, err := addMessage(context.Background(), "alice", "first")
+	require.NoError(t, err)
+	_, err = addMessage(context.Background(), "bob", "second")
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	traceMiddleware(messagesAPIHandler)(rec, httptest.NewRequest(http.MethodGet, "/api/messages", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp struct {
+		Success bool      `json:"success"`
+		Data    []Message `json:"data"`
+		TraceID string    `json:"trace_id"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), "Response should be valid JSON")
+	require.True(t, resp.Success)
+	require.Len(t, resp.Data, 2)
+	require.Equal(t, "alice", resp.Data[0].User)
+	require.Equal(t, "second", resp.Data[1].Message)
+	require.Equal(t, resp.TraceID, resp.Data[0].TraceID, "Messages should carry the request trace ID")
+}
+
+func TestGetMessagesAPIPagesAndFilters(t *testing.T) {
+	useMemoryStore(t)
+	for i, user := range []string{"alice", "bob", "alice", "bob", "alice"} {
+		_, err := addMessage(context.Background(), user, "message "+strconv.Itoa(i+1))
+		require.NoError(t, err, "Setup failed")
+	}
+	handler := traceMiddleware(messagesAPIHandler)
+	get := func(target string) (*httptest.ResponseRecorder, []int, string) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var resp struct {
+			Data       []Message `json:"data"`
+			NextCursor string    `json:"next_cursor"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		var ids []int
+		for _, msg := range resp.Data {
+			ids = append(ids, msg.ID)
+		}
+		return rec, ids, resp.NextCursor
+	}
+
+	testCases := []struct {
+		name   string
+		target string
+		status int
+		ids    []int
+		next   string
+	}{
+		{name: "first_page", target: "/api/messages?limit=2", status: http.StatusOK, ids: []int{1, 2}, next: "2"},
+		{name: "cursor", target: "/api/messages?limit=2&cursor=2", status: http.StatusOK, ids: []int{3, 4}, next: "4"},
+		{name: "descending", target: "/api/messages?limit=2&sort=desc&cursor=4", status: http.StatusOK, ids: []int{3, 2}, next: "2"},
+		{name: "after_before", target: "/api/messages?after=1&before=4", status: http.StatusOK, ids: []int{2, 3}},
+		{name: "user", target: "/api/messages?user=alice&sort=desc", status: http.StatusOK, ids: []int{5, 3, 1}},
+		{name: "time_range", target: "/api/messages?since=2000-01-01T00:00:00Z&until=2001-01-01T00:00:00Z", status: http.StatusOK},
+		{name: "bad_limit", target: "/api/messages?limit=0", status: http.StatusBadRequest},
+		{name: "bad_cursor", target: "/api/messages?cursor=abc", status: http.StatusBadRequest},
+		{name: "bad_sort", target: "/api/messages?sort=sideways", status: http.StatusBadRequest},
+		{name: "bad_since", target: "/api/messages?since=yesterday", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec, ids, next := get(tc.target)
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+			require.Equal(t, tc.ids, ids)
+			require.Equal(t, tc.next, next)
+		})
+	}
+}
+
+func TestCSVListingDefusesFormulas(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{in: "=HYPERLINK(\"http://evil\")", want: "'=HYPERLINK(\"http://evil\")"},
+		{in: "+1", want: "'+1"},
+		{in: "-2+3", want: "'-2+3"},
+		{in: "@SUM(A1)", want: "'@SUM(A1)"},
+		{in: "\t=1", want: "'\t=1"},
+		{in: "plain = text", want: "plain = text"},
+		{in: "", want: ""},
+	} {
+		require.Equal(t, tc.want, csvCell(tc.in), tc.in)
+	}
+
+	useMemoryStore(t)
+	_, err := addMessage(context.Background(), "@mallory", "=1+1")
+	require.NoError(t, err, "Setup failed")
+	rec := httptest.NewRecorder()
+	traceMiddleware(messagesAPIHandler)(rec, httptest.NewRequest(http.MethodGet, "/api/messages?format=csv", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "\n1,'@mallory,'=1+1,")
+}
+
+func TestGetMessagesAPIFormats(t *testing.T) {
+	useMemoryStore(t)
+	for _, text := range []string{"hello, world", "say \"hi\"", "<b>bold</b> & more"} {
+		_, err := addMessage(context.Background(), "alice", text)
+		require.NoError(t, err, "Setup failed")
+	}
+	handler := traceMiddleware(messagesAPIHandler)
+
+	testCases := []struct {
+		name        string
+		target      string
+		accept      string
+		status      int
+		contentType string
+		contains    []string
+	}{
+		{name: "default_json", target: "/api/messages", status: http.StatusOK, contentType: "application/json", contains: []string{`"success":true`}},
+		{name: "csv_param", target: "/api/messages?format=csv&limit=2", status: http.StatusOK, contentType: "text/csv; charset=utf-8",
+			contains: []string{"id,user,message,timestamp,edited_at,deleted\n", `1,alice,"hello, world",`, `2,alice,"say ""hi""",`}},
+		{name: "csv_accept", target: "/api/messages", accept: "text/csv", status: http.StatusOK, contentType: "text/csv; charset=utf-8"},
+		{name: "xml_accept", target: "/api/messages", accept: "application/xml", status: http.StatusOK, contentType: "application/xml; charset=utf-8",
+			contains: []string{`<message id="3"><user>alice</user><text>&lt;b&gt;bold&lt;/b&gt; &amp; more</text>`}},
+		{name: "ndjson_accept", target: "/api/messages?sort=desc", accept: "application/x-ndjson", status: http.StatusOK, contentType: "application/x-ndjson",
+			contains: []string{`{"id":3,`}},
+		{name: "highest_weight", target: "/api/messages", accept: "application/json;q=0.5, text/xml;q=0.9, image/png", status: http.StatusOK, contentType: "application/xml; charset=utf-8"},
+		{name: "wildcard", target: "/api/messages", accept: "*/*", status: http.StatusOK, contentType: "application/json"},
+		{name: "param_beats_accept", target: "/api/messages?format=ndjson", accept: "text/csv", status: http.StatusOK, contentType: "application/x-ndjson"},
+		{name: "unknown_format", target: "/api/messages?format=yaml", status: http.StatusBadRequest, contentType: "application/json", contains: []string{`"trace_id"`}},
+		{name: "not_acceptable", target: "/api/messages", accept: "image/png", status: http.StatusNotAcceptable, contentType: "application/json", contains: []string{`"trace_id"`}},
+		{name: "csv_error", target: "/api/messages?format=csv&limit=x", status: http.StatusBadRequest, contentType: "text/csv; charset=utf-8",
+			contains: []string{"error,trace_id\nlimit must be a positive integer,"}},
+		{name: "xml_error", target: "/api/messages?limit=x", accept: "text/xml", status: http.StatusBadRequest, contentType: "application/xml; charset=utf-8",
+			contains: []string{`<error trace_id="`, `">limit must be a positive integer</error>`}},
+		{name: "ndjson_error", target: "/api/messages?format=ndjson&sort=x", status: http.StatusBadRequest, contentType: "application/x-ndjson",
+			contains: []string{`"error":"sort must be 'asc' or 'desc'"`, `"trace_id"`}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+			require.Equal(t, tc.contentType, rec.Header().Get("Content-Type"))
+			for _, want := range tc.contains {
+				require.Contains(t, rec.Body.String(), want)
+			}
+			if tc.status >= 400 {
+				require.Contains(t, rec.Body.String(), rec.Header().Get("X-Trace-ID"), "Errors should carry the trace ID")
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/messages?format=csv&limit=2", nil))
+	require.Equal(t, "2", rec.Header().Get("X-Next-Cursor"))
+
+	// NDJSON streams every message unless limited
+	for _, tc := range []struct {
+		target string
+		ids    []int
+	}{
+		{target: "/api/messages?format=ndjson", ids: []int{1, 2, 3}},
+		{target: "/api/messages?format=ndjson&limit=2&after=1", ids: []int{2, 3}},
+		{target: "/api/messages?format=ndjson&limit=1&sort=desc", ids: []int{3}},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		require.True(t, rec.Flushed, "NDJSON should be flushed row by row")
+		var ids []int
+		dec := json.NewDecoder(rec.Body)
+		for dec.More() {
+			var msg Message
+			require.NoError(t, dec.Decode(&msg))
+			ids = append(ids, msg.ID)
+		}
+		require.Equal(t, tc.ids, ids, tc.target)
+	}
+}
+
+func TestWebMessagesPageShowsChanges(t *testing.T) {
+	store := useMemoryStore(t)
+	ctx := context.Background()
+	for _, text := range []string{"typo", "secret", "plain"} {
+		_, err := store.Append(ctx, Message{User: "alice", Message: text, Timestamp: time.Now()})
+		require.NoError(t, err, "Setup failed")
+	}
+	_, err := store.Edit(ctx, 1, "fixed")
+	require.NoError(t, err, "Setup failed")
+	require.NoError(t, store.Remove(ctx, 2), "Setup failed")
+
+	rec := httptest.NewRecorder()
+	traceMiddleware(webMessagesHandler)(rec, httptest.NewRequest(http.MethodGet, "/web/messages", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := rec.Body.String()
+	require.Contains(t, page, "fixed")
+	require.Contains(t, page, "· edited ")
+	require.Contains(t, page, "This message was deleted.")
+	require.NotContains(t, page, "secret")
+	require.Equal(t, 1, strings.Count(page, "· edited "), "Only the edited message should be marked edited")
+}
+
+func TestMessageResourceAPI(t *testing.T) {
+	useMemoryStore(t)
+	for _, text := range []string{"helo", "second"} {
+		_, err := addMessage(context.Background(), "alice", text)
+		require.NoError(t, err, "Setup failed")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/messages", traceMiddleware(messagesAPIHandler))
+	mux.HandleFunc("/api/messages/{id}", traceMiddleware(messageResourceHandler))
+	do := func(method, target, body string) (*httptest.ResponseRecorder, Message) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var resp struct {
+			Data Message `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp.Data
+	}
+
+	rec, edited := do(http.MethodPatch, "/api/messages/1", `{"message":"hello"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "hello", edited.Message)
+	require.NotNil(t, edited.EditedAt)
+
+	rec, got := do(http.MethodGet, "/api/messages/1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "hello", got.Message)
+	require.Len(t, got.History, 1)
+	require.Equal(t, "helo", got.History[0].Message)
+
+	rec, _ = do(http.MethodDelete, "/api/messages/2", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	testCases := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{name: "get_deleted", method: http.MethodGet, target: "/api/messages/2", status: http.StatusGone},
+		{name: "edit_deleted", method: http.MethodPatch, target: "/api/messages/2", body: `{"message":"x"}`, status: http.StatusGone},
+		{name: "delete_deleted", method: http.MethodDelete, target: "/api/messages/2", status: http.StatusGone},
+		{name: "unknown_id", method: http.MethodGet, target: "/api/messages/99", status: http.StatusNotFound},
+		{name: "bad_id", method: http.MethodGet, target: "/api/messages/abc", status: http.StatusBadRequest},
+		{name: "empty_edit", method: http.MethodPatch, target: "/api/messages/1", body: `{"message":""}`, status: http.StatusBadRequest},
+		{name: "bad_json", method: http.MethodPatch, target: "/api/messages/1", body: `{`, status: http.StatusBadRequest},
+		{name: "method", method: http.MethodPut, target: "/api/messages/1", status: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec, _ := do(tc.method, tc.target, tc.body)
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+		})
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/messages", nil))
+	var listed struct {
+		Data []Message `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listed))
+	require.Len(t, listed.Data, 2, "The tombstone keeps its place in the listing")
+	require.Equal(t, "hello", listed.Data[0].Message)
+	require.True(t, listed.Data[1].Deleted)
+}
+
+func TestSearchMessagesAPI(t *testing.T) {
+	handler := traceMiddleware(searchMessagesHandler)
+	useMemoryStore(t)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/messages/search?q=build", nil))
+	require.Equal(t, http.StatusNotImplemented, rec.Code, "Search needs the index")
+
+	messageStore = messagestore.NewSearchIndex(messageStore)
+	for _, text := range []string{"staging build is green", "build 42 is red", "lunch?"} {
+		_, err := addMessage(context.Background(), "alice", text)
+		require.NoError(t, err, "Setup failed")
+	}
+
+	type hit struct {
+		Message Message `json:"message"`
+		Snippet string  `json:"snippet"`
+	}
+	testCases := []struct {
+		name     string
+		target   string
+		status   int
+		snippets []string
+		next     string
+	}{
+		{name: "word", target: "/api/messages/search?q=build", status: http.StatusOK, snippets: []string{"<mark>build</mark> 42 is red", "staging <mark>build</mark> is green"}},
+		{name: "phrase", target: "/api/messages/search?q=%22staging+build%22", status: http.StatusOK, snippets: []string{"<mark>staging</mark> <mark>build</mark> is green"}},
+		{name: "prefix", target: "/api/messages/search?q=gre*", status: http.StatusOK, snippets: []string{"staging build is <mark>green</mark>"}},
+		{name: "first_page", target: "/api/messages/search?q=build&limit=1", status: http.StatusOK, snippets: []string{"<mark>build</mark> 42 is red"}, next: "2"},
+		{name: "next_page", target: "/api/messages/search?q=build&limit=1&cursor=2", status: http.StatusOK, snippets: []string{"staging <mark>build</mark> is green"}},
+		{name: "no_hits", target: "/api/messages/search?q=deploy", status: http.StatusOK},
+		{name: "empty_query", target: "/api/messages/search?q=+", status: http.StatusBadRequest},
+		{name: "bad_limit", target: "/api/messages/search?q=build&limit=-1", status: http.StatusBadRequest},
+		{name: "bad_cursor", target: "/api/messages/search?q=build&cursor=x", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+			var resp struct {
+				Data       []hit  `json:"data"`
+				NextCursor string `json:"next_cursor"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			var snippets []string
+			for _, h := range resp.Data {
+				snippets = append(snippets, h.Snippet)
+			}
+			require.Equal(t, tc.snippets, snippets)
+			require.Equal(t, tc.next, resp.NextCursor)
+		})
+	}
+}
+
+func TestExportImportMessagesAPI(t *testing.T) {
+	source := useMemoryStore(t)
+	for _, user := range []string{"alice", "bob", "alice"} {
+		_, err := addMessage(context.Background(), user, "from "+user)
+		require.NoError(t, err, "Setup failed")
+	}
+	require.NoError(t, source.Remove(context.Background(), 2), "Setup failed")
+
+	rec := httptest.NewRecorder()
+	traceMiddleware(exportMessagesHandler)(rec, httptest.NewRequest(http.MethodGet, "/api/messages/export?user=alice", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	require.True(t, rec.Flushed, "The export should be streamed")
+	dump := rec.Body.String()
+	require.Equal(t, 2, strings.Count(dump, "\n"))
+
+	target := useMemoryStore(t)
+	importDump := func(target, body string) (*httptest.ResponseRecorder, messagestore.ImportReport) {
+		rec := httptest.NewRecorder()
+		traceMiddleware(importMessagesHandler)(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+		var resp struct {
+			Data messagestore.ImportReport `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp.Data
+	}
+
+	rec, report := importDump("/api/messages/import?dry_run=true", dump)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, 2, report.Imported)
+	messages, err := target.List(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, messages)
+
+	rec, report = importDump("/api/messages/import", dump+"{\"user\":\"eve\"}\n")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, 2, report.Imported)
+	require.Equal(t, []messagestore.ImportError{{Line: 3, Error: "message is required"}}, report.Errors)
+	messages, err = target.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, "from alice", messages[1].Message)
+
+	rec, _ = importDump("/api/messages/import?dry_run=maybe", dump)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = httptest.NewRecorder()
+	traceMiddleware(importMessagesHandler)(rec, httptest.NewRequest(http.MethodGet, "/api/messages/import", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestExportImportMessagesCLI(t *testing.T) {
+	source := useMemoryStore(t)
+	_, err := addMessage(context.Background(), "alice", "moving house")
+	require.NoError(t, err, "Setup failed")
+	path := filepath.Join(t.TempDir(), "messages.ndjson")
+	exportMessages(path)
+
+	target := useMemoryStore(t)
+	importMessages(path, false)
+	exported, err := source.List(context.Background())
+	require.NoError(t, err)
+	imported, err := target.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, imported, 1)
+	require.Equal(t, exported[0].User, imported[0].User)
+	require.True(t, exported[0].Timestamp.Equal(imported[0].Timestamp), "Import should keep the original timestamp")
+}
+
+func TestMessageLogMaintenanceNeedsFileStore(t *testing.T) {
+	previous := messageStore
+	t.Cleanup(func() { messageStore = previous })
+
+	messageStore = messagestore.NewSegmentStore(t.TempDir(), messagestore.SegmentOptions{})
+	err := migrateMessageLog(true)
+	require.ErrorContains(t, err, "not supported for the segmented message store")
+
+	messageStore = messagestore.NewMemoryStore()
+	require.Error(t, migrateMessageLog(false))
+
+	messageStore = messagestore.NewFileStore(filepath.Join(t.TempDir(), "messages.txt"))
+	require.NoError(t, migrateMessageLog(true))
+}
+
+func TestMaintenanceReportsUnresolvedProblems(t *testing.T) {
+	previous := messageStore
+	t.Cleanup(func() { messageStore = previous })
+	logPath := filepath.Join(t.TempDir(), "messages.txt")
+	require.NoError(t, os.WriteFile(logPath, []byte("not a message\n"), 0644), "Setup failed")
+	messageStore = messagestore.NewFileStore(logPath)
+	require.ErrorContains(t, migrateMessageLog(true), "1 message log lines need repair")
+	require.NoError(t, migrateMessageLog(false))
+	require.NoError(t, migrateMessageLog(true), "A repaired log has nothing left to report")
+
+	cfg := storage.BackendConfig{Kind: "local", Root: t.TempDir()}
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.Root, "notes.txt"), []byte("no checksum"), 0644), "Setup failed")
+	require.ErrorContains(t, checkStorageRoot(cfg, false), "1 file storage problems found")
+	require.NoError(t, checkStorageRoot(cfg, true))
+	require.NoError(t, checkStorageRoot(cfg, false), "A repaired root has nothing left to report")
+
+	require.NoError(t, checkStorageRoot(storage.BackendConfig{Kind: "memory"}, false), "Other backends are skipped")
+}
+
+func TestCreateMessageAPIReturnsPersistedID(t *testing.T) {
+	useMemoryStore(t)
+	handler := traceMiddleware(messagesAPIHandler)
+
+	var created struct {
+		Data Message `json:"data"`
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/messages", strings.NewReader(`{"user":"alice","message":"hi"}`)))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+
+	var listed struct {
+		Data []Message `json:"data"`
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/messages", nil))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &listed))
+
+	require.Len(t, listed.Data, 1)
+	require.Equal(t, created.Data.ID, listed.Data[0].ID, "POST and GET must agree on the message ID")
+	require.True(t, created.Data.Timestamp.Equal(listed.Data[0].Timestamp), "POST and GET must agree on the timestamp")
+}
+
+func TestCreateMessageAPIRejectsOversizedMessages(t *testing.T) {
+	previous := messageStore
+	messageStore = messagestore.NewFileStore(filepath.Join(t.TempDir(), "messages.txt"))
+	t.Cleanup(func() { messageStore = previous })
+	handler := traceMiddleware(messagesAPIHandler)
+
+	testCases := []struct {
+		name    string
+		message string
+	}{
+		{name: "body_too_large", message: strings.Repeat("x", 2*message.MaxLineSize)},
+		// JSON escapes < as \u003c, so the record outgrows the body
+		{name: "record_too_large", message: strings.Repeat("<", message.MaxLineSize/4)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := json.Marshal(CreateMessageRequest{User: "alice", Message: tc.message})
+			require.NoError(t, err, "Setup failed")
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, "/api/messages", bytes.NewReader(body)))
+			require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/messages", strings.NewReader(`{"user":"alice","message":"hi"}`)))
+	require.Equal(t, http.StatusCreated, rec.Code, "Rejected messages must not break later writes")
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/messages", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"message":"hi"`)
+}
+
+func TestFileStorageHandlerConfinesPaths(t *testing.T) {
+	root := useFileRoot(t)
+	handler := traceMiddleware(fileStorageHandler)
+	require.NoError(t, root.SaveData(context.Background(), "existing.txt", "hello"), "Setup failed")
+
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "save_inside_root",
+			body:           `{"action":"save","file_path":"notes/today.txt","data":"hi"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "read_inside_root",
+			body:           `{"action":"read","file_path":"existing.txt"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "read_missing_file",
+			body:           `{"action":"read","file_path":"missing.txt"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "read_traversal",
+			body:           `{"action":"read","file_path":"../../etc/passwd"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "save_over_message_log",
+			body:           `{"action":"save","file_path":"../messages.txt","data":"pwned"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "read_absolute_path",
+			body:           `{"action":"read","file_path":"/etc/passwd"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, "/api/files", strings.NewReader(tc.body)))
+			require.Equal(t, tc.expectedStatus, rec.Code, "Unexpected status: %s", rec.Body.String())
+		})
+	}
+}
+
+func TestFileStorageHandlerUsesConfiguredBackend(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	useFileBackend(t, backend)
+	handler := traceMiddleware(fileStorageHandler)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/files", strings.NewReader(`{"action":"save","file_path":"notes.txt","data":"in memory"}`)))
+	require.Equal(t, http.StatusOK, rec.Code, "Unexpected status: %s", rec.Body.String())
+
+	content, err := backend.ReadData(context.Background(), "notes.txt")
+	require.NoError(t, err)
+	require.Equal(t, "in memory", content, "Saves should land in the injected backend")
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/files", strings.NewReader(`{"action":"read","file_path":"notes.txt"}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "in memory")
+}
+
+func TestFileStorageHandlerReportsCorruption(t *testing.T) {
+	root := useFileRoot(t)
+	require.NoError(t, root.SaveData(context.Background(), "notes.txt", "intact"), "Setup failed")
+	require.NoError(t, os.WriteFile(filepath.Join(root.Dir(), "notes.txt"), []byte("rotted"), 0644), "Setup failed")
+	handler := traceMiddleware(fileStorageHandler)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/files", strings.NewReader(`{"action":"read","file_path":"notes.txt"}`)))
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Contains(t, rec.Body.String(), "File is corrupt")
+}
+
+// fileResourceMux routes /api/files and /api/files/{path...} the way
+// startWebApplication does, so handlers see the path value.
+func fileResourceMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/files", traceMiddleware(authMiddleware(fileStorageHandler)))
+	mux.HandleFunc("/api/files/{path...}", traceMiddleware(authMiddleware(fileResourceHandler)))
+	mux.HandleFunc("/api/usage", traceMiddleware(authMiddleware(usageHandler)))
+	return mux
+}
+
+func TestFileResourceLifecycle(t *testing.T) {
+	useFileRoot(t)
+	mux := fileResourceMux()
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := send(http.MethodPut, "/api/files/docs/readme.txt", "raw body, not JSON")
+	require.Equal(t, http.StatusCreated, rec.Code, "First PUT should create: %s", rec.Body.String())
+	rec = send(http.MethodPut, "/api/files/docs/readme.txt", "hello world")
+	require.Equal(t, http.StatusOK, rec.Code, "Second PUT should replace")
+
+	rec = send(http.MethodGet, "/api/files/docs/readme.txt", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "hello world", rec.Body.String())
+	require.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.Equal(t, "11", rec.Header().Get("Content-Length"))
+	require.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"))
+	require.NotEmpty(t, rec.Header().Get("Last-Modified"))
+
+	rec = send(http.MethodHead, "/api/files/docs/readme.txt", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "11", rec.Header().Get("Content-Length"))
+	require.Empty(t, rec.Body.String(), "HEAD must not return a body")
+
+	rec = send(http.MethodPatch, "/api/files/docs/readme.txt", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	require.Equal(t, "GET, HEAD, PUT, DELETE, POST", rec.Header().Get("Allow"))
+
+	rec = send(http.MethodDelete, "/api/files/docs/readme.txt", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = send(http.MethodGet, "/api/files/docs/readme.txt", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = send(http.MethodDelete, "/api/files/docs/readme.txt", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = send(http.MethodPut, "/api/files/%2E%2E%2Fescaped.txt", "x")
+	require.Equal(t, http.StatusForbidden, rec.Code, "Encoded traversal must be rejected")
+	rec = send(http.MethodGet, "/api/files/docs", "")
+	require.Equal(t, http.StatusBadRequest, rec.Code, "Directories are not file resources")
+}
+
+func TestFileResourceRanges(t *testing.T) {
+	root := useFileRoot(t)
+	require.NoError(t, root.SaveData(context.Background(), "digits.txt", "0123456789"), "Setup failed")
+	mux := fileResourceMux()
+
+	testCases := []struct {
+		name          string
+		rangeHeader   string
+		expectedCode  int
+		expectedBody  string
+		expectedRange string
+	}{
+		{name: "no_range", expectedCode: http.StatusOK, expectedBody: "0123456789"},
+		{name: "closed_range", rangeHeader: "bytes=2-5", expectedCode: http.StatusPartialContent, expectedBody: "2345", expectedRange: "bytes 2-5/10"},
+		{name: "open_range", rangeHeader: "bytes=7-", expectedCode: http.StatusPartialContent, expectedBody: "789", expectedRange: "bytes 7-9/10"},
+		{name: "suffix_range", rangeHeader: "bytes=-3", expectedCode: http.StatusPartialContent, expectedBody: "789", expectedRange: "bytes 7-9/10"},
+		{name: "end_past_size", rangeHeader: "bytes=8-100", expectedCode: http.StatusPartialContent, expectedBody: "89", expectedRange: "bytes 8-9/10"},
+		{name: "start_past_size", rangeHeader: "bytes=10-", expectedCode: http.StatusRequestedRangeNotSatisfiable, expectedRange: "bytes */10"},
+		{name: "multiple_ranges_serve_whole_file", rangeHeader: "bytes=0-1,4-5", expectedCode: http.StatusOK, expectedBody: "0123456789"},
+		{name: "malformed_range_ignored", rangeHeader: "bytes=five-", expectedCode: http.StatusOK, expectedBody: "0123456789"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/files/digits.txt", nil)
+			if tc.rangeHeader != "" {
+				req.Header.Set("Range", tc.rangeHeader)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			require.Equal(t, tc.expectedCode, rec.Code, "Unexpected status: %s", rec.Body.String())
+			require.Equal(t, tc.expectedRange, rec.Header().Get("Content-Range"))
+			if tc.expectedBody != "" {
+				require.Equal(t, tc.expectedBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestFileResourceServesGzip(t *testing.T) {
+	root, err := storage.NewRoot(t.TempDir())
+	require.NoError(t, err)
+	backend := storage.NewCompressedBackend(root, storage.CompressionPolicy{Enabled: true})
+	useFileBackend(t, backend)
+	content := strings.Repeat("compressible line\n", 200)
+	require.NoError(t, backend.SaveData(context.Background(), "notes.txt", content), "Setup failed")
+	info, err := backend.Stat(context.Background(), "notes.txt")
+	require.NoError(t, err, "Setup failed")
+	mux := fileResourceMux()
+
+	testCases := []struct {
+		name           string
+		acceptEncoding string
+		rangeHeader    string
+		expectGzip     bool
+	}{
+		{name: "gzip", acceptEncoding: "gzip, deflate", expectGzip: true},
+		{name: "gzip_refused", acceptEncoding: "gzip;q=0"},
+		{name: "no_header"},
+		{name: "range_is_decoded", acceptEncoding: "gzip", rangeHeader: "bytes=0-9"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/files/notes.txt", nil)
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			if tc.rangeHeader != "" {
+				req.Header.Set("Range", tc.rangeHeader)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			require.Contains(t, []int{http.StatusOK, http.StatusPartialContent}, rec.Code, rec.Body.String())
+			require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+			require.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+
+			if !tc.expectGzip {
+				require.Empty(t, rec.Header().Get("Content-Encoding"))
+				require.Equal(t, info.ETag(), rec.Header().Get("ETag"))
+				require.True(t, strings.HasPrefix(content, rec.Body.String()))
+				return
+			}
+			require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+			require.Equal(t, gzipETag(info.ETag()), rec.Header().Get("ETag"), "Each encoding needs its own ETag")
+			require.Less(t, rec.Body.Len(), len(content))
+			zr, err := gzip.NewReader(rec.Body)
+			require.NoError(t, err)
+			decoded, err := io.ReadAll(zr)
+			require.NoError(t, err)
+			require.Equal(t, content, string(decoded))
+		})
+	}
+
+	revalidate := func(acceptEncoding, etag string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/files/notes.txt", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		req.Header.Set("If-None-Match", etag)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	require.Equal(t, http.StatusNotModified, revalidate("gzip", gzipETag(info.ETag())))
+	require.Equal(t, http.StatusOK, revalidate("gzip", info.ETag()), "A cached identity response must not stand in for gzip")
+	require.Equal(t, http.StatusOK, revalidate("", gzipETag(info.ETag())), "A cached gzip response must not stand in for identity")
+	require.Equal(t, http.StatusNotModified, revalidate("", info.ETag()))
+}
+
+func TestFileListAndStatAPI(t *testing.T) {
+	backend := storage.NewMemoryBackend()
+	useFileBackend(t, backend)
+	ctx := context.Background()
+	for _, name := range []string{"docs/a.txt", "docs/b.txt", "docs/c.md", "other.txt"} {
+		require.NoError(t, backend.SaveData(ctx, name, name), "Setup failed")
+	}
+
+	mux := fileResourceMux()
+	get := func(target string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var response Response
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response), "Response should be JSON: %s", rec.Body.String())
+		data, _ := response.Data.(map[string]interface{})
+		return rec, data
+	}
+	names := func(data map[string]interface{}) []string {
+		var names []string
+		files, _ := data["files"].([]interface{})
+		for _, file := range files {
+			names = append(names, file.(map[string]interface{})["name"].(string))
+		}
+		return names
+	}
+
+	rec, data := get("/api/files?prefix=docs/&glob=*/*.txt&limit=1")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, []string{"docs/a.txt"}, names(data))
+	require.Equal(t, "docs/a.txt", data["next_cursor"])
+
+	rec, data = get("/api/files?prefix=docs/&glob=*/*.txt&cursor=docs/a.txt")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, []string{"docs/b.txt"}, names(data))
+	require.Nil(t, data["next_cursor"], "The last page should have no cursor")
+
+	rec, _ = get("/api/files?glob=[")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec, _ = get("/api/files?limit=-1")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec, _ = get("/api/files?prefix=../")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec, data = get("/api/files/other.txt?stat")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "other.txt", data["name"])
+	require.Equal(t, float64(len("other.txt")), data["size"])
+	require.Len(t, data["sha256"], 64, "Stat should include the SHA-256 checksum")
+
+	rec, _ = get("/api/files/missing.txt?stat")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestFileVersionsAPI(t *testing.T) {
+	mux := fileResourceMux()
+	send := func(method, target, body string) (*httptest.ResponseRecorder, Response) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var response Response
+		json.Unmarshal(rec.Body.Bytes(), &response)
+		return rec, response
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		useFileBackend(t, storage.NewMemoryBackend())
+		rec, _ := send(http.MethodGet, "/api/files/plan.txt?versions", "")
+		require.Equal(t, http.StatusNotImplemented, rec.Code)
+		rec, _ = send(http.MethodPost, "/api/files", `{"action":"versions","file_path":"plan.txt"}`)
+		require.Equal(t, http.StatusNotImplemented, rec.Code)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		useFileBackend(t, storage.NewVersionedBackend(storage.NewMemoryBackend(), 0))
+		for _, content := range []string{"v1", "v2", "v3"} {
+			rec, _ := send(http.MethodPut, "/api/files/plan.txt", content)
+			require.Less(t, rec.Code, 300, "Setup failed: %s", rec.Body.String())
+		}
+
+		rec, response := send(http.MethodPost, "/api/files", `{"action":"versions","file_path":"plan.txt"}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		versions := response.Data.(map[string]interface{})["versions"].([]interface{})
+		require.Len(t, versions, 2)
+		oldest := versions[0].(map[string]interface{})["id"].(string)
+
+		rec, response = send(http.MethodPost, "/api/files", `{"action":"read_version","file_path":"plan.txt","version_id":"`+oldest+`"}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "v1", response.Data.(map[string]interface{})["content"])
+
+		rec, _ = send(http.MethodGet, "/api/files/plan.txt?version="+oldest, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "v1", rec.Body.String(), "Versions should be served raw")
+
+		rec, _ = send(http.MethodPost, "/api/files", `{"action":"restore","file_path":"plan.txt","version_id":"`+oldest+`"}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		rec, _ = send(http.MethodGet, "/api/files/plan.txt", "")
+		require.Equal(t, "v1", rec.Body.String())
+
+		rec, _ = send(http.MethodGet, "/api/files/plan.txt?versions", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), `"versions"`)
+
+		rec, _ = send(http.MethodPost, "/api/files/plan.txt?restore=00000000000000000001", "")
+		require.Equal(t, http.StatusNotFound, rec.Code, "Unknown versions should be 404")
+		rec, _ = send(http.MethodGet, "/api/files/.versions/plan.txt", "")
+		require.Equal(t, http.StatusBadRequest, rec.Code, "The version store must not be addressable")
+	})
+}
+
+func TestFileETagConcurrency(t *testing.T) {
+	useFileBackend(t, storage.NewMemoryBackend())
+	mux := fileResourceMux()
+	send := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send(http.MethodPut, "/api/files/doc.txt", "v1", map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	first := rec.Header().Get("ETag")
+	require.NotEmpty(t, first, "Saves should return the new ETag")
+
+	rec = send(http.MethodPut, "/api/files/doc.txt", "v1 again", map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code, "Create-only writes must not overwrite")
+
+	rec = send(http.MethodGet, "/api/files/doc.txt", "", nil)
+	require.Equal(t, first, rec.Header().Get("ETag"), "Reads should return the current ETag")
+	rec = send(http.MethodGet, "/api/files/doc.txt", "", map[string]string{"If-None-Match": first})
+	require.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = send(http.MethodPut, "/api/files/doc.txt", "v2 from alice", map[string]string{"If-Match": first})
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = send(http.MethodPut, "/api/files/doc.txt", "v2 from bob", map[string]string{"If-Match": first})
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code, "The second writer holding a stale ETag must lose")
+
+	// The legacy JSON endpoint takes the ETag in the body
+	rec = send(http.MethodPost, "/api/files", `{"action":"read","file_path":"doc.txt"}`, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response Response
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	current := response.Data.(map[string]interface{})["etag"].(string)
+	require.Equal(t, rec.Header().Get("ETag"), current)
+
+	body := `{"action":"save","file_path":"doc.txt","data":"v3","expected_etag":` + strconv.Quote(first) + `}`
+	rec = send(http.MethodPost, "/api/files", body, nil)
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	body = `{"action":"save","file_path":"doc.txt","data":"v3","expected_etag":` + strconv.Quote(current) + `}`
+	rec = send(http.MethodPost, "/api/files", body, nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	rec = send(http.MethodPut, "/api/files/doc.txt", "v4", map[string]string{"If-Match": `"a", "b"`})
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = send(http.MethodPut, "/api/files/new.txt", "v1", map[string]string{"If-Match": "*"})
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code, "If-Match: * requires an existing file")
+}
+
+func TestLegacyFileReadThenConditionalSave(t *testing.T) {
+	testCases := []struct {
+		name string
+		wrap func(storage.Backend) storage.Backend
+	}{
+		{name: "plain", wrap: func(b storage.Backend) storage.Backend { return b }},
+		{name: "encrypted", wrap: func(b storage.Backend) storage.Backend {
+			return storage.NewEncryptedBackend(b, testKeys(t, "k1"))
+		}},
+		{name: "compressed", wrap: func(b storage.Backend) storage.Backend {
+			return storage.NewCompressedBackend(b, storage.CompressionPolicy{Enabled: true})
+		}},
+		{name: "compressed_encrypted", wrap: func(b storage.Backend) storage.Backend {
+			return storage.NewCompressedBackend(storage.NewEncryptedBackend(b, testKeys(t, "k1")), storage.CompressionPolicy{Enabled: true})
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root, err := storage.NewRoot(t.TempDir())
+			require.NoError(t, err)
+			backend := tc.wrap(root)
+			useFileBackend(t, backend)
+			require.NoError(t, backend.SaveData(context.Background(), "doc.txt", strings.Repeat("first draft\n", 100)), "Setup failed")
+			send := func(body string) (*httptest.ResponseRecorder, Response) {
+				rec := httptest.NewRecorder()
+				traceMiddleware(fileStorageHandler)(rec, httptest.NewRequest(http.MethodPost, "/api/files", strings.NewReader(body)))
+				var response Response
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				return rec, response
+			}
+
+			rec, response := send(`{"action":"read","file_path":"doc.txt"}`)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+			etag := response.Data.(map[string]interface{})["etag"].(string)
+			info, err := backend.Stat(context.Background(), "doc.txt")
+			require.NoError(t, err)
+			require.Equal(t, info.ETag(), etag, "Reads should return the ETag saves are checked against")
+
+			body := `{"action":"save","file_path":"doc.txt","data":"second draft","expected_etag":` + strconv.Quote(etag) + `}`
+			rec, _ = send(body)
+			require.Equal(t, http.StatusOK, rec.Code, "A save after a read should succeed: %s", rec.Body.String())
+			rec, _ = send(body)
+			require.Equal(t, http.StatusPreconditionFailed, rec.Code, "The ETag read before the save is stale now")
+		})
+	}
+}
+
+func TestFileQuotasAndUsageAPI(t *testing.T) {
+	mux := fileResourceMux()
+	send := func(method, target, body, token string) (*httptest.ResponseRecorder, Response) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var response Response
+		json.Unmarshal(rec.Body.Bytes(), &response)
+		return rec, response
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		useFileBackend(t, storage.NewVersionedBackend(storage.NewMemoryBackend(), 0))
+		rec, _ := send(http.MethodGet, "/api/usage", "", "")
+		require.Equal(t, http.StatusNotImplemented, rec.Code)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		tokens, err := parseAuthTokens(strings.NewReader("# user token\nalice secret-a\nbob secret-b\n"))
+		require.NoError(t, err)
+		previous := authTokens
+		authTokens = tokens
+		t.Cleanup(func() { authTokens = previous })
+
+		backend, err := storage.NewQuotaBackend(context.Background(), storage.NewMemoryBackend(), storage.QuotaConfig{
+			User: storage.Limit{Bytes: 10},
+		})
+		require.NoError(t, err)
+		useFileBackend(t, backend)
+
+		rec, _ := send(http.MethodPut, "/api/files/a.txt", "12345", "")
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+		require.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+		rec, _ = send(http.MethodGet, "/api/usage", "", "wrong")
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		rec, _ = send(http.MethodPut, "/api/files/docs/a.txt", "12345", "secret-a")
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		rec, _ = send(http.MethodPut, "/api/files/docs/b.txt", "123456", "secret-a")
+		require.Equal(t, http.StatusInsufficientStorage, rec.Code, "Writes over the quota should be 507")
+		rec, _ = send(http.MethodPut, "/api/files/docs/c.txt", "12345678901", "secret-b")
+		require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "Files larger than the quota should be 413")
+		rec, _ = send(http.MethodPut, "/api/files/docs/b.txt", "123456", "secret-b")
+		require.Equal(t, http.StatusCreated, rec.Code, "Quotas are per user")
+
+		rec, response := send(http.MethodGet, "/api/usage", "", "secret-a")
+		require.Equal(t, http.StatusOK, rec.Code)
+		data := response.Data.(map[string]interface{})
+		require.Equal(t, "alice", data["user"])
+		require.Equal(t, float64(5), data["usage"].(map[string]interface{})["bytes"])
+		docs := data["directories"].(map[string]interface{})["docs"].(map[string]interface{})
+		require.Equal(t, float64(11), docs["bytes"])
+		require.Equal(t, float64(2), docs["files"])
+	})
+}
@@ -25,12 +25,19 @@ const (
 
 // Message represents a message in our system
 type Message struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Id            int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
-	User          string                 `protobuf:"bytes,2,opt,name=user,proto3" json:"user,omitempty"`
-	Message       string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
-	Timestamp     *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
-	TraceId       string                 `protobuf:"bytes,5,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Stable ID assigned when the message is written; identical across
+	// REST, WebSocket, the web page and this service
+	Id        int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	User      string                 `protobuf:"bytes,2,opt,name=user,proto3" json:"user,omitempty"`
+	Message   string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	Timestamp *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	TraceId   string                 `protobuf:"bytes,5,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	// Set when the message was deleted: a tombstone keeps its ID, user and
+	// timestamp but no text
+	Deleted bool `protobuf:"varint,6,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	// When the message was last edited or deleted; unset if it never was
+	EditedAt      *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=edited_at,json=editedAt,proto3" json:"edited_at,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -100,6 +107,20 @@ func (x *Message) GetTraceId() string {
 	return ""
 }
 
+func (x *Message) GetDeleted() bool {
+	if x != nil {
+		return x.Deleted
+	}
+	return false
+}
+
+func (x *Message) GetEditedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.EditedAt
+	}
+	return nil
+}
+
 // SaveMessageRequest contains the data needed to save a new message
 type SaveMessageRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
@@ -198,25 +219,212 @@ func (x *GetLast10Response) GetMessages() []*Message {
 	return nil
 }
 
+// SearchRequest is a full-text search over message text and user
+type SearchRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Words that must all occur, in any case; "quoted phrases" must occur as
+	// consecutive words and words ending in * match as prefixes
+	Query string `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
+	// Maximum number of hits; 0 means 100, at most 1000
+	Limit int32 `protobuf:"varint,2,opt,name=limit,proto3" json:"limit,omitempty"`
+	// next_cursor of the previous page
+	Cursor        string `protobuf:"bytes,3,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchRequest) Reset() {
+	*x = SearchRequest{}
+	mi := &file_proto_message_service_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchRequest) ProtoMessage() {}
+
+func (x *SearchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_message_service_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchRequest.ProtoReflect.Descriptor instead.
+func (*SearchRequest) Descriptor() ([]byte, []int) {
+	return file_proto_message_service_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *SearchRequest) GetQuery() string {
+	if x != nil {
+		return x.Query
+	}
+	return ""
+}
+
+func (x *SearchRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *SearchRequest) GetCursor() string {
+	if x != nil {
+		return x.Cursor
+	}
+	return ""
+}
+
+// SearchHit is a message matching a search
+type SearchHit struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Message *Message               `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	// HTML excerpt of the text with the matches wrapped in <mark>
+	Snippet       string `protobuf:"bytes,2,opt,name=snippet,proto3" json:"snippet,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchHit) Reset() {
+	*x = SearchHit{}
+	mi := &file_proto_message_service_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchHit) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchHit) ProtoMessage() {}
+
+func (x *SearchHit) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_message_service_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchHit.ProtoReflect.Descriptor instead.
+func (*SearchHit) Descriptor() ([]byte, []int) {
+	return file_proto_message_service_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SearchHit) GetMessage() *Message {
+	if x != nil {
+		return x.Message
+	}
+	return nil
+}
+
+func (x *SearchHit) GetSnippet() string {
+	if x != nil {
+		return x.Snippet
+	}
+	return ""
+}
+
+// SearchResponse contains one page of hits, newest first
+type SearchResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Hits  []*SearchHit           `protobuf:"bytes,1,rep,name=hits,proto3" json:"hits,omitempty"`
+	// Fetches the next page when passed as cursor; empty on the last page
+	NextCursor    string `protobuf:"bytes,2,opt,name=next_cursor,json=nextCursor,proto3" json:"next_cursor,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchResponse) Reset() {
+	*x = SearchResponse{}
+	mi := &file_proto_message_service_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchResponse) ProtoMessage() {}
+
+func (x *SearchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_message_service_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchResponse.ProtoReflect.Descriptor instead.
+func (*SearchResponse) Descriptor() ([]byte, []int) {
+	return file_proto_message_service_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *SearchResponse) GetHits() []*SearchHit {
+	if x != nil {
+		return x.Hits
+	}
+	return nil
+}
+
+func (x *SearchResponse) GetNextCursor() string {
+	if x != nil {
+		return x.NextCursor
+	}
+	return ""
+}
+
 var File_proto_message_service_proto protoreflect.FileDescriptor
 
 const file_proto_message_service_proto_rawDesc = "" +
 	"\n" +
-	"\x1bproto/message_service.proto\x12\x0fmessage_service\x1a\x1fgoogle/protobuf/timestamp.proto\x1a\x1bgoogle/protobuf/empty.proto\"\x9c\x01\n" +
+	"\x1bproto/message_service.proto\x12\x0fmessage_service\x1a\x1fgoogle/protobuf/timestamp.proto\x1a\x1bgoogle/protobuf/empty.proto\"\xef\x01\n" +
 	"\aMessage\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x12\n" +
 	"\x04user\x18\x02 \x01(\tR\x04user\x12\x18\n" +
 	"\amessage\x18\x03 \x01(\tR\amessage\x128\n" +
 	"\ttimestamp\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12\x19\n" +
-	"\btrace_id\x18\x05 \x01(\tR\atraceId\"B\n" +
+	"\btrace_id\x18\x05 \x01(\tR\atraceId\x12\x18\n" +
+	"\adeleted\x18\x06 \x01(\bR\adeleted\x127\n" +
+	"\tedited_at\x18\a \x01(\v2\x1a.google.protobuf.TimestampR\beditedAt\"B\n" +
 	"\x12SaveMessageRequest\x12\x12\n" +
 	"\x04user\x18\x01 \x01(\tR\x04user\x12\x18\n" +
 	"\amessage\x18\x02 \x01(\tR\amessage\"I\n" +
 	"\x11GetLast10Response\x124\n" +
-	"\bmessages\x18\x01 \x03(\v2\x18.message_service.MessageR\bmessages2\x9e\x01\n" +
-	"\x0eMessageService\x12C\n" +
-	"\x04Save\x12#.message_service.SaveMessageRequest\x1a\x16.google.protobuf.Empty\x12G\n" +
-	"\tGetLast10\x12\x16.google.protobuf.Empty\x1a\".message_service.GetLast10ResponseB.Z,cgi.com/goLangTraining/proto/message_serviceb\x06proto3"
+	"\bmessages\x18\x01 \x03(\v2\x18.message_service.MessageR\bmessages\"S\n" +
+	"\rSearchRequest\x12\x14\n" +
+	"\x05query\x18\x01 \x01(\tR\x05query\x12\x14\n" +
+	"\x05limit\x18\x02 \x01(\x05R\x05limit\x12\x16\n" +
+	"\x06cursor\x18\x03 \x01(\tR\x06cursor\"Y\n" +
+	"\tSearchHit\x122\n" +
+	"\amessage\x18\x01 \x01(\v2\x18.message_service.MessageR\amessage\x12\x18\n" +
+	"\asnippet\x18\x02 \x01(\tR\asnippet\"a\n" +
+	"\x0eSearchResponse\x12.\n" +
+	"\x04hits\x18\x01 \x03(\v2\x1a.message_service.SearchHitR\x04hits\x12\x1f\n" +
+	"\vnext_cursor\x18\x02 \x01(\tR\n" +
+	"nextCursor2\xeb\x01\n" +
+	"\x0eMessageService\x12E\n" +
+	"\x04Save\x12#.message_service.SaveMessageRequest\x1a\x18.message_service.Message\x12G\n" +
+	"\tGetLast10\x12\x16.google.protobuf.Empty\x1a\".message_service.GetLast10Response\x12I\n" +
+	"\x06Search\x12\x1e.message_service.SearchRequest\x1a\x1f.message_service.SearchResponseB.Z,cgi.com/goLangTraining/proto/message_serviceb\x06proto3"
 
 var (
 	file_proto_message_service_proto_rawDescOnce sync.Once
@@ -230,26 +438,34 @@ func file_proto_message_service_proto_rawDescGZIP() []byte {
 	return file_proto_message_service_proto_rawDescData
 }
 
-var file_proto_message_service_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_proto_message_service_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
 var file_proto_message_service_proto_goTypes = []any{
 	(*Message)(nil),               // 0: message_service.Message
 	(*SaveMessageRequest)(nil),    // 1: message_service.SaveMessageRequest
 	(*GetLast10Response)(nil),     // 2: message_service.GetLast10Response
-	(*timestamppb.Timestamp)(nil), // 3: google.protobuf.Timestamp
-	(*emptypb.Empty)(nil),         // 4: google.protobuf.Empty
+	(*SearchRequest)(nil),         // 3: message_service.SearchRequest
+	(*SearchHit)(nil),             // 4: message_service.SearchHit
+	(*SearchResponse)(nil),        // 5: message_service.SearchResponse
+	(*timestamppb.Timestamp)(nil), // 6: google.protobuf.Timestamp
+	(*emptypb.Empty)(nil),         // 7: google.protobuf.Empty
 }
 var file_proto_message_service_proto_depIdxs = []int32{
-	3, // 0: message_service.Message.timestamp:type_name -> google.protobuf.Timestamp
-	0, // 1: message_service.GetLast10Response.messages:type_name -> message_service.Message
-	1, // 2: message_service.MessageService.Save:input_type -> message_service.SaveMessageRequest
-	4, // 3: message_service.MessageService.GetLast10:input_type -> google.protobuf.Empty
-	4, // 4: message_service.MessageService.Save:output_type -> google.protobuf.Empty
-	2, // 5: message_service.MessageService.GetLast10:output_type -> message_service.GetLast10Response
-	4, // [4:6] is the sub-list for method output_type
-	2, // [2:4] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	6, // 0: message_service.Message.timestamp:type_name -> google.protobuf.Timestamp
+	6, // 1: message_service.Message.edited_at:type_name -> google.protobuf.Timestamp
+	0, // 2: message_service.GetLast10Response.messages:type_name -> message_service.Message
+	0, // 3: message_service.SearchHit.message:type_name -> message_service.Message
+	4, // 4: message_service.SearchResponse.hits:type_name -> message_service.SearchHit
+	1, // 5: message_service.MessageService.Save:input_type -> message_service.SaveMessageRequest
+	7, // 6: message_service.MessageService.GetLast10:input_type -> google.protobuf.Empty
+	3, // 7: message_service.MessageService.Search:input_type -> message_service.SearchRequest
+	0, // 8: message_service.MessageService.Save:output_type -> message_service.Message
+	2, // 9: message_service.MessageService.GetLast10:output_type -> message_service.GetLast10Response
+	5, // 10: message_service.MessageService.Search:output_type -> message_service.SearchResponse
+	8, // [8:11] is the sub-list for method output_type
+	5, // [5:8] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_proto_message_service_proto_init() }
@@ -263,7 +479,7 @@ func file_proto_message_service_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_message_service_proto_rawDesc), len(file_proto_message_service_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   3,
+			NumMessages:   6,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
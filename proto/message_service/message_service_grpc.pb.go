@@ -22,6 +22,7 @@ const _ = grpc.SupportPackageIsVersion9
 const (
 	MessageService_Save_FullMethodName      = "/message_service.MessageService/Save"
 	MessageService_GetLast10_FullMethodName = "/message_service.MessageService/GetLast10"
+	MessageService_Search_FullMethodName    = "/message_service.MessageService/Search"
 )
 
 // MessageServiceClient is the client API for MessageService service.
@@ -30,10 +31,12 @@ const (
 //
 // MessageService defines the gRPC service for message operations
 type MessageServiceClient interface {
-	// Save endpoint that saves a message and returns nothing
-	Save(ctx context.Context, in *SaveMessageRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// Save endpoint that saves a message and returns it with its assigned ID
+	Save(ctx context.Context, in *SaveMessageRequest, opts ...grpc.CallOption) (*Message, error)
 	// GetLast10 returns a list of the last 10 messages
 	GetLast10(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetLast10Response, error)
+	// Search returns the messages matching a full-text query
+	Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error)
 }
 
 type messageServiceClient struct {
@@ -44,9 +47,9 @@ func NewMessageServiceClient(cc grpc.ClientConnInterface) MessageServiceClient {
 	return &messageServiceClient{cc}
 }
 
-func (c *messageServiceClient) Save(ctx context.Context, in *SaveMessageRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+func (c *messageServiceClient) Save(ctx context.Context, in *SaveMessageRequest, opts ...grpc.CallOption) (*Message, error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
-	out := new(emptypb.Empty)
+	out := new(Message)
 	err := c.cc.Invoke(ctx, MessageService_Save_FullMethodName, in, out, cOpts...)
 	if err != nil {
 		return nil, err
@@ -64,16 +67,28 @@ func (c *messageServiceClient) GetLast10(ctx context.Context, in *emptypb.Empty,
 	return out, nil
 }
 
+func (c *messageServiceClient) Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SearchResponse)
+	err := c.cc.Invoke(ctx, MessageService_Search_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MessageServiceServer is the server API for MessageService service.
 // All implementations must embed UnimplementedMessageServiceServer
 // for forward compatibility.
 //
 // MessageService defines the gRPC service for message operations
 type MessageServiceServer interface {
-	// Save endpoint that saves a message and returns nothing
-	Save(context.Context, *SaveMessageRequest) (*emptypb.Empty, error)
+	// Save endpoint that saves a message and returns it with its assigned ID
+	Save(context.Context, *SaveMessageRequest) (*Message, error)
 	// GetLast10 returns a list of the last 10 messages
 	GetLast10(context.Context, *emptypb.Empty) (*GetLast10Response, error)
+	// Search returns the messages matching a full-text query
+	Search(context.Context, *SearchRequest) (*SearchResponse, error)
 	mustEmbedUnimplementedMessageServiceServer()
 }
 
@@ -84,12 +99,15 @@ type MessageServiceServer interface {
 // pointer dereference when methods are called.
 type UnimplementedMessageServiceServer struct{}
 
-func (UnimplementedMessageServiceServer) Save(context.Context, *SaveMessageRequest) (*emptypb.Empty, error) {
+func (UnimplementedMessageServiceServer) Save(context.Context, *SaveMessageRequest) (*Message, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Save not implemented")
 }
 func (UnimplementedMessageServiceServer) GetLast10(context.Context, *emptypb.Empty) (*GetLast10Response, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetLast10 not implemented")
 }
+func (UnimplementedMessageServiceServer) Search(context.Context, *SearchRequest) (*SearchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Search not implemented")
+}
 func (UnimplementedMessageServiceServer) mustEmbedUnimplementedMessageServiceServer() {}
 func (UnimplementedMessageServiceServer) testEmbeddedByValue()                        {}
 
@@ -147,6 +165,24 @@ func _MessageService_GetLast10_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MessageService_Search_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServiceServer).Search(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MessageService_Search_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServiceServer).Search(ctx, req.(*SearchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MessageService_ServiceDesc is the grpc.ServiceDesc for MessageService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -162,6 +198,10 @@ var MessageService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetLast10",
 			Handler:    _MessageService_GetLast10_Handler,
 		},
+		{
+			MethodName: "Search",
+			Handler:    _MessageService_Search_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/message_service.proto",
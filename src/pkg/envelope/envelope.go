@@ -0,0 +1,212 @@
+// Package envelope implements envelope encryption for data at rest. Every
+// object (a stored file, a log record) is encrypted with AES-256-GCM under
+// its own random data key. The data key is itself encrypted ("wrapped")
+// under a master key from a key file and stored in a header in front of the
+// object together with the master key's ID, so master keys can be rotated
+// while data written under earlier keys stays readable.
+//
+// An encrypted object is the header followed by the content split into
+// chunks of ChunkSize bytes, each sealed separately so ranges can be
+// decrypted without reading everything before them. Chunks are numbered and
+// the last one is marked, so reordered, dropped or truncated chunks fail to
+// decrypt.
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// magic starts every encrypted object.
+	magic = "GENV"
+	// formatVersion is the version of the header and chunk layout.
+	formatVersion = 1
+
+	nonceSize      = 12
+	tagSize        = 16
+	wrappedKeySize = nonceSize + KeySize + tagSize
+
+	// HeaderSize is the length of the header in front of every encrypted
+	// object: magic, version, key ID and the wrapped data key.
+	HeaderSize = len(magic) + 1 + 1 + maxKeyIDLen + wrappedKeySize
+	// ChunkSize is the amount of content sealed in each chunk.
+	ChunkSize = 64 * 1024
+	// SealedChunkSize is the stored size of every chunk but the last.
+	SealedChunkSize = ChunkSize + tagSize
+)
+
+var (
+	// ErrNotEncrypted is returned for data that does not start with an
+	// envelope header.
+	ErrNotEncrypted = errors.New("data is not encrypted")
+	// ErrDecrypt is returned when encrypted data fails authentication:
+	// it was corrupted, truncated or tampered with.
+	ErrDecrypt = errors.New("decryption failed")
+)
+
+// Header is the plaintext prefix of an encrypted object.
+type Header struct {
+	// KeyID names the master key the data key is wrapped under.
+	KeyID string
+
+	wrapped [wrappedKeySize]byte
+}
+
+// ParseHeader decodes the header at the start of b. It returns
+// ErrNotEncrypted if b does not start with one.
+func ParseHeader(b []byte) (Header, error) {
+	if !bytes.HasPrefix(b, []byte(magic)) {
+		return Header{}, ErrNotEncrypted
+	}
+	if len(b) < HeaderSize {
+		return Header{}, fmt.Errorf("%w: truncated header", ErrDecrypt)
+	}
+	if v := b[len(magic)]; v != formatVersion {
+		return Header{}, fmt.Errorf("unsupported envelope version %d", v)
+	}
+
+	idLen := int(b[len(magic)+1])
+	if idLen == 0 || idLen > maxKeyIDLen {
+		return Header{}, fmt.Errorf("%w: malformed header", ErrDecrypt)
+	}
+	var h Header
+	h.KeyID = string(b[len(magic)+2 : len(magic)+2+idLen])
+	copy(h.wrapped[:], b[HeaderSize-wrappedKeySize:HeaderSize])
+	return h, nil
+}
+
+// ReadHeader reads and decodes the header at the start of r.
+func ReadHeader(r io.Reader) (Header, error) {
+	b := make([]byte, HeaderSize)
+	n, err := io.ReadFull(r, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Header{}, err
+	}
+	return ParseHeader(b[:n])
+}
+
+// Bytes encodes the header.
+func (h Header) Bytes() []byte {
+	b := make([]byte, HeaderSize)
+	copy(b, h.prefix())
+	copy(b[HeaderSize-wrappedKeySize:], h.wrapped[:])
+	return b
+}
+
+// prefix returns the header up to the wrapped key. It is authenticated when
+// the data key is wrapped, so the key ID cannot be swapped.
+func (h Header) prefix() []byte {
+	b := make([]byte, HeaderSize-wrappedKeySize)
+	copy(b, magic)
+	b[len(magic)] = formatVersion
+	b[len(magic)+1] = byte(len(h.KeyID))
+	copy(b[len(magic)+2:], h.KeyID)
+	return b
+}
+
+// newDataKey returns a fresh data key and a header holding it wrapped under
+// the active master key.
+func (k *Keyring) newDataKey() ([]byte, Header, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, Header{}, err
+	}
+
+	h := Header{KeyID: k.active}
+	nonce := h.wrapped[:nonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, Header{}, err
+	}
+	k.keys[k.active].Seal(h.wrapped[nonceSize:nonceSize], nonce, dataKey, h.prefix())
+	return dataKey, h, nil
+}
+
+// unwrap returns the data key held in h.
+func (k *Keyring) unwrap(h Header) ([]byte, error) {
+	master, err := k.key(h.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := master.Open(nil, h.wrapped[:nonceSize], h.wrapped[nonceSize:], h.prefix())
+	if err != nil {
+		return nil, fmt.Errorf("%w: data key does not unwrap under key %q", ErrDecrypt, h.KeyID)
+	}
+	return dataKey, nil
+}
+
+// Current reports whether h wraps its data key under the active key.
+func (k *Keyring) Current(h Header) bool {
+	return h.KeyID == k.active
+}
+
+// Seal encrypts plaintext as a single object.
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	r, err := k.EncryptReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	sealed := bytes.NewBuffer(make([]byte, 0, SealedSize(int64(len(plaintext)))))
+	if _, err := sealed.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return sealed.Bytes(), nil
+}
+
+// Open decrypts an object produced by Seal or EncryptReader.
+func (k *Keyring) Open(sealed []byte) ([]byte, error) {
+	h, err := ParseHeader(sealed)
+	if err != nil {
+		return nil, err
+	}
+	size, last, err := PlainSize(int64(len(sealed)))
+	if err != nil {
+		return nil, err
+	}
+	r, err := k.DecryptReader(h, bytes.NewReader(sealed[HeaderSize:]), 0, last)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := plaintext.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return plaintext.Bytes(), nil
+}
+
+// SealedSize returns the stored size of size bytes of content.
+func SealedSize(size int64) int64 {
+	return int64(HeaderSize) + size + (size/ChunkSize+1)*tagSize
+}
+
+// PlainSize returns the content size of an encrypted object of sealedSize
+// bytes and the index of its last chunk. Sizes no writer produces are
+// reported as ErrDecrypt.
+func PlainSize(sealedSize int64) (size, lastChunk int64, err error) {
+	body := sealedSize - int64(HeaderSize) - tagSize
+	if body < 0 || body%SealedChunkSize >= ChunkSize {
+		return 0, 0, fmt.Errorf("%w: %d bytes is not a valid encrypted size", ErrDecrypt, sealedSize)
+	}
+	lastChunk = body / SealedChunkSize
+	return lastChunk*ChunkSize + body%SealedChunkSize, lastChunk, nil
+}
+
+// ChunkOffset returns where chunk i starts in an encrypted object.
+func ChunkOffset(i int64) int64 {
+	return int64(HeaderSize) + i*SealedChunkSize
+}
+
+// chunkNonce returns the nonce of chunk i. Every data key encrypts a single
+// object, so the chunk number alone keeps nonces unique.
+func chunkNonce(nonce []byte, i int64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce, uint64(i))
+	nonce[8], nonce[9], nonce[10], nonce[11] = 0, 0, 0, 0
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
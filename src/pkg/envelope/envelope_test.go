@@ -0,0 +1,213 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testKey returns a valid base64-encoded key made of b repeated.
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, KeySize))
+}
+
+// testKeyring parses a keyring from "<id> <key>" lines.
+func testKeyring(t *testing.T, lines ...string) *Keyring {
+	t.Helper()
+	keys, err := ParseKeyring(strings.NewReader(strings.Join(lines, "\n")))
+	require.NoError(t, err, "Setup failed")
+	return keys
+}
+
+func TestParseKeyring(t *testing.T) {
+	testCases := []struct {
+		name      string
+		file      string
+		active    string
+		expectErr bool
+	}{
+		{name: "single", file: "k1 " + testKey(1), active: "k1"},
+		{name: "last_is_active", file: "# rotated 2026-10\nk1 " + testKey(1) + "\n\nk2 " + testKey(2) + "\n", active: "k2"},
+		{name: "empty", file: "# nothing yet\n", expectErr: true},
+		{name: "missing_key", file: "k1", expectErr: true},
+		{name: "short_key", file: "k1 " + base64.StdEncoding.EncodeToString([]byte("short")), expectErr: true},
+		{name: "not_base64", file: "k1 !!!", expectErr: true},
+		{name: "duplicate_id", file: "k1 " + testKey(1) + "\nk1 " + testKey(2), expectErr: true},
+		{name: "long_id", file: strings.Repeat("k", maxKeyIDLen+1) + " " + testKey(1), expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := ParseKeyring(strings.NewReader(tc.file))
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.active, keys.ActiveKeyID())
+		})
+	}
+}
+
+func TestLoadKeyringRejectsSharedKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("k1 "+testKey(1)+"\n"), 0644), "Setup failed")
+
+	_, err := LoadKeyring(path)
+	require.Error(t, err, "A key file readable by others must be refused")
+
+	require.NoError(t, os.Chmod(path, 0600), "Setup failed")
+	keys, err := LoadKeyring(path)
+	require.NoError(t, err)
+	require.Equal(t, "k1", keys.ActiveKeyID())
+
+	keys, err = Config{}.Load()
+	require.NoError(t, err)
+	require.Nil(t, keys, "No key file means no encryption")
+}
+
+func TestSealAndOpen(t *testing.T) {
+	keys := testKeyring(t, "k1 "+testKey(1))
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 5} {
+		plaintext := bytes.Repeat([]byte("abcdefg"), size/7+1)[:size]
+
+		sealed, err := keys.Seal(plaintext)
+		require.NoError(t, err)
+		require.Equal(t, SealedSize(int64(size)), int64(len(sealed)), "Size %d", size)
+		plainSize, _, err := PlainSize(int64(len(sealed)))
+		require.NoError(t, err)
+		require.Equal(t, int64(size), plainSize)
+
+		opened, err := keys.Open(sealed)
+		require.NoError(t, err, "Size %d", size)
+		require.Equal(t, plaintext, opened)
+	}
+
+	first, err := keys.Seal([]byte("same"))
+	require.NoError(t, err)
+	second, err := keys.Seal([]byte("same"))
+	require.NoError(t, err)
+	require.NotEqual(t, first, second, "Every object gets its own data key")
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	keys := testKeyring(t, "k1 "+testKey(1))
+	plaintext := bytes.Repeat([]byte("x"), 2*ChunkSize+10)
+	sealed, err := keys.Seal(plaintext)
+	require.NoError(t, err)
+
+	flipped := bytes.Clone(sealed)
+	flipped[ChunkOffset(1)+3] ^= 1
+
+	swapped := bytes.Clone(sealed)
+	copy(swapped[ChunkOffset(0):], sealed[ChunkOffset(1):ChunkOffset(2)])
+	copy(swapped[ChunkOffset(1):], sealed[ChunkOffset(0):ChunkOffset(1)])
+
+	// Dropping the final chunk leaves a valid size ending in a full chunk.
+	truncated := bytes.Clone(sealed[:ChunkOffset(2)])
+	truncated = append(truncated, sealed[len(sealed)-tagSize:]...)
+
+	otherKey := bytes.Clone(sealed)
+	copy(otherKey, otherHeader(t, sealed))
+
+	testCases := []struct {
+		name   string
+		sealed []byte
+	}{
+		{name: "flipped_bit", sealed: flipped},
+		{name: "swapped_chunks", sealed: swapped},
+		{name: "dropped_chunk", sealed: truncated},
+		{name: "cut_short", sealed: sealed[:len(sealed)-1]},
+		{name: "header_from_other_object", sealed: otherKey},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := keys.Open(tc.sealed)
+			require.ErrorIs(t, err, ErrDecrypt)
+		})
+	}
+
+	_, err = keys.Open([]byte("plain text"))
+	require.ErrorIs(t, err, ErrNotEncrypted)
+}
+
+// otherHeader returns the header of a different object sealed under
+// the same key as sealed.
+func otherHeader(t *testing.T, sealed []byte) []byte {
+	t.Helper()
+	keys := testKeyring(t, "k1 "+testKey(1))
+	other, err := keys.Seal(sealed[:10])
+	require.NoError(t, err, "Setup failed")
+	return other[:HeaderSize]
+}
+
+func TestKeyRotation(t *testing.T) {
+	before := testKeyring(t, "k1 "+testKey(1))
+	sealed, err := before.Seal([]byte("written before rotation"))
+	require.NoError(t, err)
+
+	after := testKeyring(t, "k1 "+testKey(1), "k2 "+testKey(2))
+	opened, err := after.Open(sealed)
+	require.NoError(t, err, "Old keys stay usable for reading")
+	require.Equal(t, "written before rotation", string(opened))
+
+	h, err := ParseHeader(sealed)
+	require.NoError(t, err)
+	require.Equal(t, "k1", h.KeyID)
+	require.False(t, after.Current(h))
+
+	resealed, err := after.Seal(opened)
+	require.NoError(t, err)
+	h, err = ParseHeader(resealed)
+	require.NoError(t, err)
+	require.Equal(t, "k2", h.KeyID, "New data uses the last key")
+	require.True(t, after.Current(h))
+
+	retired := testKeyring(t, "k2 "+testKey(2))
+	_, err = retired.Open(sealed)
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	impostor := testKeyring(t, "k1 "+testKey(9))
+	_, err = impostor.Open(sealed)
+	require.ErrorIs(t, err, ErrDecrypt, "A different key under the same ID must not decrypt")
+}
+
+func TestDecryptReaderRange(t *testing.T) {
+	keys := testKeyring(t, "k1 "+testKey(1))
+	plaintext := make([]byte, 3*ChunkSize+100)
+	for i := range plaintext {
+		plaintext[i] = byte(i / ChunkSize)
+	}
+	sealed, err := keys.Seal(plaintext)
+	require.NoError(t, err)
+	h, err := ParseHeader(sealed)
+	require.NoError(t, err)
+
+	// The middle chunk alone, read from its own offset.
+	r, err := keys.DecryptReader(h, bytes.NewReader(sealed[ChunkOffset(1):ChunkOffset(2)]), 1, 1)
+	require.NoError(t, err)
+	middle, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, plaintext[ChunkSize:2*ChunkSize], middle)
+
+	// The final chunk is shorter and carries the last-chunk marker.
+	r, err = keys.DecryptReader(h, bytes.NewReader(sealed[ChunkOffset(3):]), 3, 3)
+	require.NoError(t, err)
+	tail, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, plaintext[3*ChunkSize:], tail)
+
+	// Chunks opened at the wrong position do not authenticate.
+	r, err = keys.DecryptReader(h, bytes.NewReader(sealed[ChunkOffset(1):ChunkOffset(2)]), 2, 2)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	require.ErrorIs(t, err, ErrDecrypt)
+}
@@ -0,0 +1,149 @@
+package envelope
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// KeySize is the length of master and data keys: AES-256.
+const KeySize = 32
+
+// maxKeyIDLen bounds key IDs so they fit the fixed-size header.
+const maxKeyIDLen = 32
+
+// ErrUnknownKey is returned for data encrypted under a key ID that is not in
+// the keyring.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Keyring holds the master keys read from a key file. Data keys are wrapped
+// under the active key, the last one listed; the others are kept to unwrap
+// data written before the key was rotated.
+type Keyring struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// LoadKeyring reads the key file at path. On Unix the file must not be
+// readable by group or others.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("key file %s is accessible by other users (mode %04o); restrict it to 0600", path, info.Mode().Perm())
+	}
+
+	keys, err := ParseKeyring(f)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// ParseKeyring reads a key file: one "<id> <base64 key>" pair per line, oldest
+// first. Blank lines and lines starting with '#' are ignored. IDs are at
+// most 32 bytes without spaces, and keys decode to 32 bytes.
+func ParseKeyring(r io.Reader) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"<id> <base64 key>\"", number)
+		}
+		id, encoded := fields[0], fields[1]
+		if len(id) > maxKeyIDLen {
+			return nil, fmt.Errorf("line %d: key ID longer than %d bytes", number, maxKeyIDLen)
+		}
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key ID %q", number, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("line %d: key %q is not %d base64-encoded bytes", number, id, KeySize)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		k.active = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.active == "" {
+		return nil, errors.New("no keys found")
+	}
+	return k, nil
+}
+
+// ActiveKeyID returns the ID of the key new data is encrypted under.
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// key returns the master key with the given ID.
+func (k *Keyring) key(id string) (cipher.AEAD, error) {
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	return aead, nil
+}
+
+// newAEAD returns AES-256-GCM keyed with key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Config locates the key file a binary encrypts with. Encryption is off
+// when no key file is given.
+type Config struct {
+	// KeyFile is the path of the key file.
+	KeyFile string
+}
+
+// RegisterFlags defines the encryption flags on fs, using the current values
+// of c as defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.KeyFile, "encryption-key-file", c.KeyFile, "Key file enabling encryption at rest; new data uses the last key listed")
+}
+
+// Load reads the configured key file. It returns a nil Keyring when
+// encryption is off.
+func (c Config) Load() (*Keyring, error) {
+	if c.KeyFile == "" {
+		return nil, nil
+	}
+	return LoadKeyring(c.KeyFile)
+}
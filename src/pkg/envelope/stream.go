@@ -0,0 +1,131 @@
+package envelope
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"io"
+)
+
+// EncryptReader returns a reader producing src encrypted under a fresh data
+// key: the header, then the sealed chunks. Content is read from src one
+// chunk at a time.
+func (k *Keyring) EncryptReader(src io.Reader) (io.Reader, error) {
+	dataKey, h, err := k.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		src:   src,
+		aead:  aead,
+		plain: make([]byte, ChunkSize),
+		out:   h.Bytes(),
+	}, nil
+}
+
+// encryptReader seals src chunk by chunk. Every chunk but the last holds
+// exactly ChunkSize bytes; the last holds the remainder, possibly nothing.
+type encryptReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	plain  []byte
+	sealed []byte
+	nonce  [nonceSize]byte
+	next   int64  // number of the next chunk to seal
+	out    []byte // sealed bytes not yet returned
+	done   bool   // the last chunk has been sealed
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(r.src, r.plain)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		r.sealed = r.aead.Seal(r.sealed[:0], chunkNonce(r.nonce[:], r.next, last), r.plain[:n], nil)
+		r.out = r.sealed
+		r.next++
+		r.done = last
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// DecryptReader returns a reader producing the content of chunks first
+// through last of an object whose header is h. src must be positioned at
+// the start of chunk first, and last must be the object's final chunk or
+// earlier; the final chunk is the one PlainSize reports. Chunks that fail
+// to decrypt are reported as ErrDecrypt.
+func (k *Keyring) DecryptReader(h Header, src io.Reader, first, last int64) (io.Reader, error) {
+	dataKey, err := k.unwrap(h)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		src:    src,
+		aead:   aead,
+		sealed: make([]byte, SealedChunkSize),
+		next:   first,
+		last:   last,
+	}, nil
+}
+
+// decryptReader opens chunks of an object in order.
+type decryptReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	sealed []byte
+	plain  []byte
+	nonce  [nonceSize]byte
+	next   int64 // number of the next chunk to open
+	last   int64 // number of the last chunk to open
+	out    []byte
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.next > r.last {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(r.src, r.sealed)
+		short := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !short {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("%w: chunk %d is missing", ErrDecrypt, r.next)
+		}
+
+		// Only the final chunk is shorter than a full one; it is also the
+		// one sealed with the last-chunk marker.
+		final := n < SealedChunkSize
+		plain, err := r.aead.Open(r.plain[:0], chunkNonce(r.nonce[:], r.next, final), r.sealed[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("%w: chunk %d does not authenticate", ErrDecrypt, r.next)
+		}
+		r.plain, r.out = plain, plain
+		if final {
+			r.last = r.next
+		}
+		r.next++
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
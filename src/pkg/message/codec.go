@@ -0,0 +1,350 @@
+package message
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// TimestampLayout is the layout of the bracketed timestamp in a legacy line.
+const TimestampLayout = "2006-01-02 15:04:05"
+
+const (
+	// FormatName identifies a message log written in the JSON Lines format.
+	FormatName = "cgi-messages"
+	// FormatVersion is the current version of the JSON Lines record format.
+	// Version 1 is the legacy "[timestamp] user: message" text format.
+	FormatVersion = 2
+	// MaxLineSize bounds the size of a single encoded record, its newline
+	// included. Decoders cannot read longer lines, so Codec.FormatLine
+	// refuses to write them.
+	MaxLineSize = 1024 * 1024
+)
+
+var (
+	// ErrMalformedLine is returned by ParseLine for lines that are neither a
+	// JSON record nor a legacy "[timestamp] user: message" line.
+	ErrMalformedLine = errors.New("malformed message line")
+	// ErrUnsupportedVersion is returned for header lines announcing a format
+	// version newer than this package understands.
+	ErrUnsupportedVersion = errors.New("unsupported message log version")
+	// ErrRecordTooLarge is returned by Codec.FormatLine for records that
+	// would not fit in MaxLineSize, and by Decoder for lines longer than
+	// that.
+	ErrRecordTooLarge = errors.New("message record too large")
+)
+
+// Header is the first line of a message log written in the JSON Lines format.
+// It lets readers tell the format apart from the legacy text format and
+// refuse logs written by a newer, incompatible version. BaseID carries the
+// last ID handed out before the log was cleared so IDs are never reused.
+type Header struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	BaseID  int    `json:"base_id,omitempty"`
+}
+
+// record is the on-disk representation of a single message. The ID is
+// assigned once at write time and persisted; trace IDs are per request and
+// never stored. Records written before IDs were persisted omit the ID.
+// Deleted is set on the tombstones of an edit log, and with EditedAt on
+// records a compaction has replaced by the tombstone of their message.
+type record struct {
+	ID        int        `json:"id,omitempty"`
+	User      string     `json:"user"`
+	Message   string     `json:"message"`
+	Timestamp time.Time  `json:"timestamp"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	Deleted   bool       `json:"deleted,omitempty"`
+}
+
+// FormatHeader returns the header line for a new message log, without the
+// trailing newline. baseID is the last ID already handed out, or 0.
+func FormatHeader(baseID int) string {
+	line, _ := json.Marshal(Header{Format: FormatName, Version: FormatVersion, BaseID: baseID})
+	return string(line)
+}
+
+// IsHeader reports whether line is a message log header.
+func IsHeader(line string) bool {
+	_, err := ParseHeader(line)
+	return err == nil
+}
+
+// FormatLine encodes m as a single JSON record without the trailing newline.
+// JSON escaping guarantees that newlines or separators inside the user name
+// or message text can never produce additional records.
+func FormatLine(m Message) string {
+	line, _ := json.Marshal(record{
+		ID:        m.ID,
+		User:      m.User,
+		Message:   m.Message,
+		Timestamp: m.Timestamp,
+		EditedAt:  m.EditedAt,
+		Deleted:   m.Deleted,
+	})
+	return string(line)
+}
+
+// FormatLegacyLine encodes m in the legacy "[timestamp] user: message" format.
+// It is kept for human-readable output; new logs must use FormatLine.
+func FormatLegacyLine(m Message) string {
+	return fmt.Sprintf("[%s] %s: %s", m.Timestamp.Format(TimestampLayout), m.User, m.Message)
+}
+
+// ParseLine decodes a JSON record or a legacy "[timestamp] user: message"
+// line. Legacy lines and early records carry no ID; use a Decoder or
+// IDAssigner to number them. Header lines are rejected with ErrMalformedLine
+// and encrypted records with ErrSealed; use a Codec with keys to read those.
+func ParseLine(line string) (Message, error) {
+	return Codec{}.ParseLine(line)
+}
+
+// parsePlainLine decodes a line that is not an encrypted record.
+func parsePlainLine(line string) (Message, error) {
+	if strings.HasPrefix(line, "{") {
+		return parseRecord(line)
+	}
+	return parseLegacyLine(line)
+}
+
+// ParseHeader decodes a header line. It returns ErrMalformedLine for lines
+// that are not headers and ErrUnsupportedVersion for headers written by a
+// newer format version.
+func ParseHeader(line string) (Header, error) {
+	if !strings.HasPrefix(line, "{") {
+		return Header{}, ErrMalformedLine
+	}
+
+	var h Header
+	if err := json.Unmarshal([]byte(line), &h); err != nil || h.Format != FormatName {
+		return Header{}, ErrMalformedLine
+	}
+	if h.Version > FormatVersion {
+		return h, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+	return h, nil
+}
+
+// parseRecord decodes a JSON record line.
+func parseRecord(line string) (Message, error) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.DisallowUnknownFields()
+
+	var r record
+	if err := dec.Decode(&r); err != nil {
+		return Message{}, fmt.Errorf("%w: %v", ErrMalformedLine, err)
+	}
+	if dec.More() {
+		return Message{}, fmt.Errorf("%w: trailing data", ErrMalformedLine)
+	}
+
+	if r.ID < 0 {
+		return Message{}, fmt.Errorf("%w: negative id", ErrMalformedLine)
+	}
+
+	return validate(Message{
+		ID:        r.ID,
+		User:      r.User,
+		Message:   r.Message,
+		Timestamp: r.Timestamp,
+		EditedAt:  r.EditedAt,
+		Deleted:   r.Deleted,
+	})
+}
+
+// parseLegacyLine decodes a "[timestamp] user: message" line.
+func parseLegacyLine(line string) (Message, error) {
+	if !strings.HasPrefix(line, "[") {
+		return Message{}, ErrMalformedLine
+	}
+
+	// Find end of timestamp (look for "] ")
+	timestampEnd := strings.Index(line, "] ")
+	if timestampEnd == -1 {
+		return Message{}, ErrMalformedLine
+	}
+
+	// Find ": " separator between user and message
+	remaining := line[timestampEnd+2:]
+	colonIndex := strings.Index(remaining, ": ")
+	if colonIndex == -1 {
+		return Message{}, ErrMalformedLine
+	}
+
+	timestamp, err := time.Parse(TimestampLayout, line[1:timestampEnd])
+	if err != nil {
+		return Message{}, fmt.Errorf("%w: %v", ErrMalformedLine, err)
+	}
+
+	return validate(Message{
+		User:      remaining[:colonIndex],
+		Message:   remaining[colonIndex+2:],
+		Timestamp: timestamp,
+	})
+}
+
+// validate rejects decoded messages that no writer could have produced.
+func validate(m Message) (Message, error) {
+	if m.User == "" || m.Timestamp.IsZero() {
+		return Message{}, fmt.Errorf("%w: missing user or timestamp", ErrMalformedLine)
+	}
+	return m, nil
+}
+
+// IDAssigner hands out message IDs. Writers use it to pick the ID persisted
+// with a new record; readers use it to number legacy entries that predate
+// persisted IDs, continuing from the highest ID observed so far so every
+// reader that walks the log from the start arrives at the same numbering.
+type IDAssigner struct {
+	last int
+}
+
+// NewIDAssigner returns an IDAssigner whose first assigned ID is last+1.
+func NewIDAssigner(last int) *IDAssigner {
+	return &IDAssigner{last: last}
+}
+
+// Assign sets the next ID on m and returns it.
+func (a *IDAssigner) Assign(m *Message) int {
+	a.last++
+	m.ID = a.last
+	return a.last
+}
+
+// Observe records an ID read from the log so later assignments never reuse
+// it.
+func (a *IDAssigner) Observe(id int) {
+	if id > a.last {
+		a.last = id
+	}
+}
+
+// Last returns the highest assigned or observed ID, or the starting value when
+// nothing has been assigned yet.
+func (a *IDAssigner) Last() int {
+	return a.last
+}
+
+// Decoder reads messages from a log stream. Persisted IDs are returned as
+// written; entries without one are numbered with an IDAssigner. Both JSON
+// records and legacy lines are understood; header, blank and malformed lines
+// are skipped without consuming an ID.
+type Decoder struct {
+	codec     Codec
+	scanner   *bufio.Scanner
+	ids       *IDAssigner
+	malformed int
+	next      int64 // offset of the first byte not yet split into a line
+	lineStart int64 // offset of the line most recently split
+	offset    int64 // offset of the line holding the last decoded message
+}
+
+// NewDecoder returns a Decoder that numbers messages from 1. It stops with
+// ErrSealed at the first encrypted record; use Codec.NewDecoder for those.
+func NewDecoder(r io.Reader) *Decoder {
+	return Codec{}.NewDecoder(r)
+}
+
+// NewDecoder returns a Decoder that parses lines with c.
+func (c Codec) NewDecoder(r io.Reader) *Decoder {
+	d := &Decoder{codec: c, ids: NewIDAssigner(0)}
+
+	d.scanner = bufio.NewScanner(r)
+	d.scanner.Buffer(make([]byte, 0, 64*1024), MaxLineSize)
+	d.scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			d.lineStart = d.next
+		}
+		d.next += int64(advance)
+		return advance, token, err
+	})
+	return d
+}
+
+// Decode returns the next well-formed message, or io.EOF at the end of the
+// stream. A header announcing a newer format version stops decoding with
+// ErrUnsupportedVersion, a record that cannot be decrypted for lack of a key
+// stops it with that error, and a line longer than MaxLineSize stops it with
+// ErrRecordTooLarge naming the line's offset.
+func (d *Decoder) Decode() (Message, error) {
+	for d.scanner.Scan() {
+		line := d.scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		if h, err := ParseHeader(line); err == nil {
+			d.ids.Observe(h.BaseID)
+			continue
+		} else if errors.Is(err, ErrUnsupportedVersion) {
+			return Message{}, err
+		}
+
+		m, err := d.codec.ParseLine(line)
+		if errors.Is(err, ErrMalformedLine) {
+			d.malformed++
+			continue
+		} else if err != nil {
+			return Message{}, err
+		}
+
+		if m.ID > 0 {
+			d.ids.Observe(m.ID)
+		} else {
+			d.ids.Assign(&m)
+		}
+		d.offset = d.lineStart
+		return m, nil
+	}
+
+	if err := d.scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		return Message{}, fmt.Errorf("%w: line at offset %d is longer than %d bytes", ErrRecordTooLarge, d.next, MaxLineSize)
+	} else if err != nil {
+		return Message{}, err
+	}
+	return Message{}, io.EOF
+}
+
+// LastID returns the highest ID decoded so far, including the base ID of
+// any header.
+func (d *Decoder) LastID() int {
+	return d.ids.Last()
+}
+
+// Offset returns the byte offset, from the start of the stream, of the line
+// holding the message most recently returned by Decode.
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Malformed reports how many non-blank lines were skipped so far.
+func (d *Decoder) Malformed() int {
+	return d.malformed
+}
+
+// DecodeAll reads every well-formed message from r.
+func DecodeAll(r io.Reader) ([]Message, error) {
+	return Codec{}.DecodeAll(r)
+}
+
+// DecodeAll reads every well-formed message from r, parsing lines with c.
+func (c Codec) DecodeAll(r io.Reader) ([]Message, error) {
+	messages := []Message{}
+	dec := c.NewDecoder(r)
+	for {
+		m, err := dec.Decode()
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, m)
+	}
+}
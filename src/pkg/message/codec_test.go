@@ -0,0 +1,286 @@
+package message
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	testCases := []struct {
+		name        string
+		line        string
+		expected    Message
+		expectError bool
+	}{
+		{
+			name: "well_formed_line",
+			line: "[2025-10-16 23:05:55] alice: Hello unified app!",
+			expected: Message{
+				User:      "alice",
+				Message:   "Hello unified app!",
+				Timestamp: time.Date(2025, 10, 16, 23, 5, 55, 0, time.UTC),
+			},
+		},
+		{
+			name: "message_containing_separator",
+			line: "[2025-10-16 23:05:55] bob: note: remember this",
+			expected: Message{
+				User:      "bob",
+				Message:   "note: remember this",
+				Timestamp: time.Date(2025, 10, 16, 23, 5, 55, 0, time.UTC),
+			},
+		},
+		{
+			name: "json_record",
+			line: `{"user":"carol","message":"line one\nline two","timestamp":"2025-10-16T23:05:55Z"}`,
+			expected: Message{
+				User:      "carol",
+				Message:   "line one\nline two",
+				Timestamp: time.Date(2025, 10, 16, 23, 5, 55, 0, time.UTC),
+			},
+		},
+		{
+			name:        "json_record_missing_user",
+			line:        `{"message":"Hello","timestamp":"2025-10-16T23:05:55Z"}`,
+			expectError: true,
+		},
+		{
+			name:        "json_record_trailing_data",
+			line:        `{"user":"a","message":"b","timestamp":"2025-10-16T23:05:55Z"}{}`,
+			expectError: true,
+		},
+		{
+			name:        "header_line",
+			line:        FormatHeader(0),
+			expectError: true,
+		},
+		{
+			name:        "legacy_line_without_timestamp",
+			line:        "alice: Hello World",
+			expectError: true,
+		},
+		{
+			name:        "missing_user_separator",
+			line:        "[2025-10-16 23:05:55] alice Hello",
+			expectError: true,
+		},
+		{
+			name:        "invalid_timestamp",
+			line:        "[yesterday] alice: Hello",
+			expectError: true,
+		},
+		{
+			name:        "empty_line",
+			line:        "",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ParseLine(tc.line)
+
+			if tc.expectError {
+				require.ErrorIs(t, err, ErrMalformedLine)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestFormatLineIsInjectionSafe(t *testing.T) {
+	forged := Message{
+		User:      "mallory: admin",
+		Message:   "x\n[2025-01-01 00:00:00] admin: forged",
+		Timestamp: time.Date(2025, 10, 16, 23, 5, 55, 0, time.UTC),
+	}
+
+	line := FormatLine(forged)
+	require.NotContains(t, line, "\n", "Encoded record must stay on a single line")
+
+	messages, err := DecodeAll(strings.NewReader(FormatHeader(0) + "\n" + line + "\n"))
+	require.NoError(t, err)
+	require.Len(t, messages, 1, "Embedded newline must not produce a second record")
+	require.Equal(t, forged.User, messages[0].User)
+	require.Equal(t, forged.Message, messages[0].Message)
+}
+
+func TestDecoderRejectsNewerVersion(t *testing.T) {
+	input := `{"format":"cgi-messages","version":99}` + "\n"
+
+	_, err := DecodeAll(strings.NewReader(input))
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestDecoderAssignsSequentialIDs(t *testing.T) {
+	input := "alice: Hello World\n" +
+		"\n" +
+		"[2025-10-16 23:05:55] alice: first\n" +
+		"garbage\n" +
+		FormatHeader(0) + "\n" +
+		`{"user":"bob","message":"second","timestamp":"2025-10-16T23:16:51Z"}` + "\n"
+
+	dec := NewDecoder(strings.NewReader(input))
+
+	first, err := dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, 1, first.ID, "Malformed lines should not consume IDs")
+
+	second, err := dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, 2, second.ID)
+	require.Equal(t, "bob", second.User)
+
+	_, err = dec.Decode()
+	require.Error(t, err, "Decoder should report io.EOF at the end")
+	require.Equal(t, 2, dec.Malformed(), "Both malformed lines should be counted")
+}
+
+func TestDecoderKeepsPersistedIDs(t *testing.T) {
+	input := FormatHeader(40) + "\n" +
+		`{"id":41,"user":"alice","message":"first","timestamp":"2025-10-16T23:05:55Z"}` + "\n" +
+		`{"id":45,"user":"bob","message":"second","timestamp":"2025-10-16T23:06:55Z"}` + "\n" +
+		`{"user":"carol","message":"unnumbered","timestamp":"2025-10-16T23:07:55Z"}` + "\n"
+
+	dec := NewDecoder(strings.NewReader(input))
+	var messages []Message
+	for {
+		m, err := dec.Decode()
+		if err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+		messages = append(messages, m)
+	}
+
+	require.Len(t, messages, 3)
+	require.Equal(t, 41, messages[0].ID)
+	require.Equal(t, 45, messages[1].ID, "Persisted IDs must be returned unchanged")
+	require.Equal(t, 46, messages[2].ID, "Unnumbered records continue after the highest ID")
+	require.Equal(t, 46, dec.LastID())
+}
+
+func TestDecoderReportsLineOffsets(t *testing.T) {
+	lines := []string{
+		FormatHeader(0),
+		`{"id":1,"user":"alice","message":"first","timestamp":"2025-10-16T23:05:55Z"}`,
+		"",
+		"### corrupted ###",
+		"[2025-10-16 23:06:55] bob: second",
+	}
+	input := strings.Join(lines, "\n") + "\n"
+
+	dec := NewDecoder(strings.NewReader(input))
+	var offsets []int64
+	for {
+		_, err := dec.Decode()
+		if err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+		offsets = append(offsets, dec.Offset())
+	}
+
+	require.Equal(t, []int64{
+		int64(strings.Index(input, `{"id":1`)),
+		int64(strings.Index(input, "[2025")),
+	}, offsets, "Offsets should skip headers, blank and malformed lines")
+}
+
+func TestDecoderHonoursHeaderBaseID(t *testing.T) {
+	input := FormatHeader(12) + "\n" + "[2025-10-16 23:05:55] alice: after clear\n"
+
+	messages, err := DecodeAll(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, 13, messages[0].ID, "IDs must continue after the base ID of a cleared log")
+}
+
+func TestIDAssigner(t *testing.T) {
+	ids := NewIDAssigner(41)
+	var m Message
+
+	require.Equal(t, 41, ids.Last())
+	require.Equal(t, 42, ids.Assign(&m))
+	require.Equal(t, 42, m.ID)
+	require.Equal(t, 42, ids.Last())
+
+	ids.Observe(50)
+	require.Equal(t, 51, ids.Assign(&m), "Observed IDs must never be reused")
+	ids.Observe(10)
+	require.Equal(t, 51, ids.Last(), "Observing a lower ID must not move the counter back")
+}
+
+func FuzzParseLine(f *testing.F) {
+	seeds := []string{
+		"[2025-10-16 23:05:55] alice: Hello unified app!",
+		"[2025-10-16 23:18:40] user3: Message number 3",
+		"[2025-10-16 23:05:55] bob: a: b: c",
+		"alice: Hello World",
+		"[] : ",
+		`{"user":"carol","message":"hi\nthere","timestamp":"2025-10-16T23:05:55+02:00"}`,
+		`{"format":"cgi-messages","version":2}`,
+		`{"id":7,"user":"dave","message":"numbered","timestamp":"2025-10-16T23:05:55Z"}`,
+		`{"user":"","message":"","timestamp":"0001-01-01T00:00:00Z"}`,
+		"[2025-10-16 23:05:55]",
+		"",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		m, err := ParseLine(line)
+		if err != nil || !utf8.ValidString(line) {
+			return
+		}
+
+		// Anything the parser accepts must survive a format/parse round trip.
+		formatted := FormatLine(m)
+		if strings.Contains(formatted, "\n") {
+			t.Fatalf("encoded record %q spans several lines", formatted)
+		}
+		again, err := ParseLine(formatted)
+		if err != nil {
+			t.Fatalf("re-parsing %q (from %q) failed: %v", formatted, line, err)
+		}
+		if again.ID != m.ID || again.User != m.User || again.Message != m.Message {
+			t.Fatalf("round trip mismatch: %+v != %+v", again, m)
+		}
+		if !again.Timestamp.Equal(m.Timestamp) {
+			t.Fatalf("timestamp mismatch: %v != %v", again.Timestamp, m.Timestamp)
+		}
+	})
+}
+
+func FuzzFormatLine(f *testing.F) {
+	f.Add("alice", "Hello World")
+	f.Add("mallory: admin", "x\n[2025-01-01 00:00:00] admin: forged")
+	f.Add("bob", `{"user":"eve","message":"nested","timestamp":"2025-01-01T00:00:00Z"}`)
+
+	f.Fuzz(func(t *testing.T, user, text string) {
+		if user == "" || !utf8.ValidString(user) || !utf8.ValidString(text) {
+			t.Skip("the API only accepts non-empty, valid UTF-8 input")
+		}
+
+		m := Message{User: user, Message: text, Timestamp: time.Date(2025, 10, 16, 23, 5, 55, 0, time.UTC)}
+		messages, err := DecodeAll(strings.NewReader(FormatLine(m) + "\n"))
+		if err != nil {
+			t.Fatalf("decoding failed: %v", err)
+		}
+		if len(messages) != 1 {
+			t.Fatalf("expected exactly one record, got %d", len(messages))
+		}
+		if messages[0].User != user || messages[0].Message != text {
+			t.Fatalf("round trip mismatch: %+v", messages[0])
+		}
+	})
+}
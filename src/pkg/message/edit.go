@@ -0,0 +1,47 @@
+package message
+
+import "time"
+
+// Revision is an earlier text of an edited message.
+type Revision struct {
+	Message string `json:"message"`
+	// Timestamp is when this text was written: the time of the message for
+	// the original text, otherwise the time of the edit.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewEdit returns the edit-log record replacing the text of m with text at
+// time at.
+func NewEdit(m Message, text string, at time.Time) Message {
+	return Message{ID: m.ID, User: m.User, Message: text, Timestamp: at}
+}
+
+// NewTombstone returns the edit-log record deleting m at time at.
+func NewTombstone(m Message, at time.Time) Message {
+	return Message{ID: m.ID, User: m.User, Timestamp: at, Deleted: true}
+}
+
+// Amend applies change, an edit or tombstone record for m, to m. Edits move
+// the current text to History; tombstones drop the text and its history.
+// Changes to a deleted message are ignored, so a message stays deleted
+// whatever order concurrent writers recorded their changes in.
+func Amend(m Message, change Message) Message {
+	if m.Deleted {
+		return m
+	}
+	at := change.Timestamp
+	if change.Deleted {
+		m.Message, m.History, m.Deleted = "", nil, true
+		m.EditedAt = &at
+		return m
+	}
+
+	written := m.Timestamp
+	if m.EditedAt != nil {
+		written = *m.EditedAt
+	}
+	m.History = append(m.History[:len(m.History):len(m.History)], Revision{Message: m.Message, Timestamp: written})
+	m.Message = change.Message
+	m.EditedAt = &at
+	return m
+}
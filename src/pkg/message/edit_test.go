@@ -0,0 +1,39 @@
+package message
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAmend(t *testing.T) {
+	written := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	original := Message{ID: 7, User: "alice", Message: "helo", Timestamp: written}
+
+	edited := Amend(original, NewEdit(original, "hello", written.Add(time.Minute)))
+	edited = Amend(edited, NewEdit(edited, "hello!", written.Add(2*time.Minute)))
+	require.Equal(t, "hello!", edited.Message)
+	require.Equal(t, written.Add(2*time.Minute), *edited.EditedAt)
+	require.Equal(t, []Revision{
+		{Message: "helo", Timestamp: written},
+		{Message: "hello", Timestamp: written.Add(time.Minute)},
+	}, edited.History)
+	require.Equal(t, "helo", original.Message, "Amend must not change its argument")
+
+	deleted := Amend(edited, NewTombstone(edited, written.Add(3*time.Minute)))
+	require.True(t, deleted.Deleted)
+	require.Empty(t, deleted.Message)
+	require.Nil(t, deleted.History, "Deleting drops the earlier texts too")
+	require.Equal(t, deleted, Amend(deleted, NewEdit(deleted, "undead", written.Add(4*time.Minute))), "Tombstones are final")
+
+	line := FormatLine(NewTombstone(original, written))
+	parsed, err := ParseLine(line)
+	require.NoError(t, err)
+	require.True(t, parsed.Deleted, "Tombstones should survive the codec")
+
+	parsed, err = ParseLine(FormatLine(deleted))
+	require.NoError(t, err)
+	require.Equal(t, deleted.EditedAt, parsed.EditedAt, "Compacted tombstones keep when they were deleted")
+	require.Equal(t, written, parsed.Timestamp)
+}
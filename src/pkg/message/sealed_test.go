@@ -0,0 +1,114 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/envelope"
+	"github.com/stretchr/testify/require"
+)
+
+// testKeys returns a keyring holding one key per ID, the last one active.
+// Keys are derived from their IDs, so the same ID always names the same key.
+func testKeys(t *testing.T, ids ...string) *envelope.Keyring {
+	t.Helper()
+	var file strings.Builder
+	for _, id := range ids {
+		sum := sha256.Sum256([]byte(id))
+		key := base64.StdEncoding.EncodeToString(sum[:])
+		file.WriteString(id + " " + key + "\n")
+	}
+	keys, err := envelope.ParseKeyring(strings.NewReader(file.String()))
+	require.NoError(t, err, "Setup failed")
+	return keys
+}
+
+func TestCodecSealsRecords(t *testing.T) {
+	codec := Codec{Keys: testKeys(t, "k1")}
+	m := Message{ID: 3, User: "alice", Message: "top secret", Timestamp: time.Date(2025, 10, 16, 23, 5, 55, 0, time.UTC)}
+
+	line, err := codec.FormatLine(m)
+	require.NoError(t, err)
+	require.True(t, IsSealed(line))
+	require.NotContains(t, line, "secret", "The record must not be readable on disk")
+	require.NotContains(t, line, "alice")
+	require.True(t, codec.Current(line))
+
+	parsed, err := codec.ParseLine(line)
+	require.NoError(t, err)
+	require.Equal(t, m, parsed)
+
+	_, err = ParseLine(line)
+	require.ErrorIs(t, err, ErrSealed, "Reading without keys must fail loudly, not skip the record")
+	_, err = DecodeAll(strings.NewReader(line + "\n"))
+	require.ErrorIs(t, err, ErrSealed)
+
+	_, err = Codec{Keys: testKeys(t, "other")}.ParseLine(line)
+	require.ErrorIs(t, err, envelope.ErrUnknownKey)
+}
+
+func TestCodecReadsMixedLogs(t *testing.T) {
+	rotated := Codec{Keys: testKeys(t, "k1", "k2")}
+	old := Codec{Keys: testKeys(t, "k1")}
+	at := time.Date(2025, 10, 16, 23, 5, 55, 0, time.UTC)
+
+	sealedOld, err := old.FormatLine(Message{ID: 2, User: "bob", Message: "sealed under k1", Timestamp: at})
+	require.NoError(t, err)
+	sealedNew, err := rotated.FormatLine(Message{ID: 3, User: "carol", Message: "sealed under k2", Timestamp: at})
+	require.NoError(t, err)
+	// Flip content well past the header, inside the sealed record
+	end := len(sealedNew) - 10
+	tampered := sealedNew[:end-4] + strings.Map(func(r rune) rune {
+		if r == 'A' {
+			return 'B'
+		}
+		return 'A'
+	}, sealedNew[end-4:end]) + sealedNew[end:]
+
+	log := strings.Join([]string{
+		FormatHeader(0),
+		"[2025-10-16 23:05:55] alice: legacy",
+		sealedOld,
+		tampered,
+		sealedNew,
+	}, "\n") + "\n"
+
+	dec := rotated.NewDecoder(strings.NewReader(log))
+	var users []string
+	for {
+		m, err := dec.Decode()
+		if err != nil {
+			break
+		}
+		users = append(users, m.User)
+	}
+	require.Equal(t, []string{"alice", "bob", "carol"}, users)
+	require.Equal(t, 1, dec.Malformed(), "A record that fails authentication is skipped like any malformed line")
+
+	require.False(t, rotated.Current(sealedOld), "Records under a retired key need re-encryption")
+	require.True(t, rotated.Current(sealedNew))
+	require.False(t, rotated.Current(FormatLine(Message{User: "dave", Message: "plain", Timestamp: at})))
+	require.True(t, Codec{}.Current(FormatLine(Message{User: "dave", Message: "plain", Timestamp: at})))
+}
+
+func TestCodecRejectsRecordsTooLongToDecode(t *testing.T) {
+	m := Message{ID: 1, User: "alice", Timestamp: time.Date(2025, 10, 16, 23, 5, 55, 0, time.UTC)}
+	// The longest text whose plain line, newline included, fits
+	m.Message = strings.Repeat("x", MaxLineSize-1-len(FormatLine(m)))
+
+	line, err := Codec{}.FormatLine(m)
+	require.NoError(t, err)
+	messages, err := DecodeAll(strings.NewReader(line + "\n"))
+	require.NoError(t, err, "Every record written must be readable")
+	require.Equal(t, []Message{m}, messages)
+
+	longer := m
+	longer.Message += "x"
+	_, err = Codec{}.FormatLine(longer)
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+	_, err = Codec{Keys: testKeys(t, "k1")}.FormatLine(m)
+	require.ErrorIs(t, err, ErrRecordTooLarge, "Sealing makes the record longer")
+}
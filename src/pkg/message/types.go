@@ -0,0 +1,23 @@
+package message
+
+import "time"
+
+// Message represents a message in our system.
+// This type is shared by the web application, the CLI and the gRPC store so
+// REST, WebSocket and gRPC responses are built from identical data.
+type Message struct {
+	ID        int       `json:"id"`
+	User      string    `json:"user"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	// EditedAt is when the message was last edited or deleted; nil if it
+	// never was.
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// Deleted marks a tombstone: the message was deleted and its text
+	// dropped, but its ID and position are kept.
+	Deleted bool `json:"deleted,omitempty"`
+	// History holds the earlier texts of an edited message, oldest first.
+	// Listings leave it out; it is filled in when a single message is read.
+	History []Revision `json:"history,omitempty"`
+}
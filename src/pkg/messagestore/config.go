@@ -0,0 +1,76 @@
+package messagestore
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/envelope"
+)
+
+// Config selects and configures the MessageStore a binary uses. The web
+// service and the gRPC store register the same flags so both can be pointed
+// at the same log.
+type Config struct {
+	// Kind is the backend: "file", "segmented" or "memory".
+	Kind string
+	// FilePath is the log used by the file backend.
+	FilePath string
+	// Dir is the directory used by the segmented backend.
+	Dir string
+	// Segments configures rotation and retention of the segmented backend.
+	Segments SegmentOptions
+	// CompactInterval is how often the segmented backend is compacted.
+	CompactInterval time.Duration
+	// Keys encrypts records of the file and segmented backends at rest. It
+	// is not set by a flag; binaries load it from envelope.Config.
+	Keys *envelope.Keyring
+}
+
+// DefaultConfig returns the configuration used when no flags are given: a
+// single log file at filePath.
+func DefaultConfig(filePath string) Config {
+	return Config{
+		Kind:     "file",
+		FilePath: filePath,
+		Dir:      "messages.d",
+		Segments: SegmentOptions{
+			MaxSegmentBytes: 64 * 1024 * 1024,
+		},
+		CompactInterval: 5 * time.Minute,
+	}
+}
+
+// RegisterFlags defines the message store flags on fs, using the current
+// values of c as defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Kind, "message-store", c.Kind, "Message store backend: 'file', 'segmented' or 'memory'")
+	fs.StringVar(&c.Dir, "message-dir", c.Dir, "Directory for the segmented message store")
+	fs.Int64Var(&c.Segments.MaxSegmentBytes, "segment-max-bytes", c.Segments.MaxSegmentBytes, "Start a new message segment once the active one reaches this size (0 disables)")
+	fs.DurationVar(&c.Segments.MaxSegmentAge, "segment-max-age", c.Segments.MaxSegmentAge, "Start a new message segment once the active one is this old (0 disables)")
+	fs.DurationVar(&c.Segments.RetentionAge, "retention-max-age", c.Segments.RetentionAge, "Drop message segments last written longer ago than this (0 keeps all)")
+	fs.Int64Var(&c.Segments.RetentionBytes, "retention-max-bytes", c.Segments.RetentionBytes, "Drop the oldest message segments while the log is larger than this (0 keeps all)")
+	fs.DurationVar(&c.CompactInterval, "compact-interval", c.CompactInterval, "How often the segmented message store is compacted")
+}
+
+// Open builds the configured MessageStore.
+func (c Config) Open() (MessageStore, error) {
+	switch c.Kind {
+	case "file":
+		if c.Keys != nil {
+			return NewEncryptedFileStore(c.FilePath, c.Keys), nil
+		}
+		return NewFileStore(c.FilePath), nil
+	case "segmented":
+		if c.CompactInterval <= 0 {
+			return nil, fmt.Errorf("compact interval must be positive, got %s", c.CompactInterval)
+		}
+		opts := c.Segments
+		opts.Keys = c.Keys
+		return NewSegmentStore(c.Dir, opts), nil
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown message store %q (expected 'file', 'segmented' or 'memory')", c.Kind)
+	}
+}
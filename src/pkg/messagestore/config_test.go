@@ -0,0 +1,50 @@
+package messagestore
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigOpen(t *testing.T) {
+	testCases := []struct {
+		name      string
+		args      []string
+		wantType  MessageStore
+		expectErr bool
+	}{
+		{name: "default_file", wantType: &FileStore{}},
+		{name: "memory", args: []string{"-message-store=memory"}, wantType: &MemoryStore{}},
+		{
+			name:     "segmented",
+			args:     []string{"-message-store=segmented", "-message-dir=log.d", "-segment-max-bytes=1024", "-retention-max-age=24h"},
+			wantType: &SegmentStore{},
+		},
+		{name: "segmented_without_compaction", args: []string{"-message-store=segmented", "-compact-interval=0"}, expectErr: true},
+		{name: "unknown", args: []string{"-message-store=s3"}, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig("messages.txt")
+			fs := flag.NewFlagSet(tc.name, flag.ContinueOnError)
+			cfg.RegisterFlags(fs)
+			require.NoError(t, fs.Parse(tc.args))
+
+			store, err := cfg.Open()
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.IsType(t, tc.wantType, store)
+
+			if segments, ok := store.(*SegmentStore); ok {
+				require.Equal(t, "log.d", segments.Dir())
+				require.Equal(t, SegmentOptions{MaxSegmentBytes: 1024, RetentionAge: 24 * time.Hour}, segments.opts)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package messagestore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+)
+
+// ErrDeleted is returned for edits and deletes of a message that has
+// already been deleted.
+var ErrDeleted = errors.New("message was deleted")
+
+// editLog is the sidecar JSON Lines file recording the edits and tombstones
+// of a log, one record per change, in the order they were made. The log
+// itself is append-only, so readers apply the edit log to what they read;
+// IDs and positions never change. Records are encoded with the log's codec,
+// so an encrypted log has an encrypted edit log.
+type editLog struct {
+	path  string
+	codec message.Codec
+	// cache, if set, keeps the changes loaded between reads.
+	cache *editCache
+}
+
+// editCache holds the changes last loaded from an edit log and the file
+// they were loaded from. The edit log is only ever appended to or replaced
+// as a whole, so as long as the same file has the same size and modification
+// time the changes still hold.
+type editCache struct {
+	mu      sync.Mutex
+	info    os.FileInfo
+	changes map[int][]message.Message
+}
+
+// load reads every change, grouped by message ID in the order they were
+// made. A missing file holds no changes; malformed lines are skipped like
+// in the log. With a cache, the file is only parsed again once it changed;
+// the returned map is then shared and must not be modified.
+func (l editLog) load() (map[int][]message.Message, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[int][]message.Message{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if l.cache == nil {
+		return l.parse(f)
+	}
+
+	// Stat before parsing: records appended meanwhile are parsed too, and
+	// only make the next load parse again
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	l.cache.mu.Lock()
+	defer l.cache.mu.Unlock()
+	if l.cache.info != nil && unchanged(l.cache.info, info) {
+		return l.cache.changes, nil
+	}
+	changes, err := l.parse(f)
+	if err != nil {
+		return nil, err
+	}
+	l.cache.info, l.cache.changes = info, changes
+	return changes, nil
+}
+
+// stat returns the file info of the edit log, or nil if there is none.
+func (l editLog) stat() (os.FileInfo, error) {
+	info, err := os.Stat(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// unchanged reports whether the edit log described by before, or nil if
+// there was none, is still the one described by after.
+func unchanged(before, after os.FileInfo) bool {
+	if before == nil || after == nil {
+		return before == after
+	}
+	return os.SameFile(before, after) && before.Size() == after.Size() && before.ModTime().Equal(after.ModTime())
+}
+
+// parse reads the changes recorded in f.
+func (l editLog) parse(f *os.File) (map[int][]message.Message, error) {
+	changes := map[int][]message.Message{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), message.MaxLineSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		change, err := l.codec.ParseLine(line)
+		if errors.Is(err, message.ErrMalformedLine) || (err == nil && change.ID <= 0) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		changes[change.ID] = append(changes[change.ID], change)
+	}
+	return changes, scanner.Err()
+}
+
+// append records change. The caller must hold the writer lock.
+func (l editLog) append(change message.Message) error {
+	line, err := l.codec.FormatLine(change)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reseal rewrites the edit log with every record encoded as the codec
+// writes it now and returns how many records changed. A dry run only
+// counts them. The caller must hold the writer lock.
+func (l editLog) reseal(dryRun bool) (int, error) {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var b strings.Builder
+	changed := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if !l.codec.Current(line) {
+			change, err := l.codec.ParseLine(line)
+			if errors.Is(err, message.ErrMalformedLine) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			if line, err = l.codec.FormatLine(change); err != nil {
+				return 0, err
+			}
+			changed++
+		}
+		b.WriteString(line + "\n")
+	}
+	if changed == 0 || dryRun {
+		return changed, nil
+	}
+	return changed, replaceFile(l.path, []byte(b.String()))
+}
+
+// drop rewrites the edit log without the records of the given IDs and
+// returns how many it dropped. The caller must hold the writer lock.
+func (l editLog) drop(ids map[int]bool) (int, error) {
+	data, err := os.ReadFile(l.path)
+	if err != nil || len(ids) == 0 {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var b strings.Builder
+	dropped := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		change, err := l.codec.ParseLine(line)
+		if err != nil && !errors.Is(err, message.ErrMalformedLine) {
+			return 0, err
+		}
+		if err == nil && ids[change.ID] {
+			dropped++
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	return dropped, replaceFile(l.path, []byte(b.String()))
+}
+
+// amend applies changes to messages in place. History is only kept when it
+// is asked for; listings leave it out.
+func amend(messages []message.Message, changes map[int][]message.Message, history bool) {
+	if len(changes) == 0 {
+		return
+	}
+	for i, m := range messages {
+		for _, change := range changes[m.ID] {
+			m = message.Amend(m, change)
+		}
+		if !history {
+			m.History = nil
+		}
+		messages[i] = m
+	}
+}
+
+// rangeFunc reads at most limit messages starting at position offset, as
+// MessageStore.Range does.
+type rangeFunc func(offset, limit int) ([]message.Message, error)
+
+// locateFunc locates IDs in a store, as idLocator does.
+type locateFunc func(ids ...int) (count int, positions []int, err error)
+
+// findMessage returns the message with the given ID, located by locate and
+// read by read, or ErrNotFound.
+func findMessage(read rangeFunc, locate locateFunc, id int) (message.Message, error) {
+	count, positions, err := locate(id)
+	if err != nil {
+		return message.Message{}, err
+	}
+	if positions[0] == count {
+		return message.Message{}, ErrNotFound
+	}
+	found, err := read(positions[0], 1)
+	if err != nil {
+		return message.Message{}, err
+	}
+	if len(found) == 0 || found[0].ID != id {
+		return message.Message{}, ErrNotFound
+	}
+	return found[0], nil
+}
+
+// editor implements Get, Edit and Remove for a store on top of a read of
+// its unamended messages, a search of its index and an edit log guarded by
+// the store's lock.
+type editor struct {
+	log    editLog
+	lock   func(exclusive bool) (func(), error)
+	read   rangeFunc
+	locate locateFunc
+}
+
+// get returns message id with its changes and history applied.
+func (e editor) get(ctx context.Context, id int) (message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	m, err := findMessage(e.read, e.locate, id)
+	if err != nil {
+		return message.Message{}, err
+	}
+	changes, err := e.changes()
+	if err != nil {
+		return message.Message{}, err
+	}
+	messages := []message.Message{m}
+	amend(messages, changes, true)
+	messages[0].TraceID = traceID
+	return messages[0], nil
+}
+
+// change records the change that build makes to message id and returns the
+// amended message.
+func (e editor) change(ctx context.Context, id int, build func(m message.Message) message.Message) (message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	// The record itself never changes, so it is found before locking
+	found, err := findMessage(e.read, e.locate, id)
+	if err != nil {
+		return message.Message{}, err
+	}
+
+	unlock, err := e.lock(true)
+	if err != nil {
+		return message.Message{}, err
+	}
+	defer unlock()
+
+	// Changes are read under the writer lock so a concurrent delete wins
+	changes, err := e.log.load()
+	if err != nil {
+		return message.Message{}, err
+	}
+	messages := []message.Message{found}
+	amend(messages, changes, true)
+	if messages[0].Deleted {
+		return message.Message{}, ErrDeleted
+	}
+
+	change := build(messages[0])
+	if err := e.log.append(change); err != nil {
+		return message.Message{}, err
+	}
+
+	slog.InfoContext(ctx, "Message changed",
+		"message_id", id,
+		"deleted", change.Deleted,
+		"editLog", e.log.path,
+		"traceID", traceID)
+
+	amended := message.Amend(messages[0], change)
+	amended.TraceID = traceID
+	return amended, nil
+}
+
+// edit replaces the text of message id.
+func (e editor) edit(ctx context.Context, id int, text string) (message.Message, error) {
+	return e.change(ctx, id, func(m message.Message) message.Message {
+		return message.NewEdit(m, text, time.Now())
+	})
+}
+
+// remove replaces message id with a tombstone.
+func (e editor) remove(ctx context.Context, id int) error {
+	_, err := e.change(ctx, id, func(m message.Message) message.Message {
+		return message.NewTombstone(m, time.Now())
+	})
+	return err
+}
+
+// changes loads the edit log under the reader lock.
+func (e editor) changes() (map[int][]message.Message, error) {
+	unlock, err := e.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return e.log.load()
+}
+
+// amended applies the edit log to messages read from the store, without
+// history.
+func (e editor) amended(messages []message.Message, err error) ([]message.Message, error) {
+	if err != nil {
+		return messages, err
+	}
+	changes, err := e.changes()
+	if err != nil {
+		return []message.Message{}, fmt.Errorf("read edit log: %w", err)
+	}
+	amend(messages, changes, false)
+	return messages, nil
+}
@@ -0,0 +1,140 @@
+package messagestore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageStoreEdits(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "traceID", "trace-edit")
+	timestamp := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+
+	for _, factory := range storeFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			store := factory.new(t)
+			for _, text := range []string{"helo", "second", "third"} {
+				_, err := store.Append(ctx, message.Message{User: "alice", Message: text, Timestamp: timestamp})
+				require.NoError(t, err, "Setup failed")
+			}
+
+			edited, err := store.Edit(ctx, 1, "hello")
+			require.NoError(t, err)
+			require.Equal(t, "hello", edited.Message)
+			require.NotNil(t, edited.EditedAt)
+			require.Equal(t, "trace-edit", edited.TraceID)
+			_, err = store.Edit(ctx, 1, "hello!")
+			require.NoError(t, err)
+
+			got, err := store.Get(ctx, 1)
+			require.NoError(t, err)
+			require.Equal(t, "hello!", got.Message)
+			require.Len(t, got.History, 2)
+			require.Equal(t, "helo", got.History[0].Message)
+			require.True(t, timestamp.Equal(got.History[0].Timestamp), "The original text is dated by the message")
+			require.Equal(t, "hello", got.History[1].Message)
+
+			require.NoError(t, store.Remove(ctx, 2))
+			require.ErrorIs(t, store.Remove(ctx, 2), ErrDeleted)
+			_, err = store.Edit(ctx, 2, "back again")
+			require.ErrorIs(t, err, ErrDeleted)
+			tombstone, err := store.Get(ctx, 2)
+			require.NoError(t, err)
+			require.True(t, tombstone.Deleted)
+			require.Empty(t, tombstone.Message)
+			require.Equal(t, "alice", tombstone.User)
+
+			_, err = store.Get(ctx, 42)
+			require.ErrorIs(t, err, ErrNotFound)
+			_, err = store.Edit(ctx, 42, "x")
+			require.ErrorIs(t, err, ErrNotFound)
+			require.ErrorIs(t, store.Remove(ctx, 0), ErrNotFound)
+
+			messages, err := store.List(ctx)
+			require.NoError(t, err)
+			require.Equal(t, []int{1, 2, 3}, messageIDs(messages), "Tombstones keep their position")
+			require.Equal(t, "hello!", messages[0].Message)
+			require.Nil(t, messages[0].History, "Listings leave the history out")
+			require.True(t, messages[1].Deleted)
+			page, err := store.Range(ctx, 1, 2)
+			require.NoError(t, err)
+			require.Equal(t, []int{2, 3}, messageIDs(page))
+			require.True(t, page[0].Deleted)
+			tail, err := store.Tail(ctx, 3)
+			require.NoError(t, err)
+			require.Equal(t, "hello!", tail[0].Message)
+
+			require.NoError(t, store.Clear(ctx))
+			saved, err := store.Append(ctx, message.Message{User: "bob", Message: "fresh", Timestamp: timestamp})
+			require.NoError(t, err)
+			got, err = store.Get(ctx, saved.ID)
+			require.NoError(t, err)
+			require.Nil(t, got.EditedAt, "Clear should drop the edit log")
+		})
+	}
+}
+
+func TestFileStoreEditLog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "messages.txt")
+	plain := NewFileStore(path)
+	_, err := plain.Append(ctx, message.Message{User: "alice", Message: "draft", Timestamp: time.Now()})
+	require.NoError(t, err, "Setup failed")
+	_, err = plain.Edit(ctx, 1, "top secret plan")
+	require.NoError(t, err)
+
+	// Another process sees the edit too
+	got, err := NewFileStore(path).Get(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, "top secret plan", got.Message)
+
+	encrypted := NewEncryptedFileStore(path, testKeys(t, "k1"))
+	report, err := encrypted.Migrate(ctx, MigrateOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.EditsResealed)
+	raw, err := os.ReadFile(plain.EditsPath())
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "top secret", "Migrate should seal the edit log")
+
+	got, err = encrypted.Get(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, "top secret plan", got.Message)
+	_, err = plain.Get(ctx, 1)
+	require.ErrorIs(t, err, message.ErrSealed)
+}
+
+func TestEditLogCache(t *testing.T) {
+	log := editLog{path: filepath.Join(t.TempDir(), "messages.txt.edits"), cache: &editCache{}}
+	at := time.Now()
+	require.NoError(t, log.append(message.NewEdit(message.Message{ID: 1, User: "alice"}, "first", at)), "Setup failed")
+
+	first, err := log.load()
+	require.NoError(t, err)
+	require.Len(t, first[1], 1)
+	again, err := log.load()
+	require.NoError(t, err)
+	require.Equal(t, reflect.ValueOf(first).Pointer(), reflect.ValueOf(again).Pointer(), "An unchanged edit log should not be parsed again")
+
+	// Appended by another process
+	require.NoError(t, editLog{path: log.path}.append(message.NewEdit(message.Message{ID: 1, User: "alice"}, "second", at)))
+	changes, err := log.load()
+	require.NoError(t, err)
+	require.Len(t, changes[1], 2, "Appends should invalidate the cache")
+
+	// Replaced as a whole, keeping the size
+	line, err := message.Codec{}.FormatLine(message.NewEdit(message.Message{ID: 2, User: "alice"}, "first", at))
+	require.NoError(t, err)
+	line2, err := message.Codec{}.FormatLine(message.NewEdit(message.Message{ID: 2, User: "alice"}, "second", at))
+	require.NoError(t, err)
+	require.NoError(t, replaceFile(log.path, []byte(line+"\n"+line2+"\n")))
+	changes, err = log.load()
+	require.NoError(t, err)
+	require.Empty(t, changes[1], "Replacing the edit log should invalidate the cache")
+	require.Len(t, changes[2], 2)
+}
@@ -0,0 +1,20 @@
+module cgi.com/goLangTraining/src/pkg/messagestore
+
+go 1.22
+
+replace cgi.com/goLangTraining/src/pkg/message => ../message
+
+replace cgi.com/goLangTraining/src/pkg/envelope => ../envelope
+
+require (
+	cgi.com/goLangTraining/src/pkg/envelope v0.0.0-00010101000000-000000000000
+	cgi.com/goLangTraining/src/pkg/message v0.0.0-00010101000000-000000000000
+	github.com/stretchr/testify v1.11.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,324 @@
+package messagestore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+)
+
+// The offset index is a sidecar file that records where every message of the
+// log starts, so Tail and Range read only the lines they return instead of
+// decoding the whole log. It holds a fixed-size header (magic, the log size
+// it describes, entry count) followed by one fixed-size entry per message in
+// write order: the byte offset of its line and its ID.
+//
+// The index is a cache. Append and Clear keep it in step with the log, and
+// readers rebuild it whenever the log size no longer matches the size it
+// covers, e.g. after an older binary or an editor touched the log.
+const (
+	indexMagic      = "CGIMIDX1"
+	indexHeaderSize = 24
+	indexEntrySize  = 16
+)
+
+// errStaleIndex reports an index that does not describe the current log.
+var errStaleIndex = errors.New("message index is stale")
+
+// indexEntry locates a single message in the log.
+type indexEntry struct {
+	offset int64
+	id     int64
+}
+
+// offsetIndex is an open index file together with its decoded header. An
+// index whose header could not be read covers nothing, which readers treat
+// as stale.
+type offsetIndex struct {
+	f       *os.File
+	covered int64
+	count   int64
+}
+
+// openIndex opens the index at path and reads its header. A writable index
+// is created if it does not exist yet.
+func openIndex(path string, writable bool) (*offsetIndex, error) {
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ix := &offsetIndex{f: f, covered: -1}
+	header := make([]byte, indexHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return ix, nil
+		}
+		f.Close()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	covered := int64(binary.LittleEndian.Uint64(header[8:]))
+	count := int64(binary.LittleEndian.Uint64(header[16:]))
+	if string(header[:8]) != indexMagic || covered < 0 || count < 0 ||
+		count > (info.Size()-indexHeaderSize)/indexEntrySize {
+		return ix, nil
+	}
+	ix.covered, ix.count = covered, count
+	return ix, nil
+}
+
+// Close closes the index file.
+func (ix *offsetIndex) Close() error {
+	return ix.f.Close()
+}
+
+// covers reports whether the index describes a log of the given size.
+func (ix *offsetIndex) covers(size int64) bool {
+	return ix.covered == size
+}
+
+// writeHeader persists the covered size and entry count.
+func (ix *offsetIndex) writeHeader() error {
+	header := make([]byte, indexHeaderSize)
+	copy(header, indexMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(ix.covered))
+	binary.LittleEndian.PutUint64(header[16:], uint64(ix.count))
+	_, err := ix.f.WriteAt(header, 0)
+	return err
+}
+
+// add records a message appended to the log and the log size after the
+// append. The entry is written before the header, so an interrupted update
+// leaves an index that no longer covers the log and is rebuilt.
+func (ix *offsetIndex) add(entry indexEntry, covered int64) error {
+	buf := make([]byte, indexEntrySize)
+	putEntry(buf, entry)
+	if _, err := ix.f.WriteAt(buf, indexHeaderSize+ix.count*indexEntrySize); err != nil {
+		return err
+	}
+
+	ix.covered = covered
+	ix.count++
+	return ix.writeHeader()
+}
+
+// reset empties the index for a log of the given size holding no messages.
+func (ix *offsetIndex) reset(covered int64) error {
+	if err := ix.f.Truncate(indexHeaderSize); err != nil {
+		return err
+	}
+	ix.covered, ix.count = covered, 0
+	return ix.writeHeader()
+}
+
+// rebuild re-creates the index by decoding the first size bytes of log
+// with codec. The header is written last, so a failed rebuild leaves a stale
+// index.
+func (ix *offsetIndex) rebuild(log *os.File, codec message.Codec, size int64) error {
+	if err := ix.f.Truncate(0); err != nil {
+		return err
+	}
+	ix.covered, ix.count = -1, 0
+
+	w := bufio.NewWriter(io.NewOffsetWriter(ix.f, indexHeaderSize))
+	buf := make([]byte, indexEntrySize)
+	dec := codec.NewDecoder(io.NewSectionReader(log, 0, size))
+	for {
+		m, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		putEntry(buf, indexEntry{offset: dec.Offset(), id: int64(m.ID)})
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		ix.count++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	ix.covered = size
+	return ix.writeHeader()
+}
+
+// entries returns n entries starting at position start.
+func (ix *offsetIndex) entries(start, n int64) ([]indexEntry, error) {
+	buf := make([]byte, n*indexEntrySize)
+	if _, err := ix.f.ReadAt(buf, indexHeaderSize+start*indexEntrySize); err != nil {
+		if err == io.EOF {
+			return nil, errStaleIndex
+		}
+		return nil, err
+	}
+
+	entries := make([]indexEntry, n)
+	for i := range entries {
+		b := buf[i*indexEntrySize:]
+		entries[i] = indexEntry{
+			offset: int64(binary.LittleEndian.Uint64(b)),
+			id:     int64(binary.LittleEndian.Uint64(b[8:])),
+		}
+	}
+	return entries, nil
+}
+
+// search returns the position of the first entry whose ID is at least id,
+// or the entry count if there is none. IDs grow in write order, so the
+// entries are binary searched.
+func (ix *offsetIndex) search(id int) (int, error) {
+	var searchErr error
+	pos := sort.Search(int(ix.count), func(pos int) bool {
+		if searchErr != nil {
+			return true
+		}
+		entries, err := ix.entries(int64(pos), 1)
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return entries[0].id >= int64(id)
+	})
+	return pos, searchErr
+}
+
+// read decodes n messages starting at position start with codec. Their
+// lines are read from log in a single block that ends where the following
+// message starts, or at the end of the covered log. A line that no longer
+// decodes to the indexed message is reported as errStaleIndex.
+func (ix *offsetIndex) read(log *os.File, codec message.Codec, start, n int64) ([]message.Message, error) {
+	if n <= 0 {
+		return []message.Message{}, nil
+	}
+
+	// Reading one entry past the page tells us where its last line ends.
+	withNext := n
+	if start+n < ix.count {
+		withNext++
+	}
+	entries, err := ix.entries(start, withNext)
+	if err != nil {
+		return nil, err
+	}
+	end := ix.covered
+	if withNext > n {
+		end = entries[n].offset
+		entries = entries[:n]
+	}
+
+	base := entries[0].offset
+	if base < 0 || end < base || end > ix.covered {
+		return nil, errStaleIndex
+	}
+	block := make([]byte, end-base)
+	if _, err := log.ReadAt(block, base); err != nil {
+		if err == io.EOF {
+			return nil, errStaleIndex
+		}
+		return nil, err
+	}
+
+	messages := make([]message.Message, 0, len(entries))
+	for _, entry := range entries {
+		rel := entry.offset - base
+		if rel < 0 || rel >= int64(len(block)) {
+			return nil, errStaleIndex
+		}
+		line := block[rel:]
+		if newline := bytes.IndexByte(line, '\n'); newline >= 0 {
+			line = line[:newline]
+		}
+
+		m, err := codec.ParseLine(string(bytes.TrimSuffix(line, []byte("\r"))))
+		if err != nil || (m.ID > 0 && int64(m.ID) != entry.id) {
+			return nil, errStaleIndex
+		}
+		m.ID = int(entry.id)
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// openCoveringIndex opens the index at path for reading and returns
+// errStaleIndex unless it exists and describes a log of size bytes.
+func openCoveringIndex(path string, size int64) (*offsetIndex, error) {
+	ix, err := openIndex(path, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errStaleIndex
+		}
+		return nil, err
+	}
+	if !ix.covers(size) {
+		ix.Close()
+		return nil, errStaleIndex
+	}
+	return ix, nil
+}
+
+// rebuildIndex re-creates the index at path from the first size bytes of
+// log, decoded with codec, and returns it open. The caller must hold the
+// writer lock.
+func rebuildIndex(path string, log *os.File, codec message.Codec, size int64) (*offsetIndex, error) {
+	ix, err := openIndex(path, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := ix.rebuild(log, codec, size); err != nil {
+		ix.Close()
+		return nil, err
+	}
+	return ix, nil
+}
+
+// appendIndex records a message appended to log at entry.offset, growing it
+// from before to after bytes. An index that did not cover the log before the
+// append is rebuilt instead, decoding the log with codec.
+func appendIndex(path string, log *os.File, codec message.Codec, before int64, entry indexEntry, after int64) error {
+	ix, err := openIndex(path, true)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+
+	if ix.covers(before) {
+		return ix.add(entry, after)
+	}
+	return ix.rebuild(log, codec, after)
+}
+
+// resetIndex empties the index at path for a log of size bytes holding no
+// messages.
+func resetIndex(path string, size int64) error {
+	ix, err := openIndex(path, true)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+	return ix.reset(size)
+}
+
+// putEntry encodes entry into buf.
+func putEntry(buf []byte, entry indexEntry) {
+	binary.LittleEndian.PutUint64(buf, uint64(entry.offset))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(entry.id))
+}
@@ -0,0 +1,175 @@
+package messagestore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+// appendN appends n numbered messages to store.
+func appendN(t *testing.T, store MessageStore, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := store.Append(context.Background(), message.Message{
+			User:      "alice",
+			Message:   fmt.Sprintf("message %d", i),
+			Timestamp: time.Now(),
+		})
+		require.NoError(t, err, "Append failed")
+	}
+}
+
+func TestFileStoreMaintainsIndexOnAppend(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileStore(filepath.Join(t.TempDir(), "messages.txt"))
+	appendN(t, store, 25)
+
+	ix, err := openIndex(store.IndexPath(), false)
+	require.NoError(t, err, "Append should create the index")
+	info, err := os.Stat(store.Path())
+	require.NoError(t, err)
+	require.True(t, ix.covers(info.Size()), "Index should cover the whole log")
+	require.EqualValues(t, 25, ix.count)
+	require.NoError(t, ix.Close())
+
+	tail, err := store.Tail(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, []int{16, 17, 18, 19, 20, 21, 22, 23, 24, 25}, messageIDs(tail))
+	require.Equal(t, "message 24", tail[9].Message)
+}
+
+func TestFileStoreRebuildsIndex(t *testing.T) {
+	testCases := []struct {
+		name    string
+		corrupt func(t *testing.T, store *FileStore)
+	}{
+		{
+			name: "missing",
+			corrupt: func(t *testing.T, store *FileStore) {
+				require.NoError(t, os.Remove(store.IndexPath()))
+			},
+		},
+		{
+			name: "garbage",
+			corrupt: func(t *testing.T, store *FileStore) {
+				require.NoError(t, os.WriteFile(store.IndexPath(), []byte("not an index"), 0644))
+			},
+		},
+		{
+			name: "truncated",
+			corrupt: func(t *testing.T, store *FileStore) {
+				require.NoError(t, os.Truncate(store.IndexPath(), indexHeaderSize+3*indexEntrySize))
+			},
+		},
+		{
+			name: "log_written_without_index",
+			corrupt: func(t *testing.T, store *FileStore) {
+				f, err := os.OpenFile(store.Path(), os.O_APPEND|os.O_WRONLY, 0644)
+				require.NoError(t, err)
+				_, err = f.WriteString("[2025-10-16 23:16:51] bob: written by an older binary\n")
+				require.NoError(t, err)
+				require.NoError(t, f.Close())
+			},
+		},
+		{
+			name: "log_rewritten_with_same_size",
+			corrupt: func(t *testing.T, store *FileStore) {
+				content, err := os.ReadFile(store.Path())
+				require.NoError(t, err)
+				// Shift every record by one byte so no indexed offset
+				// points at the start of a line any more.
+				shifted := append([]byte("\n"), content[:len(content)-1]...)
+				require.NoError(t, os.WriteFile(store.Path(), shifted, 0644))
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewFileStore(filepath.Join(t.TempDir(), "messages.txt"))
+			appendN(t, store, 12)
+			tc.corrupt(t, store)
+
+			want, err := store.List(ctx)
+			require.NoError(t, err)
+
+			tail, err := store.Tail(ctx, 5)
+			require.NoError(t, err, "Tail should rebuild the index")
+			require.Equal(t, want[len(want)-5:], tail, "Tail should match a full scan")
+
+			page, err := store.Range(ctx, 2, 4)
+			require.NoError(t, err)
+			require.Equal(t, want[2:6], page, "Range should match a full scan")
+
+			ix, err := openIndex(store.IndexPath(), false)
+			require.NoError(t, err)
+			defer ix.Close()
+			require.EqualValues(t, len(want), ix.count, "Index should be rebuilt on disk")
+		})
+	}
+}
+
+func TestFileStoreIndexesLegacyLog(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte(legacyLog), 0644), "Setup failed")
+	store := NewFileStore(filePath)
+
+	tail, err := store.Tail(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, messageIDs(tail), "Legacy lines keep their positional IDs")
+	require.Equal(t, "bob", tail[1].User)
+
+	saved, err := store.Append(ctx, message.Message{User: "carol", Message: "current", Timestamp: time.Now()})
+	require.NoError(t, err)
+	tail, err = store.Tail(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int{2, saved.ID}, messageIDs(tail))
+}
+
+func TestFileStoreClearResetsIndex(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileStore(filepath.Join(t.TempDir(), "messages.txt"))
+	appendN(t, store, 5)
+	require.NoError(t, store.Clear(ctx))
+
+	tail, err := store.Tail(ctx, 10)
+	require.NoError(t, err)
+	require.Empty(t, tail, "Cleared log should have an empty tail")
+
+	appendN(t, store, 2)
+	tail, err = store.Tail(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, []int{6, 7}, messageIDs(tail))
+}
+
+func TestClampRange(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		count, offset, limit int
+		start, n             int
+	}{
+		{name: "inside", count: 10, offset: 2, limit: 3, start: 2, n: 3},
+		{name: "past_end", count: 10, offset: 8, limit: 5, start: 8, n: 2},
+		{name: "beyond_end", count: 10, offset: 12, limit: 5, start: 10, n: 0},
+		{name: "tail_longer_than_store", count: 3, offset: -7, limit: 10, start: 0, n: 3},
+		{name: "before_start", count: 10, offset: -5, limit: 3, start: 0, n: 0},
+		{name: "zero_limit", count: 10, offset: 0, limit: 0, start: 10, n: 0},
+		{name: "negative_limit", count: 10, offset: 0, limit: -1, start: 10, n: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			start, n := clampRange(tc.count, tc.offset, tc.limit)
+			require.Equal(t, tc.start, start, "start")
+			require.Equal(t, tc.n, n, "length")
+		})
+	}
+}
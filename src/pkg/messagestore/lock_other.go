@@ -0,0 +1,38 @@
+//go:build !unix
+
+package messagestore
+
+import (
+	"os"
+	"sync"
+)
+
+// processLock stands in for flock on platforms without it. It only
+// serialises FileStores within a single process; running several writer
+// processes against the same log is unsupported there.
+var processLock sync.RWMutex
+
+// lockModes remembers which mode each lock file was locked in.
+var lockModes sync.Map
+
+// lockFile takes the process-wide lock.
+func lockFile(f *os.File, exclusive bool) error {
+	if exclusive {
+		processLock.Lock()
+	} else {
+		processLock.RLock()
+	}
+	lockModes.Store(f, exclusive)
+	return nil
+}
+
+// unlockFile releases a lock taken by lockFile.
+func unlockFile(f *os.File) error {
+	exclusive, _ := lockModes.LoadAndDelete(f)
+	if exclusive == true {
+		processLock.Unlock()
+	} else {
+		processLock.RUnlock()
+	}
+	return nil
+}
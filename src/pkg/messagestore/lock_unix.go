@@ -0,0 +1,29 @@
+//go:build unix
+
+package messagestore
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile places an advisory flock on f. Locks are held per open file, so
+// two FileStores in the same process exclude each other just like separate
+// processes do.
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// unlockFile releases a lock taken by lockFile.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
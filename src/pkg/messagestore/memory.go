@@ -0,0 +1,159 @@
+package messagestore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+)
+
+// MemoryStore is a MessageStore that keeps messages in process memory.
+// It is intended for tests and ephemeral deployments; nothing survives a
+// restart.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	messages []message.Message
+	changes  map[int][]message.Message // edits and tombstones by ID
+	ids      *message.IDAssigner
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{ids: message.NewIDAssigner(0), changes: map[int][]message.Message{}}
+}
+
+// Append assigns msg the next ID and stores a copy of it.
+func (s *MemoryStore) Append(ctx context.Context, msg message.Message) (message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ids.Assign(&msg)
+	msg.TraceID = ""
+	s.messages = append(s.messages, msg)
+
+	msg.TraceID = traceID
+	return msg, nil
+}
+
+// List returns every stored message in write order.
+func (s *MemoryStore) List(ctx context.Context) ([]message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	messages := make([]message.Message, len(s.messages))
+	for i, msg := range s.messages {
+		msg.TraceID = traceID
+		messages[i] = msg
+	}
+	amend(messages, s.changes, false)
+	return messages, nil
+}
+
+// Tail returns the last n stored messages.
+func (s *MemoryStore) Tail(ctx context.Context, n int) ([]message.Message, error) {
+	return s.window(ctx, func(count int) (int, int) {
+		return clampRange(count, count-n, n)
+	}), nil
+}
+
+// Range returns at most limit stored messages starting at position offset.
+func (s *MemoryStore) Range(ctx context.Context, offset, limit int) ([]message.Message, error) {
+	return s.window(ctx, func(count int) (int, int) {
+		return clampRange(count, offset, limit)
+	}), nil
+}
+
+// window copies the messages that pick selects given the number of stored
+// messages.
+func (s *MemoryStore) window(ctx context.Context, pick func(count int) (int, int)) []message.Message {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	start, n := pick(len(s.messages))
+	messages := make([]message.Message, n)
+	for i, msg := range s.messages[start : start+n] {
+		msg.TraceID = traceID
+		messages[i] = msg
+	}
+	amend(messages, s.changes, false)
+	return messages
+}
+
+// Get returns the message with the given ID and its edit history.
+func (s *MemoryStore) Get(ctx context.Context, id int) (message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, err := s.find(id)
+	m.TraceID = traceID
+	return m, err
+}
+
+// Edit records a new text for the message with the given ID.
+func (s *MemoryStore) Edit(ctx context.Context, id int, text string) (message.Message, error) {
+	return s.change(ctx, id, func(m message.Message) message.Message {
+		return message.NewEdit(m, text, time.Now())
+	})
+}
+
+// Remove records a tombstone for the message with the given ID.
+func (s *MemoryStore) Remove(ctx context.Context, id int) error {
+	_, err := s.change(ctx, id, func(m message.Message) message.Message {
+		return message.NewTombstone(m, time.Now())
+	})
+	return err
+}
+
+// change records the change build makes to message id.
+func (s *MemoryStore) change(ctx context.Context, id int, build func(m message.Message) message.Message) (message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.find(id)
+	if err != nil {
+		return message.Message{}, err
+	}
+	if m.Deleted {
+		return message.Message{}, ErrDeleted
+	}
+	change := build(m)
+	s.changes[id] = append(s.changes[id], change)
+
+	m = message.Amend(m, change)
+	m.TraceID = traceID
+	return m, nil
+}
+
+// find returns message id with its changes applied. s.mu must be held.
+func (s *MemoryStore) find(id int) (message.Message, error) {
+	i := sort.Search(len(s.messages), func(i int) bool { return s.messages[i].ID >= id })
+	if i == len(s.messages) || s.messages[i].ID != id {
+		return message.Message{}, ErrNotFound
+	}
+	found := []message.Message{s.messages[i]}
+	amend(found, s.changes, true)
+	return found[0], nil
+}
+
+// Clear drops every stored message. The ID counter is kept so IDs are
+// never reused.
+func (s *MemoryStore) Clear(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = nil
+	s.changes = map[int][]message.Message{}
+	return nil
+}
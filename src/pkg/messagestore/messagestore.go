@@ -0,0 +1,548 @@
+package messagestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+
+	"cgi.com/goLangTraining/src/pkg/envelope"
+	"cgi.com/goLangTraining/src/pkg/message"
+)
+
+// tailWindow is how much of the log is read at a time when searching
+// backwards from its end for the last ID.
+const tailWindow = 64 * 1024
+
+// MessageStore abstracts message persistence so handlers, the CLI and the
+// gRPC server can share one implementation and tests can swap in a backend
+// that never touches disk.
+type MessageStore interface {
+	// Append persists a single message and returns it with the ID assigned
+	// at write time. IDs are never reused, not even after Clear.
+	Append(ctx context.Context, msg message.Message) (message.Message, error)
+	// List returns every stored message in write order.
+	List(ctx context.Context) ([]message.Message, error)
+	// Tail returns at most the last n messages in write order.
+	Tail(ctx context.Context, n int) ([]message.Message, error)
+	// Range returns at most limit messages in write order, starting at the
+	// zero-based position offset.
+	Range(ctx context.Context, offset, limit int) ([]message.Message, error)
+	// Clear removes all stored messages.
+	Clear(ctx context.Context) error
+	// Get returns the message with the given ID, including its edit
+	// history, or ErrNotFound. Deleted messages are returned as tombstones.
+	Get(ctx context.Context, id int) (message.Message, error)
+	// Edit replaces the text of the message with the given ID, keeping the
+	// previous text in its history, and returns the edited message. It
+	// returns ErrNotFound for unknown IDs and ErrDeleted for tombstones.
+	Edit(ctx context.Context, id int, text string) (message.Message, error)
+	// Remove replaces the message with the given ID by a tombstone, which
+	// keeps its ID, user, timestamp and position but not its text. It
+	// returns ErrNotFound for unknown IDs and ErrDeleted for tombstones.
+	// Readers no longer see the text, but whether it is erased from disk
+	// depends on the store: FileStore never erases it.
+	Remove(ctx context.Context, id int) error
+}
+
+// FileStore is a MessageStore backed by a JSON Lines file: a format header
+// followed by one JSON record per message. Files written in the legacy
+// "[timestamp] user: message" format remain readable, and new records are
+// appended to them in the current format.
+//
+// The web server, the CLI and the gRPC store may share one log. Every
+// operation holds an advisory lock on a sidecar "<path>.lock" file (shared
+// for reads, exclusive for writes) so concurrent writers in different
+// processes never interleave partial lines, lose an append, or truncate the
+// log underneath a reader.
+//
+// Tail and Range use a sidecar "<path>.idx" offset index, kept up to date on
+// Append and Clear, so they read only the lines they return. A missing or
+// stale index is rebuilt on the next read.
+//
+// Edits and deletes are recorded in a sidecar "<path>.edits" log and applied
+// by every read; the log itself is only ever appended to.
+type FileStore struct {
+	path  string
+	codec message.Codec
+	edits *editCache
+}
+
+// NewFileStore returns a FileStore that reads and writes the file at path.
+// The file is created lazily on the first Append.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path, edits: &editCache{}}
+}
+
+// NewEncryptedFileStore returns a FileStore that seals every record it
+// appends with envelope encryption under the active key of keys. Header
+// lines and records written before encryption was enabled stay plain until
+// Migrate re-encrypts them.
+func NewEncryptedFileStore(path string, keys *envelope.Keyring) *FileStore {
+	return &FileStore{path: path, codec: message.Codec{Keys: keys}, edits: &editCache{}}
+}
+
+// Path returns the location of the backing file.
+func (s *FileStore) Path() string {
+	return s.path
+}
+
+// LockPath returns the location of the lock file guarding the log.
+func (s *FileStore) LockPath() string {
+	return s.path + ".lock"
+}
+
+// IndexPath returns the location of the offset index kept next to the log.
+func (s *FileStore) IndexPath() string {
+	return s.path + ".idx"
+}
+
+// EditsPath returns the location of the edit log.
+func (s *FileStore) EditsPath() string {
+	return s.path + ".edits"
+}
+
+// editLog returns the edit log of the log.
+func (s *FileStore) editLog() editLog {
+	return editLog{path: s.EditsPath(), codec: s.codec, cache: s.edits}
+}
+
+// editor returns the editor over the log and its edit log.
+func (s *FileStore) editor(ctx context.Context) editor {
+	return editor{
+		log:  s.editLog(),
+		lock: s.lock,
+		read: func(offset, limit int) ([]message.Message, error) {
+			return s.readIndexed(ctx, func(count int) (int, int) {
+				return clampRange(count, offset, limit)
+			})
+		},
+		locate: func(ids ...int) (int, []int, error) {
+			return s.locate(ctx, ids...)
+		},
+	}
+}
+
+// lock takes the advisory lock guarding the log and returns a function that
+// releases it. Writers lock exclusively, readers shared.
+func (s *FileStore) lock(exclusive bool) (func(), error) {
+	return acquireLock(s.LockPath(), exclusive)
+}
+
+// acquireLock takes the advisory lock held on the file at path and returns
+// a function that releases it. A reader whose directory does not exist yet
+// has nothing to read and proceeds unlocked.
+func acquireLock(path string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		if !exclusive && os.IsNotExist(err) {
+			return func() {}, nil
+		}
+		return nil, err
+	}
+
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// Append assigns msg the next ID and writes it as a new line at the end of
+// the file.
+func (s *FileStore) Append(ctx context.Context, msg message.Message) (message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return message.Message{}, err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return message.Message{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return message.Message{}, err
+	}
+	last, err := lastID(f, s.codec, info.Size())
+	if err != nil {
+		return message.Message{}, err
+	}
+	message.NewIDAssigner(last).Assign(&msg)
+	msg.TraceID = ""
+
+	line, err := s.codec.FormatLine(msg)
+	if err != nil {
+		return message.Message{}, err
+	}
+	// A new log starts with a format header so readers can tell it apart
+	// from the legacy text format.
+	var prefix string
+	if info.Size() == 0 {
+		prefix = message.FormatHeader(0) + "\n"
+	}
+	record := prefix + line + "\n"
+
+	if _, err := f.WriteString(record); err != nil {
+		return message.Message{}, err
+	}
+	s.indexAppend(ctx, f, info.Size(), indexEntry{
+		offset: info.Size() + int64(len(prefix)),
+		id:     int64(msg.ID),
+	}, info.Size()+int64(len(record)))
+
+	slog.InfoContext(ctx, "Message appended to file",
+		"user", msg.User,
+		"message_id", msg.ID,
+		"filePath", s.path,
+		"traceID", traceID)
+
+	msg.TraceID = traceID
+	return msg, nil
+}
+
+// List reads and parses every line of the file. Malformed lines are skipped
+// and a missing file is treated as an empty store.
+func (s *FileStore) List(ctx context.Context) ([]message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	unlock, err := s.lock(false)
+	if err != nil {
+		return []message.Message{}, err
+	}
+	defer unlock()
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []message.Message{}, nil
+		}
+		return []message.Message{}, err
+	}
+	defer f.Close()
+
+	messages, err := s.codec.DecodeAll(f)
+	if err != nil {
+		return messages, err
+	}
+	changes, err := s.editLog().load()
+	if err != nil {
+		return []message.Message{}, err
+	}
+	amend(messages, changes, false)
+	for i := range messages {
+		messages[i].TraceID = traceID
+	}
+	return messages, nil
+}
+
+// Tail returns the last n messages of the file.
+func (s *FileStore) Tail(ctx context.Context, n int) ([]message.Message, error) {
+	return s.editor(ctx).amended(s.readIndexed(ctx, func(count int) (int, int) {
+		return clampRange(count, count-n, n)
+	}))
+}
+
+// Range returns at most limit messages starting at position offset.
+func (s *FileStore) Range(ctx context.Context, offset, limit int) ([]message.Message, error) {
+	return s.editor(ctx).amended(s.readIndexed(ctx, func(count int) (int, int) {
+		return clampRange(count, offset, limit)
+	}))
+}
+
+// Get returns the message with the given ID and its edit history. The
+// message is found by binary search over the index.
+func (s *FileStore) Get(ctx context.Context, id int) (message.Message, error) {
+	return s.editor(ctx).get(ctx, id)
+}
+
+// Edit records a new text for the message with the given ID.
+func (s *FileStore) Edit(ctx context.Context, id int, text string) (message.Message, error) {
+	return s.editor(ctx).edit(ctx, id, text)
+}
+
+// Remove records a tombstone for the message with the given ID. The log is
+// append-only, so the original record, text included, stays in the file for
+// good; only a SegmentStore erases the text of removed messages, when it
+// compacts their segment.
+func (s *FileStore) Remove(ctx context.Context, id int) error {
+	return s.editor(ctx).remove(ctx, id)
+}
+
+// locate finds the positions of ids by binary search over the index, as
+// idLocator describes.
+func (s *FileStore) locate(ctx context.Context, ids ...int) (count int, positions []int, err error) {
+	_, err = s.useIndex(ctx, func(f *os.File, ix *offsetIndex) ([]message.Message, error) {
+		count, positions = int(ix.count), make([]int, len(ids))
+		for i, id := range ids {
+			if positions[i], err = ix.search(id); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if positions == nil {
+		// A missing log holds no messages
+		positions = make([]int, len(ids))
+	}
+	return count, positions, err
+}
+
+// readIndexed returns the messages that window selects given the number of
+// messages in the log.
+func (s *FileStore) readIndexed(ctx context.Context, window func(count int) (int, int)) ([]message.Message, error) {
+	return s.useIndex(ctx, func(f *os.File, ix *offsetIndex) ([]message.Message, error) {
+		start, n := window(int(ix.count))
+		return ix.read(f, s.codec, int64(start), int64(n))
+	})
+}
+
+// useIndex runs fn over the open log and its index. The index is used under
+// the reader lock; if it is missing or stale it is rebuilt under the writer
+// lock and fn runs again.
+func (s *FileStore) useIndex(ctx context.Context, fn func(f *os.File, ix *offsetIndex) ([]message.Message, error)) ([]message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	messages, err := s.withIndex(fn, false)
+	if errors.Is(err, errStaleIndex) {
+		slog.InfoContext(ctx, "Rebuilding message index",
+			"indexPath", s.IndexPath(),
+			"traceID", traceID)
+		messages, err = s.withIndex(fn, true)
+	}
+	if err != nil {
+		return []message.Message{}, err
+	}
+
+	for i := range messages {
+		messages[i].TraceID = traceID
+	}
+	return messages, nil
+}
+
+// withIndex opens the log and its index and runs fn over them. Without
+// rebuild it only takes the reader lock and reports a missing or stale
+// index as errStaleIndex; with rebuild it takes the writer lock and
+// re-creates the index first.
+func (s *FileStore) withIndex(fn func(f *os.File, ix *offsetIndex) ([]message.Message, error), rebuild bool) ([]message.Message, error) {
+	unlock, err := s.lock(rebuild)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []message.Message{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var ix *offsetIndex
+	if rebuild {
+		ix, err = rebuildIndex(s.IndexPath(), f, s.codec, info.Size())
+	} else {
+		ix, err = openCoveringIndex(s.IndexPath(), info.Size())
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer ix.Close()
+	return fn(f, ix)
+}
+
+// indexAppend records a message appended to the log at entry.offset.
+// Failures are logged rather than returned: the message is already in the
+// log, and readers rebuild an index that does not match it.
+func (s *FileStore) indexAppend(ctx context.Context, f *os.File, before int64, entry indexEntry, after int64) {
+	if err := appendIndex(s.IndexPath(), f, s.codec, before, entry, after); err != nil {
+		s.warnIndex(ctx, err)
+	}
+}
+
+// indexReset empties the index after the log was truncated to size bytes
+// holding no messages. An index that cannot be reset is removed.
+func (s *FileStore) indexReset(ctx context.Context, size int64) {
+	if err := resetIndex(s.IndexPath(), size); err != nil {
+		s.warnIndex(ctx, err)
+		s.dropIndex()
+	}
+}
+
+// dropIndex removes the index so the next read rebuilds it.
+func (s *FileStore) dropIndex() error {
+	return removeIfExists(s.IndexPath())
+}
+
+// warnIndex logs a failure to maintain the index.
+func (s *FileStore) warnIndex(ctx context.Context, err error) {
+	warnIndex(ctx, s.IndexPath(), err)
+}
+
+// Clear truncates the file down to a header that remembers the last ID
+// handed out, so IDs assigned after a clear never collide with earlier ones.
+// A missing file is not an error.
+func (s *FileStore) Clear(ctx context.Context) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	last, err := lastID(f, s.codec, info.Size())
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	header := message.FormatHeader(last) + "\n"
+	if _, err := f.WriteAt([]byte(header), 0); err != nil {
+		return err
+	}
+	s.indexReset(ctx, int64(len(header)))
+	return removeIfExists(s.EditsPath())
+}
+
+// lastID returns the highest ID in the log held by f, decoding records with
+// codec. Writers always append increasing IDs, so the last record carries it
+// (a numbered record, or the header left by Clear) and the file is read
+// backwards from the end until one is found. Malformed lines and lines too
+// long to decode, such as a torn or oversized write, are stepped over. Logs
+// whose tail predates persisted IDs are decoded in full.
+func lastID(f *os.File, codec message.Codec, size int64) (int, error) {
+	end := size // end of the line being looked for, newline excluded
+	for end > 0 {
+		start, err := lineStart(f, end)
+		if err != nil {
+			return 0, err
+		}
+		if end-start < message.MaxLineSize {
+			buf := make([]byte, end-start)
+			if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+				return 0, err
+			}
+			line := string(bytes.TrimSpace(buf))
+			if h, err := message.ParseHeader(line); err == nil {
+				return h.BaseID, nil
+			}
+			if line != "" {
+				m, err := codec.ParseLine(line)
+				if err == nil && m.ID > 0 {
+					return m.ID, nil
+				}
+				if err == nil {
+					// A legacy line is numbered by its position
+					return decodeLastID(f, codec)
+				}
+				if !errors.Is(err, message.ErrMalformedLine) {
+					return 0, err
+				}
+			}
+		}
+		end = start - 1
+	}
+	return 0, nil
+}
+
+// decodeLastID decodes the whole log held by f and returns its highest ID.
+func decodeLastID(f *os.File, codec message.Codec) (int, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	dec := codec.NewDecoder(f)
+	for {
+		if _, err := dec.Decode(); err == io.EOF {
+			return dec.LastID(), nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// lineStart returns the offset of the line in f that ends at end, reading
+// backwards tailWindow bytes at a time.
+func lineStart(f *os.File, end int64) (int64, error) {
+	buf := make([]byte, tailWindow)
+	for pos := end; pos > 0; {
+		n := int64(len(buf))
+		if n > pos {
+			n = pos
+		}
+		pos -= n
+		if _, err := f.ReadAt(buf[:n], pos); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// clampRange bounds the window of limit messages starting at offset to a
+// store holding count messages and returns its start and length.
+func clampRange(count, offset, limit int) (int, int) {
+	if limit <= 0 || offset >= count {
+		return count, 0
+	}
+	if offset < 0 {
+		if limit <= -offset {
+			return 0, 0
+		}
+		limit += offset
+		offset = 0
+	}
+	if limit > count-offset {
+		limit = count - offset
+	}
+	return offset, limit
+}
+
+// removeIfExists removes the file at path; a missing file is not an error.
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// warnIndex logs a failure to maintain the index at path.
+func warnIndex(ctx context.Context, path string, err error) {
+	traceID, _ := ctx.Value("traceID").(string)
+	slog.WarnContext(ctx, "Failed to update message index",
+		"error", err,
+		"indexPath", path,
+		"traceID", traceID)
+}
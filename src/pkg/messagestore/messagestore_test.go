@@ -0,0 +1,303 @@
+package messagestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/envelope"
+	"cgi.com/goLangTraining/src/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+// storeFactories lists every MessageStore implementation so the same
+// behavioural contract is exercised against each of them.
+var storeFactories = []struct {
+	name string
+	new  func(t *testing.T) MessageStore
+}{
+	{
+		name: "file",
+		new: func(t *testing.T) MessageStore {
+			return NewFileStore(filepath.Join(t.TempDir(), "messages.txt"))
+		},
+	},
+	{
+		name: "segmented",
+		new: func(t *testing.T) MessageStore {
+			// Tiny segments so the contract is checked across many of them.
+			return NewSegmentStore(filepath.Join(t.TempDir(), "messages.d"), SegmentOptions{MaxSegmentBytes: 300})
+		},
+	},
+	{
+		name: "encrypted_file",
+		new: func(t *testing.T) MessageStore {
+			return NewEncryptedFileStore(filepath.Join(t.TempDir(), "messages.txt"), testKeys(t, "k1"))
+		},
+	},
+	{
+		name: "encrypted_segmented",
+		new: func(t *testing.T) MessageStore {
+			return NewSegmentStore(filepath.Join(t.TempDir(), "messages.d"), SegmentOptions{MaxSegmentBytes: 300, Keys: testKeys(t, "k1")})
+		},
+	},
+	{
+		name: "memory",
+		new: func(t *testing.T) MessageStore {
+			return NewMemoryStore()
+		},
+	},
+}
+
+// testKeys returns a keyring holding one key per ID, the last one active.
+// Keys are derived from their IDs, so the same ID always names the same key.
+func testKeys(t *testing.T, ids ...string) *envelope.Keyring {
+	t.Helper()
+	var file strings.Builder
+	for _, id := range ids {
+		sum := sha256.Sum256([]byte(id))
+		key := base64.StdEncoding.EncodeToString(sum[:])
+		file.WriteString(id + " " + key + "\n")
+	}
+	keys, err := envelope.ParseKeyring(strings.NewReader(file.String()))
+	require.NoError(t, err, "Setup failed")
+	return keys
+}
+
+func TestMessageStoreContract(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "traceID", "trace-123")
+	timestamp := time.Date(2025, 10, 16, 23, 5, 55, 0, time.UTC)
+
+	for _, factory := range storeFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			store := factory.new(t)
+
+			messages, err := store.List(ctx)
+			require.NoError(t, err, "List on an empty store should succeed")
+			require.Empty(t, messages, "Empty store should return no messages")
+
+			for i := 1; i <= 12; i++ {
+				saved, err := store.Append(ctx, message.Message{
+					User:      fmt.Sprintf("user%d", i),
+					Message:   fmt.Sprintf("Message number %d", i),
+					Timestamp: timestamp,
+				})
+				require.NoError(t, err, "Append failed")
+				require.Equal(t, i, saved.ID, "Append should return the assigned ID")
+				require.Equal(t, "trace-123", saved.TraceID)
+			}
+
+			messages, err = store.List(ctx)
+			require.NoError(t, err, "List failed")
+			require.Len(t, messages, 12, "List should return every appended message")
+			require.Equal(t, 1, messages[0].ID, "IDs should start at 1")
+			require.Equal(t, "user1", messages[0].User)
+			require.Equal(t, "Message number 1", messages[0].Message)
+			require.True(t, timestamp.Equal(messages[0].Timestamp), "Timestamp mismatch")
+			require.Equal(t, "trace-123", messages[0].TraceID, "TraceID should come from the context")
+
+			tail, err := store.Tail(ctx, 10)
+			require.NoError(t, err, "Tail failed")
+			require.Len(t, tail, 10, "Tail should cap the result size")
+			require.Equal(t, 3, tail[0].ID, "Tail should start at the 3rd message")
+			require.Equal(t, 12, tail[9].ID, "Tail should end at the last message")
+			require.Equal(t, "trace-123", tail[0].TraceID)
+
+			page, err := store.Range(ctx, 4, 3)
+			require.NoError(t, err, "Range failed")
+			require.Equal(t, []int{5, 6, 7}, messageIDs(page), "Range should start at the zero-based offset")
+			page, err = store.Range(ctx, 10, 5)
+			require.NoError(t, err)
+			require.Equal(t, []int{11, 12}, messageIDs(page), "Range should stop at the last message")
+			page, err = store.Range(ctx, 20, 5)
+			require.NoError(t, err)
+			require.Empty(t, page, "Range past the end should be empty")
+
+			require.NoError(t, store.Clear(ctx), "Clear failed")
+			messages, err = store.List(ctx)
+			require.NoError(t, err, "List after Clear failed")
+			require.Empty(t, messages, "Clear should remove every message")
+
+			saved, err := store.Append(ctx, message.Message{User: "alice", Message: "after clear", Timestamp: timestamp})
+			require.NoError(t, err, "Append after Clear failed")
+			require.Equal(t, 13, saved.ID, "IDs must not be reused after Clear")
+
+			messages, err = store.List(ctx)
+			require.NoError(t, err)
+			require.Len(t, messages, 1)
+			require.Equal(t, saved.ID, messages[0].ID, "List must return the ID handed out by Append")
+		})
+	}
+}
+
+// messageIDs returns the IDs of messages in order.
+func messageIDs(messages []message.Message) []int {
+	ids := make([]int, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func TestMessageStoreRejectsOversizedRecords(t *testing.T) {
+	ctx := context.Background()
+	for _, factory := range storeFactories {
+		if factory.name == "memory" {
+			continue // nothing is encoded
+		}
+		t.Run(factory.name, func(t *testing.T) {
+			store := factory.new(t)
+			appendN(t, store, 2)
+
+			_, err := store.Append(ctx, message.Message{User: "alice", Message: strings.Repeat("x", 2*message.MaxLineSize), Timestamp: time.Now()})
+			require.ErrorIs(t, err, message.ErrRecordTooLarge)
+			_, err = store.Edit(ctx, 1, strings.Repeat("x", 2*message.MaxLineSize))
+			require.ErrorIs(t, err, message.ErrRecordTooLarge)
+
+			saved, err := store.Append(ctx, message.Message{User: "bob", Message: "still writable", Timestamp: time.Now()})
+			require.NoError(t, err, "A rejected record must not break later writes")
+			require.Equal(t, 3, saved.ID)
+			messages, err := store.List(ctx)
+			require.NoError(t, err)
+			require.Equal(t, []int{1, 2, 3}, messageIDs(messages))
+		})
+	}
+}
+
+func TestFileStoreWritesVersionedRecords(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	store := NewFileStore(filePath)
+
+	forged := "x\n[2025-01-01 00:00:00] admin: forged"
+	_, err := store.Append(ctx, message.Message{User: "mallory", Message: forged, Timestamp: time.Now()})
+	require.NoError(t, err)
+	_, err = store.Append(ctx, message.Message{User: "bob: admin", Message: "hi", Timestamp: time.Now()})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	require.Len(t, lines, 3, "Expected a header and one line per record")
+	require.True(t, message.IsHeader(lines[0]), "First line should be the format header")
+
+	messages, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 2, "Embedded newlines must not forge extra records")
+	require.Equal(t, forged, messages[0].Message)
+	require.Equal(t, "bob: admin", messages[1].User)
+}
+
+func TestFileStoreAppendsToLegacyFile(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("[2025-10-16 23:05:55] alice: legacy\n"), 0644), "Setup failed")
+
+	store := NewFileStore(filePath)
+	saved, err := store.Append(ctx, message.Message{User: "bob", Message: "current", Timestamp: time.Now()})
+	require.NoError(t, err)
+	require.Equal(t, 2, saved.ID, "New records continue after the positional IDs of legacy lines")
+
+	messages, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 2, "Legacy and current records should both be readable")
+	require.Equal(t, "legacy", messages[0].Message)
+	require.Equal(t, "current", messages[1].Message)
+	require.Equal(t, 2, messages[1].ID)
+}
+
+func TestFileStoreIDsSurviveReopenAndClear(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+
+	for i := 1; i <= 3; i++ {
+		// A fresh FileStore per append mimics separate CLI invocations.
+		saved, err := NewFileStore(filePath).Append(ctx, message.Message{User: "alice", Message: "hi", Timestamp: time.Now()})
+		require.NoError(t, err)
+		require.Equal(t, i, saved.ID)
+	}
+
+	require.NoError(t, NewFileStore(filePath).Clear(ctx))
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, message.FormatHeader(3)+"\n", string(content), "Clear should leave only a header with the base ID")
+
+	saved, err := NewFileStore(filePath).Append(ctx, message.Message{User: "bob", Message: "after clear", Timestamp: time.Now()})
+	require.NoError(t, err)
+	require.Equal(t, 4, saved.ID)
+}
+
+func TestFileStoreSkipsUnparseableLines(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+
+	content := "alice: Hello World\n" +
+		"\n" +
+		"[2025-10-16 23:05:55] alice: Hello unified app!\n" +
+		"[2025-10-16 23:16:51] bob: Hello from Bob!\n"
+	require.NoError(t, os.WriteFile(filePath, []byte(content), 0644), "Setup failed")
+
+	messages, err := NewFileStore(filePath).List(ctx)
+	require.NoError(t, err, "List failed")
+	require.Len(t, messages, 2, "Lines without a timestamp should be skipped")
+	require.Equal(t, "alice", messages[0].User)
+	require.Equal(t, "bob", messages[1].User)
+	require.Equal(t, 2, messages[1].ID)
+}
+
+func TestFileStoreAppendsPastBadTail(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	store := NewFileStore(filePath)
+	appendN(t, store, 2)
+
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err, "Setup failed")
+	_, err = f.WriteString(`{"user":"mallory","message":"` + strings.Repeat("x", message.MaxLineSize) + "\"}\n{\"id\":4,\"us\n")
+	require.NoError(t, err, "Setup failed")
+	require.NoError(t, f.Close(), "Setup failed")
+
+	saved, err := store.Append(ctx, message.Message{User: "bob", Message: "after the bad lines", Timestamp: time.Now()})
+	require.NoError(t, err, "Oversized and torn lines at the end must not stop writes")
+	require.Equal(t, 3, saved.ID, "The ID should follow the last record that can be decoded")
+
+	_, err = store.List(ctx)
+	require.ErrorIs(t, err, message.ErrRecordTooLarge)
+	require.Contains(t, err.Error(), "offset ", "Readers should name where the oversized record is")
+}
+
+func TestFileStoreClearMissingFile(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "missing.txt"))
+	require.NoError(t, store.Clear(context.Background()), "Clearing a missing file should not fail")
+}
+
+func TestEncryptedFileStoreSealsRecords(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("[2025-10-16 23:05:55] alice: legacy\n"), 0644), "Setup failed")
+
+	store := NewEncryptedFileStore(filePath, testKeys(t, "k1"))
+	saved, err := store.Append(ctx, message.Message{User: "bob", Message: "top secret", Timestamp: time.Now()})
+	require.NoError(t, err)
+	require.Equal(t, 2, saved.ID)
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "top secret", "New records must not be readable on disk")
+
+	messages, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"legacy", "top secret"}, []string{messages[0].Message, messages[1].Message},
+		"Plain records written before encryption was enabled stay readable")
+
+	_, err = NewFileStore(filePath).List(ctx)
+	require.ErrorIs(t, err, message.ErrSealed, "Reading sealed records without keys must fail, not drop them")
+	_, err = NewFileStore(filePath).Append(ctx, message.Message{User: "carol", Message: "plain", Timestamp: time.Now()})
+	require.ErrorIs(t, err, message.ErrSealed, "Without keys the next ID cannot be known")
+}
@@ -0,0 +1,406 @@
+package messagestore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+)
+
+// Outcomes recorded for each non-blank line scanned by Migrate.
+const (
+	LineCurrent     = "current"     // already a JSON record, sealed under the active key if encrypting
+	LineConverted   = "converted"   // legacy "[timestamp] user: message" line
+	LineRepaired    = "repaired"    // legacy "user: message" line without a timestamp
+	LineResealed    = "resealed"    // plain record, or one sealed under an older key, to re-encrypt
+	LineQuarantined = "quarantined" // unrecoverable; moved to the quarantine file
+)
+
+// MigrateOptions controls how Migrate treats the log.
+type MigrateOptions struct {
+	// DryRun scans and reports without touching any file.
+	DryRun bool
+}
+
+// LineIssue describes a line that could not be carried over unchanged.
+type LineIssue struct {
+	Line    int    `json:"line"`
+	Text    string `json:"text"`
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason"`
+}
+
+// MigrationReport summarises a Migrate run.
+type MigrationReport struct {
+	Lines          int         `json:"lines"` // non-blank, non-header lines scanned
+	Current        int         `json:"current"`
+	Converted      int         `json:"converted"`
+	Repaired       int         `json:"repaired"`
+	Resealed       int         `json:"resealed"`
+	EditsResealed  int         `json:"edits_resealed"` // edit-log records re-encrypted
+	Quarantined    int         `json:"quarantined"`
+	Issues         []LineIssue `json:"issues,omitempty"`
+	BackupPath     string      `json:"backup_path,omitempty"`
+	QuarantinePath string      `json:"quarantine_path,omitempty"`
+	Rewritten      bool        `json:"rewritten"`
+}
+
+// scannedLine is a non-blank line of the log together with its decoded
+// message, if any.
+type scannedLine struct {
+	number  int
+	text    string
+	header  bool
+	msg     message.Message
+	outcome string
+	reason  string
+}
+
+// Migrate scans the log for lines the reader would drop, repairs legacy
+// "user: message" lines that predate timestamps, quarantines anything it
+// cannot recover and rewrites the file in the current format. Messages keep
+// their IDs; repaired ones are appended after them with new IDs. A store with
+// encryption keys also re-encrypts plain records and records sealed under
+// an older key with the active key, in the log and its edit log. The
+// original log is kept as a timestamped backup next to it. A missing log is
+// reported as empty.
+func (s *FileStore) Migrate(ctx context.Context, opts MigrateOptions) (MigrationReport, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+	report := MigrationReport{}
+
+	// Hold the writer lock for the whole run so no append lands between the
+	// scan and the rewrite.
+	unlock, err := s.lock(true)
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, nil
+		}
+		return report, err
+	}
+
+	lines, err := scanLog(s.path, s.codec)
+	if err != nil {
+		return report, err
+	}
+	// Edit-log records are whole records already, so they only need
+	// resealing
+	report.EditsResealed, err = s.editLog().reseal(opts.DryRun)
+	if err != nil {
+		return report, fmt.Errorf("reseal edit log: %w", err)
+	}
+	repairTimestamps(lines, info.ModTime())
+
+	// A log that does not start with a header, or that contains stray headers
+	// from concatenated files, is rewritten even if every record is current.
+	needsRewrite := len(lines) > 0 && !lines[0].header
+	for i, line := range lines {
+		if line.header {
+			needsRewrite = needsRewrite || i > 0
+			continue
+		}
+
+		report.Lines++
+		switch line.outcome {
+		case LineCurrent:
+			report.Current++
+		case LineConverted:
+			report.Converted++
+		case LineRepaired:
+			report.Repaired++
+		case LineResealed:
+			report.Resealed++
+		case LineQuarantined:
+			report.Quarantined++
+		}
+		if line.outcome == LineCurrent {
+			continue
+		}
+
+		needsRewrite = true
+		if line.outcome == LineRepaired || line.outcome == LineQuarantined {
+			report.Issues = append(report.Issues, LineIssue{
+				Line:    line.number,
+				Text:    line.text,
+				Outcome: line.outcome,
+				Reason:  line.reason,
+			})
+		}
+	}
+
+	if opts.DryRun || !needsRewrite {
+		return report, nil
+	}
+
+	stamp := time.Now().Format("20060102T150405")
+	report.BackupPath = fmt.Sprintf("%s.bak-%s", s.path, stamp)
+	if report.Quarantined > 0 {
+		report.QuarantinePath = fmt.Sprintf("%s.quarantine-%s", s.path, stamp)
+	}
+
+	if err := copyFile(s.path, report.BackupPath); err != nil {
+		return report, fmt.Errorf("backup failed: %w", err)
+	}
+	if err := writeQuarantine(report.QuarantinePath, lines); err != nil {
+		return report, fmt.Errorf("quarantine failed: %w", err)
+	}
+	if err := rewriteLog(s.path, lines, s.codec); err != nil {
+		return report, fmt.Errorf("rewrite failed: %w", err)
+	}
+	report.Rewritten = true
+
+	// Record offsets changed; the next read rebuilds the index.
+	if err := s.dropIndex(); err != nil {
+		s.warnIndex(ctx, err)
+	}
+
+	slog.InfoContext(ctx, "Message log migrated",
+		"filePath", s.path,
+		"backupPath", report.BackupPath,
+		"converted", report.Converted,
+		"repaired", report.Repaired,
+		"resealed", report.Resealed,
+		"quarantined", report.Quarantined,
+		"traceID", traceID)
+	return report, nil
+}
+
+// scanLog classifies every non-blank line of the file at path, decoding
+// records with codec. Records that cannot be decrypted for lack of a key
+// stop the scan: they are not damaged and must never be quarantined.
+func scanLog(path string, codec message.Codec) ([]scannedLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []scannedLine
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), message.MaxLineSize)
+	number := 0
+
+	for scanner.Scan() {
+		number++
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		line := scannedLine{number: number, text: text}
+		if _, err := message.ParseHeader(text); err == nil {
+			line.header, line.outcome = true, LineCurrent
+			lines = append(lines, line)
+			continue
+		} else if errors.Is(err, message.ErrUnsupportedVersion) {
+			// Never rewrite a log produced by a newer release.
+			return nil, err
+		}
+
+		msg, err := codec.ParseLine(text)
+		switch {
+		case err != nil && !errors.Is(err, message.ErrMalformedLine):
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		case err == nil && codec.Current(text):
+			line.msg, line.outcome = msg, LineCurrent
+		case err == nil && strings.HasPrefix(text, "{"):
+			line.msg, line.outcome = msg, LineResealed
+		case err == nil:
+			line.msg, line.outcome = msg, LineConverted
+		default:
+			if user, body, ok := splitUntimedLine(text); ok {
+				line.msg = message.Message{User: user, Message: body}
+				line.outcome, line.reason = LineRepaired, "missing timestamp"
+			} else {
+				line.outcome, line.reason = LineQuarantined, err.Error()
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
+
+// splitUntimedLine recognises the earliest log format, "user: message",
+// written before timestamps were recorded.
+func splitUntimedLine(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false
+	}
+	user, body, ok := strings.Cut(text, ": ")
+	if !ok || user == "" || strings.ContainsAny(user, " \t") {
+		return "", "", false
+	}
+	return user, body, true
+}
+
+// repairTimestamps gives every repaired line the timestamp of the closest
+// preceding dated message, falling back to the next dated message and then to
+// fallback, so it is dated among the messages it was written between.
+func repairTimestamps(lines []scannedLine, fallback time.Time) {
+	var next time.Time
+	nextAt := make([]time.Time, len(lines))
+	for i := len(lines) - 1; i >= 0; i-- {
+		nextAt[i] = next
+		if !lines[i].msg.Timestamp.IsZero() {
+			next = lines[i].msg.Timestamp
+		}
+	}
+
+	var previous time.Time
+	for i := range lines {
+		if lines[i].outcome != LineRepaired {
+			if !lines[i].msg.Timestamp.IsZero() {
+				previous = lines[i].msg.Timestamp
+			}
+			continue
+		}
+		switch {
+		case !previous.IsZero():
+			lines[i].msg.Timestamp = previous
+		case !nextAt[i].IsZero():
+			lines[i].msg.Timestamp = nextAt[i]
+		default:
+			lines[i].msg.Timestamp = fallback
+		}
+	}
+}
+
+// rewriteLog replaces the file at path with a header followed by every
+// recoverable message, encoded with codec. The new content is written to a
+// temporary file in the same directory and renamed over the original.
+func rewriteLog(path string, lines []scannedLine, codec message.Codec) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".migrate-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	baseID := 0
+	for _, line := range lines {
+		if h, err := message.ParseHeader(line.text); line.header && err == nil && h.BaseID > baseID {
+			baseID = h.BaseID
+		}
+	}
+
+	// Every rewritten record carries a persisted ID, and every message keeps
+	// the ID readers gave it before: persisted IDs as written and legacy
+	// lines numbered in order, the way message.Decoder numbers them. Edits
+	// and cursors refer to those IDs. Repaired lines were dropped by readers,
+	// so they are numbered after everything else and moved to the end, which
+	// keeps IDs ascending through the log.
+	ids := message.NewIDAssigner(0)
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintln(w, message.FormatHeader(baseID))
+	var repaired []message.Message
+	for _, line := range lines {
+		if line.header {
+			if h, err := message.ParseHeader(line.text); err == nil {
+				ids.Observe(h.BaseID)
+			}
+			continue
+		}
+		msg := line.msg
+		switch {
+		case line.outcome == LineQuarantined:
+			continue
+		case line.outcome == LineRepaired:
+			repaired = append(repaired, msg)
+			continue
+		case msg.ID > 0:
+			ids.Observe(msg.ID)
+		default:
+			ids.Assign(&msg)
+		}
+		if err := writeRecord(w, codec, msg); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	for _, msg := range repaired {
+		ids.Assign(&msg)
+		if err := writeRecord(w, codec, msg); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeRecord writes msg to w as a line encoded with codec.
+func writeRecord(w *bufio.Writer, codec message.Codec, msg message.Message) error {
+	record, err := codec.FormatLine(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, record)
+	return err
+}
+
+// writeQuarantine stores the raw text of every quarantined line so nothing
+// is lost, even when it cannot be parsed.
+func writeQuarantine(path string, lines []scannedLine) error {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		if line.outcome == LineQuarantined {
+			fmt.Fprintln(w, line.text)
+		}
+	}
+	return w.Flush()
+}
+
+// copyFile copies src to a new file at dst, refusing to overwrite dst.
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
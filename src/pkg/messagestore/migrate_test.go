@@ -0,0 +1,167 @@
+package messagestore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyLog mirrors the history found in the original messages.txt: early
+// untimed entries, bracketed lines and a line nothing can recover.
+const legacyLog = "alice: Hello World\n" +
+	"test: Final test\n" +
+	"\n" +
+	"[2025-10-16 23:05:55] alice: Hello unified app!\n" +
+	"### corrupted ###\n" +
+	"[2025-10-16 23:16:51] bob: Hello from Bob!\n"
+
+func TestMigrateDryRunReportsWithoutWriting(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte(legacyLog), 0644), "Setup failed")
+
+	report, err := NewFileStore(filePath).Migrate(context.Background(), MigrateOptions{DryRun: true})
+	require.NoError(t, err)
+
+	require.Equal(t, 5, report.Lines)
+	require.Equal(t, 2, report.Converted)
+	require.Equal(t, 2, report.Repaired)
+	require.Equal(t, 1, report.Quarantined)
+	require.Len(t, report.Issues, 3, "Repaired and quarantined lines should be reported")
+	require.Equal(t, 5, report.Issues[2].Line, "Issues should carry the original line number")
+	require.False(t, report.Rewritten)
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, legacyLog, string(content), "Dry run must not modify the log")
+}
+
+func TestMigrateRewritesLogWithBackup(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte(legacyLog), 0644), "Setup failed")
+	store := NewFileStore(filePath)
+
+	report, err := store.Migrate(ctx, MigrateOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Rewritten)
+
+	backup, err := os.ReadFile(report.BackupPath)
+	require.NoError(t, err, "Backup should exist")
+	require.Equal(t, legacyLog, string(backup), "Backup should hold the original content")
+
+	quarantine, err := os.ReadFile(report.QuarantinePath)
+	require.NoError(t, err, "Quarantine file should exist")
+	require.Equal(t, "### corrupted ###\n", string(quarantine))
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	require.True(t, message.IsHeader(lines[0]), "Rewritten log should start with a header")
+
+	messages, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, messages, 4, "No recoverable history should be lost")
+	require.Equal(t, "Hello World", messages[2].Message, "Repaired entries should follow the messages readers already saw")
+	require.Equal(t, messages[0].Timestamp, messages[2].Timestamp,
+		"Untimed entries should inherit the next known timestamp")
+	for i, m := range messages {
+		require.Equal(t, i+1, m.ID, "Rewritten records should carry persisted IDs")
+	}
+	require.Contains(t, string(content), `"id":4`, "IDs should be written to the log")
+
+	// A second run finds nothing left to do.
+	report, err = store.Migrate(ctx, MigrateOptions{})
+	require.NoError(t, err)
+	require.False(t, report.Rewritten)
+	require.Equal(t, 4, report.Current)
+}
+
+func TestMigrateKeepsMessageIDs(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte(legacyLog), 0644), "Setup failed")
+	store := NewFileStore(filePath)
+	for _, text := range []string{"first JSON record", "second JSON record"} {
+		_, err := store.Append(ctx, message.Message{User: "carol", Message: text, Timestamp: time.Now()})
+		require.NoError(t, err, "Setup failed")
+	}
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err, "Setup failed")
+	_, err = f.WriteString("dave: untimed after JSON\n")
+	require.NoError(t, err, "Setup failed")
+	require.NoError(t, f.Close(), "Setup failed")
+	_, err = store.Edit(ctx, 2, "Hello from Bob, edited")
+	require.NoError(t, err, "Setup failed")
+
+	before, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4}, messageIDs(before), "Setup failed")
+
+	_, err = store.Migrate(ctx, MigrateOptions{})
+	require.NoError(t, err)
+
+	after, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7}, messageIDs(after), "IDs should stay unique and ascending")
+	require.Equal(t, before, after[:len(before)], "Every message should keep the ID readers gave it")
+	require.Equal(t, "Hello from Bob, edited", after[1].Message, "Edits should stay with their message")
+	for _, m := range after[len(before):] {
+		require.Contains(t, []string{"Hello World", "Final test", "untimed after JSON"}, m.Message,
+			"Repaired entries should get new IDs after the existing ones")
+	}
+
+	saved, err := store.Append(ctx, message.Message{User: "erin", Message: "after migration", Timestamp: time.Now()})
+	require.NoError(t, err)
+	require.Equal(t, 8, saved.ID)
+}
+
+func TestMigrateRefusesNewerFormat(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	content := `{"format":"cgi-messages","version":99}` + "\n" + "something new\n"
+	require.NoError(t, os.WriteFile(filePath, []byte(content), 0644), "Setup failed")
+
+	_, err := NewFileStore(filePath).Migrate(context.Background(), MigrateOptions{})
+	require.ErrorIs(t, err, message.ErrUnsupportedVersion)
+}
+
+func TestMigrateResealsUnderActiveKey(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "messages.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("[2025-10-16 23:05:55] alice: plain\n"), 0644), "Setup failed")
+	_, err := NewEncryptedFileStore(filePath, testKeys(t, "k1")).Append(ctx, message.Message{User: "bob", Message: "under k1", Timestamp: time.Now()})
+	require.NoError(t, err, "Setup failed")
+
+	report, err := NewFileStore(filePath).Migrate(ctx, MigrateOptions{DryRun: true})
+	require.ErrorIs(t, err, message.ErrSealed, "Sealed records must never be quarantined for lack of a key")
+	require.False(t, report.Rewritten)
+
+	rotated := NewEncryptedFileStore(filePath, testKeys(t, "k1", "k2"))
+	report, err = rotated.Migrate(ctx, MigrateOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Converted)
+	require.Equal(t, 1, report.Resealed)
+	require.True(t, report.Rewritten)
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	require.Len(t, lines, 3)
+	codec := message.Codec{Keys: testKeys(t, "k1", "k2")}
+	for _, line := range lines[1:] {
+		require.True(t, codec.Current(line), "Every record should be sealed under k2: %s", line)
+	}
+
+	messages, err := NewEncryptedFileStore(filePath, testKeys(t, "k2")).List(ctx)
+	require.NoError(t, err, "The retired key is no longer needed")
+	require.Equal(t, []int{1, 2}, messageIDs(messages))
+
+	report, err = rotated.Migrate(ctx, MigrateOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Current, "A second run has nothing left to do")
+}
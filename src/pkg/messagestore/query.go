@@ -0,0 +1,252 @@
+package messagestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+)
+
+const (
+	// DefaultQueryLimit is the page size used when Query.Limit is not set.
+	DefaultQueryLimit = 100
+	// MaxQueryLimit caps Query.Limit.
+	MaxQueryLimit = 1000
+)
+
+// queryBatch is how many messages Find reads from the store at a time.
+const queryBatch = 256
+
+// ErrInvalidCursor is returned for cursors that are not message IDs.
+var ErrInvalidCursor = errors.New("invalid message cursor")
+
+// Query filters and pages the messages returned by Find.
+type Query struct {
+	// User keeps only messages written by this user. Empty matches every
+	// user.
+	User string
+	// Since and Until keep only messages with Since <= Timestamp < Until.
+	// Zero values are unbounded.
+	Since, Until time.Time
+	// After and Before keep only messages with After < ID < Before. Zero
+	// values are unbounded.
+	After, Before int
+	// Limit is the maximum number of messages returned; zero means
+	// DefaultQueryLimit.
+	Limit int
+	// Descending returns the newest messages first.
+	Descending bool
+}
+
+// Page is one page of Find results.
+type Page struct {
+	// Messages are in write order, or newest first if the query is
+	// descending.
+	Messages []message.Message `json:"messages"`
+	// NextCursor fetches the next page when passed to ParseCursor and used
+	// as After, or Before if descending; it is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ParseCursor returns the message ID a NextCursor stands for.
+func ParseCursor(cursor string) (int, error) {
+	id, err := strconv.Atoi(cursor)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+	return id, nil
+}
+
+// limit returns the page size the query asks for, within MaxQueryLimit.
+func (q Query) limit() int {
+	if q.Limit <= 0 {
+		return DefaultQueryLimit
+	}
+	return min(q.Limit, MaxQueryLimit)
+}
+
+// matches reports whether msg passes the user and time filters.
+func (q Query) matches(msg message.Message) bool {
+	if q.User != "" && msg.User != q.User {
+		return false
+	}
+	if !q.Since.IsZero() && msg.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !msg.Timestamp.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// errPageFull stops the Scan of Find once its page is complete.
+var errPageFull = errors.New("page full")
+
+// Find returns a page of the messages in store matching q. The page is
+// complete, and gets a NextCursor pointing past its last message, once a
+// matching message arrives when q's limit is already held.
+func Find(ctx context.Context, store MessageStore, q Query) (Page, error) {
+	limit := q.limit()
+	page := Page{Messages: []message.Message{}}
+	err := Scan(ctx, store, q, func(msg message.Message) error {
+		if len(page.Messages) == limit {
+			page.NextCursor = strconv.Itoa(page.Messages[limit-1].ID)
+			return errPageFull
+		}
+		page.Messages = append(page.Messages, msg)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		return Page{}, err
+	}
+	return page, nil
+}
+
+// Scan calls fn with every message in store matching q, in the order Find
+// returns them, ignoring q.Limit. It stops at, and returns, the first error
+// fn returns. IDs grow in write order, so the cursors are located by binary
+// search and only the messages from there on are read, in batches as fn
+// consumes them. Stores that index their log, like FileStore and
+// SegmentStore, search their index and read only those lines; the user and
+// time filters still read every message they skip.
+func Scan(ctx context.Context, store MessageStore, q Query, fn func(msg message.Message) error) error {
+	count, positions, err := locateIDs(ctx, store, q.After+1, q.Before)
+	if err != nil {
+		return err
+	}
+	// Positions [start, end) hold the messages between the ID cursors
+	start, end := 0, count
+	if q.After > 0 {
+		start = positions[0]
+	}
+	if q.Before > 0 {
+		end = positions[1]
+	}
+
+	for start < end {
+		offset, n := start, min(queryBatch, end-start)
+		if q.Descending {
+			offset = end - n
+		}
+		batch, err := store.Range(ctx, offset, n)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			// The store shrank underneath us
+			break
+		}
+		if q.Descending {
+			end = offset
+			slices.Reverse(batch)
+		} else {
+			start = offset + len(batch)
+		}
+		for _, msg := range batch {
+			if !q.matches(msg) {
+				continue
+			}
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// idLocator is implemented by stores that locate IDs by searching their
+// offset index directly, opening it once under a single reader lock,
+// rather than through a Range call per probe.
+type idLocator interface {
+	// locate returns the number of messages and, for each of ids, the
+	// position of the first message whose ID is at least it, or the number
+	// of messages if there is none.
+	locate(ctx context.Context, ids ...int) (count int, positions []int, err error)
+}
+
+// locateIDs returns the number of messages in store and, for each of ids,
+// the position of the first message whose ID is at least it, or the number
+// of messages if there is none. Stores without an index are probed through
+// Range.
+func locateIDs(ctx context.Context, store MessageStore, ids ...int) (int, []int, error) {
+	if locator, ok := store.(idLocator); ok {
+		return locator.locate(ctx, ids...)
+	}
+
+	read := func(offset, limit int) ([]message.Message, error) {
+		return store.Range(ctx, offset, limit)
+	}
+	count, err := countMessages(read)
+	if err != nil {
+		return 0, nil, err
+	}
+	positions := make([]int, len(ids))
+	for i, id := range ids {
+		if positions[i], err = searchID(read, count, id); err != nil {
+			return 0, nil, err
+		}
+	}
+	return count, positions, nil
+}
+
+// countMessages returns the number of messages read can return by probing
+// it with doubling, then halving, offsets.
+func countMessages(read rangeFunc) (int, error) {
+	exists := func(position int) (bool, error) {
+		messages, err := read(position, 1)
+		return len(messages) > 0, err
+	}
+
+	// Position lo holds a message and position hi does not
+	lo, hi := -1, 0
+	for {
+		ok, err := exists(hi)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		lo, hi = hi, hi*2+1
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := exists(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi, nil
+}
+
+// searchID returns the position of the first of the count messages read
+// returns whose ID is at least id, or count if there is none.
+func searchID(read rangeFunc, count, id int) (int, error) {
+	lo, hi := 0, count
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		messages, err := read(mid, 1)
+		if err != nil {
+			return 0, err
+		}
+		if len(messages) == 0 {
+			hi = mid
+			continue
+		}
+		if messages[0].ID < id {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
@@ -0,0 +1,189 @@
+package messagestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFind(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2026, 10, 16, 9, 0, 0, 0, time.UTC)
+	at := func(minute int) time.Time { return start.Add(time.Duration(minute) * time.Minute) }
+
+	testCases := []struct {
+		name   string
+		query  Query
+		expect []int
+		next   string
+	}{
+		{name: "first_page", query: Query{Limit: 4}, expect: []int{6, 7, 8, 9}, next: "9"},
+		{name: "next_page", query: Query{Limit: 4, After: 9}, expect: []int{10, 11, 12, 13}, next: "13"},
+		{name: "last_page", query: Query{Limit: 4, After: 21}, expect: []int{22, 23, 24, 25}},
+		{name: "descending", query: Query{Limit: 3, Descending: true}, expect: []int{25, 24, 23}, next: "23"},
+		{name: "descending_next_page", query: Query{Limit: 3, Before: 23, Descending: true}, expect: []int{22, 21, 20}, next: "20"},
+		{name: "between_cursors", query: Query{After: 10, Before: 14}, expect: []int{11, 12, 13}},
+		{name: "cursor_past_end", query: Query{After: 99}, expect: []int{}},
+		{name: "user", query: Query{User: "bob", Limit: 3}, expect: []int{7, 10, 13}, next: "13"},
+		{name: "user_descending", query: Query{User: "bob", Before: 13, Descending: true}, expect: []int{10, 7}},
+		{name: "time_range", query: Query{Since: at(3), Until: at(6)}, expect: []int{9, 10, 11}},
+		{name: "all_filters", query: Query{User: "alice", Since: at(2), Until: at(12), After: 9, Limit: 2}, expect: []int{12, 15}},
+		{name: "default_limit", query: Query{}, expect: []int{6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25}},
+	}
+
+	for _, factory := range storeFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			store := factory.new(t)
+			// Cleared messages keep IDs and positions apart
+			for i := 0; i < 5; i++ {
+				_, err := store.Append(ctx, message.Message{User: "setup", Message: "cleared", Timestamp: start})
+				require.NoError(t, err, "Setup failed")
+			}
+			require.NoError(t, store.Clear(ctx), "Setup failed")
+			users := []string{"alice", "bob", "carol"}
+			for i := 0; i < 20; i++ {
+				_, err := store.Append(ctx, message.Message{
+					User:      users[i%len(users)],
+					Message:   fmt.Sprintf("message %d", i),
+					Timestamp: at(i),
+				})
+				require.NoError(t, err, "Setup failed")
+			}
+
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					page, err := Find(ctx, store, tc.query)
+					require.NoError(t, err)
+					require.Equal(t, tc.expect, messageIDs(page.Messages))
+					require.Equal(t, tc.next, page.NextCursor)
+				})
+			}
+		})
+	}
+
+	empty, err := Find(ctx, NewMemoryStore(), Query{Descending: true})
+	require.NoError(t, err)
+	require.Empty(t, empty.Messages)
+	require.Empty(t, empty.NextCursor)
+}
+
+func TestFindPagesThroughLargeLogs(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for i := 0; i < 3*queryBatch+7; i++ {
+		_, err := store.Append(ctx, message.Message{User: "alice", Message: "m", Timestamp: time.Now()})
+		require.NoError(t, err, "Setup failed")
+	}
+
+	for _, descending := range []bool{false, true} {
+		var ids []int
+		q := Query{Limit: 100, Descending: descending}
+		for {
+			page, err := Find(ctx, store, q)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(page.Messages), 100)
+			ids = append(ids, messageIDs(page.Messages)...)
+			if page.NextCursor == "" {
+				break
+			}
+			cursor, err := ParseCursor(page.NextCursor)
+			require.NoError(t, err)
+			if descending {
+				q.Before = cursor
+			} else {
+				q.After = cursor
+			}
+		}
+		require.Len(t, ids, 3*queryBatch+7, "Paging should visit every message once")
+	}
+
+	require.Equal(t, MaxQueryLimit, Query{Limit: MaxQueryLimit + 1}.limit())
+	_, err := ParseCursor("abc")
+	require.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for i := 0; i < queryBatch+10; i++ {
+		_, err := store.Append(ctx, message.Message{User: "alice", Message: "m", Timestamp: time.Now()})
+		require.NoError(t, err, "Setup failed")
+	}
+
+	var ids []int
+	err := Scan(ctx, store, Query{After: 5, Limit: 1, Descending: true}, func(msg message.Message) error {
+		ids = append(ids, msg.ID)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, ids, queryBatch+5, "Scan should ignore the limit")
+	require.Equal(t, queryBatch+10, ids[0])
+	require.Equal(t, 6, ids[len(ids)-1])
+
+	stop := errors.New("stop")
+	visited := 0
+	err = Scan(ctx, store, Query{}, func(msg message.Message) error {
+		visited++
+		if visited == 3 {
+			return stop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, stop)
+	require.Equal(t, 3, visited)
+}
+
+func TestLocateIDsSearchesTheIndex(t *testing.T) {
+	ctx := context.Background()
+	ids := []int{0, 1, 2, 3, 5, 8, 9, 10, 11, 42}
+
+	for _, factory := range storeFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			store := factory.new(t)
+			if _, ok := store.(idLocator); !ok {
+				t.Skip("The store has no index to search")
+			}
+			// Embedding hides locate, so this one is probed through Range
+			probed := struct{ MessageStore }{store}
+
+			check := func(t *testing.T) {
+				t.Helper()
+				count, positions, err := locateIDs(ctx, store, ids...)
+				require.NoError(t, err)
+				wantCount, wantPositions, err := locateIDs(ctx, probed, ids...)
+				require.NoError(t, err)
+				require.Equal(t, wantCount, count)
+				require.Equal(t, wantPositions, positions)
+			}
+
+			t.Run("empty", check)
+			appendN(t, store, 10)
+			t.Run("filled", check)
+			switch store := store.(type) {
+			case *FileStore:
+				require.NoError(t, os.Remove(store.IndexPath()))
+			case *SegmentStore:
+				segments, err := store.segments()
+				require.NoError(t, err)
+				for _, seg := range segments {
+					require.NoError(t, os.Remove(seg.indexPath()))
+				}
+			}
+			t.Run("rebuilt", check)
+			if segments, ok := store.(*SegmentStore); ok {
+				first, err := segments.segments()
+				require.NoError(t, err)
+				require.NoError(t, removeSegment(first[0]))
+				t.Run("retention", check)
+			}
+			require.NoError(t, store.Clear(ctx))
+			t.Run("cleared", check)
+		})
+	}
+}
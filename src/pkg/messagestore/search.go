@@ -0,0 +1,629 @@
+package messagestore
+
+import (
+	"context"
+	"errors"
+	"html"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+)
+
+const (
+	// snippetWords is the most words a search snippet shows.
+	snippetWords = 24
+	// snippetLead is how many words a snippet shows before the first match.
+	snippetLead = 6
+)
+
+// ErrEmptySearch is returned for search queries without any words.
+var ErrEmptySearch = errors.New("search query has no words")
+
+// SearchQuery selects the messages returned by SearchIndex.Search.
+type SearchQuery struct {
+	// Text is the query. Every word must occur in the message text or user,
+	// in any case; a "quoted phrase" must occur as consecutive words; and a
+	// word ending in * matches every word it begins.
+	Text string
+	// Before keeps only messages with ID < Before. Zero is unbounded.
+	Before int
+	// Limit is the maximum number of hits returned; zero means
+	// DefaultQueryLimit.
+	Limit int
+}
+
+// SearchHit is a message matching a search.
+type SearchHit struct {
+	Message message.Message `json:"message"`
+	// Snippet is an HTML excerpt of the text around the first match with
+	// every match wrapped in <mark>; the text itself is escaped.
+	Snippet string `json:"snippet"`
+}
+
+// SearchPage is one page of search hits, newest first.
+type SearchPage struct {
+	Hits []SearchHit `json:"hits"`
+	// NextCursor fetches the next page when passed to ParseCursor and used
+	// as Before; it is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// SearchIndex is a MessageStore that keeps an inverted index over the text
+// and user of the messages of another store, along with the messages
+// themselves. Messages appended, edited or removed through it are indexed as
+// they are written. Before each search, messages appended by other processes
+// sharing the log are indexed, messages whose edit log entries changed are
+// read again, and messages cleared or dropped by retention are forgotten.
+//
+// The index lives in memory and is built by the first search, without
+// holding up writes: the whole log is read into a fresh index that is then
+// swapped in, and what was written meanwhile is caught up with like changes
+// made by other processes. Edits and deletes drop the postings of the text
+// they replace, so the index only ever holds the live messages.
+type SearchIndex struct {
+	MessageStore
+
+	build sync.Mutex // held while the first search builds the index
+	mu    sync.Mutex // guards built and ix
+	built bool
+	ix    *invertedIndex
+}
+
+// invertedIndex is the data of a SearchIndex.
+type invertedIndex struct {
+	store    MessageStore
+	lastID   int                     // highest message ID indexed
+	floor    int                     // lowest message ID still stored
+	docs     map[int]message.Message // live messages by ID, without history
+	postings map[string][]int        // message IDs by word, ascending
+	terms    []string                // the words in postings, sorted for prefix queries
+
+	// The edit log as of the last catch up, for stores that keep one
+	editsInfo os.FileInfo
+	applied   map[int]int // changes per message ID reflected in docs
+}
+
+// editLogger is implemented by stores keeping their changes in an edit log
+// other processes may append to.
+type editLogger interface {
+	editLog() editLog
+}
+
+// NewSearchIndex returns a SearchIndex over store.
+func NewSearchIndex(store MessageStore) *SearchIndex {
+	return &SearchIndex{MessageStore: store, ix: newInvertedIndex(store)}
+}
+
+// newInvertedIndex returns an empty index over store.
+func newInvertedIndex(store MessageStore) *invertedIndex {
+	return &invertedIndex{
+		store:    store,
+		docs:     map[int]message.Message{},
+		postings: map[string][]int{},
+		applied:  map[int]int{},
+	}
+}
+
+// Append appends msg to the store and indexes it.
+func (s *SearchIndex) Append(ctx context.Context, msg message.Message) (message.Message, error) {
+	saved, err := s.MessageStore.Append(ctx, msg)
+	if err != nil {
+		return saved, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Messages appended in between are left for the next catch up
+	if s.built && saved.ID == s.ix.lastID+1 {
+		s.ix.add(saved)
+		s.ix.lastID = saved.ID
+	}
+	return saved, nil
+}
+
+// locate locates IDs in the store, so Find and Scan over the index search
+// the store's own index.
+func (s *SearchIndex) locate(ctx context.Context, ids ...int) (int, []int, error) {
+	return locateIDs(ctx, s.MessageStore, ids...)
+}
+
+// Remove deletes message id from the store and forgets it.
+func (s *SearchIndex) Remove(ctx context.Context, id int) error {
+	if err := s.MessageStore.Remove(ctx, id); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ix.docs[id]; ok {
+		s.ix.remove(id)
+		s.ix.applied[id]++
+	}
+	return nil
+}
+
+// Edit replaces the text of message id and indexes the new text.
+func (s *SearchIndex) Edit(ctx context.Context, id int, text string) (message.Message, error) {
+	edited, err := s.MessageStore.Edit(ctx, id, text)
+	if err != nil {
+		return edited, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ix.docs[id]; ok {
+		s.ix.add(edited)
+		s.ix.applied[id]++
+	}
+	return edited, nil
+}
+
+// Clear removes every message from the store and the index.
+func (s *SearchIndex) Clear(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.MessageStore.Clear(ctx); err != nil {
+		return err
+	}
+	// IDs keep growing after a clear, so lastID stays
+	ix := newInvertedIndex(s.MessageStore)
+	ix.lastID, ix.floor = s.ix.lastID, s.ix.floor
+	ix.editsInfo = s.ix.editsInfo
+	s.ix = ix
+	return nil
+}
+
+// Search returns a page of the messages matching q, newest first. Hits are
+// checked against and returned from the indexed messages, so the store is
+// only read to catch up with changes made by other processes.
+func (s *SearchIndex) Search(ctx context.Context, q SearchQuery) (SearchPage, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	clauses := parseSearch(q.Text)
+	if len(clauses) == 0 {
+		return SearchPage{}, ErrEmptySearch
+	}
+	if err := s.buildIndex(ctx); err != nil {
+		return SearchPage{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ix.catchUp(ctx, false); err != nil {
+		return SearchPage{}, err
+	}
+	candidates := s.ix.candidates(clauses)
+
+	limit := Query{Limit: q.Limit}.limit()
+	page := SearchPage{Hits: []SearchHit{}}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		id := candidates[i]
+		if q.Before > 0 && id >= q.Before {
+			continue
+		}
+		// Postings are per word, so phrases are matched here
+		snippet, ok := matchSearch(clauses, s.ix.docs[id])
+		if !ok {
+			continue
+		}
+		if len(page.Hits) == limit {
+			page.NextCursor = strconv.Itoa(page.Hits[limit-1].Message.ID)
+			break
+		}
+		m := s.ix.docs[id]
+		m.TraceID = traceID
+		page.Hits = append(page.Hits, SearchHit{Message: m, Snippet: snippet})
+	}
+
+	slog.InfoContext(ctx, "Messages searched",
+		"query", q.Text,
+		"candidates", len(candidates),
+		"hits", len(page.Hits),
+		"traceID", traceID)
+
+	return page, nil
+}
+
+// buildIndex reads the whole store into a fresh index and swaps it in, the
+// first time it is called. s.mu is only held for the swap, so writes go on
+// meanwhile and are picked up by the next catch up.
+func (s *SearchIndex) buildIndex(ctx context.Context) error {
+	s.build.Lock()
+	defer s.build.Unlock()
+	s.mu.Lock()
+	built := s.built
+	s.mu.Unlock()
+	if built {
+		return nil
+	}
+
+	ix := newInvertedIndex(s.MessageStore)
+	if err := ix.catchUp(ctx, true); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ix, s.built = ix, true
+	return nil
+}
+
+// catchUp brings the index up to date with changes other processes made to
+// the store: it reads messages whose edit log entries changed again, forgets
+// messages no longer stored and indexes the messages appended since the
+// last one indexed. A fresh index is read in full. The index must not be
+// used by anyone else meanwhile.
+func (ix *invertedIndex) catchUp(ctx context.Context, fresh bool) error {
+	read := func(offset, limit int) ([]message.Message, error) {
+		return ix.store.Range(ctx, offset, limit)
+	}
+	// Changes are looked at first: messages appended afterwards are read
+	// with every change made so far
+	refreshed, err := ix.refreshChanged(ctx, fresh)
+	if err != nil {
+		return err
+	}
+
+	// Clearing and retention remove the oldest messages
+	first, err := read(0, 1)
+	if err != nil {
+		return err
+	}
+	floor := ix.lastID + 1
+	if len(first) > 0 {
+		floor = first[0].ID
+	}
+	forgotten := 0
+	if floor > ix.floor {
+		for id := range ix.docs {
+			if id < floor {
+				ix.remove(id)
+				forgotten++
+			}
+		}
+		ix.floor = floor
+	}
+
+	count, positions, err := locateIDs(ctx, ix.store, ix.lastID+1)
+	if err != nil {
+		return err
+	}
+	pos := positions[0]
+
+	indexed := 0
+	for pos < count {
+		batch, err := read(pos, queryBatch)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, m := range batch {
+			if m.ID > ix.lastID {
+				ix.add(m)
+				ix.lastID = m.ID
+				indexed++
+			}
+		}
+		pos += len(batch)
+	}
+
+	if fresh || indexed > 0 || refreshed > 0 || forgotten > 0 {
+		slog.DebugContext(ctx, "Search index caught up",
+			"indexed", indexed,
+			"refreshed", refreshed,
+			"forgotten", forgotten,
+			"terms", len(ix.terms),
+			"lastID", ix.lastID)
+	}
+	return nil
+}
+
+// refreshChanged reads the indexed messages whose number of changes in the
+// store's edit log differs from what the index reflects again, and returns
+// how many it read. Unless the index is fresh, the edit log is only loaded
+// once its size or modification time changed.
+func (ix *invertedIndex) refreshChanged(ctx context.Context, fresh bool) (int, error) {
+	logger, ok := ix.store.(editLogger)
+	if !ok {
+		return 0, nil
+	}
+	log := logger.editLog()
+	info, err := log.stat()
+	if err != nil || (!fresh && unchanged(ix.editsInfo, info)) {
+		return 0, err
+	}
+	changes, err := log.load()
+	if err != nil {
+		return 0, err
+	}
+
+	refreshed := 0
+	for id, n := range ix.applied {
+		if len(changes[id]) == n {
+			continue
+		}
+		if err := ix.refresh(ctx, id); err != nil {
+			return refreshed, err
+		}
+		refreshed++
+	}
+	applied := make(map[int]int, len(changes))
+	for id, list := range changes {
+		_, seen := ix.applied[id]
+		if _, indexed := ix.docs[id]; indexed && !seen {
+			if err := ix.refresh(ctx, id); err != nil {
+				return refreshed, err
+			}
+			refreshed++
+		}
+		applied[id] = len(list)
+	}
+	ix.editsInfo, ix.applied = info, applied
+	return refreshed, nil
+}
+
+// refresh reads message id from the store again, indexing its text or
+// forgetting it if it was deleted.
+func (ix *invertedIndex) refresh(ctx context.Context, id int) error {
+	m, err := ix.store.Get(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		ix.remove(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ix.add(m)
+	return nil
+}
+
+// add indexes the words of the text and user of m, in place of those of any
+// earlier version, and keeps m as the message with its ID. A deleted m is
+// forgotten.
+func (ix *invertedIndex) add(m message.Message) {
+	ix.remove(m.ID)
+	if m.Deleted {
+		return
+	}
+	m.History, m.TraceID = nil, ""
+	ix.docs[m.ID] = m
+	for _, term := range docTerms(m) {
+		ids, ok := ix.postings[term]
+		if !ok {
+			i, _ := slices.BinarySearch(ix.terms, term)
+			ix.terms = slices.Insert(ix.terms, i, term)
+		}
+		if n := len(ids); n == 0 || ids[n-1] < m.ID {
+			ix.postings[term] = append(ids, m.ID)
+			continue
+		}
+		// Edits index older messages again
+		if i, found := slices.BinarySearch(ids, m.ID); !found {
+			ix.postings[term] = slices.Insert(ids, i, m.ID)
+		}
+	}
+}
+
+// remove forgets message id and drops it from the postings of its words,
+// dropping words no other message holds.
+func (ix *invertedIndex) remove(id int) {
+	m, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+	delete(ix.docs, id)
+	for _, term := range docTerms(m) {
+		ids := ix.postings[term]
+		i, found := slices.BinarySearch(ids, id)
+		if !found {
+			continue
+		}
+		if ids = slices.Delete(ids, i, i+1); len(ids) > 0 {
+			ix.postings[term] = ids
+			continue
+		}
+		delete(ix.postings, term)
+		if i, found := slices.BinarySearch(ix.terms, term); found {
+			ix.terms = slices.Delete(ix.terms, i, i+1)
+		}
+	}
+}
+
+// docTerms returns the distinct words of the text and user of m.
+func docTerms(m message.Message) []string {
+	var terms []string
+	for _, tok := range append(tokenize(m.Message), tokenize(m.User)...) {
+		terms = append(terms, tok.term)
+	}
+	slices.Sort(terms)
+	return slices.Compact(terms)
+}
+
+// candidates returns the IDs, ascending, of the messages holding every word
+// of clauses.
+func (ix *invertedIndex) candidates(clauses [][]searchTerm) []int {
+	var ids []int
+	first := true
+	for _, clause := range clauses {
+		for _, term := range clause {
+			matched := ix.lookup(term)
+			if first {
+				ids, first = matched, false
+			} else {
+				ids = intersect(ids, matched)
+			}
+			if len(ids) == 0 {
+				return nil
+			}
+		}
+	}
+	return ids
+}
+
+// lookup returns the IDs, ascending, of the messages holding term.
+func (ix *invertedIndex) lookup(term searchTerm) []int {
+	if !term.prefix {
+		return ix.postings[term.text]
+	}
+	var ids []int
+	i, _ := slices.BinarySearch(ix.terms, term.text)
+	for ; i < len(ix.terms) && strings.HasPrefix(ix.terms[i], term.text); i++ {
+		ids = append(ids, ix.postings[ix.terms[i]]...)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+// intersect returns the IDs in both ascending slices a and b.
+func intersect(a, b []int) []int {
+	var ids []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			ids = append(ids, a[i])
+			i++
+			j++
+		}
+	}
+	return ids
+}
+
+// token is a word of a text: its lower case form and its byte offsets.
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits s into words: runs of letters and digits.
+func tokenize(s string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range s {
+		word := unicode.IsLetter(r) || unicode.IsNumber(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			tokens = append(tokens, token{term: strings.ToLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{term: strings.ToLower(s[start:]), start: start, end: len(s)})
+	}
+	return tokens
+}
+
+// searchTerm is a word of a search query.
+type searchTerm struct {
+	text   string
+	prefix bool // matches every word text begins
+}
+
+// parseSearch splits a search query into clauses, each a single word or a
+// phrase of consecutive words. A quote left open runs to the end of the
+// query; words joined by punctuation, like e-mail, form a phrase.
+func parseSearch(text string) [][]searchTerm {
+	var clauses [][]searchTerm
+	for i, part := range strings.Split(text, `"`) {
+		fields := strings.Fields(part)
+		if i%2 == 1 {
+			fields = []string{part}
+		}
+		for _, field := range fields {
+			tokens := tokenize(field)
+			if len(tokens) == 0 {
+				continue
+			}
+			clause := make([]searchTerm, len(tokens))
+			for j, tok := range tokens {
+				clause[j] = searchTerm{text: tok.term}
+			}
+			clause[len(clause)-1].prefix = strings.HasSuffix(strings.TrimSpace(field), "*")
+			clauses = append(clauses, clause)
+		}
+	}
+	return clauses
+}
+
+// matchAt returns the positions in tokens where clause starts.
+func matchAt(tokens []token, clause []searchTerm) []int {
+	var starts []int
+	for i := 0; i+len(clause) <= len(tokens); i++ {
+		matched := true
+		for j, term := range clause {
+			word := tokens[i+j].term
+			if word != term.text && !(term.prefix && strings.HasPrefix(word, term.text)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+// matchSearch reports whether every clause occurs in the text or user of m
+// and returns the snippet of its text highlighting the matches.
+func matchSearch(clauses [][]searchTerm, m message.Message) (string, bool) {
+	text, user := tokenize(m.Message), tokenize(m.User)
+	marked := make([]bool, len(text))
+	for _, clause := range clauses {
+		starts := matchAt(text, clause)
+		if len(starts) == 0 && len(matchAt(user, clause)) == 0 {
+			return "", false
+		}
+		for _, start := range starts {
+			for i := start; i < start+len(clause); i++ {
+				marked[i] = true
+			}
+		}
+	}
+	return snippet(m.Message, text, marked), true
+}
+
+// snippet returns up to snippetWords words of text, starting a little before
+// the first marked token, HTML escaped with the marked tokens in <mark>.
+func snippet(text string, tokens []token, marked []bool) string {
+	first := slices.Index(marked, true)
+	start := max(0, first-snippetLead)
+	end := min(len(tokens), start+snippetWords)
+
+	var b strings.Builder
+	pos := 0
+	if start > 0 {
+		b.WriteString("…")
+		pos = tokens[start].start
+	}
+	for i := start; i < end; i++ {
+		tok := tokens[i]
+		b.WriteString(html.EscapeString(text[pos:tok.start]))
+		word := html.EscapeString(text[tok.start:tok.end])
+		if marked[i] {
+			word = "<mark>" + word + "</mark>"
+		}
+		b.WriteString(word)
+		pos = tok.end
+	}
+	if end < len(tokens) {
+		b.WriteString("…")
+	} else {
+		b.WriteString(html.EscapeString(text[pos:]))
+	}
+	return b.String()
+}
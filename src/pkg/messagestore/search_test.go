@@ -0,0 +1,290 @@
+package messagestore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchIndex(t *testing.T) {
+	ctx := context.Background()
+	texts := []struct{ user, text string }{
+		{"alice", "Deploy the new build to staging"},
+		{"bob", "The staging build is broken again"},
+		{"alice", "Rolled back: build 42 broke the deploy"},
+		{"carol", "Lunch at noon? <b>Pizza</b> & salad"},
+		{"bob", "Café opens at 8"},
+	}
+
+	testCases := []struct {
+		name    string
+		query   string
+		expect  []int
+		snippet string // of the first hit, if set
+	}{
+		{name: "word", query: "staging", expect: []int{2, 1}, snippet: "The <mark>staging</mark> build is broken again"},
+		{name: "every_word", query: "build deploy", expect: []int{3, 1}},
+		{name: "any_case", query: "BUILD Staging", expect: []int{2, 1}},
+		{name: "phrase", query: `"staging build"`, expect: []int{2}, snippet: "The <mark>staging</mark> <mark>build</mark> is broken again"},
+		{name: "phrase_in_order", query: `"build staging"`, expect: []int{}},
+		{name: "prefix", query: "bro*", expect: []int{3, 2}, snippet: "Rolled back: build 42 <mark>broke</mark> the deploy"},
+		{name: "phrase_prefix", query: `"build is bro*"`, expect: []int{2}},
+		{name: "user", query: "alice", expect: []int{3, 1}, snippet: "Rolled back: build 42 broke the deploy"},
+		{name: "user_and_word", query: "bob build", expect: []int{2}},
+		{name: "number", query: "42", expect: []int{3}},
+		{name: "unicode", query: "café", expect: []int{5}},
+		{name: "escaped", query: "pizza", expect: []int{4}, snippet: "Lunch at noon? &lt;b&gt;<mark>Pizza</mark>&lt;/b&gt; &amp; salad"},
+		{name: "no_match", query: "production", expect: []int{}},
+	}
+
+	for _, factory := range storeFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			inner := factory.new(t)
+			index := NewSearchIndex(inner)
+			for i, m := range texts {
+				store := MessageStore(index)
+				if i%2 == 1 {
+					// Appended by another process
+					store = inner
+				}
+				_, err := store.Append(ctx, message.Message{User: m.user, Message: m.text, Timestamp: time.Now()})
+				require.NoError(t, err, "Setup failed")
+			}
+
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					page, err := index.Search(ctx, SearchQuery{Text: tc.query})
+					require.NoError(t, err)
+					ids := []int{}
+					for _, hit := range page.Hits {
+						ids = append(ids, hit.Message.ID)
+					}
+					require.Equal(t, tc.expect, ids)
+					if tc.snippet != "" {
+						require.Equal(t, tc.snippet, page.Hits[0].Snippet)
+					}
+				})
+			}
+
+			_, err := index.Edit(ctx, 1, "Deploy the new build to production")
+			require.NoError(t, err)
+			require.NoError(t, index.Remove(ctx, 2))
+			_, err = inner.Append(ctx, message.Message{User: "dave", Message: "production is down", Timestamp: time.Now()})
+			require.NoError(t, err)
+			page, err := index.Search(ctx, SearchQuery{Text: "production"})
+			require.NoError(t, err)
+			require.Len(t, page.Hits, 2)
+			require.Equal(t, 6, page.Hits[0].Message.ID)
+			require.Equal(t, 1, page.Hits[1].Message.ID, "Edits should be searchable")
+			page, err = index.Search(ctx, SearchQuery{Text: "staging"})
+			require.NoError(t, err)
+			require.Empty(t, page.Hits, "Neither the old text nor deleted messages should match")
+
+			require.NoError(t, index.Clear(ctx))
+			page, err = index.Search(ctx, SearchQuery{Text: "production"})
+			require.NoError(t, err)
+			require.Empty(t, page.Hits)
+		})
+	}
+}
+
+func TestSearchIndexPages(t *testing.T) {
+	ctx := context.Background()
+	index := NewSearchIndex(NewMemoryStore())
+	for i := 1; i <= 25; i++ {
+		_, err := index.Append(ctx, message.Message{User: "alice", Message: fmt.Sprintf("report %d", i), Timestamp: time.Now()})
+		require.NoError(t, err, "Setup failed")
+	}
+
+	var ids []int
+	q := SearchQuery{Text: "report", Limit: 10}
+	for {
+		page, err := index.Search(ctx, q)
+		require.NoError(t, err)
+		for _, hit := range page.Hits {
+			ids = append(ids, hit.Message.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Before, err = ParseCursor(page.NextCursor)
+		require.NoError(t, err)
+	}
+	require.Len(t, ids, 25)
+	require.Equal(t, 25, ids[0], "Newest first")
+	require.Equal(t, 1, ids[24])
+
+	_, err := index.Search(ctx, SearchQuery{Text: ` "" * - `})
+	require.ErrorIs(t, err, ErrEmptySearch)
+}
+
+func TestSnippetWindow(t *testing.T) {
+	text := "one two three four five six seven eight nine ten eleven twelve thirteen fourteen fifteen sixteen seventeen eighteen nineteen twenty twentyone twentytwo twentythree twentyfour twentyfive twentysix twentyseven twentyeight twentynine thirty"
+	got, ok := matchSearch(parseSearch("ten"), message.Message{Message: text})
+	require.True(t, ok)
+	require.Equal(t, "…four five six seven eight nine <mark>ten</mark> eleven twelve thirteen fourteen fifteen sixteen seventeen eighteen nineteen twenty twentyone twentytwo twentythree twentyfour twentyfive twentysix twentyseven…", got)
+}
+
+func TestSearchIndexFollowsOtherProcesses(t *testing.T) {
+	testCases := []struct {
+		name string
+		new  func(t *testing.T) (mine, other MessageStore)
+	}{
+		{
+			name: "file",
+			new: func(t *testing.T) (MessageStore, MessageStore) {
+				path := filepath.Join(t.TempDir(), "messages.txt")
+				return NewFileStore(path), NewFileStore(path)
+			},
+		},
+		{
+			name: "segmented",
+			new: func(t *testing.T) (MessageStore, MessageStore) {
+				dir := filepath.Join(t.TempDir(), "messages.d")
+				return NewSegmentStore(dir, SegmentOptions{MaxSegmentBytes: 300}), NewSegmentStore(dir, SegmentOptions{MaxSegmentBytes: 300})
+			},
+		},
+	}
+
+	search := func(t *testing.T, index *SearchIndex, text string) []int {
+		t.Helper()
+		page, err := index.Search(context.Background(), SearchQuery{Text: text})
+		require.NoError(t, err)
+		ids := []int{}
+		for _, hit := range page.Hits {
+			ids = append(ids, hit.Message.ID)
+		}
+		return ids
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			mine, other := tc.new(t)
+			index := NewSearchIndex(mine)
+			for _, text := range []string{"staging is green", "staging is red", "lunch"} {
+				_, err := index.Append(ctx, message.Message{User: "alice", Message: text, Timestamp: time.Now()})
+				require.NoError(t, err, "Setup failed")
+			}
+			require.Equal(t, []int{2, 1}, search(t, index, "staging"), "Setup failed")
+
+			_, err := other.Edit(ctx, 3, "staging at lunch")
+			require.NoError(t, err)
+			_, err = other.Edit(ctx, 1, "production is green")
+			require.NoError(t, err)
+			require.NoError(t, other.Remove(ctx, 2))
+			require.Equal(t, []int{3}, search(t, index, "staging"), "Edits and deletes by other processes should be indexed")
+			require.Equal(t, []int{1}, search(t, index, "production"))
+
+			require.NoError(t, other.Clear(ctx))
+			require.Empty(t, search(t, index, "production"), "Messages cleared by other processes should be forgotten")
+		})
+	}
+}
+
+// countingStore counts the reads of the messages of a MessageStore.
+type countingStore struct {
+	MessageStore
+	reads int
+}
+
+func (s *countingStore) Range(ctx context.Context, offset, limit int) ([]message.Message, error) {
+	s.reads++
+	return s.MessageStore.Range(ctx, offset, limit)
+}
+
+func TestSearchIndexServesHitsFromMemory(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{MessageStore: NewMemoryStore()}
+	index := NewSearchIndex(store)
+	for i := 1; i <= 100; i++ {
+		_, err := index.Append(ctx, message.Message{User: "alice", Message: fmt.Sprintf("report %d", i), Timestamp: time.Now()})
+		require.NoError(t, err, "Setup failed")
+	}
+	_, err := index.Search(ctx, SearchQuery{Text: "report"})
+	require.NoError(t, err, "Setup failed")
+
+	store.reads = 0
+	page, err := index.Search(ctx, SearchQuery{Text: "report", Limit: 50})
+	require.NoError(t, err)
+	require.Len(t, page.Hits, 50)
+	require.Less(t, store.reads, len(page.Hits), "Hits should not be read from the store one by one")
+}
+
+func TestSearchIndexDropsReplacedPostings(t *testing.T) {
+	ctx := context.Background()
+	index := NewSearchIndex(NewMemoryStore())
+	for _, text := range []string{"quarterly report draft", "draft agenda"} {
+		_, err := index.Append(ctx, message.Message{User: "alice", Message: text, Timestamp: time.Now()})
+		require.NoError(t, err, "Setup failed")
+	}
+	_, err := index.Search(ctx, SearchQuery{Text: "draft"})
+	require.NoError(t, err, "Setup failed")
+
+	_, err = index.Edit(ctx, 1, "quarterly report final")
+	require.NoError(t, err)
+	require.NoError(t, index.Remove(ctx, 2))
+
+	require.Equal(t, []string{"alice", "final", "quarterly", "report"}, index.ix.terms, "Words only held by replaced text should be dropped")
+	require.NotContains(t, index.ix.postings, "draft")
+	require.NotContains(t, index.ix.postings, "agenda")
+	page, err := index.Search(ctx, SearchQuery{Text: "alice"})
+	require.NoError(t, err)
+	require.Len(t, page.Hits, 1)
+	require.Equal(t, []int{1}, index.ix.postings["alice"])
+}
+
+// blockingStore is a MessageStore whose reads wait until release is closed.
+type blockingStore struct {
+	MessageStore
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Range(ctx context.Context, offset, limit int) ([]message.Message, error) {
+	select {
+	case s.reading <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return s.MessageStore.Range(ctx, offset, limit)
+}
+
+func TestSearchIndexBuildDoesNotBlockWrites(t *testing.T) {
+	ctx := context.Background()
+	store := &blockingStore{MessageStore: NewMemoryStore(), reading: make(chan struct{}), release: make(chan struct{})}
+	index := NewSearchIndex(store)
+	_, err := index.Append(ctx, message.Message{User: "alice", Message: "before the build", Timestamp: time.Now()})
+	require.NoError(t, err, "Setup failed")
+
+	searched := make(chan error, 1)
+	go func() {
+		_, err := index.Search(ctx, SearchQuery{Text: "build"})
+		searched <- err
+	}()
+	<-store.reading
+
+	appended := make(chan error, 1)
+	go func() {
+		_, err := index.Append(ctx, message.Message{User: "bob", Message: "during the build", Timestamp: time.Now()})
+		appended <- err
+	}()
+	select {
+	case err := <-appended:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Append should not wait for the index to be built")
+	}
+
+	close(store.release)
+	require.NoError(t, <-searched)
+	page, err := index.Search(ctx, SearchQuery{Text: "build"})
+	require.NoError(t, err)
+	require.Len(t, page.Hits, 2, "Messages appended during the build should be caught up with")
+	require.Equal(t, 2, page.Hits[0].Message.ID)
+}
@@ -0,0 +1,841 @@
+package messagestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/envelope"
+	"cgi.com/goLangTraining/src/pkg/message"
+)
+
+// ErrNotFound is returned for operations on a message ID that is not stored.
+var ErrNotFound = errors.New("message not found")
+
+const (
+	// segmentSuffix is the extension of segment files. Segments are named
+	// after the first ID they may hold, zero-padded so lexical order is
+	// write order.
+	segmentSuffix = ".log"
+	// segmentLockName is the lock file guarding the whole directory.
+	segmentLockName = ".lock"
+	// segmentEditsName is the edit log of the segments.
+	segmentEditsName = "edits"
+)
+
+// SegmentOptions configures rotation and retention of a SegmentStore. A
+// zero value disables the corresponding limit.
+type SegmentOptions struct {
+	// MaxSegmentBytes seals the active segment once it reaches this size.
+	MaxSegmentBytes int64
+	// MaxSegmentAge seals the active segment once its first message is
+	// older than this.
+	MaxSegmentAge time.Duration
+	// RetentionAge drops sealed segments last written longer ago than this.
+	RetentionAge time.Duration
+	// RetentionBytes drops the oldest sealed segments while the log as a
+	// whole is larger than this.
+	RetentionBytes int64
+	// Keys, when set, seals every record appended or rewritten by
+	// compaction with envelope encryption.
+	Keys *envelope.Keyring
+}
+
+// SegmentStore is a MessageStore that splits the log into segments in a
+// directory. Every segment is a JSON Lines file with its own header and
+// offset index; only the newest, active segment is appended to, and it is
+// sealed and a new one started once it exceeds the size or age limit.
+//
+// Remove leaves a tombstone in the message's place; it and Edit are
+// recorded in an edit log shared by all segments. Compact replaces the
+// records of removed messages in sealed segments by their tombstones and
+// drops their edits, so the text is gone from disk as well. The tombstones
+// themselves are kept, since IDs and positions must stay stable; only
+// retention drops records, by dropping whole sealed segments. Readers
+// span segments transparently, and a directory lock shared by every process
+// serialises writers the same way FileStore does.
+type SegmentStore struct {
+	dir   string
+	opts  SegmentOptions
+	codec message.Codec
+	edits *editCache
+}
+
+// CompactionReport summarises a Compact run. BytesReclaimed counts the
+// segments dropped and what rewritten segments and the edit log shrank by;
+// a segment whose tombstones came out longer than the records they replaced
+// reclaims nothing rather than a negative amount.
+type CompactionReport struct {
+	SegmentsRemoved   int   `json:"segments_removed"`   // dropped by retention
+	SegmentsCompacted int   `json:"segments_compacted"` // rewritten without removed text
+	RecordsScrubbed   int   `json:"records_scrubbed"`   // removed messages replaced by their tombstone
+	EditsDropped      int   `json:"edits_dropped"`      // edit log records no longer needed
+	BytesReclaimed    int64 `json:"bytes_reclaimed"`
+}
+
+// segment is a single segment file of a SegmentStore.
+type segment struct {
+	base int
+	path string
+}
+
+// indexPath returns the location of the segment's offset index.
+func (g segment) indexPath() string {
+	return g.path + ".idx"
+}
+
+// NewSegmentStore returns a SegmentStore keeping its segments in dir. The
+// directory is created lazily on the first Append.
+func NewSegmentStore(dir string, opts SegmentOptions) *SegmentStore {
+	return &SegmentStore{dir: dir, opts: opts, codec: message.Codec{Keys: opts.Keys}, edits: &editCache{}}
+}
+
+// Dir returns the directory holding the segments.
+func (s *SegmentStore) Dir() string {
+	return s.dir
+}
+
+// editLog returns the edit log shared by the segments.
+func (s *SegmentStore) editLog() editLog {
+	return editLog{path: filepath.Join(s.dir, segmentEditsName), codec: s.codec, cache: s.edits}
+}
+
+// editor returns the editor over the segments and their edit log.
+func (s *SegmentStore) editor(ctx context.Context) editor {
+	return editor{
+		log:  s.editLog(),
+		lock: s.lock,
+		read: func(offset, limit int) ([]message.Message, error) {
+			return s.rangeRecords(ctx, offset, limit)
+		},
+		locate: func(ids ...int) (int, []int, error) {
+			return s.locate(ctx, ids...)
+		},
+	}
+}
+
+// lock takes the directory lock. Writers lock exclusively, readers shared.
+func (s *SegmentStore) lock(exclusive bool) (func(), error) {
+	if exclusive {
+		if err := os.MkdirAll(s.dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return acquireLock(filepath.Join(s.dir, segmentLockName), exclusive)
+}
+
+// segments lists the segment files in write order. A missing directory
+// holds no segments.
+func (s *SegmentStore) segments() ([]segment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, err := strconv.Atoi(strings.TrimSuffix(name, segmentSuffix))
+		if err != nil || base < 1 {
+			continue
+		}
+		segments = append(segments, segment{base: base, path: filepath.Join(s.dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].base < segments[j].base })
+	return segments, nil
+}
+
+// newSegment returns the segment whose first ID is base.
+func (s *SegmentStore) newSegment(base int) segment {
+	return segment{base: base, path: filepath.Join(s.dir, fmt.Sprintf("%020d%s", base, segmentSuffix))}
+}
+
+// Append assigns msg the next ID and writes it to the active segment,
+// sealing it first and starting a new one if it has outgrown the limits.
+func (s *SegmentStore) Append(ctx context.Context, msg message.Message) (message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return message.Message{}, err
+	}
+	defer unlock()
+
+	segments, err := s.segments()
+	if err != nil {
+		return message.Message{}, err
+	}
+	active := s.newSegment(1)
+	if len(segments) > 0 {
+		active = segments[len(segments)-1]
+	}
+
+	f, err := os.OpenFile(active.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return message.Message{}, err
+	}
+	defer func() { f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return message.Message{}, err
+	}
+	size := info.Size()
+	last, err := lastID(f, s.codec, size)
+	if err != nil {
+		return message.Message{}, err
+	}
+
+	message.NewIDAssigner(last).Assign(&msg)
+	msg.TraceID = ""
+	// The record is encoded before rotating, so a record that cannot be
+	// written leaves no empty segment behind
+	line, err := s.codec.FormatLine(msg)
+	if err != nil {
+		return message.Message{}, err
+	}
+
+	// A segment is only sealed once it holds a message, so a rotation never
+	// reuses the active segment's name.
+	if last >= active.base && s.shouldRotate(active, f, size) {
+		f.Close()
+		active = s.newSegment(last + 1)
+		if f, err = os.OpenFile(active.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644); err != nil {
+			return message.Message{}, err
+		}
+		size = 0
+		slog.InfoContext(ctx, "Message segment rotated",
+			"segment", active.path,
+			"traceID", traceID)
+	}
+
+	// Every segment starts with a header carrying the last ID before it.
+	var prefix string
+	if size == 0 {
+		prefix = message.FormatHeader(active.base-1) + "\n"
+	}
+	record := prefix + line + "\n"
+
+	if _, err := f.WriteString(record); err != nil {
+		return message.Message{}, err
+	}
+	entry := indexEntry{offset: size + int64(len(prefix)), id: int64(msg.ID)}
+	if err := appendIndex(active.indexPath(), f, s.codec, size, entry, size+int64(len(record))); err != nil {
+		warnIndex(ctx, active.indexPath(), err)
+	}
+
+	slog.InfoContext(ctx, "Message appended to segment",
+		"user", msg.User,
+		"message_id", msg.ID,
+		"segment", active.path,
+		"traceID", traceID)
+
+	msg.TraceID = traceID
+	return msg, nil
+}
+
+// shouldRotate reports whether the active segment held by f has reached the
+// size limit, or holds a first message older than the age limit.
+func (s *SegmentStore) shouldRotate(active segment, f *os.File, size int64) bool {
+	if s.opts.MaxSegmentBytes > 0 && size >= s.opts.MaxSegmentBytes {
+		return true
+	}
+	if s.opts.MaxSegmentAge <= 0 {
+		return false
+	}
+
+	ix, err := openCoveringIndex(active.indexPath(), size)
+	if errors.Is(err, errStaleIndex) {
+		ix, err = rebuildIndex(active.indexPath(), f, s.codec, size)
+	}
+	if err != nil {
+		return false
+	}
+	defer ix.Close()
+	if ix.count == 0 {
+		return false
+	}
+
+	first, err := ix.read(f, s.codec, 0, 1)
+	if err != nil {
+		return false
+	}
+	return time.Since(first[0].Timestamp) > s.opts.MaxSegmentAge
+}
+
+// List returns every message across all segments.
+func (s *SegmentStore) List(ctx context.Context) ([]message.Message, error) {
+	return s.editor(ctx).amended(s.read(ctx, func(view *segmentView) ([]message.Message, error) {
+		messages := []message.Message{}
+		for _, seg := range view.segments {
+			f, err := os.Open(seg.path)
+			if err != nil {
+				return nil, err
+			}
+			decoded, err := s.codec.DecodeAll(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, decoded...)
+		}
+		return messages, nil
+	}))
+}
+
+// Tail returns the last n messages, reading segments newest first
+// until enough have been collected.
+func (s *SegmentStore) Tail(ctx context.Context, n int) ([]message.Message, error) {
+	return s.editor(ctx).amended(s.read(ctx, func(view *segmentView) ([]message.Message, error) {
+		var pages [][]message.Message
+		for i := len(view.segments) - 1; i >= 0 && n > 0; i-- {
+			page, err := view.window(i, func(count int) (int, int) {
+				return clampRange(count, count-n, n)
+			})
+			if err != nil {
+				return nil, err
+			}
+			pages = append(pages, page)
+			n -= len(page)
+		}
+
+		messages := []message.Message{}
+		for i := len(pages) - 1; i >= 0; i-- {
+			messages = append(messages, pages[i]...)
+		}
+		return messages, nil
+	}))
+}
+
+// Range returns at most limit messages starting at position offset.
+// Whole segments before offset are skipped using their message counts.
+func (s *SegmentStore) Range(ctx context.Context, offset, limit int) ([]message.Message, error) {
+	return s.editor(ctx).amended(s.rangeRecords(ctx, offset, limit))
+}
+
+// Get returns the message with the given ID and its edit history.
+func (s *SegmentStore) Get(ctx context.Context, id int) (message.Message, error) {
+	return s.editor(ctx).get(ctx, id)
+}
+
+// Edit records a new text for the message with the given ID.
+func (s *SegmentStore) Edit(ctx context.Context, id int, text string) (message.Message, error) {
+	return s.editor(ctx).edit(ctx, id, text)
+}
+
+// Remove records a tombstone for the message with the given ID. Its text is
+// erased from disk by Compact once its segment is sealed.
+func (s *SegmentStore) Remove(ctx context.Context, id int) error {
+	return s.editor(ctx).remove(ctx, id)
+}
+
+// rangeRecords returns at most limit messages starting at position offset,
+// without applying the edit log.
+func (s *SegmentStore) rangeRecords(ctx context.Context, offset, limit int) ([]message.Message, error) {
+	return s.read(ctx, func(view *segmentView) ([]message.Message, error) {
+		messages := []message.Message{}
+		if offset < 0 {
+			limit += offset
+			offset = 0
+		}
+		for i := range view.segments {
+			if limit <= 0 {
+				break
+			}
+			count, err := view.count(i)
+			if err != nil {
+				return nil, err
+			}
+			if offset >= count {
+				offset -= count
+				continue
+			}
+
+			page, err := view.window(i, func(count int) (int, int) {
+				return clampRange(count, offset, limit)
+			})
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, page...)
+			limit -= len(page)
+			offset = 0
+		}
+		return messages, nil
+	})
+}
+
+// locate finds the positions of ids by binary search over the index of the
+// segment holding each, as idLocator describes.
+func (s *SegmentStore) locate(ctx context.Context, ids ...int) (count int, positions []int, err error) {
+	_, err = s.read(ctx, func(view *segmentView) ([]message.Message, error) {
+		count, positions, err = view.locate(ids)
+		return nil, err
+	})
+	return count, positions, err
+}
+
+// read runs fn over a view of the segments under the reader lock. If a
+// segment index is missing or stale, fn is run again under the writer lock,
+// which lets the view rebuild indexes.
+func (s *SegmentStore) read(ctx context.Context, fn func(view *segmentView) ([]message.Message, error)) ([]message.Message, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	messages, err := s.readView(fn, false)
+	if errors.Is(err, errStaleIndex) {
+		slog.InfoContext(ctx, "Rebuilding message segment indexes",
+			"dir", s.dir,
+			"traceID", traceID)
+		messages, err = s.readView(fn, true)
+	}
+	if err != nil {
+		return []message.Message{}, err
+	}
+
+	for i := range messages {
+		messages[i].TraceID = traceID
+	}
+	return messages, nil
+}
+
+// readView locks the directory, loads the segment list and runs fn over it.
+func (s *SegmentStore) readView(fn func(view *segmentView) ([]message.Message, error), rebuild bool) ([]message.Message, error) {
+	unlock, err := s.lock(rebuild)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	view := &segmentView{segments: segments, rebuild: rebuild, codec: s.codec}
+	return fn(view)
+}
+
+// segmentView is a locked snapshot of the segments.
+type segmentView struct {
+	segments []segment
+	rebuild  bool
+	codec    message.Codec
+}
+
+// count returns the number of messages in segment i.
+func (v *segmentView) count(i int) (int, error) {
+	f, ix, err := v.open(i)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	defer ix.Close()
+	return int(ix.count), nil
+}
+
+// locate returns the number of messages in the segments and, for each of
+// ids, the position of the first message whose ID is at least it. Only the
+// segment whose range of IDs holds an ID is searched; IDs before the first
+// segment are at position 0.
+func (v *segmentView) locate(ids []int) (int, []int, error) {
+	count, positions := 0, make([]int, len(ids))
+	for i, seg := range v.segments {
+		f, ix, err := v.open(i)
+		if err != nil {
+			return 0, nil, err
+		}
+		for j, id := range ids {
+			if id < seg.base || (i+1 < len(v.segments) && id >= v.segments[i+1].base) {
+				continue
+			}
+			pos, err := ix.search(id)
+			if err != nil {
+				f.Close()
+				ix.Close()
+				return 0, nil, err
+			}
+			positions[j] = count + pos
+		}
+		count += int(ix.count)
+		f.Close()
+		ix.Close()
+	}
+	return count, positions, nil
+}
+
+// window returns the messages of segment i that pick selects given the
+// number of messages in it, read straight through the index.
+func (v *segmentView) window(i int, pick func(count int) (int, int)) ([]message.Message, error) {
+	f, ix, err := v.open(i)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer ix.Close()
+
+	start, n := pick(int(ix.count))
+	return v.readIndexed(i, f, ix, int64(start), int64(n))
+}
+
+// readIndexed reads n messages of segment i starting at position start. In
+// rebuild mode an index found stale while reading is rebuilt and read again.
+func (v *segmentView) readIndexed(i int, f *os.File, ix *offsetIndex, start, n int64) ([]message.Message, error) {
+	messages, err := ix.read(f, v.codec, start, n)
+	if !errors.Is(err, errStaleIndex) || !v.rebuild {
+		return messages, err
+	}
+
+	if err := ix.rebuild(f, v.codec, ix.covered); err != nil {
+		return nil, err
+	}
+	return ix.read(f, v.codec, start, n)
+}
+
+// open opens segment i and an index covering it. Outside rebuild mode a
+// missing or stale index is reported as errStaleIndex.
+func (v *segmentView) open(i int) (*os.File, *offsetIndex, error) {
+	seg := v.segments[i]
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	ix, err := openCoveringIndex(seg.indexPath(), info.Size())
+	if errors.Is(err, errStaleIndex) && v.rebuild {
+		ix, err = rebuildIndex(seg.indexPath(), f, v.codec, info.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, ix, nil
+}
+
+// Clear removes every segment and the edit log and starts a new, empty active
+// segment whose header remembers the last ID handed out, so IDs are never
+// reused.
+func (s *SegmentStore) Clear(ctx context.Context) error {
+	unlock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	segments, err := s.segments()
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+
+	active := segments[len(segments)-1]
+	last, err := segmentLastID(active, s.codec)
+	if err != nil {
+		return err
+	}
+
+	// The new segment is written before the old ones are removed so an
+	// interrupted Clear never loses the last ID.
+	fresh := s.newSegment(last + 1)
+	header := message.FormatHeader(last) + "\n"
+	if err := replaceFile(fresh.path, []byte(header)); err != nil {
+		return err
+	}
+	if err := resetIndex(fresh.indexPath(), int64(len(header))); err != nil {
+		warnIndex(ctx, fresh.indexPath(), err)
+		removeIfExists(fresh.indexPath())
+	}
+
+	for _, seg := range segments {
+		if seg.path == fresh.path {
+			continue
+		}
+		if err := removeSegment(seg); err != nil {
+			return err
+		}
+	}
+	return removeIfExists(filepath.Join(s.dir, segmentEditsName))
+}
+
+// Compact enforces retention by dropping the oldest sealed segments, then
+// rewrites the records of removed messages in sealed segments as their
+// tombstones and prunes the edits it no longer needs. The active segment is
+// left untouched.
+func (s *SegmentStore) Compact(ctx context.Context) (CompactionReport, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+	report := CompactionReport{}
+
+	unlock, err := s.lock(true)
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	segments, err := s.segments()
+	if err != nil || len(segments) < 2 {
+		return report, err
+	}
+	changes, err := s.editLog().load()
+	if err != nil {
+		return report, err
+	}
+	removed := removedIDs(changes)
+
+	segments, err = s.applyRetention(segments, &report)
+	if err != nil {
+		return report, err
+	}
+
+	// Edits are no longer needed once the message is gone or its tombstone
+	// is in the segment
+	settled := map[int]bool{}
+	for i, seg := range segments[:len(segments)-1] {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if countIn(removed, seg.base, segments[i+1].base) == 0 {
+			continue
+		}
+		if err := compactSegment(seg, s.codec, changes, settled, &report); err != nil {
+			return report, fmt.Errorf("compacting %s: %w", seg.path, err)
+		}
+	}
+	for id := range changes {
+		if id < segments[0].base {
+			settled[id] = true
+		}
+	}
+	// The segments are rewritten first: after a crash in between, the edits
+	// left behind are ignored by the tombstones and dropped next time
+	before, err := s.editLog().stat()
+	if err != nil {
+		return report, err
+	}
+	if report.EditsDropped, err = s.editLog().drop(settled); err != nil {
+		return report, err
+	}
+	if report.EditsDropped > 0 {
+		after, err := s.editLog().stat()
+		if err != nil {
+			return report, err
+		}
+		report.BytesReclaimed += before.Size() - after.Size()
+	}
+
+	if report != (CompactionReport{}) {
+		slog.InfoContext(ctx, "Message segments compacted",
+			"dir", s.dir,
+			"segmentsRemoved", report.SegmentsRemoved,
+			"segmentsCompacted", report.SegmentsCompacted,
+			"recordsScrubbed", report.RecordsScrubbed,
+			"editsDropped", report.EditsDropped,
+			"bytesReclaimed", report.BytesReclaimed,
+			"traceID", traceID)
+	}
+	return report, nil
+}
+
+// applyRetention drops the oldest sealed segments that are older than the
+// retention age, or while the log exceeds the retention size, and returns
+// the segments left.
+func (s *SegmentStore) applyRetention(segments []segment, report *CompactionReport) ([]segment, error) {
+	if s.opts.RetentionAge <= 0 && s.opts.RetentionBytes <= 0 {
+		return segments, nil
+	}
+
+	infos := make([]os.FileInfo, len(segments))
+	var total int64
+	for i, seg := range segments {
+		info, err := os.Stat(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = info
+		total += info.Size()
+	}
+
+	cutoff := time.Now().Add(-s.opts.RetentionAge)
+	dropped := 0
+	for i := range segments[:len(segments)-1] {
+		expired := s.opts.RetentionAge > 0 && infos[i].ModTime().Before(cutoff)
+		oversized := s.opts.RetentionBytes > 0 && total > s.opts.RetentionBytes
+		if !expired && !oversized {
+			break
+		}
+		if err := removeSegment(segments[i]); err != nil {
+			return nil, err
+		}
+		total -= infos[i].Size()
+		report.SegmentsRemoved++
+		report.BytesReclaimed += infos[i].Size()
+		dropped++
+	}
+	return segments[dropped:], nil
+}
+
+// removedIDs returns the IDs of the messages changes delete.
+func removedIDs(changes map[int][]message.Message) map[int]bool {
+	removed := map[int]bool{}
+	for id, list := range changes {
+		if deletes(list) {
+			removed[id] = true
+		}
+	}
+	return removed
+}
+
+// countIn counts the IDs in ids from lo up to but excluding hi.
+func countIn(ids map[int]bool, lo, hi int) int {
+	count := 0
+	for id := range ids {
+		if id >= lo && id < hi {
+			count++
+		}
+	}
+	return count
+}
+
+// deletes reports whether the changes of a message hold a tombstone.
+func deletes(changes []message.Message) bool {
+	for _, change := range changes {
+		if change.Deleted {
+			return true
+		}
+	}
+	return false
+}
+
+// compactSegment rewrites seg, re-encoding its records with codec and
+// replacing those of the messages changes delete by the amended tombstone,
+// whose IDs it adds to settled. The modification time is preserved so
+// retention still sees when the segment was last written.
+func compactSegment(seg segment, codec message.Codec, changes map[int][]message.Message, settled map[int]bool, report *CompactionReport) error {
+	info, err := os.Stat(seg.path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	messages, err := codec.DecodeAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintln(&b, message.FormatHeader(seg.base-1))
+	for _, m := range messages {
+		if deletes(changes[m.ID]) {
+			// A record already replaced keeps the time it was deleted at
+			if !m.Deleted {
+				for _, change := range changes[m.ID] {
+					m = message.Amend(m, change)
+				}
+				report.RecordsScrubbed++
+			}
+			settled[m.ID] = true
+		}
+		line, err := codec.FormatLine(m)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(&b, line)
+	}
+
+	report.SegmentsCompacted++
+	if saved := info.Size() - int64(b.Len()); saved > 0 {
+		report.BytesReclaimed += saved
+	}
+	if err := replaceFile(seg.path, []byte(b.String())); err != nil {
+		return err
+	}
+	if err := removeIfExists(seg.indexPath()); err != nil {
+		return err
+	}
+	return os.Chtimes(seg.path, info.ModTime(), info.ModTime())
+}
+
+// RunCompactor calls Compact every interval until ctx is cancelled.
+// Failures are logged and retried on the next tick.
+func (s *SegmentStore) RunCompactor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Compact(ctx); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Message segment compaction failed",
+					"error", err,
+					"dir", s.dir)
+			}
+		}
+	}
+}
+
+// segmentLastID returns the highest ID handed out up to and including seg,
+// decoding records with codec.
+func segmentLastID(seg segment, codec message.Codec) (int, error) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return lastID(f, codec, info.Size())
+}
+
+// removeSegment deletes a segment file and its index.
+func removeSegment(seg segment) error {
+	if err := removeIfExists(seg.path); err != nil {
+		return err
+	}
+	return removeIfExists(seg.indexPath())
+}
+
+// replaceFile atomically replaces the file at path with data by writing a
+// temporary file in the same directory and renaming it over path.
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,238 @@
+package messagestore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSegmentStore returns a SegmentStore in a temporary directory whose
+// segments hold about three messages each.
+func newTestSegmentStore(t *testing.T, opts SegmentOptions) *SegmentStore {
+	t.Helper()
+	if opts.MaxSegmentBytes == 0 {
+		opts.MaxSegmentBytes = 300
+	}
+	return NewSegmentStore(filepath.Join(t.TempDir(), "messages.d"), opts)
+}
+
+// segmentBases lists the first IDs of the store's segments.
+func segmentBases(t *testing.T, store *SegmentStore) []int {
+	t.Helper()
+	segments, err := store.segments()
+	require.NoError(t, err)
+	bases := make([]int, len(segments))
+	for i, seg := range segments {
+		bases[i] = seg.base
+	}
+	return bases
+}
+
+func TestSegmentStoreRotatesBySize(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSegmentStore(t, SegmentOptions{})
+	appendN(t, store, 10)
+
+	bases := segmentBases(t, store)
+	require.Greater(t, len(bases), 2, "Appends should be spread across segments")
+	require.Equal(t, 1, bases[0])
+
+	content, err := os.ReadFile(store.newSegment(bases[1]).path)
+	require.NoError(t, err)
+	h, err := message.ParseHeader(string(content[:len(message.FormatHeader(bases[1]-1))]))
+	require.NoError(t, err, "Every segment should start with a header")
+	require.Equal(t, bases[1]-1, h.BaseID)
+
+	messages, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, messageIDs(messages), "Readers should span segments")
+
+	tail, err := store.Tail(ctx, 5)
+	require.NoError(t, err)
+	require.Equal(t, []int{6, 7, 8, 9, 10}, messageIDs(tail))
+}
+
+func TestSegmentStoreRotatesByAge(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSegmentStore(t, SegmentOptions{MaxSegmentBytes: -1, MaxSegmentAge: time.Hour})
+
+	_, err := store.Append(ctx, message.Message{User: "alice", Message: "old", Timestamp: time.Now().Add(-2 * time.Hour)})
+	require.NoError(t, err)
+	appendN(t, store, 3)
+
+	require.Equal(t, []int{1, 2}, segmentBases(t, store), "A segment whose first message is too old should be sealed")
+}
+
+func TestSegmentStoreCompactScrubsRemovedMessages(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSegmentStore(t, SegmentOptions{})
+	appendN(t, store, 10)
+	bases := segmentBases(t, store)
+	_, err := store.Edit(ctx, 2, "top secret plan")
+	require.NoError(t, err, "Setup failed")
+	for _, id := range []int{2, 10} {
+		require.NoError(t, store.Remove(ctx, id), "Setup failed")
+	}
+	_, err = store.Edit(ctx, 4, "still here")
+	require.NoError(t, err, "Setup failed")
+	before, err := store.List(ctx)
+	require.NoError(t, err)
+
+	report, err := store.Compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.RecordsScrubbed, "Only sealed segments are compacted")
+	require.Equal(t, 2, report.EditsDropped, "The edit and tombstone of message 2 are settled")
+	require.Positive(t, report.BytesReclaimed)
+
+	after, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, before, after, "Compaction must not change what readers see")
+	require.True(t, after[1].Deleted)
+	require.NotNil(t, after[1].EditedAt, "The tombstone should keep when it was deleted")
+	got, err := store.Get(ctx, 2)
+	require.NoError(t, err)
+	require.True(t, got.Deleted)
+	require.ErrorIs(t, store.Remove(ctx, 2), ErrDeleted)
+
+	segments, err := store.segments()
+	require.NoError(t, err)
+	raw, err := os.ReadFile(segments[0].path)
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), `"message":"message 1"`, "The removed text should be gone from the segment")
+	edits, err := os.ReadFile(store.editLog().path)
+	require.NoError(t, err)
+	require.NotContains(t, string(edits), "top secret", "The removed message's edits should be dropped")
+	require.Contains(t, string(edits), "still here", "Edits of live messages must be kept")
+	require.Contains(t, string(edits), `"id":10`, "Messages in the active segment keep their tombstone in the edit log")
+
+	require.Equal(t, bases, segmentBases(t, store), "Segments holding tombstones should be kept")
+
+	report, err = store.Compact(ctx)
+	require.NoError(t, err)
+	require.Zero(t, report.RecordsScrubbed, "Compaction should not scrub a message twice")
+
+	saved, err := store.Append(ctx, message.Message{User: "bob", Message: "next", Timestamp: time.Now()})
+	require.NoError(t, err)
+	require.Equal(t, 11, saved.ID, "IDs must not be reused after compaction")
+}
+
+func TestSegmentStoreCompactNeverReclaimsNegativeBytes(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSegmentStore(t, SegmentOptions{})
+	for i := 0; i < 8; i++ {
+		_, err := store.Append(ctx, message.Message{User: "a", Message: "x", Timestamp: time.Now()})
+		require.NoError(t, err, "Setup failed")
+	}
+	require.Greater(t, len(segmentBases(t, store)), 1, "Setup should seal a segment")
+	require.NoError(t, store.Remove(ctx, 1), "Setup failed")
+	segments, err := store.segments()
+	require.NoError(t, err)
+	before, err := os.Stat(segments[0].path)
+	require.NoError(t, err)
+	edits, err := os.Stat(store.editLog().path)
+	require.NoError(t, err)
+
+	report, err := store.Compact(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.RecordsScrubbed)
+	after, err := os.Stat(segments[0].path)
+	require.NoError(t, err)
+	require.Greater(t, after.Size(), before.Size(), "Setup should make the tombstone longer than the record")
+	require.Equal(t, edits.Size(), report.BytesReclaimed, "Only the dropped edits are reclaimed; a segment that grew reclaims nothing")
+}
+
+func TestSegmentStoreRetention(t *testing.T) {
+	testCases := []struct {
+		name          string
+		opts          SegmentOptions
+		age           func(t *testing.T, store *SegmentStore)
+		wantRemaining int
+	}{
+		{
+			name: "max_age",
+			opts: SegmentOptions{RetentionAge: time.Hour},
+			age: func(t *testing.T, store *SegmentStore) {
+				segments, err := store.segments()
+				require.NoError(t, err)
+				old := time.Now().Add(-2 * time.Hour)
+				for _, seg := range segments[:2] {
+					require.NoError(t, os.Chtimes(seg.path, old, old))
+				}
+			},
+			wantRemaining: 2,
+		},
+		{
+			name:          "max_total_size",
+			opts:          SegmentOptions{RetentionBytes: 700},
+			wantRemaining: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newTestSegmentStore(t, tc.opts)
+			appendN(t, store, 10)
+			require.Len(t, segmentBases(t, store), 4, "Setup should produce four segments")
+			if tc.age != nil {
+				tc.age(t, store)
+			}
+
+			report, err := store.Compact(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 4-tc.wantRemaining, report.SegmentsRemoved)
+
+			bases := segmentBases(t, store)
+			require.Len(t, bases, tc.wantRemaining)
+			messages, err := store.List(ctx)
+			require.NoError(t, err)
+			require.Equal(t, bases[0], messages[0].ID, "Only the oldest messages should be dropped")
+			require.Equal(t, 10, messages[len(messages)-1].ID)
+		})
+	}
+}
+
+func TestSegmentStoreClear(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSegmentStore(t, SegmentOptions{})
+	appendN(t, store, 7)
+	require.NoError(t, store.Remove(ctx, 7))
+
+	require.NoError(t, store.Clear(ctx))
+	require.Equal(t, []int{8}, segmentBases(t, store), "Clear should leave one empty segment after the last ID")
+	messages, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, messages)
+
+	saved, err := store.Append(ctx, message.Message{User: "alice", Message: "after clear", Timestamp: time.Now()})
+	require.NoError(t, err)
+	require.Equal(t, 8, saved.ID)
+	require.Equal(t, []int{8}, segmentBases(t, store), "An empty segment should be reused, not rotated")
+}
+
+func TestSegmentStoreRebuildsSegmentIndexes(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSegmentStore(t, SegmentOptions{})
+	appendN(t, store, 10)
+
+	segments, err := store.segments()
+	require.NoError(t, err)
+	for _, seg := range segments {
+		require.NoError(t, os.Remove(seg.indexPath()))
+	}
+
+	page, err := store.Range(ctx, 2, 5)
+	require.NoError(t, err)
+	require.Equal(t, []int{3, 4, 5, 6, 7}, messageIDs(page))
+	tail, err := store.Tail(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []int{10}, messageIDs(tail))
+	for _, seg := range segments {
+		require.FileExists(t, seg.indexPath(), "Missing indexes should be rebuilt")
+	}
+}
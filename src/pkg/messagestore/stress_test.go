@@ -0,0 +1,228 @@
+package messagestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+// Environment variables used to re-run the test binary as a writer process.
+const (
+	stressLogEnv   = "MESSAGESTORE_STRESS_LOG"
+	stressModeEnv  = "MESSAGESTORE_STRESS_MODE"
+	stressNameEnv  = "MESSAGESTORE_STRESS_NAME"
+	stressCountEnv = "MESSAGESTORE_STRESS_COUNT"
+)
+
+func TestMain(m *testing.M) {
+	if logPath := os.Getenv(stressLogEnv); logPath != "" {
+		count, _ := strconv.Atoi(os.Getenv(stressCountEnv))
+		if err := runStressWriter(logPath, os.Getenv(stressModeEnv), os.Getenv(stressNameEnv), count); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runStressWriter appends count messages to the log the way one of the
+// binaries does: "cli" opens a fresh store per message like repeated
+// `-cli -user` invocations, while "server" keeps one store and reads the tail
+// between writes like the web and gRPC servers.
+func runStressWriter(logPath, mode, name string, count int) error {
+	ctx := context.Background()
+	store := NewFileStore(logPath)
+
+	for i := 0; i < count; i++ {
+		if mode == "cli" {
+			store = NewFileStore(logPath)
+		}
+		_, err := store.Append(ctx, message.Message{
+			User:      name,
+			Message:   strconv.Itoa(i),
+			Timestamp: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		if mode == "server" {
+			if _, err := store.Tail(ctx, 10); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startStressWriter launches the test binary as a separate writer process.
+func startStressWriter(t *testing.T, logPath, mode, name string, count int) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(),
+		stressLogEnv+"="+logPath,
+		stressModeEnv+"="+mode,
+		stressNameEnv+"="+name,
+		stressCountEnv+"="+strconv.Itoa(count),
+	)
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start(), "Failed to start writer process")
+	return cmd
+}
+
+// readRawLog decodes the whole log under a shared lock and reports how many
+// lines could not be parsed.
+func readRawLog(t *testing.T, store *FileStore) ([]message.Message, int) {
+	t.Helper()
+	unlock, err := store.lock(false)
+	require.NoError(t, err)
+	defer unlock()
+
+	f, err := os.Open(store.Path())
+	if os.IsNotExist(err) {
+		return nil, 0
+	}
+	require.NoError(t, err)
+	defer f.Close()
+
+	var messages []message.Message
+	dec := message.NewDecoder(f)
+	for {
+		m, err := dec.Decode()
+		if err == io.EOF {
+			return messages, dec.Malformed()
+		}
+		require.NoError(t, err)
+		messages = append(messages, m)
+	}
+}
+
+func TestConcurrentAppendsFromSeveralProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+
+	ctx := context.Background()
+	logPath := filepath.Join(t.TempDir(), "messages.txt")
+	const perWriter = 100
+
+	// Two CLI-style and two server-style writer processes...
+	writers := map[string]*exec.Cmd{}
+	for i, mode := range []string{"cli", "cli", "server", "server"} {
+		name := fmt.Sprintf("%s-%d", mode, i)
+		writers[name] = startStressWriter(t, logPath, mode, name, perWriter)
+	}
+
+	// ...race in-process web handlers sharing a single store.
+	web := NewFileStore(logPath)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("web-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				_, err := web.Append(ctx, message.Message{User: name, Message: strconv.Itoa(j), Timestamp: time.Now()})
+				require.NoError(t, err)
+				_, err = web.List(ctx)
+				require.NoError(t, err)
+			}
+		}()
+		writers[name] = nil
+	}
+
+	wg.Wait()
+	for name, cmd := range writers {
+		if cmd != nil {
+			require.NoError(t, cmd.Wait(), "Writer process %s failed", name)
+		}
+	}
+
+	messages, malformed := readRawLog(t, web)
+	require.Zero(t, malformed, "No partial or interleaved lines may be written")
+	require.Len(t, messages, len(writers)*perWriter, "No append may be lost")
+
+	next := map[string]int{}
+	for i, m := range messages {
+		require.Equal(t, i+1, m.ID, "IDs must be unique and gap-free")
+		require.Equal(t, strconv.Itoa(next[m.User]), m.Message, "Each writer's messages must stay in order")
+		next[m.User]++
+	}
+	for name := range writers {
+		require.Equal(t, perWriter, next[name], "Writer %s lost messages", name)
+	}
+}
+
+func TestConcurrentClearNeverExposesPartialLog(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+
+	ctx := context.Background()
+	logPath := filepath.Join(t.TempDir(), "messages.txt")
+	const writers, perWriter = 4, 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store := NewFileStore(logPath)
+			for j := 0; j < perWriter; j++ {
+				_, err := store.Append(ctx, message.Message{User: "writer", Message: strconv.Itoa(j), Timestamp: time.Now()})
+				require.NoError(t, err)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		store := NewFileStore(logPath)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			require.NoError(t, store.Clear(ctx))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		store := NewFileStore(logPath)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			messages, malformed := readRawLog(t, store)
+			require.Zero(t, malformed, "Readers must never observe a half-written or truncated line")
+			for i := 1; i < len(messages); i++ {
+				require.Greater(t, messages[i].ID, messages[i-1].ID, "IDs must keep increasing")
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	saved, err := NewFileStore(logPath).Append(ctx, message.Message{User: "final", Message: "check", Timestamp: time.Now()})
+	require.NoError(t, err)
+	require.Equal(t, writers*perWriter+1, saved.ID, "Clears racing appends must never cause an ID to be reused")
+}
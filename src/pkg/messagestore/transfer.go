@@ -0,0 +1,169 @@
+package messagestore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+)
+
+// maxImportErrors caps the rejected records an ImportReport lists; the rest
+// are only counted.
+const maxImportErrors = 100
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	// DryRun validates every record without appending any.
+	DryRun bool
+}
+
+// ImportError is a record Import rejected.
+type ImportError struct {
+	// Line is the 1-based line number of the record.
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ImportReport is what Import found and did.
+type ImportReport struct {
+	// Lines counts the non-blank lines read.
+	Lines int `json:"lines"`
+	// Imported counts the records appended, or that would be in a dry run.
+	Imported int `json:"imported"`
+	// Failed counts the records rejected; Errors lists the first of them.
+	Failed int           `json:"failed"`
+	Errors []ImportError `json:"errors,omitempty"`
+	// FirstID and LastID are the IDs given to the first and last record
+	// appended.
+	FirstID int  `json:"first_id,omitempty"`
+	LastID  int  `json:"last_id,omitempty"`
+	DryRun  bool `json:"dry_run"`
+}
+
+// importRecord is the part of an exported message Import keeps. Other
+// fields, such as id, are ignored: imported messages are numbered by the
+// store they are imported into.
+type importRecord struct {
+	User      string    `json:"user"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+	Deleted   bool      `json:"deleted"`
+}
+
+// Export writes the messages of store matching q to w as NDJSON, one message
+// per line in the order of q, ignoring q.Limit. Tombstones are left out and
+// edited messages are written with their current text. It returns how many
+// messages it wrote.
+func Export(ctx context.Context, store MessageStore, q Query, w io.Writer) (int, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	enc := json.NewEncoder(w)
+	written := 0
+	err := Scan(ctx, store, q, func(msg message.Message) error {
+		if msg.Deleted {
+			return nil
+		}
+		msg.TraceID = ""
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+
+	slog.InfoContext(ctx, "Messages exported",
+		"count", written,
+		"error", err,
+		"traceID", traceID)
+
+	return written, err
+}
+
+// Import appends the messages read from r, NDJSON as written by Export, to
+// store in the order they are read, keeping their users and timestamps.
+// Every record is validated first; rejected records are reported by line
+// and the others are still imported. The returned error is for r or store
+// failing, or a line longer than message.MaxLineSize; the report then covers
+// the lines before it.
+func Import(ctx context.Context, store MessageStore, r io.Reader, opts ImportOptions) (ImportReport, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+	report := ImportReport{DryRun: opts.DryRun}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), message.MaxLineSize)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		report.Lines++
+
+		msg, err := parseImportRecord(line)
+		if err != nil {
+			report.Failed++
+			if len(report.Errors) < maxImportErrors {
+				report.Errors = append(report.Errors, ImportError{Line: lineNo, Error: err.Error()})
+			}
+			continue
+		}
+		if !opts.DryRun {
+			saved, err := store.Append(ctx, msg)
+			if errors.Is(err, message.ErrRecordTooLarge) {
+				// Sealing can push a record that fit the import past the limit
+				report.Failed++
+				if len(report.Errors) < maxImportErrors {
+					report.Errors = append(report.Errors, ImportError{Line: lineNo, Error: err.Error()})
+				}
+				continue
+			}
+			if err != nil {
+				return report, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			if report.FirstID == 0 {
+				report.FirstID = saved.ID
+			}
+			report.LastID = saved.ID
+		}
+		report.Imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return report, fmt.Errorf("line %d: %w", lineNo+1, err)
+	}
+
+	slog.InfoContext(ctx, "Messages imported",
+		"lines", report.Lines,
+		"imported", report.Imported,
+		"failed", report.Failed,
+		"dryRun", opts.DryRun,
+		"traceID", traceID)
+
+	return report, nil
+}
+
+// parseImportRecord decodes and validates one line of an import.
+func parseImportRecord(line string) (message.Message, error) {
+	var record importRecord
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return message.Message{}, fmt.Errorf("invalid JSON: %v", err)
+	}
+	switch {
+	case record.Deleted:
+		return message.Message{}, fmt.Errorf("deleted messages cannot be imported")
+	case strings.TrimSpace(record.User) == "":
+		return message.Message{}, fmt.Errorf("user is required")
+	case record.Message == "":
+		return message.Message{}, fmt.Errorf("message is required")
+	case record.Timestamp.IsZero():
+		return message.Message{}, fmt.Errorf("timestamp is required")
+	}
+	return message.Message{User: record.User, Message: record.Message, Timestamp: record.Timestamp}, nil
+}
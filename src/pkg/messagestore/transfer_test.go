@@ -0,0 +1,97 @@
+package messagestore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	written := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, factory := range storeFactories {
+		t.Run(factory.name, func(t *testing.T) {
+			source := factory.new(t)
+			for i, text := range []string{"first", "second", "third"} {
+				_, err := source.Append(ctx, message.Message{User: "alice", Message: text, Timestamp: written.Add(time.Duration(i) * time.Hour)})
+				require.NoError(t, err, "Setup failed")
+			}
+			_, err := source.Edit(ctx, 1, "first, edited")
+			require.NoError(t, err, "Setup failed")
+			require.NoError(t, source.Remove(ctx, 2), "Setup failed")
+
+			var dump bytes.Buffer
+			n, err := Export(ctx, source, Query{}, &dump)
+			require.NoError(t, err)
+			require.Equal(t, 2, n, "Tombstones should not be exported")
+
+			target := factory.new(t)
+			_, err = target.Append(ctx, message.Message{User: "bob", Message: "already here", Timestamp: time.Now()})
+			require.NoError(t, err, "Setup failed")
+			report, err := Import(ctx, target, &dump, ImportOptions{})
+			require.NoError(t, err)
+			require.Equal(t, ImportReport{Lines: 2, Imported: 2, FirstID: 2, LastID: 3}, report)
+
+			imported, err := target.List(ctx)
+			require.NoError(t, err)
+			require.Len(t, imported, 3)
+			require.Equal(t, "first, edited", imported[1].Message)
+			require.Equal(t, "alice", imported[2].User)
+			require.True(t, written.Add(2*time.Hour).Equal(imported[2].Timestamp), "Import should keep the original timestamp")
+			require.Nil(t, imported[1].EditedAt)
+		})
+	}
+}
+
+func TestImportReportsLineErrors(t *testing.T) {
+	ctx := context.Background()
+	input := strings.Join([]string{
+		`{"user":"alice","message":"ok","timestamp":"2025-03-01T12:00:00Z"}`,
+		``,
+		`{"user":"alice","message":"ok"`,
+		`{"user":"","message":"no user","timestamp":"2025-03-01T12:00:00Z"}`,
+		`{"user":"bob","message":"","timestamp":"2025-03-01T12:00:00Z"}`,
+		`{"user":"bob","message":"no time"}`,
+		`{"user":"bob","message":"","timestamp":"2025-03-01T12:00:00Z","deleted":true}`,
+		`{"id":99,"user":"carol","message":"ok too","timestamp":"2025-03-01T13:00:00+02:00","trace_id":"x"}`,
+	}, "\n")
+
+	store := NewMemoryStore()
+	dryRun, err := Import(ctx, store, strings.NewReader(input), ImportOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, dryRun.Imported)
+	require.True(t, dryRun.DryRun)
+	messages, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, messages, "A dry run must not import anything")
+
+	report, err := Import(ctx, store, strings.NewReader(input), ImportOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 7, report.Lines)
+	require.Equal(t, 2, report.Imported)
+	require.Equal(t, 5, report.Failed)
+	lines := []int{}
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	require.Equal(t, []int{3, 4, 5, 6, 7}, lines)
+	require.Contains(t, report.Errors[0].Error, "invalid JSON")
+	require.Equal(t, "user is required", report.Errors[1].Error)
+	require.Equal(t, "deleted messages cannot be imported", report.Errors[4].Error)
+
+	messages, err = store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, messageIDs(messages), "Imported messages are numbered by the store")
+	require.Equal(t, "carol", messages[1].User)
+
+	long := `{"user":"alice","message":"` + strings.Repeat("x", message.MaxLineSize) + `"}`
+	_, err = Import(ctx, store, strings.NewReader(long), ImportOptions{})
+	require.ErrorIs(t, err, bufio.ErrTooLong)
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Durability selects how much of an atomic write is flushed to stable
+// storage before it returns. Every level replaces the file atomically, so
+// concurrent readers only ever see the old or the new content; the levels
+// differ in what survives a power loss or kernel crash.
+type Durability int
+
+const (
+	// DurabilityFull fsyncs the new content and the parent directory, so
+	// once the write returns the new content survives a crash.
+	DurabilityFull Durability = iota
+	// DurabilityFile fsyncs the new content but not the directory. After a
+	// crash the file holds either the old or the complete new content.
+	DurabilityFile
+	// DurabilityNone leaves flushing to the operating system. After a crash
+	// the file may hold the old content, the new content, or be empty.
+	DurabilityNone
+)
+
+// DefaultDurability is the level used by SaveData.
+var DefaultDurability = DurabilityFull
+
+// String returns the name accepted by ParseDurability.
+func (d Durability) String() string {
+	switch d {
+	case DurabilityFull:
+		return "full"
+	case DurabilityFile:
+		return "file"
+	case DurabilityNone:
+		return "none"
+	default:
+		return fmt.Sprintf("Durability(%d)", int(d))
+	}
+}
+
+// ParseDurability parses a durability level name: "full", "file" or "none".
+func ParseDurability(name string) (Durability, error) {
+	switch strings.ToLower(name) {
+	case "full":
+		return DurabilityFull, nil
+	case "file":
+		return DurabilityFile, nil
+	case "none":
+		return DurabilityNone, nil
+	default:
+		return 0, fmt.Errorf("unknown durability %q (expected 'full', 'file' or 'none')", name)
+	}
+}
+
+// Steps of an atomic write, reported to failpoint.
+const (
+	stepCreated   = "created"    // temporary file created, still empty
+	stepWritten   = "written"    // content written to the temporary file
+	stepSynced    = "synced"     // temporary file flushed to disk
+	stepRenamed   = "renamed"    // temporary file renamed over the target
+	stepDirSynced = "dir-synced" // parent directory flushed to disk
+)
+
+// failpoint is called after each step of an atomic write to path. Tests set
+// it to inspect the target mid-write and to abort the write by returning an
+// error, simulating a crash at that point. It is nil outside tests.
+var failpoint func(path, step string) error
+
+// atomicWrite replaces the file at filePath with the content produced by
+// write. The content goes to a temporary file in the same directory, which
+// is flushed according to durability and renamed over filePath, so readers
+// never observe a partially written file. The mode of an existing file is
+// kept; new files are created with mode 0644. It returns the number of bytes
+// written.
+func atomicWrite(filePath string, durability Durability, write func(w io.Writer) (int64, error)) (int64, error) {
+	return atomicReplace(filePath, durability, write, nil)
+}
+
+// atomicReplace is atomicWrite with a hook: once the new content is written
+// and flushed, beforeRename is called, if set, and the write is abandoned if
+// it fails.
+func atomicReplace(filePath string, durability Durability, write func(w io.Writer) (int64, error), beforeRename func() error) (written int64, err error) {
+	dir, base := filepath.Split(filePath)
+	if dir == "" {
+		dir = "."
+	}
+
+	mode := os.FileMode(0644)
+	if info, statErr := os.Stat(filePath); statErr == nil {
+		if info.IsDir() {
+			return 0, &os.PathError{Op: "write", Path: filePath, Err: fmt.Errorf("is a directory")}
+		}
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err := step(filePath, stepCreated); err != nil {
+		return 0, err
+	}
+	if written, err = write(tmp); err != nil {
+		return written, err
+	}
+	if err := step(filePath, stepWritten); err != nil {
+		return written, err
+	}
+
+	if durability != DurabilityNone {
+		if err := tmp.Sync(); err != nil {
+			return written, err
+		}
+		if err := step(filePath, stepSynced); err != nil {
+			return written, err
+		}
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return written, err
+	}
+	if err := tmp.Close(); err != nil {
+		return written, err
+	}
+	if beforeRename != nil {
+		if err := beforeRename(); err != nil {
+			return written, err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return written, err
+	}
+	renamed = true
+	if err := step(filePath, stepRenamed); err != nil {
+		return written, err
+	}
+
+	if durability == DurabilityFull {
+		if err := syncDir(dir); err != nil {
+			return written, err
+		}
+		if err := step(filePath, stepDirSynced); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// step reports a completed step of the write to path to failpoint, if set.
+func step(path, name string) error {
+	if failpoint == nil {
+		return nil
+	}
+	return failpoint(path, name)
+}
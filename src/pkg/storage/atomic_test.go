@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// errSimulatedCrash aborts a write from failpoint.
+var errSimulatedCrash = errors.New("simulated crash")
+
+// setFailpoint installs hook for the duration of a test.
+func setFailpoint(t *testing.T, hook func(path, step string) error) {
+	t.Helper()
+	failpoint = hook
+	t.Cleanup(func() { failpoint = nil })
+}
+
+func TestSaveDataCrashSimulation(t *testing.T) {
+	const oldContent, newContent = "old content", "new content that is longer"
+
+	// A crash before the rename must leave the old content in place; from
+	// the rename on, the new content is in place.
+	testCases := []struct {
+		step     string
+		expected string
+	}{
+		{step: stepCreated, expected: oldContent},
+		{step: stepWritten, expected: oldContent},
+		{step: stepSynced, expected: oldContent},
+		{step: stepRenamed, expected: newContent},
+		{step: stepDirSynced, expected: newContent},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.step, func(t *testing.T) {
+			dir := t.TempDir()
+			filePath := filepath.Join(dir, "data.txt")
+			require.NoError(t, SaveData(context.Background(), filePath, oldContent), "Setup failed")
+
+			var atCrash string
+			setFailpoint(t, func(path, step string) error {
+				if path != filePath || step != tc.step {
+					return nil
+				}
+				// What a reader sees at the instant of the crash.
+				content, err := os.ReadFile(filePath)
+				require.NoError(t, err, "Target must stay readable mid-write")
+				atCrash = string(content)
+				return errSimulatedCrash
+			})
+
+			err := SaveData(context.Background(), filePath, newContent)
+			require.ErrorIs(t, err, errSimulatedCrash)
+			require.Equal(t, tc.expected, atCrash, "Readers must see the old or the new content, never a mix")
+
+			failpoint = nil
+			content, err := ReadData(context.Background(), filePath)
+			require.NoError(t, err, "Whichever content survives must match its recorded checksum")
+			require.Equal(t, tc.expected, content)
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Len(t, entries, 2, "Temporary files should be cleaned up after a failed write")
+		})
+	}
+}
+
+func TestSaveDataDurabilityLevels(t *testing.T) {
+	testCases := []struct {
+		durability Durability
+		steps      []string
+	}{
+		{durability: DurabilityFull, steps: []string{stepCreated, stepWritten, stepSynced, stepRenamed, stepDirSynced}},
+		{durability: DurabilityFile, steps: []string{stepCreated, stepWritten, stepSynced, stepRenamed}},
+		{durability: DurabilityNone, steps: []string{stepCreated, stepWritten, stepRenamed}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.durability.String(), func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "data.txt")
+			var steps []string
+			setFailpoint(t, func(path, step string) error {
+				if path == filePath {
+					steps = append(steps, step)
+				}
+				return nil
+			})
+
+			err := SaveDataWithOptions(context.Background(), filePath, "content", WriteOptions{Durability: tc.durability})
+			require.NoError(t, err)
+			require.Equal(t, tc.steps, steps, "Unexpected flush sequence")
+
+			content, err := os.ReadFile(filePath)
+			require.NoError(t, err)
+			require.Equal(t, "content", string(content))
+		})
+	}
+}
+
+func TestSaveDataConcurrentReadersNeverSeePartialContent(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	contents := []string{strings.Repeat("a", 256*1024), strings.Repeat("b", 128*1024)}
+	require.NoError(t, SaveData(ctx, filePath, contents[0]), "Setup failed")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				content, err := os.ReadFile(filePath)
+				if err != nil || (string(content) != contents[0] && string(content) != contents[1]) {
+					t.Errorf("Reader saw partial content (%d bytes, err %v)", len(content), err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		err := SaveDataWithOptions(ctx, filePath, contents[i%2], WriteOptions{Durability: DurabilityNone})
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestSaveDataKeepsFileMode(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "secret.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("old"), 0600), "Setup failed")
+
+	require.NoError(t, SaveData(context.Background(), filePath, "new"))
+
+	info, err := os.Stat(filePath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Replacing a file must not widen its permissions")
+}
+
+func TestParseDurability(t *testing.T) {
+	for _, d := range []Durability{DurabilityFull, DurabilityFile, DurabilityNone} {
+		parsed, err := ParseDurability(d.String())
+		require.NoError(t, err)
+		require.Equal(t, d, parsed)
+	}
+
+	_, err := ParseDurability("sometimes")
+	require.Error(t, err)
+}
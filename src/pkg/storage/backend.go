@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cgi.com/goLangTraining/src/pkg/envelope"
+)
+
+// Backend stores named blobs. Names are slash-separated paths relative to
+// the backend; names that are empty, absolute or climb out with ".." are
+// rejected with a *PathError, and reading a name that was never written
+// returns an error matching fs.ErrNotExist. Every implementation logs its
+// operations with FileMetrics.
+type Backend interface {
+	SaveData(ctx context.Context, name string, data string) error
+	ReadData(ctx context.Context, name string) (string, error)
+	// SaveStream replaces name with everything read from r and returns the
+	// number of bytes stored.
+	SaveStream(ctx context.Context, name string, r io.Reader) (int64, error)
+	// SaveIf replaces name with everything read from r only if cond holds,
+	// returning an error matching ErrPreconditionFailed otherwise, and
+	// describes the new content, with Created set if name did not exist.
+	// Checking and replacing is atomic with respect to other writes through
+	// the same Backend.
+	SaveIf(ctx context.Context, name string, cond Condition, r io.Reader) (FileInfo, error)
+	// OpenStream opens the range rng of name for reading.
+	OpenStream(ctx context.Context, name string, rng ReadRange) (*Stream, error)
+	// Stat describes name, including its checksum.
+	Stat(ctx context.Context, name string) (FileInfo, error)
+	// Delete removes name.
+	Delete(ctx context.Context, name string) error
+	// List returns the stored files matching opts, sorted by name.
+	List(ctx context.Context, opts ListOptions) (ListPage, error)
+}
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	// Name is the cleaned, slash-separated name of the file.
+	Name string `json:"name"`
+	// Size is the length of the content in bytes.
+	Size int64 `json:"size"`
+	// ModTime is when the content was last replaced.
+	ModTime time.Time `json:"mod_time"`
+	// SHA256 is the hex-encoded checksum of the content. It is only filled
+	// in by Stat.
+	SHA256 string `json:"sha256,omitempty"`
+	// Created is set by SaveIf when the save created the file rather than
+	// replacing it.
+	Created bool `json:"-"`
+}
+
+var (
+	_ Backend = (*Root)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+	_ Backend = (*VersionedBackend)(nil)
+	_ Backend = (*EncryptedBackend)(nil)
+	_ Backend = (*CompressedBackend)(nil)
+)
+
+// BackendConfig selects and configures the Backend a binary uses.
+type BackendConfig struct {
+	// Kind is the backend: "local" or "memory".
+	Kind string
+	// Root is the directory used by the local backend.
+	Root string
+	// Versioning keeps the previous content of files on every overwrite,
+	// delete and restore.
+	Versioning bool
+	// MaxVersions caps the versions kept per file; zero keeps all.
+	MaxVersions int
+	// Compression compresses stored files, versions included.
+	Compression CompressionPolicy
+	// Keys encrypts stored files, versions included. It is not set by a
+	// flag; binaries load it from envelope.Config.
+	Keys *envelope.Keyring
+	// Quota limits the storage used per user and per top-level directory.
+	// Versions count against the directory of their file.
+	Quota QuotaConfig
+}
+
+// DefaultBackendConfig returns the configuration used when no flags are
+// given: local files confined to root.
+func DefaultBackendConfig(root string) BackendConfig {
+	return BackendConfig{
+		Kind: "local",
+		Root: root,
+		Compression: CompressionPolicy{
+			Extensions: DefaultCompressExtensions,
+			MinSize:    1024,
+		},
+	}
+}
+
+// RegisterFlags defines the storage backend flags on fs, using the current
+// values of c as defaults.
+func (c *BackendConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Kind, "storage-backend", c.Kind, "File storage backend: 'local' or 'memory'")
+	fs.StringVar(&c.Root, "storage-root", c.Root, "Directory the local file storage backend is confined to")
+	fs.BoolVar(&c.Versioning, "storage-versioning", c.Versioning, "Keep previous versions of files when they are overwritten or deleted")
+	fs.IntVar(&c.MaxVersions, "storage-max-versions", c.MaxVersions, "Versions kept per file when versioning is enabled (0 keeps all)")
+	fs.BoolVar(&c.Compression.Enabled, "storage-compress", c.Compression.Enabled, "Store files gzip-compressed; reads decompress transparently")
+	fs.Func("storage-compress-ext", "Comma-separated extensions compressed with -storage-compress, or '*' for all (default "+strings.Join(c.Compression.Extensions, ",")+")", func(list string) error {
+		c.Compression.Extensions = nil
+		if strings.TrimSpace(list) != "*" {
+			c.Compression.Extensions = parseExtensions(list)
+		}
+		return nil
+	})
+	fs.Int64Var(&c.Compression.MinSize, "storage-compress-min-size", c.Compression.MinSize, "Files smaller than this many bytes are stored uncompressed")
+	c.Quota.RegisterFlags(fs)
+}
+
+// Open builds the configured Backend.
+func (c BackendConfig) Open() (Backend, error) {
+	var backend Backend
+	switch c.Kind {
+	case "local":
+		root, err := NewRoot(c.Root)
+		if err != nil {
+			return nil, err
+		}
+		backend = root
+	case "memory":
+		backend = NewMemoryBackend()
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (expected 'local' or 'memory')", c.Kind)
+	}
+
+	if c.Keys != nil {
+		backend = NewEncryptedBackend(backend, c.Keys)
+	}
+	// Compression runs before encryption, since encrypted data does not
+	// compress
+	if c.Compression.Enabled {
+		backend = NewCompressedBackend(backend, c.Compression)
+	}
+	// Quotas sit below versioning, so the versions kept by a save are
+	// charged like the save itself
+	if c.Quota.Enabled() {
+		quota, err := NewQuotaBackend(context.Background(), backend, c.Quota)
+		if err != nil {
+			return nil, err
+		}
+		backend = quota
+	}
+	if c.Versioning {
+		return NewVersionedBackend(backend, c.MaxVersions), nil
+	}
+	return backend, nil
+}
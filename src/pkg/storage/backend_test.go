@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendContract(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"local": func(t *testing.T) Backend {
+			root, err := NewRoot(t.TempDir())
+			require.NoError(t, err)
+			return root
+		},
+		"memory": func(t *testing.T) Backend {
+			return NewMemoryBackend()
+		},
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), "traceID", "test-trace")
+			backend := newBackend(t)
+
+			_, err := backend.ReadData(ctx, "missing.txt")
+			require.ErrorIs(t, err, fs.ErrNotExist, "Missing files should match fs.ErrNotExist")
+
+			require.NoError(t, backend.SaveData(ctx, "docs/notes.txt", "first"))
+			require.NoError(t, backend.SaveData(ctx, "docs/./notes.txt", "second"), "Equivalent names should address the same file")
+			content, err := backend.ReadData(ctx, "docs/notes.txt")
+			require.NoError(t, err)
+			require.Equal(t, "second", content)
+
+			written, err := backend.SaveStream(ctx, "artifacts/build.log", strings.NewReader("streamed content"))
+			require.NoError(t, err)
+			require.Equal(t, int64(len("streamed content")), written)
+			stream, err := backend.OpenStream(ctx, "artifacts/build.log", ReadRange{Offset: 9, Length: 4})
+			require.NoError(t, err)
+			part, err := io.ReadAll(stream)
+			require.NoError(t, err)
+			require.NoError(t, stream.Close())
+			require.Equal(t, "cont", string(part))
+			require.Equal(t, written, stream.Size)
+
+			_, err = backend.OpenStream(ctx, "missing.bin", ReadRange{})
+			require.ErrorIs(t, err, fs.ErrNotExist)
+			_, err = backend.OpenStream(ctx, "artifacts/build.log", ReadRange{Offset: 100})
+			require.ErrorIs(t, err, ErrInvalidRange)
+
+			info, err := backend.Stat(ctx, "artifacts/./build.log")
+			require.NoError(t, err)
+			require.Equal(t, "artifacts/build.log", info.Name)
+			require.Equal(t, written, info.Size)
+			require.False(t, info.ModTime.IsZero())
+			require.Equal(t, "d9f93d83f082633feac23f4e3d5dea332ca698ba7b00dd6ef8a9e93bae65aa6b", info.SHA256)
+
+			require.NoError(t, backend.SaveData(ctx, "artifacts/test.log", "test"))
+			page, err := backend.List(ctx, ListOptions{Prefix: "artifacts/", Limit: 1})
+			require.NoError(t, err)
+			require.Equal(t, []string{"artifacts/build.log"}, listNames(page))
+			page, err = backend.List(ctx, ListOptions{Prefix: "artifacts/", Cursor: page.NextCursor})
+			require.NoError(t, err)
+			require.Equal(t, []string{"artifacts/test.log"}, listNames(page))
+			require.Empty(t, page.NextCursor)
+
+			require.NoError(t, backend.Delete(ctx, "artifacts/build.log"))
+			_, err = backend.Stat(ctx, "artifacts/build.log")
+			require.ErrorIs(t, err, fs.ErrNotExist, "Deleted files should be gone")
+			require.ErrorIs(t, backend.Delete(ctx, "artifacts/build.log"), fs.ErrNotExist)
+
+			require.ErrorIs(t, backend.SaveData(ctx, "../escaped.txt", "x"), ErrPathTraversal)
+			require.ErrorIs(t, backend.SaveData(ctx, "/etc/passwd", "x"), ErrAbsolutePath)
+			_, err = backend.ReadData(ctx, "")
+			require.ErrorIs(t, err, ErrInvalidPath)
+		})
+	}
+}
+
+func TestBackendConfigOpen(t *testing.T) {
+	testCases := []struct {
+		name      string
+		args      []string
+		keys      bool
+		wantType  Backend
+		expectErr bool
+	}{
+		{name: "default_local", wantType: &Root{}},
+		{name: "memory", args: []string{"-storage-backend=memory"}, wantType: &MemoryBackend{}},
+		{name: "versioned", args: []string{"-storage-versioning", "-storage-max-versions=5"}, wantType: &VersionedBackend{}},
+		{name: "unknown", args: []string{"-storage-backend=s3"}, expectErr: true},
+		{name: "encrypted", keys: true, wantType: &EncryptedBackend{}},
+		{name: "encrypted_versioned", args: []string{"-storage-versioning"}, keys: true, wantType: &VersionedBackend{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultBackendConfig(t.TempDir())
+			fs := flag.NewFlagSet(tc.name, flag.ContinueOnError)
+			cfg.RegisterFlags(fs)
+			require.NoError(t, fs.Parse(tc.args))
+			if tc.keys {
+				cfg.Keys = testKeys(t, "k1")
+			}
+
+			backend, err := cfg.Open()
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.IsType(t, tc.wantType, backend)
+		})
+	}
+}
+
+func TestRootRejectsDirectories(t *testing.T) {
+	ctx := context.Background()
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, root.SaveData(ctx, "docs/notes.txt", "notes"), "Setup failed")
+
+	_, err = root.Stat(ctx, "docs")
+	require.ErrorIs(t, err, ErrIsDirectory)
+	_, err = root.OpenStream(ctx, "docs", ReadRange{})
+	require.ErrorIs(t, err, ErrIsDirectory)
+	require.ErrorIs(t, root.SaveData(ctx, "docs", "x"), ErrIsDirectory)
+	require.ErrorIs(t, root.Delete(ctx, "docs"), ErrIsDirectory)
+
+	content, err := root.ReadData(ctx, "docs/notes.txt")
+	require.NoError(t, err)
+	require.Equal(t, "notes", content, "Rejected operations must leave the directory intact")
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrCorrupt is returned when a file no longer matches the checksum recorded
+// when it was saved.
+var ErrCorrupt = errors.New("stored file is corrupt")
+
+// CorruptionError reports a file whose content does not match its recorded
+// SHA-256.
+type CorruptionError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s: checksum mismatch (recorded %s, content %s)", e.Path, e.Expected, e.Actual)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorrupt
+}
+
+// checksumSuffix ends the name of the file recording a file's SHA-256.
+const checksumSuffix = ".sha256"
+
+// checksumPath returns where the checksum of filePath is recorded: a hidden
+// file next to it in sha256sum format, so the pair can also be checked
+// with "sha256sum -c".
+func checksumPath(filePath string) string {
+	dir, base := filepath.Split(filePath)
+	return filepath.Join(dir, "."+base+checksumSuffix)
+}
+
+// maxReadAttempts bounds how often readConsistent reads a file that keeps
+// being replaced while it is read.
+const maxReadAttempts = 3
+
+// writeChecksum records sums as the checksums of filePath, one sha256sum
+// line each. Readers accept any of them.
+func writeChecksum(filePath string, durability Durability, sums ...string) error {
+	var record strings.Builder
+	for _, sum := range sums {
+		fmt.Fprintf(&record, "%s  %s\n", sum, filepath.Base(filePath))
+	}
+	_, err := atomicWrite(checksumPath(filePath), durability, func(w io.Writer) (int64, error) {
+		n, err := io.WriteString(w, record.String())
+		return int64(n), err
+	})
+	if err != nil {
+		return fmt.Errorf("record checksum of %s: %w", filePath, err)
+	}
+	return nil
+}
+
+// writeChecked atomically replaces filePath with the content produced by
+// write and records its SHA-256. Content and record are two files, so the
+// record is committed around the rename: just before it, the new sum is
+// recorded alongside the previous ones, and once the new content is in
+// place, on its own. Whichever content a reader or a crash finds, one of
+// the recorded sums matches it.
+func writeChecked(filePath string, durability Durability, write func(w io.Writer) (int64, error)) (int64, error) {
+	var sum string
+	written, err := atomicReplace(filePath, durability, func(w io.Writer) (int64, error) {
+		hw, h := hashingWriter(w)
+		n, err := write(hw)
+		sum = hexSum(h)
+		return n, err
+	}, func() error {
+		// A file without a record passes verification, so it needs no
+		// interim record either
+		previous, err := readChecksums(filePath)
+		if err != nil || len(previous) == 0 {
+			return err
+		}
+		return writeChecksum(filePath, durability, append([]string{sum}, previous...)...)
+	})
+	if err != nil {
+		return written, err
+	}
+
+	// A concurrent save that recorded its own sum since then finishes the
+	// record itself
+	recorded, err := readChecksums(filePath)
+	if err == nil && (len(recorded) == 0 || recorded[0] == sum) {
+		err = writeChecksum(filePath, durability, sum)
+	}
+	return written, err
+}
+
+// readChecksums returns the recorded checksums of filePath, newest first:
+// one normally, and the previous ones as well while a save is replacing the
+// file. It returns none for files saved before checksums were recorded.
+func readChecksums(filePath string) ([]string, error) {
+	f, err := os.Open(checksumPath(filePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sums []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		sum, _, _ := strings.Cut(line, " ")
+		if len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s: malformed checksum record", checksumPath(filePath))
+		}
+		sums = append(sums, sum)
+	}
+	return sums, scanner.Err()
+}
+
+// removeChecksum deletes the recorded checksum of filePath, if any.
+func removeChecksum(filePath string) error {
+	err := os.Remove(checksumPath(filePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// matchChecksum compares actual with the checksums recorded for filePath.
+// Files without a recorded checksum pass.
+func matchChecksum(filePath, actual string, recorded []string) error {
+	if len(recorded) == 0 || slices.Contains(recorded, actual) {
+		return nil
+	}
+	return &CorruptionError{Path: filePath, Expected: recorded[0], Actual: actual}
+}
+
+// readConsistent opens filePath and calls read, which returns the SHA-256
+// of what it read from the file, then reads the checksums recorded for it.
+// If none matches because the file was replaced in the meantime, the record
+// may describe the new file, so the whole read is repeated.
+func readConsistent(filePath string, read func(f *os.File) (string, error)) (actual string, recorded []string, err error) {
+	for attempt := 1; ; attempt++ {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return "", nil, err
+		}
+		actual, err = read(f)
+		if err == nil {
+			recorded, err = readChecksums(filePath)
+		}
+		retry := err == nil && matchChecksum(filePath, actual, recorded) != nil &&
+			attempt < maxReadAttempts && replacedSince(f, filePath)
+		f.Close()
+		if !retry {
+			return actual, recorded, err
+		}
+	}
+}
+
+// replacedSince reports whether filePath no longer names the file open as
+// f.
+func replacedSince(f *os.File, filePath string) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(filePath)
+	return err != nil || !os.SameFile(opened, current)
+}
+
+// hashingWriter tees everything written to w into a SHA-256.
+func hashingWriter(w io.Writer) (io.Writer, hash.Hash) {
+	h := sha256.New()
+	return io.MultiWriter(w, h), h
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flipByte corrupts the file at filePath in place without changing its size.
+func flipByte(t *testing.T, filePath string) {
+	t.Helper()
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err, "Setup failed")
+	content[0] ^= 0xff
+	require.NoError(t, os.WriteFile(filePath, content, 0644), "Setup failed")
+}
+
+func TestReadDataDetectsCorruption(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	require.NoError(t, SaveData(ctx, filePath, "precious content"))
+
+	recorded, err := os.ReadFile(checksumPath(filePath))
+	require.NoError(t, err, "A checksum should be recorded next to the file")
+	require.True(t, strings.HasSuffix(string(recorded), "  data.txt\n"), "The record should be in sha256sum format")
+
+	content, err := ReadData(ctx, filePath)
+	require.NoError(t, err)
+	require.Equal(t, "precious content", content)
+
+	flipByte(t, filePath)
+	_, err = ReadData(ctx, filePath)
+	require.ErrorIs(t, err, ErrCorrupt)
+	var corruption *CorruptionError
+	require.ErrorAs(t, err, &corruption)
+	require.Equal(t, filePath, corruption.Path)
+	require.NotEqual(t, corruption.Expected, corruption.Actual)
+
+	stream, err := OpenStream(ctx, filePath, ReadRange{})
+	require.NoError(t, err)
+	_, err = io.ReadAll(stream)
+	require.ErrorIs(t, err, ErrCorrupt, "Full streamed reads should be verified too")
+	require.NoError(t, stream.Close())
+
+	stream, err = OpenStream(ctx, filePath, ReadRange{Offset: 1, Length: 4})
+	require.NoError(t, err)
+	part, err := io.ReadAll(stream)
+	require.NoError(t, err, "Range reads cannot be verified and must not fail")
+	require.Equal(t, "reci", string(part))
+	require.NoError(t, stream.Close())
+}
+
+func TestReadDataAcceptsFilesWithoutChecksum(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "legacy.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("from before checksums"), 0644), "Setup failed")
+
+	content, err := ReadData(context.Background(), filePath)
+	require.NoError(t, err)
+	require.Equal(t, "from before checksums", content)
+}
+
+func TestRootHidesChecksums(t *testing.T) {
+	ctx := context.Background()
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, root.SaveData(ctx, "docs/a.txt", "a"))
+
+	page, err := root.List(ctx, ListOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"docs/a.txt"}, listNames(page))
+
+	_, err = root.ReadData(ctx, "docs/.a.txt.sha256")
+	require.ErrorIs(t, err, ErrReservedPath)
+	require.ErrorIs(t, root.SaveData(ctx, "docs/.a.txt.sha256", "forged"), ErrReservedPath)
+
+	require.NoError(t, root.Delete(ctx, "docs/a.txt"))
+	entries, err := os.ReadDir(filepath.Join(root.Dir(), "docs"))
+	require.NoError(t, err)
+	require.Empty(t, entries, "Deleting a file should delete its checksum")
+}
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+	dir := root.Dir()
+
+	require.NoError(t, root.SaveData(ctx, "ok.txt", "fine"), "Setup failed")
+	require.NoError(t, root.SaveData(ctx, "docs/rotten.txt", "will rot"), "Setup failed")
+	flipByte(t, filepath.Join(dir, "docs", "rotten.txt"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "legacy.txt"), []byte("old"), 0644), "Setup failed")
+	require.NoError(t, root.SaveData(ctx, "gone.txt", "soon gone"), "Setup failed")
+	require.NoError(t, os.Remove(filepath.Join(dir, "gone.txt")), "Setup failed")
+
+	problems := func(report FsckReport) map[string]string {
+		found := make(map[string]string)
+		for _, issue := range report.Issues {
+			found[issue.Name] = issue.Problem
+		}
+		return found
+	}
+	expected := map[string]string{
+		"docs/rotten.txt":  FsckCorrupt,
+		"legacy.txt":       FsckMissingChecksum,
+		".gone.txt.sha256": FsckOrphanChecksum,
+	}
+
+	report, err := root.Fsck(ctx, FsckOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Files)
+	require.Equal(t, 1, report.OK)
+	require.Equal(t, expected, problems(report))
+	for _, issue := range report.Issues {
+		require.Empty(t, issue.Action, "A check without repair must not change anything")
+	}
+
+	report, err = root.Fsck(ctx, FsckOptions{Repair: true})
+	require.NoError(t, err)
+	require.Equal(t, expected, problems(report))
+	for _, issue := range report.Issues {
+		require.NotEmpty(t, issue.Action, "Repair should act on %s", issue.Name)
+	}
+
+	report, err = root.Fsck(ctx, FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Issues, "Nothing should be left to repair")
+	require.Equal(t, 2, report.Files, "The corrupt file should have been moved aside")
+
+	_, err = root.Stat(ctx, "docs/rotten.txt")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	quarantined, err := filepath.Glob(filepath.Join(dir, "docs", ".rotten.txt.quarantine-*"))
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1, "The corrupt content should be kept for inspection")
+}
+
+func TestChecksumRecordedBeforeRename(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "data.txt")
+	require.NoError(t, SaveData(ctx, filePath, "old content"), "Setup failed")
+
+	var atRename []string
+	setFailpoint(t, func(path, step string) error {
+		if path != filePath || step != stepRenamed {
+			return nil
+		}
+		var err error
+		atRename, err = readChecksums(filePath)
+		require.NoError(t, err)
+		return errSimulatedCrash
+	})
+	_, err := SaveStream(ctx, filePath, strings.NewReader("new content"), WriteOptions{})
+	require.ErrorIs(t, err, errSimulatedCrash)
+	require.Len(t, atRename, 2, "The new sum should be recorded before the content is renamed into place")
+	failpoint = nil
+
+	content, err := ReadData(ctx, filePath)
+	require.NoError(t, err)
+	require.Equal(t, "new content", content)
+	report, err := Fsck(ctx, filepath.Dir(filePath), FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Issues, "An interrupted save must not look corrupt")
+
+	require.NoError(t, SaveData(ctx, filePath, "newer content"))
+	recorded, err := readChecksums(filePath)
+	require.NoError(t, err)
+	require.Len(t, recorded, 1, "A completed save should record only its own sum")
+}
+
+func TestChecksumVerifiedDuringConcurrentSaves(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "data.txt")
+	contents := []string{strings.Repeat("a", 64*1024), strings.Repeat("b", 32*1024)}
+	require.NoError(t, SaveData(ctx, filePath, contents[0]), "Setup failed")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	readers := []func() error{
+		func() error {
+			_, err := ReadData(ctx, filePath)
+			return err
+		},
+		func() error {
+			stream, err := OpenStream(ctx, filePath, ReadRange{})
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+			_, err = io.Copy(io.Discard, stream)
+			return err
+		},
+		func() error {
+			report, err := Fsck(ctx, dir, FsckOptions{})
+			if err == nil && len(report.Issues) > 0 {
+				err = fmt.Errorf("fsck reported %+v", report.Issues)
+			}
+			return err
+		},
+	}
+	for _, read := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := read(); err != nil {
+					t.Errorf("Reader failed during saves: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		opts := WriteOptions{Durability: DurabilityNone}
+		var err error
+		if i%2 == 0 {
+			err = SaveDataWithOptions(ctx, filePath, contents[i%2], opts)
+		} else {
+			_, err = SaveStream(ctx, filePath, strings.NewReader(contents[i%2]), opts)
+		}
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,481 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+)
+
+// A compressed file is compressedMagic, a single gzip member holding the
+// content, and the length of the content as 8 big-endian bytes. The
+// trailer lets Stat report the logical size without decompressing.
+const (
+	compressedMagic       = "GZST\x01"
+	compressedTrailerSize = 8
+)
+
+// ErrNotCompressed is returned by OpenGzip for files stored as they are.
+var ErrNotCompressed = errors.New("file is not stored compressed")
+
+// DefaultCompressExtensions are the extensions compressed when no others
+// are configured: text formats that shrink well.
+var DefaultCompressExtensions = []string{".txt", ".log", ".csv", ".json", ".ndjson", ".xml", ".html", ".md", ".svg"}
+
+// CompressionPolicy decides which files a CompressedBackend compresses.
+type CompressionPolicy struct {
+	// Enabled turns compression on.
+	Enabled bool
+	// Extensions lists the lower-case extensions, with their dot, of the
+	// files to compress. Empty compresses every file.
+	Extensions []string
+	// MinSize is the size below which files are stored as they are; that
+	// much of every matching file is buffered before deciding.
+	MinSize int64
+}
+
+// matches reports whether files called name are compressed.
+func (p CompressionPolicy) matches(name string) bool {
+	if len(p.Extensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range p.Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExtensions splits a comma-separated list of extensions, adding
+// missing dots.
+func parseExtensions(list string) []string {
+	var exts []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+// GzipOpener is implemented by backends that can hand out the gzip encoding
+// of a compressed file as it is stored, so it can be served to clients that
+// accept gzip without decompressing it first.
+type GzipOpener interface {
+	// OpenGzip opens the gzip data of name, or returns ErrNotCompressed if
+	// name is stored as it is.
+	OpenGzip(ctx context.Context, name string) (*Stream, error)
+}
+
+var (
+	_ GzipOpener = (*CompressedBackend)(nil)
+	_ GzipOpener = (*VersionedBackend)(nil)
+)
+
+// CompressedBackend wraps a Backend and gzip-compresses the files its policy
+// selects. Reads decompress transparently, and files stored as they are
+// stay readable, so the policy can change at any time.
+//
+// Sizes and ranges refer to the logical, uncompressed content. Checksums
+// and ETags describe the stored bytes.
+type CompressedBackend struct {
+	inner  Backend
+	policy CompressionPolicy
+}
+
+// NewCompressedBackend returns a CompressedBackend storing files in inner and
+// compressing those policy selects.
+func NewCompressedBackend(inner Backend, policy CompressionPolicy) *CompressedBackend {
+	return &CompressedBackend{inner: inner, policy: policy}
+}
+
+// SaveData stores data as name, compressed if the policy selects it.
+func (c *CompressedBackend) SaveData(ctx context.Context, name string, data string) error {
+	_, err := c.SaveIf(ctx, name, Condition{}, strings.NewReader(data))
+	return err
+}
+
+// ReadData returns the uncompressed content of name.
+func (c *CompressedBackend) ReadData(ctx context.Context, name string) (string, error) {
+	stream, err := c.OpenStream(ctx, name, ReadRange{})
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	var buf strings.Builder
+	if _, err := io.Copy(&buf, stream); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// SaveStream stores the content of r as name, compressed if the policy
+// selects it.
+func (c *CompressedBackend) SaveStream(ctx context.Context, name string, r io.Reader) (int64, error) {
+	info, err := c.SaveIf(ctx, name, Condition{}, r)
+	return info.Size, err
+}
+
+// SaveIf stores the content of r as name if cond holds, compressed if the
+// policy selects it. Content that happens to start like a compressed file
+// is always compressed, so it cannot be mistaken for one.
+func (c *CompressedBackend) SaveIf(ctx context.Context, name string, cond Condition, r io.Reader) (FileInfo, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	compress := c.policy.Enabled && c.policy.matches(name)
+	head := make([]byte, max(c.policy.MinSize, int64(len(compressedMagic))))
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return FileInfo{}, err
+	}
+	head = head[:n]
+	src := io.MultiReader(bytes.NewReader(head), r)
+	if int64(n) < c.policy.MinSize {
+		compress = false
+	}
+	if bytes.HasPrefix(head, []byte(compressedMagic)) {
+		compress = true
+	}
+	if !compress {
+		return c.inner.SaveIf(ctx, name, cond, src)
+	}
+
+	cr := newCompressReader(src)
+	info, err := c.inner.SaveIf(ctx, name, cond, cr)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	metrics := FileMetrics{
+		LogicalSize: cr.size,
+		DiskSize:    info.Size,
+		Operation:   "compress",
+	}
+	slog.InfoContext(ctx, "File stored compressed",
+		"name", name,
+		"traceID", traceID,
+		"metrics", metrics)
+	info.Size = cr.size
+	return info, nil
+}
+
+// OpenStream opens the range rng of the uncompressed content of name.
+// Compressed content that fails to decode is reported as ErrCorrupt.
+func (c *CompressedBackend) OpenStream(ctx context.Context, name string, rng ReadRange) (*Stream, error) {
+	for attempt := 1; ; attempt++ {
+		stream, err := c.openStream(ctx, name, rng)
+		if !errors.Is(err, errReplaced) || attempt == reopenAttempts {
+			return stream, err
+		}
+	}
+}
+
+func (c *CompressedBackend) openStream(ctx context.Context, name string, rng ReadRange) (*Stream, error) {
+	head, err := c.inner.OpenStream(ctx, name, ReadRange{})
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(head, streamChunkSize)
+	compressed, err := hasCompressedMagic(br)
+	if err != nil || !compressed {
+		head.Close()
+		if err != nil {
+			return nil, err
+		}
+		return c.inner.OpenStream(ctx, name, rng)
+	}
+
+	size, err := c.logicalSize(ctx, name, head.Size, head.ModTime)
+	if err != nil {
+		head.Close()
+		return nil, err
+	}
+	offset, length, err := rng.resolve(size)
+	if err != nil {
+		head.Close()
+		return nil, err
+	}
+
+	br.Discard(len(compressedMagic))
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		head.Close()
+		return nil, decodeError(name, err)
+	}
+	// The trailer follows the gzip member; it is not another member
+	gz.Multistream(false)
+	src := &decompressReader{name: name, gz: gz, rest: br, want: size}
+	if _, err := io.CopyN(io.Discard, src, offset); err != nil {
+		head.Close()
+		return nil, err
+	}
+	return newStream(ctx, name, src, head, head.ModTime, size, offset, length), nil
+}
+
+// OpenGzip opens the gzip data of name as it is stored. The stream's Length
+// is the length of the gzip data; Size and Offset describe the stored file.
+func (c *CompressedBackend) OpenGzip(ctx context.Context, name string) (*Stream, error) {
+	for attempt := 1; ; attempt++ {
+		stream, err := c.openGzip(ctx, name)
+		if !errors.Is(err, errReplaced) || attempt == reopenAttempts {
+			return stream, err
+		}
+	}
+}
+
+func (c *CompressedBackend) openGzip(ctx context.Context, name string) (*Stream, error) {
+	head, err := c.inner.OpenStream(ctx, name, ReadRange{Length: int64(len(compressedMagic))})
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := hasCompressedMagic(bufio.NewReader(head))
+	head.Close()
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotCompressed)
+	}
+	if head.Size < int64(len(compressedMagic)+compressedTrailerSize) {
+		return nil, badCompressed(name, "truncated file")
+	}
+
+	body, err := c.inner.OpenStream(ctx, name, ReadRange{
+		Offset: int64(len(compressedMagic)),
+		Length: head.Size - int64(len(compressedMagic)+compressedTrailerSize),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if body.Size != head.Size || !body.ModTime.Equal(head.ModTime) {
+		body.Close()
+		return nil, fmt.Errorf("%s: %w", name, errReplaced)
+	}
+	return body, nil
+}
+
+// Stat describes name. Size is the length of the uncompressed content.
+func (c *CompressedBackend) Stat(ctx context.Context, name string) (FileInfo, error) {
+	info, err := c.inner.Stat(ctx, name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return c.describe(ctx, info)
+}
+
+// Delete removes name.
+func (c *CompressedBackend) Delete(ctx context.Context, name string) error {
+	return c.inner.Delete(ctx, name)
+}
+
+// List returns the stored files matching opts, with the sizes of their
+// uncompressed content.
+func (c *CompressedBackend) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	page, err := c.inner.List(ctx, opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+	for i, file := range page.Files {
+		// Files that cannot be decoded are still listed; reading them
+		// reports the problem.
+		if info, err := c.describe(ctx, file); err == nil {
+			page.Files[i] = info
+		}
+	}
+	return page, nil
+}
+
+// describe replaces the stored size in info with the logical size if the
+// file is compressed.
+func (c *CompressedBackend) describe(ctx context.Context, info FileInfo) (FileInfo, error) {
+	head, err := c.inner.OpenStream(ctx, info.Name, ReadRange{Length: int64(len(compressedMagic))})
+	if err != nil {
+		return FileInfo{}, err
+	}
+	compressed, err := hasCompressedMagic(bufio.NewReader(head))
+	head.Close()
+	if err != nil || !compressed {
+		return info, err
+	}
+
+	size, err := c.logicalSize(ctx, info.Name, head.Size, head.ModTime)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info.Size = size
+	return info, nil
+}
+
+// logicalSize reads the trailer of the compressed file name, which must
+// still have the given stored size and modification time.
+func (c *CompressedBackend) logicalSize(ctx context.Context, name string, size int64, modTime time.Time) (int64, error) {
+	if size < int64(len(compressedMagic)+compressedTrailerSize) {
+		return 0, badCompressed(name, "truncated file")
+	}
+	trailer, err := c.inner.OpenStream(ctx, name, ReadRange{Offset: size - compressedTrailerSize})
+	if err != nil {
+		return 0, err
+	}
+	defer trailer.Close()
+	if trailer.Size != size || !trailer.ModTime.Equal(modTime) {
+		return 0, fmt.Errorf("%s: %w", name, errReplaced)
+	}
+
+	var b [compressedTrailerSize]byte
+	if _, err := io.ReadFull(trailer, b[:]); err != nil {
+		return 0, err
+	}
+	logical := binary.BigEndian.Uint64(b[:])
+	if logical > 1<<62 {
+		return 0, badCompressed(name, "implausible size %d", logical)
+	}
+	return int64(logical), nil
+}
+
+// hasCompressedMagic reports whether r starts like a compressed file
+// without consuming anything.
+func hasCompressedMagic(r *bufio.Reader) (bool, error) {
+	prefix, err := r.Peek(len(compressedMagic))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return string(prefix) == compressedMagic, nil
+}
+
+// compressReader produces the compressed file format from src, compressing
+// one chunk at a time.
+type compressReader struct {
+	src   io.Reader
+	gz    *gzip.Writer
+	chunk []byte
+	out   bytes.Buffer // compressed bytes not yet returned
+	size  int64        // content read from src so far
+	done  bool         // the trailer has been written
+}
+
+func newCompressReader(src io.Reader) *compressReader {
+	r := &compressReader{src: src, chunk: make([]byte, streamChunkSize)}
+	r.out.WriteString(compressedMagic)
+	r.gz = gzip.NewWriter(&r.out)
+	return r
+}
+
+func (r *compressReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n, err := r.src.Read(r.chunk)
+		r.size += int64(n)
+		if _, werr := r.gz.Write(r.chunk[:n]); werr != nil {
+			return 0, werr
+		}
+		if err == io.EOF {
+			if err := r.gz.Close(); err != nil {
+				return 0, err
+			}
+			binary.Write(&r.out, binary.BigEndian, uint64(r.size))
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+// decompressReader decodes the gzip member of a compressed file. Once the
+// member ends it reads the trailer to the end of the file, so the stored
+// file's checksum is verified, and checks the decoded length against it.
+type decompressReader struct {
+	name string
+	gz   *gzip.Reader
+	rest io.Reader
+	want int64
+	n    int64
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	n, err := d.gz.Read(p)
+	d.n += int64(n)
+	if err == io.EOF {
+		trailer, rerr := io.ReadAll(d.rest)
+		if rerr != nil {
+			return n, rerr
+		}
+		if len(trailer) != compressedTrailerSize || int64(binary.BigEndian.Uint64(trailer)) != d.n || d.n != d.want {
+			return n, badCompressed(d.name, "decoded %d bytes, expected %d", d.n, d.want)
+		}
+	} else if err != nil {
+		err = decodeError(d.name, err)
+	}
+	return n, err
+}
+
+// encodeCompressed returns data in the compressed file format.
+func encodeCompressed(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(newCompressReader(bytes.NewReader(data))); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCompressed returns the content of a compressed file read into
+// memory. Files stored as they are are returned unchanged.
+func decodeCompressed(name string, stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, []byte(compressedMagic)) {
+		return stored, nil
+	}
+	if len(stored) < len(compressedMagic)+compressedTrailerSize {
+		return nil, badCompressed(name, "truncated file")
+	}
+
+	body := stored[len(compressedMagic) : len(stored)-compressedTrailerSize]
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, decodeError(name, err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, decodeError(name, err)
+	}
+	if want := binary.BigEndian.Uint64(stored[len(stored)-compressedTrailerSize:]); uint64(len(data)) != want {
+		return nil, badCompressed(name, "decoded %d bytes, expected %d", len(data), want)
+	}
+	return data, nil
+}
+
+// decodeError reports compressed content of name that does not decode as
+// ErrCorrupt. Errors that are not about the data, such as a cancelled
+// context, are returned unchanged.
+func decodeError(name string, err error) error {
+	var flateErr flate.CorruptInputError
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.As(err, &flateErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%s: %w: compressed data does not decode: %w", name, ErrCorrupt, err)
+	}
+	return err
+}
+
+// badCompressed reports compressed content of name that is inconsistent
+// with its trailer as ErrCorrupt.
+func badCompressed(name, format string, args ...any) error {
+	return fmt.Errorf("%s: %w: %s", name, ErrCorrupt, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveDataCompressed(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "report.txt")
+	content := strings.Repeat("status: all systems nominal\n", 500)
+
+	require.NoError(t, SaveDataWithOptions(ctx, filePath, content, WriteOptions{Compress: true}))
+	stat, err := os.Stat(filePath)
+	require.NoError(t, err)
+	require.Less(t, stat.Size(), int64(len(content)/10), "Repetitive text should shrink on disk")
+
+	read, err := ReadData(ctx, filePath)
+	require.NoError(t, err)
+	require.Equal(t, content, read)
+
+	report, err := Fsck(ctx, filepath.Dir(filePath), FsckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Issues, "The recorded checksum describes the compressed bytes")
+}
+
+func TestCompressedBackend(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	root, err := NewRoot(dir)
+	require.NoError(t, err)
+	backend := NewCompressedBackend(root, CompressionPolicy{Enabled: true, Extensions: []string{".txt"}, MinSize: 64})
+
+	content := strings.Repeat("0123456789abcdef", 10000)
+	info, err := backend.SaveIf(ctx, "logs/app.txt", Condition{}, strings.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), info.Size, "Sizes describe the logical content")
+
+	stored, err := os.Stat(filepath.Join(dir, "logs", "app.txt"))
+	require.NoError(t, err)
+	require.Less(t, stored.Size(), int64(len(content)/10))
+
+	stat, err := backend.Stat(ctx, "logs/app.txt")
+	require.NoError(t, err)
+	require.True(t, info.Created)
+	info.Created = false
+	require.Equal(t, info, stat)
+	page, err := backend.List(ctx, ListOptions{Prefix: "logs/"})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), page.Files[0].Size)
+
+	stream, err := backend.OpenStream(ctx, "logs/app.txt", ReadRange{Offset: 100000, Length: 20})
+	require.NoError(t, err)
+	part, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	require.Equal(t, content[100000:100020], string(part))
+	require.Equal(t, int64(len(content)), stream.Size)
+
+	read, err := backend.ReadData(ctx, "logs/app.txt")
+	require.NoError(t, err)
+	require.Equal(t, content, read)
+
+	gz, err := backend.OpenGzip(ctx, "logs/app.txt")
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(gz)
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	require.Equal(t, content, string(decoded), "The stored encoding should be plain gzip")
+
+	testCases := []struct {
+		name    string
+		file    string
+		content string
+		stored  bool // stored compressed
+	}{
+		{name: "other_extension", file: "image.png", content: strings.Repeat("x", 1000)},
+		{name: "too_small", file: "small.txt", content: "tiny"},
+		{name: "looks_compressed", file: "trick.png", content: compressedMagic + "not really", stored: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, backend.SaveData(ctx, tc.file, tc.content))
+			read, err := backend.ReadData(ctx, tc.file)
+			require.NoError(t, err)
+			require.Equal(t, tc.content, read)
+			info, err := backend.Stat(ctx, tc.file)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(tc.content)), info.Size)
+
+			_, err = backend.OpenGzip(ctx, tc.file)
+			if tc.stored {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrNotCompressed)
+			}
+		})
+	}
+}
+
+func TestCompressedBackendReportsCorruption(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	root, err := NewRoot(dir)
+	require.NoError(t, err)
+	backend := NewCompressedBackend(root, CompressionPolicy{Enabled: true})
+	require.NoError(t, backend.SaveData(ctx, "notes.txt", strings.Repeat("note ", 1000)))
+
+	// Damage the file and drop its checksum, so only decoding can notice
+	filePath := filepath.Join(dir, "notes.txt")
+	raw, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	raw[len(raw)/2] ^= 0xff
+	require.NoError(t, os.Remove(checksumPath(filePath)))
+	require.NoError(t, os.WriteFile(filePath, raw, 0644))
+
+	_, err = backend.ReadData(ctx, "notes.txt")
+	require.ErrorIs(t, err, ErrCorrupt)
+	_, err = ReadData(ctx, filePath)
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestBackendConfigCompressesBeforeEncrypting(t *testing.T) {
+	ctx := context.Background()
+	cfg := DefaultBackendConfig(t.TempDir())
+	fs := flag.NewFlagSet("compress", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-storage-compress", "-storage-compress-ext=log, CSV", "-storage-versioning"}))
+	require.Equal(t, []string{".log", ".csv"}, cfg.Compression.Extensions)
+	cfg.Keys = testKeys(t, "k1")
+
+	backend, err := cfg.Open()
+	require.NoError(t, err)
+	content := strings.Repeat("2026-10-16 INFO request served\n", 2000)
+	require.NoError(t, backend.SaveData(ctx, "app.log", content))
+
+	stored, err := os.Stat(filepath.Join(cfg.Root, "app.log"))
+	require.NoError(t, err)
+	require.Less(t, stored.Size(), int64(len(content)/10), "Content should be compressed before it is encrypted")
+
+	read, err := backend.ReadData(ctx, "app.log")
+	require.NoError(t, err)
+	require.Equal(t, content, read)
+	_, err = backend.(GzipOpener).OpenGzip(ctx, "app.log")
+	require.NoError(t, err, "The versioning layer should pass gzip reads through")
+}
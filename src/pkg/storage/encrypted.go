@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+
+	"cgi.com/goLangTraining/src/pkg/envelope"
+)
+
+// Problems reported by Reencrypt.
+const (
+	ReencryptChanged = "changed" // replaced while it was being re-encrypted
+	ReencryptFailed  = "failed"  // could not be decrypted or rewritten
+)
+
+// reopenAttempts bounds how often OpenStream retries a file that is replaced
+// between reading its header and opening the requested range.
+const reopenAttempts = 3
+
+// errReplaced reports a file that changed between two opens.
+var errReplaced = errors.New("file was replaced while it was opened")
+
+// EncryptedBackend wraps a Backend and encrypts everything it stores with
+// envelope encryption under the active key of a keyring. Files written
+// before encryption was enabled are still read as they are, so encryption
+// can be turned on for an existing tree and the tree re-encrypted later
+// with Reencrypt.
+//
+// Sizes and ranges refer to the decrypted content. Checksums and ETags
+// describe the stored, encrypted bytes, so Fsck keeps working without keys
+// and every save still changes the ETag.
+type EncryptedBackend struct {
+	inner Backend
+	keys  *envelope.Keyring
+}
+
+// NewEncryptedBackend returns an EncryptedBackend storing files in inner,
+// encrypted under keys.
+func NewEncryptedBackend(inner Backend, keys *envelope.Keyring) *EncryptedBackend {
+	return &EncryptedBackend{inner: inner, keys: keys}
+}
+
+// SaveData encrypts data and stores it as name.
+func (e *EncryptedBackend) SaveData(ctx context.Context, name string, data string) error {
+	_, err := e.SaveIf(ctx, name, Condition{}, strings.NewReader(data))
+	return err
+}
+
+// ReadData returns the decrypted content of name.
+func (e *EncryptedBackend) ReadData(ctx context.Context, name string) (string, error) {
+	stream, err := e.OpenStream(ctx, name, ReadRange{})
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	var buf strings.Builder
+	if _, err := io.Copy(&buf, stream); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// SaveStream encrypts the content of r and stores it as name.
+func (e *EncryptedBackend) SaveStream(ctx context.Context, name string, r io.Reader) (int64, error) {
+	info, err := e.SaveIf(ctx, name, Condition{}, r)
+	return info.Size, err
+}
+
+// SaveIf encrypts the content of r and stores it as name if cond holds.
+func (e *EncryptedBackend) SaveIf(ctx context.Context, name string, cond Condition, r io.Reader) (FileInfo, error) {
+	sealed, err := e.keys.EncryptReader(r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := e.inner.SaveIf(ctx, name, cond, sealed)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return plainInfo(name, info)
+}
+
+// OpenStream opens the range rng of the decrypted content of name. Only the
+// chunks covering the range are read and decrypted. Content that fails to
+// decrypt is reported as ErrCorrupt, either here or by Read.
+func (e *EncryptedBackend) OpenStream(ctx context.Context, name string, rng ReadRange) (*Stream, error) {
+	for attempt := 1; ; attempt++ {
+		stream, err := e.openStream(ctx, name, rng)
+		if !errors.Is(err, errReplaced) || attempt == reopenAttempts {
+			return stream, err
+		}
+	}
+}
+
+func (e *EncryptedBackend) openStream(ctx context.Context, name string, rng ReadRange) (*Stream, error) {
+	head, err := e.inner.OpenStream(ctx, name, ReadRange{})
+	if err != nil {
+		return nil, err
+	}
+	h, err := envelope.ReadHeader(head)
+	if errors.Is(err, envelope.ErrNotEncrypted) {
+		// Written before encryption was enabled
+		head.Close()
+		return e.inner.OpenStream(ctx, name, rng)
+	}
+	if err != nil {
+		head.Close()
+		return nil, corrupt(name, err)
+	}
+
+	size, lastChunk, err := envelope.PlainSize(head.Size)
+	if err != nil {
+		head.Close()
+		return nil, corrupt(name, err)
+	}
+	offset, length, err := rng.resolve(size)
+	if err != nil {
+		head.Close()
+		return nil, err
+	}
+	first := offset / envelope.ChunkSize
+	last := lastChunk
+	if length > 0 {
+		last = min(lastChunk, (offset+length-1)/envelope.ChunkSize)
+	}
+
+	// Reading the whole file through head also verifies its checksum;
+	// later ranges are opened where their first chunk starts.
+	body := head
+	if first > 0 {
+		body, err = e.inner.OpenStream(ctx, name, ReadRange{Offset: envelope.ChunkOffset(first)})
+		head.Close()
+		if err != nil {
+			return nil, err
+		}
+		if body.Size != head.Size || !body.ModTime.Equal(head.ModTime) {
+			body.Close()
+			return nil, fmt.Errorf("%s: %w", name, errReplaced)
+		}
+	}
+
+	plain, err := e.keys.DecryptReader(h, body, first, last)
+	if err != nil {
+		body.Close()
+		return nil, corrupt(name, err)
+	}
+	src := &decryptedReader{name: name, r: plain}
+	if _, err := io.CopyN(io.Discard, src, offset-first*envelope.ChunkSize); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return newStream(ctx, name, src, body, head.ModTime, size, offset, length), nil
+}
+
+// Stat describes name. Size is the length of the decrypted content.
+func (e *EncryptedBackend) Stat(ctx context.Context, name string) (FileInfo, error) {
+	info, err := e.inner.Stat(ctx, name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if _, err := e.header(ctx, name); errors.Is(err, envelope.ErrNotEncrypted) {
+		return info, nil
+	} else if err != nil {
+		return FileInfo{}, err
+	}
+	return plainInfo(name, info)
+}
+
+// Delete removes name.
+func (e *EncryptedBackend) Delete(ctx context.Context, name string) error {
+	return e.inner.Delete(ctx, name)
+}
+
+// List returns the stored files matching opts, with the sizes of their
+// decrypted content.
+func (e *EncryptedBackend) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	page, err := e.inner.List(ctx, opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+	for i, file := range page.Files {
+		if _, err := e.header(ctx, file.Name); errors.Is(err, envelope.ErrNotEncrypted) {
+			continue
+		}
+		// Files that cannot be decrypted are still listed; reading them
+		// reports the problem.
+		if size, _, err := envelope.PlainSize(file.Size); err == nil {
+			page.Files[i].Size = size
+		}
+	}
+	return page, nil
+}
+
+// ReencryptReport summarises a Reencrypt run.
+type ReencryptReport struct {
+	Files     int         `json:"files"`     // stored files checked, versions included
+	Current   int         `json:"current"`   // already encrypted under the active key
+	Encrypted int         `json:"encrypted"` // plain files encrypted
+	Rotated   int         `json:"rotated"`   // files moved from an older key to the active one
+	Issues    []FsckIssue `json:"issues,omitempty"`
+}
+
+// Reencrypt encrypts every stored file that is plain, or encrypted under a
+// key other than the active one, under the active key. Once it reports no
+// issues, older keys can be removed from the key file. Each file is only
+// replaced if it did not change while it was being re-encrypted; files that
+// did are reported as ReencryptChanged and can be picked up by running
+// Reencrypt again.
+func (e *EncryptedBackend) Reencrypt(ctx context.Context) (ReencryptReport, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+	var report ReencryptReport
+
+	opts := ListOptions{Limit: MaxListLimit}
+	for {
+		page, err := e.inner.List(ctx, opts)
+		if err != nil {
+			return report, err
+		}
+		for _, file := range page.Files {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			report.Files++
+			if err := e.reencryptFile(ctx, file.Name, &report); err != nil {
+				return report, err
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+
+	slog.InfoContext(ctx, "Storage re-encryption finished",
+		"keyID", e.keys.ActiveKeyID(),
+		"files", report.Files,
+		"encrypted", report.Encrypted,
+		"rotated", report.Rotated,
+		"issues", len(report.Issues),
+		"traceID", traceID)
+	return report, nil
+}
+
+// reencryptFile re-encrypts name under the active key if it needs to be and
+// records the outcome in report. The new content is staged encrypted in a
+// temporary file, so name is closed before it is replaced and plain content
+// never reaches the disk.
+func (e *EncryptedBackend) reencryptFile(ctx context.Context, name string, report *ReencryptReport) error {
+	current, err := e.inner.Stat(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h, err := e.header(ctx, name)
+	plain := errors.Is(err, envelope.ErrNotEncrypted)
+	switch {
+	case err != nil && !plain:
+		report.Issues = append(report.Issues, FsckIssue{Name: name, Problem: ReencryptFailed, Actual: err.Error()})
+		return nil
+	case err == nil && e.keys.Current(h):
+		report.Current++
+		return nil
+	}
+
+	staged, err := os.CreateTemp("", "reencrypt-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	if err := e.stage(ctx, name, staged); err != nil {
+		report.Issues = append(report.Issues, FsckIssue{Name: name, Problem: ReencryptFailed, Actual: err.Error()})
+		return nil
+	}
+	_, err = e.inner.SaveIf(ctx, name, Condition{ETag: current.ETag()}, staged)
+	if errors.Is(err, ErrPreconditionFailed) {
+		report.Issues = append(report.Issues, FsckIssue{Name: name, Problem: ReencryptChanged})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if plain {
+		report.Encrypted++
+	} else {
+		report.Rotated++
+	}
+	return nil
+}
+
+// stage writes the content of name, encrypted under the active key, to
+// staged and rewinds it.
+func (e *EncryptedBackend) stage(ctx context.Context, name string, staged *os.File) error {
+	stream, err := e.OpenStream(ctx, name, ReadRange{})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	sealed, err := e.keys.EncryptReader(stream)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(staged, sealed); err != nil {
+		return err
+	}
+	_, err = staged.Seek(0, io.SeekStart)
+	return err
+}
+
+// header reads the envelope header of name. Plain files are reported with
+// envelope.ErrNotEncrypted, damaged headers as ErrCorrupt.
+func (e *EncryptedBackend) header(ctx context.Context, name string) (envelope.Header, error) {
+	stream, err := e.inner.OpenStream(ctx, name, ReadRange{Length: int64(envelope.HeaderSize)})
+	if err != nil {
+		return envelope.Header{}, err
+	}
+	defer stream.Close()
+
+	h, err := envelope.ReadHeader(stream)
+	if err != nil && !errors.Is(err, envelope.ErrNotEncrypted) {
+		return envelope.Header{}, corrupt(name, err)
+	}
+	return h, err
+}
+
+// plainInfo converts info about the encrypted file name to the size of its
+// decrypted content.
+func plainInfo(name string, info FileInfo) (FileInfo, error) {
+	size, _, err := envelope.PlainSize(info.Size)
+	if err != nil {
+		return FileInfo{}, corrupt(name, err)
+	}
+	info.Size = size
+	return info, nil
+}
+
+// decryptedReader reports content that fails to decrypt as ErrCorrupt.
+type decryptedReader struct {
+	name string
+	r    io.Reader
+}
+
+func (d *decryptedReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if errors.Is(err, envelope.ErrDecrypt) {
+		err = corrupt(d.name, err)
+	}
+	return n, err
+}
+
+// corrupt reports name as corrupt because of err, a failure to decrypt it.
+func corrupt(name string, err error) error {
+	if errors.Is(err, ErrCorrupt) || errors.Is(err, envelope.ErrUnknownKey) {
+		return err
+	}
+	return fmt.Errorf("%s: %w: %w", name, ErrCorrupt, err)
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cgi.com/goLangTraining/src/pkg/envelope"
+	"github.com/stretchr/testify/require"
+)
+
+// testKeys returns a keyring holding one key per ID, the last one active.
+// Keys are derived from their IDs, so the same ID always names the same key.
+func testKeys(t *testing.T, ids ...string) *envelope.Keyring {
+	t.Helper()
+	var file strings.Builder
+	for _, id := range ids {
+		sum := sha256.Sum256([]byte(id))
+		file.WriteString(id + " " + base64.StdEncoding.EncodeToString(sum[:]) + "\n")
+	}
+	keys, err := envelope.ParseKeyring(strings.NewReader(file.String()))
+	require.NoError(t, err, "Setup failed")
+	return keys
+}
+
+func TestEncryptedBackend(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	root, err := NewRoot(dir)
+	require.NoError(t, err)
+	backend := NewEncryptedBackend(root, testKeys(t, "k1"))
+
+	content := make([]byte, 3*envelope.ChunkSize+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	info, err := backend.SaveIf(ctx, "data/blob.bin", Condition{MustNotExist: true}, bytes.NewReader(content))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), info.Size, "Sizes describe the decrypted content")
+
+	raw, err := os.ReadFile(filepath.Join(dir, "data", "blob.bin"))
+	require.NoError(t, err)
+	require.Equal(t, envelope.SealedSize(int64(len(content))), int64(len(raw)))
+	require.False(t, bytes.Contains(raw, content[:64]), "Content must not be stored in the clear")
+
+	stat, err := backend.Stat(ctx, "data/blob.bin")
+	require.NoError(t, err)
+	require.True(t, info.Created)
+	info.Created = false
+	require.Equal(t, info, stat)
+	page, err := backend.List(ctx, ListOptions{Prefix: "data/"})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), page.Files[0].Size)
+
+	testCases := []struct {
+		name   string
+		rng    ReadRange
+		expect []byte
+	}{
+		{name: "whole", rng: ReadRange{}, expect: content},
+		{name: "within_chunk", rng: ReadRange{Offset: 10, Length: 20}, expect: content[10:30]},
+		{name: "across_chunks", rng: ReadRange{Offset: envelope.ChunkSize - 5, Length: envelope.ChunkSize + 10}, expect: content[envelope.ChunkSize-5 : 2*envelope.ChunkSize+5]},
+		{name: "tail", rng: ReadRange{Offset: 3*envelope.ChunkSize + 50}, expect: content[3*envelope.ChunkSize+50:]},
+		{name: "empty_at_end", rng: ReadRange{Offset: int64(len(content))}, expect: []byte{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stream, err := backend.OpenStream(ctx, "data/blob.bin", tc.rng)
+			require.NoError(t, err)
+			defer stream.Close()
+			got, err := io.ReadAll(stream)
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, got)
+			require.Equal(t, int64(len(content)), stream.Size)
+		})
+	}
+
+	_, err = backend.OpenStream(ctx, "data/blob.bin", ReadRange{Offset: int64(len(content)) + 1})
+	require.ErrorIs(t, err, ErrInvalidRange)
+
+	_, err = backend.SaveIf(ctx, "data/blob.bin", Condition{ETag: `"stale"`}, strings.NewReader("x"))
+	require.ErrorIs(t, err, ErrPreconditionFailed)
+	_, err = backend.SaveIf(ctx, "data/blob.bin", Condition{ETag: stat.ETag()}, strings.NewReader("replaced"))
+	require.NoError(t, err, "ETags from Stat should match the stored file")
+}
+
+func TestEncryptedBackendReportsTampering(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	root, err := NewRoot(dir)
+	require.NoError(t, err)
+	backend := NewEncryptedBackend(root, testKeys(t, "k1"))
+	require.NoError(t, backend.SaveData(ctx, "notes.txt", strings.Repeat("secret ", 100)))
+
+	// Rewrite the file and its checksum, as someone with disk access could
+	filePath := filepath.Join(dir, "notes.txt")
+	raw, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	raw[len(raw)-20] ^= 1
+	require.NoError(t, os.Remove(checksumPath(filePath)))
+	require.NoError(t, os.WriteFile(filePath, raw, 0644))
+
+	_, err = backend.ReadData(ctx, "notes.txt")
+	require.ErrorIs(t, err, ErrCorrupt)
+	require.ErrorIs(t, err, envelope.ErrDecrypt)
+
+	_, err = NewEncryptedBackend(root, testKeys(t, "other")).ReadData(ctx, "notes.txt")
+	require.ErrorIs(t, err, envelope.ErrUnknownKey)
+}
+
+func TestEncryptedBackendReencrypt(t *testing.T) {
+	ctx := context.Background()
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, root.SaveData(ctx, "plain.txt", "written before encryption"), "Setup failed")
+
+	before := NewVersionedBackend(NewEncryptedBackend(root, testKeys(t, "k1")), 0)
+	content, err := before.ReadData(ctx, "plain.txt")
+	require.NoError(t, err, "Plain files stay readable once encryption is enabled")
+	require.Equal(t, "written before encryption", content)
+	info, err := before.Stat(ctx, "plain.txt")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), info.Size)
+
+	require.NoError(t, before.SaveData(ctx, "doc.txt", "first"))
+	require.NoError(t, before.SaveData(ctx, "doc.txt", "second"), "Setup failed")
+
+	rotated := NewEncryptedBackend(root, testKeys(t, "k1", "k2"))
+	report, err := rotated.Reencrypt(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ReencryptReport{Files: 3, Encrypted: 1, Rotated: 2}, report, "Versions should be re-encrypted too")
+
+	report, err = rotated.Reencrypt(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ReencryptReport{Files: 3, Current: 3}, report, "A second run has nothing left to do")
+
+	after := NewVersionedBackend(NewEncryptedBackend(root, testKeys(t, "k2")), 0)
+	content, err = after.ReadData(ctx, "plain.txt")
+	require.NoError(t, err, "The retired key is no longer needed")
+	require.Equal(t, "written before encryption", content)
+	content, err = after.ReadData(ctx, "doc.txt")
+	require.NoError(t, err)
+	require.Equal(t, "second", content)
+	versions, err := after.Versions(ctx, "doc.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, int64(len("first")), versions[0].Size)
+	content, err = after.ReadVersion(ctx, "doc.txt", versions[0].ID)
+	require.NoError(t, err)
+	require.Equal(t, "first", content)
+
+	page, err := root.List(ctx, ListOptions{})
+	require.NoError(t, err)
+	for _, file := range page.Files {
+		raw, err := root.ReadData(ctx, file.Name)
+		require.NoError(t, err)
+		require.NotContains(t, raw, "written before", "%s is still plain", file.Name)
+	}
+}
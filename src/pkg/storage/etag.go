@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrPreconditionFailed is returned by SaveIf when the stored file does not
+// satisfy the Condition.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Condition guards a SaveIf call. The zero value always holds, turning SaveIf
+// into an unconditional save.
+type Condition struct {
+	// ETag, if set, must equal the ETag of the stored content: the save
+	// only succeeds if nobody replaced the file since it was read.
+	ETag string
+	// MustExist makes the save update-only: it fails if the file does not
+	// exist yet.
+	MustExist bool
+	// MustNotExist makes the save create-only: it fails if the file
+	// already exists.
+	MustNotExist bool
+}
+
+// check reports whether cond holds for the stored file described by
+// current, which is only meaningful if exists is true.
+func (c Condition) check(name string, current FileInfo, exists bool) error {
+	switch {
+	case c.MustNotExist && exists:
+		return fmt.Errorf("%w: %s already exists", ErrPreconditionFailed, name)
+	case (c.MustExist || c.ETag != "") && !exists:
+		return fmt.Errorf("%w: %s does not exist", ErrPreconditionFailed, name)
+	case c.ETag != "" && c.ETag != current.ETag():
+		return fmt.Errorf("%w: %s has changed (etag %s)", ErrPreconditionFailed, name, current.ETag())
+	}
+	return nil
+}
+
+// ETag returns the HTTP entity tag of the content: its quoted SHA-256. It is
+// empty unless SHA256 is filled in.
+func (f FileInfo) ETag() string {
+	if f.SHA256 == "" {
+		return ""
+	}
+	return `"` + f.SHA256 + `"`
+}
+
+// nameLocks serialises writes to the same name. The zero value is ready to
+// use; unused entries are dropped so the map does not grow with every name
+// ever written.
+type nameLocks struct {
+	mu    sync.Mutex
+	locks map[string]*nameLock
+}
+
+type nameLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks name and returns the function that unlocks it.
+func (l *nameLocks) lock(name string) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*nameLock)
+	}
+	entry, ok := l.locks[name]
+	if !ok {
+		entry = &nameLock{}
+		l.locks[name] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	entry.mu.Lock()
+	return func() {
+		entry.mu.Unlock()
+		l.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// checksumCache remembers the SHA-256 of files by path, keyed on size and
+// modification time, so repeated Stat calls and ETag checks do not re-read
+// unchanged files. The zero value is ready to use.
+type checksumCache struct {
+	mu      sync.Mutex
+	entries map[string]checksumEntry
+}
+
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// get returns the cached checksum of path if its size and modification time
+// are unchanged.
+func (c *checksumCache) get(path string, size int64, modTime time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[path]
+	if !ok || entry.size != size || !entry.modTime.Equal(modTime) {
+		return "", false
+	}
+	return entry.sum, true
+}
+
+func (c *checksumCache) put(path string, size int64, modTime time.Time, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]checksumEntry)
+	}
+	c.entries[path] = checksumEntry{size: size, modTime: modTime, sum: sum}
+}
+
+func (c *checksumCache) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, path)
+}
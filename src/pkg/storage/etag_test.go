@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveIf(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"local": func(t *testing.T) Backend {
+			root, err := NewRoot(t.TempDir())
+			require.NoError(t, err)
+			return root
+		},
+		"memory": func(t *testing.T) Backend {
+			return NewMemoryBackend()
+		},
+		"versioned": func(t *testing.T) Backend {
+			return NewVersionedBackend(NewMemoryBackend(), 0)
+		},
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newBackend(t)
+
+			_, err := backend.SaveIf(ctx, "doc.txt", Condition{ETag: `"abc"`}, strings.NewReader("x"))
+			require.ErrorIs(t, err, ErrPreconditionFailed, "An ETag cannot match a missing file")
+			_, err = backend.SaveIf(ctx, "doc.txt", Condition{MustExist: true}, strings.NewReader("x"))
+			require.ErrorIs(t, err, ErrPreconditionFailed, "Update-only saves must not create")
+
+			created, err := backend.SaveIf(ctx, "doc.txt", Condition{MustNotExist: true}, strings.NewReader("first"))
+			require.NoError(t, err)
+			require.NotEmpty(t, created.ETag())
+			require.True(t, created.Created)
+			_, err = backend.SaveIf(ctx, "doc.txt", Condition{MustNotExist: true}, strings.NewReader("again"))
+			require.ErrorIs(t, err, ErrPreconditionFailed, "Create-only saves must not overwrite")
+
+			info, err := backend.Stat(ctx, "doc.txt")
+			require.NoError(t, err)
+			require.Equal(t, created.ETag(), info.ETag(), "Saves and Stat should agree on the ETag")
+
+			updated, err := backend.SaveIf(ctx, "doc.txt", Condition{ETag: created.ETag()}, strings.NewReader("second"))
+			require.NoError(t, err)
+			require.NotEqual(t, created.ETag(), updated.ETag())
+			require.False(t, updated.Created, "A replaced file was not created")
+
+			_, err = backend.SaveIf(ctx, "doc.txt", Condition{ETag: created.ETag()}, strings.NewReader("lost update"))
+			require.ErrorIs(t, err, ErrPreconditionFailed, "A stale ETag must be rejected")
+			content, err := backend.ReadData(ctx, "doc.txt")
+			require.NoError(t, err)
+			require.Equal(t, "second", content)
+		})
+	}
+}
+
+func TestSaveIfConcurrentWritersOnlyOneWins(t *testing.T) {
+	ctx := context.Background()
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+	base, err := root.SaveIf(ctx, "counter.txt", Condition{}, strings.NewReader("0"))
+	require.NoError(t, err)
+
+	const writers = 8
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		successes int
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := root.SaveIf(ctx, "counter.txt", Condition{ETag: base.ETag()}, strings.NewReader(fmt.Sprint(i+1)))
+			if err == nil {
+				mu.Lock()
+				successes++
+				mu.Unlock()
+				return
+			}
+			require.ErrorIs(t, err, ErrPreconditionFailed)
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, 1, successes, "Exactly one writer holding the same ETag should win")
+}
+
+func TestRootStatNoticesExternalChanges(t *testing.T) {
+	ctx := context.Background()
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+	saved, err := root.SaveIf(ctx, "notes.txt", Condition{}, strings.NewReader("cached"))
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(root.Dir(), "notes.txt"), []byte("changed on disk"), 0644))
+	info, err := root.Stat(ctx, "notes.txt")
+	require.NoError(t, err)
+	require.NotEqual(t, saved.ETag(), info.ETag(), "Cached checksums must not outlive the content")
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultListLimit is the page size used when ListOptions.Limit is not
+	// set.
+	DefaultListLimit = 100
+	// MaxListLimit caps ListOptions.Limit.
+	MaxListLimit = 1000
+)
+
+// ListOptions filters and pages the files returned by List.
+type ListOptions struct {
+	// Prefix keeps only names starting with it, e.g. "reports/2025/".
+	Prefix string
+	// Glob keeps only names matching it with path.Match semantics, so "*"
+	// does not cross a "/". Empty matches everything.
+	Glob string
+	// Limit is the maximum number of files returned; zero means
+	// DefaultListLimit.
+	Limit int
+	// Cursor continues a previous listing: only names sorting after it are
+	// returned. Pass the NextCursor of the previous page.
+	Cursor string
+}
+
+// ListPage is one page of List results.
+type ListPage struct {
+	// Files are sorted by name and carry size and modification time but no
+	// checksum.
+	Files []FileInfo `json:"files"`
+	// NextCursor fetches the next page; it is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// validate rejects prefixes that leave the listed directory and malformed
+// globs before any file is visited.
+func (o ListOptions) validate() error {
+	if dir := path.Dir(o.Prefix); dir != "." {
+		if _, err := cleanName(dir); err != nil {
+			return err
+		}
+	}
+	if o.Glob != "" {
+		if _, err := path.Match(o.Glob, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether name passes the prefix and glob filters.
+func (o ListOptions) matches(name string) bool {
+	if !strings.HasPrefix(name, o.Prefix) {
+		return false
+	}
+	if o.Glob == "" {
+		return true
+	}
+	ok, _ := path.Match(o.Glob, name)
+	return ok
+}
+
+// paginate sorts files and cuts the page selected by o.
+func (o ListOptions) paginate(files []FileInfo) ListPage {
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	start := sort.Search(len(files), func(i int) bool { return files[i].Name > o.Cursor })
+	files = files[start:]
+
+	limit := o.limit()
+	page := ListPage{Files: files}
+	if len(files) > limit {
+		page.Files = files[:limit]
+		page.NextCursor = page.Files[limit-1].Name
+	}
+	return page
+}
+
+// limit returns the effective page size.
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return min(o.Limit, MaxListLimit)
+}
+
+// isInternalName reports whether base is one of the package's own files: an
+// in-flight atomic write, a checksum or a quarantined file. Internal files
+// are never listed and cannot be addressed through a Backend.
+func isInternalName(base string) bool {
+	if !strings.HasPrefix(base, ".") {
+		return false
+	}
+	return strings.Contains(base, ".tmp-") ||
+		strings.HasSuffix(base, checksumSuffix) ||
+		strings.Contains(base, quarantineInfix)
+}
+
+// List returns the regular files below dir that match opts, named by their
+// slash-separated path relative to dir. Symbolic links are not followed or
+// listed.
+func List(ctx context.Context, dir string, opts ListOptions) (ListPage, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	if err := opts.validate(); err != nil {
+		return ListPage{}, err
+	}
+
+	// Only the directory named by the prefix can hold matches
+	start := filepath.Join(dir, filepath.FromSlash(path.Dir(opts.Prefix)))
+
+	var files []FileInfo
+	err := filepath.WalkDir(start, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if p == start && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || isInternalName(entry.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !opts.matches(name) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "File listing failed",
+			"error", err,
+			"dir", dir,
+			"traceID", traceID)
+		return ListPage{}, err
+	}
+
+	page := opts.paginate(files)
+	slog.InfoContext(ctx, "Files listed successfully",
+		"dir", dir,
+		"prefix", opts.Prefix,
+		"glob", opts.Glob,
+		"count", len(page.Files),
+		"traceID", traceID)
+	return page, nil
+}
+
+// Stat returns the size, modification time and SHA-256 checksum of the file
+// at filePath. Computing the checksum reads the whole file.
+func Stat(ctx context.Context, filePath string) (FileInfo, error) {
+	// Size and checksum both come from the open file, so they describe the
+	// same content even if the file is replaced meanwhile
+	f, err := os.Open(filePath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if info.IsDir() {
+		return FileInfo{}, &os.PathError{Op: "stat", Path: filePath, Err: ErrIsDirectory}
+	}
+	sum, err := checksum(ctx, f)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return FileInfo{
+		Name:    filepath.ToSlash(filePath),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		SHA256:  sum,
+	}, nil
+}
+
+// Delete removes the file at filePath. Directories are left alone, even
+// when empty.
+func Delete(ctx context.Context, filePath string) error {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	err := func() error {
+		info, err := os.Lstat(filePath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return &os.PathError{Op: "remove", Path: filePath, Err: ErrIsDirectory}
+		}
+		if err := os.Remove(filePath); err != nil {
+			return err
+		}
+		return removeChecksum(filePath)
+	}()
+	if err != nil {
+		slog.ErrorContext(ctx, "File delete failed",
+			"error", err,
+			"filePath", filePath,
+			"traceID", traceID)
+		return err
+	}
+
+	slog.InfoContext(ctx, "File deleted successfully",
+		"filePath", filePath,
+		"traceID", traceID)
+	return nil
+}
+
+// checksum returns the hex-encoded SHA-256 of everything read from r.
+func checksum(ctx context.Context, r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, &ctxReader{ctx: ctx, r: r}, make([]byte, streamChunkSize)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
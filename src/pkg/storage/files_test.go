@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// listNames returns the names on a page.
+func listNames(page ListPage) []string {
+	names := make([]string, len(page.Files))
+	for i, file := range page.Files {
+		names[i] = file.Name
+	}
+	return names
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.log", "docs/readme.md", "docs/2025/q1.txt", "docs/2025/q2.txt", "docs-old/notes.txt"} {
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(full), 0755), "Setup failed")
+		require.NoError(t, os.WriteFile(full, []byte(name), 0644), "Setup failed")
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".a.txt.tmp-123"), []byte("partial"), 0644), "Setup failed")
+	require.NoError(t, os.Symlink(filepath.Join(dir, "a.txt"), filepath.Join(dir, "link.txt")), "Setup failed")
+
+	testCases := []struct {
+		name      string
+		opts      ListOptions
+		expected  []string
+		expectErr error
+	}{
+		{
+			name:     "everything",
+			expected: []string{"a.txt", "b.log", "docs-old/notes.txt", "docs/2025/q1.txt", "docs/2025/q2.txt", "docs/readme.md"},
+		},
+		{name: "directory_prefix", opts: ListOptions{Prefix: "docs/"}, expected: []string{"docs/2025/q1.txt", "docs/2025/q2.txt", "docs/readme.md"}},
+		{name: "partial_prefix", opts: ListOptions{Prefix: "docs"}, expected: []string{"docs-old/notes.txt", "docs/2025/q1.txt", "docs/2025/q2.txt", "docs/readme.md"}},
+		{name: "prefix_without_matches", opts: ListOptions{Prefix: "missing/"}, expected: []string{}},
+		{name: "glob_top_level", opts: ListOptions{Glob: "*.txt"}, expected: []string{"a.txt"}},
+		{name: "glob_nested", opts: ListOptions{Glob: "docs/*/*.txt"}, expected: []string{"docs/2025/q1.txt", "docs/2025/q2.txt"}},
+		{name: "prefix_and_glob", opts: ListOptions{Prefix: "docs/", Glob: "*/*.md"}, expected: []string{"docs/readme.md"}},
+		{name: "traversal_prefix", opts: ListOptions{Prefix: "../"}, expectErr: ErrPathTraversal},
+		{name: "malformed_glob", opts: ListOptions{Glob: "[a-"}, expectErr: path.ErrBadPattern},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			page, err := List(ctx, dir, tc.opts)
+			if tc.expectErr != nil {
+				require.ErrorIs(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, listNames(page))
+			require.Empty(t, page.NextCursor)
+		})
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, name := range []string{"1.txt", "2.txt", "3.txt", "4.txt", "5.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0644), "Setup failed")
+	}
+
+	var pages [][]string
+	opts := ListOptions{Limit: 2}
+	for {
+		page, err := List(ctx, dir, opts)
+		require.NoError(t, err)
+		pages = append(pages, listNames(page))
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+
+	require.Equal(t, [][]string{{"1.txt", "2.txt"}, {"3.txt", "4.txt"}, {"5.txt"}}, pages)
+}
+
+func TestStatAndDelete(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "hello.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("hello"), 0644), "Setup failed")
+
+	info, err := Stat(ctx, filePath)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), info.Size)
+	require.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", info.SHA256)
+
+	_, err = Stat(ctx, dir)
+	require.ErrorIs(t, err, ErrIsDirectory)
+	require.ErrorIs(t, Delete(ctx, dir), ErrIsDirectory)
+
+	require.NoError(t, Delete(ctx, filePath))
+	_, err = os.Stat(filePath)
+	require.True(t, os.IsNotExist(err), "Delete should remove the file")
+	require.ErrorIs(t, Delete(ctx, filePath), os.ErrNotExist)
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Problems reported by Fsck.
+const (
+	FsckMissingChecksum = "missing_checksum" // saved before checksums were recorded
+	FsckCorrupt         = "corrupt"          // content no longer matches its checksum
+	FsckOrphanChecksum  = "orphan_checksum"  // checksum left behind by a removed file
+)
+
+// quarantineInfix marks corrupt files Fsck moved aside.
+const quarantineInfix = ".quarantine-"
+
+// FsckOptions controls what Fsck does about the problems it finds.
+type FsckOptions struct {
+	// Repair records missing checksums, removes orphaned ones and moves
+	// corrupt files aside as hidden .<name>.quarantine-<time> files, so
+	// the name can be written again. Without it Fsck only reports.
+	Repair bool
+}
+
+// FsckIssue describes one problem found by Fsck.
+type FsckIssue struct {
+	Name     string `json:"name"`
+	Problem  string `json:"problem"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	// Action is what Repair did about the problem, if anything.
+	Action string `json:"action,omitempty"`
+}
+
+// FsckReport summarises an Fsck run.
+type FsckReport struct {
+	Files  int         `json:"files"` // data files checked
+	OK     int         `json:"ok"`
+	Issues []FsckIssue `json:"issues,omitempty"`
+}
+
+// Fsck verifies every file below dir against its recorded checksum. Names in
+// the report are slash-separated and relative to dir. Writers are not
+// coordinated with, so it is best run while nothing else writes to dir.
+func Fsck(ctx context.Context, dir string, opts FsckOptions) (FsckReport, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+	var report FsckReport
+	stamp := time.Now().Format("20060102T150405")
+
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+
+		base := entry.Name()
+		if isInternalName(base) {
+			if !strings.HasSuffix(base, checksumSuffix) {
+				return nil
+			}
+			return checkOrphanChecksum(p, name, opts, &report)
+		}
+
+		report.Files++
+		issue, err := checkFile(ctx, p, name, stamp, opts)
+		if err != nil {
+			return err
+		}
+		if issue == nil {
+			report.OK++
+			return nil
+		}
+		report.Issues = append(report.Issues, *issue)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	slog.InfoContext(ctx, "Storage fsck finished",
+		"dir", dir,
+		"files", report.Files,
+		"issues", len(report.Issues),
+		"repair", opts.Repair,
+		"traceID", traceID)
+	return report, nil
+}
+
+// checkFile verifies the data file at p and, if asked to, repairs it.
+func checkFile(ctx context.Context, p, name, stamp string, opts FsckOptions) (*FsckIssue, error) {
+	actual, recorded, err := readConsistent(p, func(f *os.File) (string, error) {
+		return checksum(ctx, f)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch mismatch := matchChecksum(p, actual, recorded); {
+	case len(recorded) == 0:
+		issue := &FsckIssue{Name: name, Problem: FsckMissingChecksum, Actual: actual}
+		if opts.Repair {
+			if err := writeChecksum(p, DefaultDurability, actual); err != nil {
+				return nil, err
+			}
+			issue.Action = "recorded checksum"
+		}
+		return issue, nil
+
+	case mismatch != nil:
+		issue := &FsckIssue{Name: name, Problem: FsckCorrupt, Expected: recorded[0], Actual: actual}
+		if opts.Repair {
+			dir, base := filepath.Split(p)
+			quarantine := filepath.Join(dir, "."+base+quarantineInfix+stamp)
+			if err := os.Rename(p, quarantine); err != nil {
+				return nil, err
+			}
+			if err := removeChecksum(p); err != nil {
+				return nil, err
+			}
+			issue.Action = fmt.Sprintf("moved to %s", filepath.Base(quarantine))
+		}
+		return issue, nil
+	}
+	return nil, nil
+}
+
+// checkOrphanChecksum reports the checksum file at p if the file it
+// describes is gone.
+func checkOrphanChecksum(p, name string, opts FsckOptions, report *FsckReport) error {
+	dir, base := filepath.Split(p)
+	dataName := strings.TrimSuffix(strings.TrimPrefix(base, "."), checksumSuffix)
+	_, err := os.Lstat(filepath.Join(dir, dataName))
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	issue := FsckIssue{Name: name, Problem: FsckOrphanChecksum}
+	if opts.Repair {
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		issue.Action = "removed"
+	}
+	report.Issues = append(report.Issues, issue)
+	return nil
+}
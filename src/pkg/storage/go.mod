@@ -2,7 +2,12 @@ module cgi.com/goLangTraining/src/pkg/storage
 
 go 1.22
 
-require github.com/stretchr/testify v1.11.1
+replace cgi.com/goLangTraining/src/pkg/envelope => ../envelope
+
+require (
+	cgi.com/goLangTraining/src/pkg/envelope v0.0.0-00010101000000-000000000000
+	github.com/stretchr/testify v1.11.1
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
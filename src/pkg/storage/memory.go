@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend is a Backend that keeps files in process memory. It is
+// intended for tests and ephemeral deployments; nothing survives a restart.
+type MemoryBackend struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+}
+
+// memoryFile is the content and modification time of one stored file.
+type memoryFile struct {
+	data    string
+	modTime time.Time
+}
+
+// NewMemoryBackend returns an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{files: make(map[string]memoryFile)}
+}
+
+// SaveData stores data under name, replacing any previous content.
+func (b *MemoryBackend) SaveData(ctx context.Context, name string, data string) error {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	key, err := canonicalName(name)
+	if err != nil {
+		return err
+	}
+
+	metrics := FileMetrics{
+		ContentSize: len(data),
+		Operation:   "write",
+	}
+	slog.InfoContext(ctx, "Starting memory write operation",
+		"name", key,
+		"traceID", traceID,
+		"metrics", metrics)
+
+	b.put(key, data)
+
+	slog.InfoContext(ctx, "Memory file written successfully",
+		"name", key,
+		"traceID", traceID)
+	return nil
+}
+
+// ReadData returns the content stored under name.
+func (b *MemoryBackend) ReadData(ctx context.Context, name string) (string, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	key, err := canonicalName(name)
+	if err != nil {
+		return "", err
+	}
+
+	slog.InfoContext(ctx, "Starting memory read operation",
+		"name", key,
+		"traceID", traceID)
+
+	file, ok := b.get(key)
+	if !ok {
+		err := &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		slog.ErrorContext(ctx, "Memory file read failed",
+			"error", err,
+			"name", key,
+			"traceID", traceID)
+		return "", err
+	}
+
+	data := file.data
+	metrics := FileMetrics{
+		BytesRead: len(data),
+		Operation: "read",
+	}
+	slog.InfoContext(ctx, "Memory file read successfully",
+		"name", key,
+		"traceID", traceID,
+		"metrics", metrics)
+	return data, nil
+}
+
+// SaveStream stores everything read from r under name. The content is
+// buffered until r is exhausted, so a failed or cancelled read leaves the
+// previous content in place.
+func (b *MemoryBackend) SaveStream(ctx context.Context, name string, r io.Reader) (int64, error) {
+	info, err := b.SaveIf(ctx, name, Condition{}, r)
+	return info.Size, err
+}
+
+// SaveIf stores everything read from r under name if cond holds once the
+// content has been read, and describes the new content.
+func (b *MemoryBackend) SaveIf(ctx context.Context, name string, cond Condition, r io.Reader) (FileInfo, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	key, err := canonicalName(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	var buf strings.Builder
+	written, err := io.CopyBuffer(&buf, &ctxReader{ctx: ctx, r: r}, make([]byte, streamChunkSize))
+	metrics := FileMetrics{
+		BytesStreamed: written,
+		Operation:     "stream-write",
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Memory stream write failed",
+			"error", err,
+			"name", key,
+			"traceID", traceID,
+			"metrics", metrics)
+		return FileInfo{}, err
+	}
+
+	b.mu.Lock()
+	current, exists := b.files[key]
+	if err := cond.check(name, describe(key, current), exists); err != nil {
+		b.mu.Unlock()
+		return FileInfo{}, err
+	}
+	file := memoryFile{data: buf.String(), modTime: time.Now()}
+	b.files[key] = file
+	b.mu.Unlock()
+
+	slog.InfoContext(ctx, "Memory file streamed successfully",
+		"name", key,
+		"traceID", traceID,
+		"metrics", metrics)
+	info := describe(key, file)
+	info.Created = !exists
+	return info, nil
+}
+
+// OpenStream opens the range rng of the content stored under name.
+func (b *MemoryBackend) OpenStream(ctx context.Context, name string, rng ReadRange) (*Stream, error) {
+	key, err := canonicalName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, ok := b.get(key)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	data := file.data
+	size := int64(len(data))
+	offset, length, err := rng.resolve(size)
+	if err != nil {
+		return nil, err
+	}
+	return newStream(ctx, key, strings.NewReader(data[offset:]), nil, file.modTime, size, offset, length), nil
+}
+
+// Stat returns the size, modification time and checksum of name.
+func (b *MemoryBackend) Stat(ctx context.Context, name string) (FileInfo, error) {
+	key, err := canonicalName(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	file, ok := b.get(key)
+	if !ok {
+		return FileInfo{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return describe(key, file), nil
+}
+
+// List returns the stored files matching opts.
+func (b *MemoryBackend) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	if err := opts.validate(); err != nil {
+		return ListPage{}, err
+	}
+
+	b.mu.RLock()
+	var files []FileInfo
+	for key, file := range b.files {
+		if opts.matches(key) {
+			files = append(files, FileInfo{Name: key, Size: int64(len(file.data)), ModTime: file.modTime})
+		}
+	}
+	b.mu.RUnlock()
+
+	return opts.paginate(files), nil
+}
+
+// Delete removes name.
+func (b *MemoryBackend) Delete(ctx context.Context, name string) error {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	key, err := canonicalName(name)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	_, ok := b.files[key]
+	delete(b.files, key)
+	b.mu.Unlock()
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	slog.InfoContext(ctx, "Memory file deleted",
+		"name", key,
+		"traceID", traceID)
+	return nil
+}
+
+// describe returns the FileInfo of file, including its checksum.
+func describe(key string, file memoryFile) FileInfo {
+	sum := sha256.Sum256([]byte(file.data))
+	return FileInfo{
+		Name:    key,
+		Size:    int64(len(file.data)),
+		ModTime: file.modTime,
+		SHA256:  hex.EncodeToString(sum[:]),
+	}
+}
+
+func (b *MemoryBackend) get(key string) (memoryFile, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	file, ok := b.files[key]
+	return file, ok
+}
+
+func (b *MemoryBackend) put(key, data string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files[key] = memoryFile{data: data, modTime: time.Now()}
+}
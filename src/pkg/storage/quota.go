@@ -0,0 +1,551 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+)
+
+// quotaIndexName is where a QuotaBackend keeps the owner and size of every
+// file, inside the wrapped Backend.
+const quotaIndexName = ".quota.json"
+
+// AnonymousUser is charged for writes made without a user in the context.
+const AnonymousUser = "anonymous"
+
+// RootDirectory names the files outside any directory in usage reports.
+const RootDirectory = "/"
+
+// ErrQuotaExceeded is returned for writes that would take a user or a
+// directory over its quota. It is always accompanied by a *QuotaError.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// ErrNoQuota is returned for usage reports from backends that do not
+// enforce quotas.
+var ErrNoQuota = errors.New("storage quotas are not enabled")
+
+// Limit caps the storage used by a user or a directory. Zero fields are
+// unlimited.
+type Limit struct {
+	Bytes int64 `json:"bytes,omitempty"`
+	Files int64 `json:"files,omitempty"`
+}
+
+// QuotaConfig sets the quotas a QuotaBackend enforces. Every user and every
+// top-level directory gets the same limits.
+type QuotaConfig struct {
+	// User limits what each user stores. Files count against the user who
+	// last wrote them.
+	User Limit
+	// Dir limits what each top-level directory holds. Files outside any
+	// directory share the RootDirectory limit.
+	Dir Limit
+}
+
+// Enabled reports whether any quota is set.
+func (c QuotaConfig) Enabled() bool {
+	return c != QuotaConfig{}
+}
+
+// RegisterFlags defines the quota flags on fs, using the current values of c
+// as defaults.
+func (c *QuotaConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.Int64Var(&c.User.Bytes, "quota-user-bytes", c.User.Bytes, "Bytes of file storage each user may use (0 is unlimited)")
+	fs.Int64Var(&c.User.Files, "quota-user-files", c.User.Files, "Files each user may store (0 is unlimited)")
+	fs.Int64Var(&c.Dir.Bytes, "quota-dir-bytes", c.Dir.Bytes, "Bytes each top-level directory may hold (0 is unlimited)")
+	fs.Int64Var(&c.Dir.Files, "quota-dir-files", c.Dir.Files, "Files each top-level directory may hold (0 is unlimited)")
+}
+
+// QuotaError describes a write refused by a quota.
+type QuotaError struct {
+	// Scope is "user" or "directory".
+	Scope string
+	// Name is the user or the top-level directory.
+	Name string
+	// Resource is "bytes" or "files".
+	Resource string
+	// Limit is the quota that would have been exceeded.
+	Limit int64
+	// TooLarge is set when the file alone exceeds the byte limit, so the
+	// write cannot succeed however much space is freed.
+	TooLarge bool
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota of %s %q exceeded (limit %d %s)", e.Resource, e.Scope, e.Name, e.Limit, e.Resource)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// Usage is the storage consumed by a user or a directory and its limit.
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+	Limit Limit `json:"limit"`
+}
+
+// UsageReport is the usage of one user and of every top-level directory.
+type UsageReport struct {
+	User        string           `json:"user"`
+	Usage       Usage            `json:"usage"`
+	Directories map[string]Usage `json:"directories"`
+}
+
+// UsageReporter is implemented by backends that track storage usage.
+type UsageReporter interface {
+	// Usage reports the usage of user and of every top-level directory,
+	// or ErrNoQuota if no quotas are tracked.
+	Usage(user string) (UsageReport, error)
+}
+
+var (
+	_ UsageReporter = (*QuotaBackend)(nil)
+	_ UsageReporter = (*VersionedBackend)(nil)
+	_ GzipOpener    = (*QuotaBackend)(nil)
+)
+
+// quotaEntry is what a QuotaBackend records about a stored file.
+type quotaEntry struct {
+	Owner string `json:"owner"`
+	Size  int64  `json:"size"`
+}
+
+// QuotaBackend wraps a Backend and refuses writes that would take the
+// writing user or the file's top-level directory over its quota. The user
+// is the "user" value of the context. The owner and size of every file are
+// kept in a hidden index in the wrapped Backend; files it does not know
+// about, such as those written before quotas were enabled, count against
+// their directory but no user.
+//
+// Writes run concurrently: each reserves the room it uses as its content is
+// read, so writes in progress count against the quotas too. Sizes are those
+// the wrapped Backend reports, so compressed files count with their logical
+// size.
+type QuotaBackend struct {
+	inner Backend
+	cfg   QuotaConfig
+
+	// mu guards files, the totals and the reservations in them. It is
+	// never held while content is written.
+	mu    sync.Mutex
+	files map[string]quotaEntry
+	users map[string]Usage
+	dirs  map[string]Usage
+
+	// persistMu orders saves of the index, so the last one saved holds
+	// the latest state.
+	persistMu sync.Mutex
+}
+
+// quotaReservation is the room a write in progress has taken: a file, if it
+// creates one, and the bytes read so far.
+type quotaReservation struct {
+	key, user, dir string
+	files, bytes   int64
+}
+
+// NewQuotaBackend returns a QuotaBackend over inner enforcing cfg. It loads
+// the index and reconciles it with the files inner holds.
+func NewQuotaBackend(ctx context.Context, inner Backend, cfg QuotaConfig) (*QuotaBackend, error) {
+	q := &QuotaBackend{
+		inner: inner,
+		cfg:   cfg,
+		files: make(map[string]quotaEntry),
+		users: make(map[string]Usage),
+		dirs:  make(map[string]Usage),
+	}
+	if err := q.load(ctx); err != nil {
+		return nil, fmt.Errorf("load quota index: %w", err)
+	}
+	return q, nil
+}
+
+// SaveData stores data as name if the quotas allow it.
+func (q *QuotaBackend) SaveData(ctx context.Context, name string, data string) error {
+	_, err := q.SaveIf(ctx, name, Condition{}, strings.NewReader(data))
+	return err
+}
+
+// ReadData returns the content of name.
+func (q *QuotaBackend) ReadData(ctx context.Context, name string) (string, error) {
+	if err := checkNotQuotaIndex(name); err != nil {
+		return "", err
+	}
+	return q.inner.ReadData(ctx, name)
+}
+
+// SaveStream stores the content of r as name if the quotas allow it.
+func (q *QuotaBackend) SaveStream(ctx context.Context, name string, r io.Reader) (int64, error) {
+	info, err := q.SaveIf(ctx, name, Condition{}, r)
+	return info.Size, err
+}
+
+// SaveIf stores the content of r as name if cond holds and the quotas allow
+// it. The file counts are checked before anything is written; the byte
+// quotas as the content is read, so a write that would exceed them fails
+// with a *QuotaError and leaves the previous content in place.
+func (q *QuotaBackend) SaveIf(ctx context.Context, name string, cond Condition, r io.Reader) (FileInfo, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+	key, err := quotaKey(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	res, err := q.reserve(key, quotaUser(ctx))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	limited := &quotaReader{r: r, q: q, res: res}
+	info, err := q.inner.SaveIf(ctx, name, cond, limited)
+
+	q.mu.Lock()
+	q.release(res)
+	if err == nil && limited.err == nil {
+		q.setFile(key, quotaEntry{Owner: res.user, Size: info.Size})
+	}
+	q.mu.Unlock()
+
+	if limited.err != nil {
+		slog.WarnContext(ctx, "Write refused by storage quota",
+			"name", name,
+			"user", res.user,
+			"error", limited.err,
+			"traceID", traceID)
+		return FileInfo{}, limited.err
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	q.persist(ctx)
+	return info, nil
+}
+
+// reserve checks the file quotas for a write of key by user and takes a
+// file for it if it creates one.
+func (q *QuotaBackend) reserve(key, user string) (*quotaReservation, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	res := &quotaReservation{key: key, user: user, dir: quotaDir(key)}
+	// Replacing a file frees what it used
+	userFiles, dirFiles := q.users[user].Files, q.dirs[res.dir].Files
+	if old, exists := q.files[key]; exists {
+		dirFiles--
+		if old.Owner == user {
+			userFiles--
+		}
+	} else {
+		res.files = 1
+	}
+
+	if err := checkFiles("user", user, q.cfg.User, userFiles); err != nil {
+		return nil, err
+	}
+	if err := checkFiles("directory", dirLabel(res.dir), q.cfg.Dir, dirFiles); err != nil {
+		return nil, err
+	}
+	q.adjust(res.user, res.dir, 0, res.files)
+	return res, nil
+}
+
+// charge takes n more bytes for the write res, unless that would exceed a
+// byte quota.
+func (q *QuotaBackend) charge(res *quotaReservation, n int64) *QuotaError {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Replacing a file frees what it used
+	userBytes, dirBytes := q.users[res.user].Bytes, q.dirs[res.dir].Bytes
+	if old, exists := q.files[res.key]; exists {
+		dirBytes -= old.Size
+		if old.Owner == res.user {
+			userBytes -= old.Size
+		}
+	}
+
+	if err := checkBytes("user", res.user, q.cfg.User.Bytes, userBytes+n, res.bytes+n); err != nil {
+		return err
+	}
+	if err := checkBytes("directory", dirLabel(res.dir), q.cfg.Dir.Bytes, dirBytes+n, res.bytes+n); err != nil {
+		return err
+	}
+	res.bytes += n
+	q.adjust(res.user, res.dir, n, 0)
+	return nil
+}
+
+// release gives back what the write res reserved. q.mu must be held.
+func (q *QuotaBackend) release(res *quotaReservation) {
+	q.adjust(res.user, res.dir, -res.bytes, -res.files)
+}
+
+// OpenStream opens the range rng of name.
+func (q *QuotaBackend) OpenStream(ctx context.Context, name string, rng ReadRange) (*Stream, error) {
+	if err := checkNotQuotaIndex(name); err != nil {
+		return nil, err
+	}
+	return q.inner.OpenStream(ctx, name, rng)
+}
+
+// OpenGzip opens the gzip data of name, if the wrapped Backend stores it
+// compressed.
+func (q *QuotaBackend) OpenGzip(ctx context.Context, name string) (*Stream, error) {
+	if err := checkNotQuotaIndex(name); err != nil {
+		return nil, err
+	}
+	if gz, ok := q.inner.(GzipOpener); ok {
+		return gz.OpenGzip(ctx, name)
+	}
+	return nil, fmt.Errorf("%s: %w", name, ErrNotCompressed)
+}
+
+// Stat describes name.
+func (q *QuotaBackend) Stat(ctx context.Context, name string) (FileInfo, error) {
+	if err := checkNotQuotaIndex(name); err != nil {
+		return FileInfo{}, err
+	}
+	return q.inner.Stat(ctx, name)
+}
+
+// Delete removes name and releases what it used.
+func (q *QuotaBackend) Delete(ctx context.Context, name string) error {
+	key, err := quotaKey(name)
+	if err != nil {
+		return err
+	}
+
+	if err := q.inner.Delete(ctx, name); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.dropFile(key)
+	q.mu.Unlock()
+	q.persist(ctx)
+	return nil
+}
+
+// List returns the stored files matching opts. The quota index is never
+// listed.
+func (q *QuotaBackend) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	page, err := q.inner.List(ctx, opts)
+	if err != nil {
+		return ListPage{}, err
+	}
+	files := page.Files[:0]
+	for _, file := range page.Files {
+		if file.Name != quotaIndexName {
+			files = append(files, file)
+		}
+	}
+	page.Files = files
+	return page, nil
+}
+
+// Usage reports the usage of user and of every top-level directory holding
+// files. Writes in progress count with what they have written so far.
+func (q *QuotaBackend) Usage(user string) (UsageReport, error) {
+	if user == "" {
+		user = AnonymousUser
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage := q.users[user]
+	usage.Limit = q.cfg.User
+	report := UsageReport{User: user, Usage: usage, Directories: make(map[string]Usage)}
+	for dir, usage := range q.dirs {
+		usage.Limit = q.cfg.Dir
+		report.Directories[dirLabel(dir)] = usage
+	}
+	return report, nil
+}
+
+// setFile records entry as the owner and size of the file key. q.mu must be
+// held.
+func (q *QuotaBackend) setFile(key string, entry quotaEntry) {
+	q.dropFile(key)
+	q.files[key] = entry
+	q.adjust(entry.Owner, quotaDir(key), entry.Size, 1)
+}
+
+// dropFile forgets the file key. q.mu must be held.
+func (q *QuotaBackend) dropFile(key string) {
+	if old, exists := q.files[key]; exists {
+		delete(q.files, key)
+		q.adjust(old.Owner, quotaDir(key), -old.Size, -1)
+	}
+}
+
+// adjust adds bytes and files to what user and the top-level directory dir
+// use. Files without an owner only count against their directory. q.mu must
+// be held.
+func (q *QuotaBackend) adjust(user, dir string, bytes, files int64) {
+	if user != "" {
+		q.users[user] = addUsage(q.users[user], bytes, files)
+		if q.users[user] == (Usage{}) {
+			delete(q.users, user)
+		}
+	}
+	q.dirs[dir] = addUsage(q.dirs[dir], bytes, files)
+	if q.dirs[dir] == (Usage{}) {
+		delete(q.dirs, dir)
+	}
+}
+
+func addUsage(u Usage, bytes, files int64) Usage {
+	u.Bytes += bytes
+	u.Files += files
+	return u
+}
+
+// load reads the index and reconciles it with the files inner holds: files
+// that are gone are dropped, sizes are refreshed and unknown files are
+// added without an owner.
+func (q *QuotaBackend) load(ctx context.Context) error {
+	recorded := make(map[string]quotaEntry)
+	data, err := q.inner.ReadData(ctx, quotaIndexName)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal([]byte(data), &recorded); err != nil {
+			return err
+		}
+	}
+
+	opts := ListOptions{Limit: MaxListLimit}
+	for {
+		page, err := q.inner.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, file := range page.Files {
+			if file.Name == quotaIndexName {
+				continue
+			}
+			q.setFile(file.Name, quotaEntry{Owner: recorded[file.Name].Owner, Size: file.Size})
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// persist saves the index. A failure is logged rather than returned: the
+// write it records has already happened, and ownership is all that is lost
+// if the index cannot be saved. q.mu must not be held; it is only taken to
+// copy the index, not while it is written.
+func (q *QuotaBackend) persist(ctx context.Context) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	q.persistMu.Lock()
+	defer q.persistMu.Unlock()
+	q.mu.Lock()
+	data, err := json.Marshal(q.files)
+	q.mu.Unlock()
+	if err == nil {
+		err = q.inner.SaveData(ctx, quotaIndexName, string(data))
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save quota index",
+			"error", err,
+			"traceID", traceID)
+	}
+}
+
+// quotaReader charges what is read to the write res, and fails once more
+// content is read than the quotas allow.
+type quotaReader struct {
+	r   io.Reader
+	q   *QuotaBackend
+	res *quotaReservation
+	err *QuotaError
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if r.err = r.q.charge(r.res, int64(n)); r.err != nil {
+			return 0, r.err
+		}
+	}
+	return n, err
+}
+
+// checkBytes refuses a write that would take a user or directory to used
+// bytes, written of them by the write itself. A zero limit is unlimited.
+func checkBytes(scope, name string, limit, used, written int64) *QuotaError {
+	if limit > 0 && used > limit {
+		return &QuotaError{Scope: scope, Name: name, Resource: "bytes", Limit: limit, TooLarge: written > limit}
+	}
+	return nil
+}
+
+// checkFiles refuses a new file for a user or directory already holding
+// files of them.
+func checkFiles(scope, name string, limit Limit, files int64) error {
+	if limit.Files > 0 && files+1 > limit.Files {
+		return &QuotaError{Scope: scope, Name: name, Resource: "files", Limit: limit.Files}
+	}
+	return nil
+}
+
+// quotaKey returns the canonical name of name, rejecting the quota index.
+func quotaKey(name string) (string, error) {
+	key, err := canonicalName(name)
+	if err != nil {
+		return "", err
+	}
+	if key == quotaIndexName {
+		return "", &PathError{Path: name, Err: ErrReservedPath}
+	}
+	return key, nil
+}
+
+// checkNotQuotaIndex rejects the name of the quota index.
+func checkNotQuotaIndex(name string) error {
+	_, err := quotaKey(name)
+	return err
+}
+
+// quotaUser returns the user a write in ctx is charged to.
+func quotaUser(ctx context.Context) string {
+	if user, _ := ctx.Value("user").(string); user != "" {
+		return user
+	}
+	return AnonymousUser
+}
+
+// quotaDir returns the top-level directory of the file key, or "" for files
+// outside any directory. Versions belong to the directory of their file.
+func quotaDir(key string) string {
+	if isVersionName(key) {
+		key = path.Dir(strings.TrimPrefix(key, versionsDir+"/"))
+	}
+	dir, _, found := strings.Cut(key, "/")
+	if !found {
+		return ""
+	}
+	return dir
+}
+
+// dirLabel names the top-level directory dir in errors and reports.
+func dirLabel(dir string) string {
+	if dir == "" {
+		return RootDirectory
+	}
+	return dir
+}
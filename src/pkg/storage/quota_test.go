@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaBackend(t *testing.T) {
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+	backend, err := NewQuotaBackend(context.Background(), root, QuotaConfig{
+		User: Limit{Bytes: 100, Files: 3},
+		Dir:  Limit{Bytes: 150},
+	})
+	require.NoError(t, err)
+
+	alice := context.WithValue(context.Background(), "user", "alice")
+	bob := context.WithValue(context.Background(), "user", "bob")
+
+	testCases := []struct {
+		name     string
+		ctx      context.Context
+		file     string
+		size     int
+		scope    string // of the quota exceeded, if any
+		resource string
+		tooLarge bool
+	}{
+		{name: "within_quota", ctx: alice, file: "docs/a.txt", size: 60},
+		{name: "user_bytes", ctx: alice, file: "docs/b.txt", size: 50, scope: "user", resource: "bytes"},
+		{name: "replacement_frees_old_size", ctx: alice, file: "docs/a.txt", size: 90},
+		{name: "too_large", ctx: alice, file: "other/c.txt", size: 101, scope: "user", resource: "bytes", tooLarge: true},
+		{name: "directory_bytes", ctx: bob, file: "docs/d.txt", size: 70, scope: "directory", resource: "bytes"},
+		{name: "other_directory", ctx: bob, file: "e.txt", size: 70},
+		{name: "small_files", ctx: bob, file: "f.txt", size: 1},
+		{name: "last_file", ctx: bob, file: "g.txt", size: 1},
+		{name: "user_files", ctx: bob, file: "h.txt", size: 1, scope: "user", resource: "files"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			content := strings.Repeat("x", tc.size)
+			err := backend.SaveData(tc.ctx, tc.file, content)
+			if tc.scope == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrQuotaExceeded)
+			var quotaErr *QuotaError
+			require.ErrorAs(t, err, &quotaErr)
+			require.Equal(t, tc.scope, quotaErr.Scope)
+			require.Equal(t, tc.resource, quotaErr.Resource)
+			require.Equal(t, tc.tooLarge, quotaErr.TooLarge)
+			_, err = backend.Stat(tc.ctx, tc.file)
+			if tc.file != "docs/a.txt" {
+				require.Error(t, err, "A refused write must not be stored")
+			}
+		})
+	}
+
+	report, err := backend.Usage("alice")
+	require.NoError(t, err)
+	require.Equal(t, Usage{Bytes: 90, Files: 1, Limit: Limit{Bytes: 100, Files: 3}}, report.Usage)
+	require.Equal(t, map[string]Usage{
+		"docs":        {Bytes: 90, Files: 1, Limit: Limit{Bytes: 150}},
+		RootDirectory: {Bytes: 72, Files: 3, Limit: Limit{Bytes: 150}},
+	}, report.Directories)
+
+	require.NoError(t, backend.Delete(bob, "e.txt"))
+	require.NoError(t, backend.SaveData(bob, "h.txt", "now it fits"), "Deleting should release the file")
+	report, err = backend.Usage("bob")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), report.Usage.Files)
+
+	page, err := backend.List(alice, ListOptions{})
+	require.NoError(t, err)
+	for _, file := range page.Files {
+		require.NotEqual(t, quotaIndexName, file.Name, "The quota index must not be listed")
+	}
+	_, err = backend.ReadData(alice, quotaIndexName)
+	require.ErrorIs(t, err, ErrReservedPath)
+	require.ErrorIs(t, backend.SaveData(alice, quotaIndexName, "{}"), ErrReservedPath)
+
+	reopened, err := NewQuotaBackend(context.Background(), root, backend.cfg)
+	require.NoError(t, err)
+	for _, user := range []string{"alice", "bob"} {
+		before, err := backend.Usage(user)
+		require.NoError(t, err)
+		after, err := reopened.Usage(user)
+		require.NoError(t, err)
+		require.Equal(t, before, after, "Usage should survive a restart")
+	}
+}
+
+func TestQuotaBackendCountsExistingFiles(t *testing.T) {
+	ctx := context.Background()
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, root.SaveData(ctx, "shared/old.txt", strings.Repeat("x", 40)), "Setup failed")
+
+	backend, err := NewQuotaBackend(ctx, root, QuotaConfig{Dir: Limit{Bytes: 50}})
+	require.NoError(t, err)
+	report, err := backend.Usage("")
+	require.NoError(t, err)
+	require.Equal(t, AnonymousUser, report.User)
+	require.Equal(t, Usage{}, report.Usage, "Files written before quotas belong to nobody")
+	require.Equal(t, int64(40), report.Directories["shared"].Bytes)
+
+	err = backend.SaveData(ctx, "shared/new.txt", strings.Repeat("y", 20))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestBackendConfigQuotaChargesVersions(t *testing.T) {
+	cfg := DefaultBackendConfig(t.TempDir())
+	fs := flag.NewFlagSet("quota", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-storage-versioning", "-quota-user-bytes=100", "-quota-dir-files=5"}))
+	require.Equal(t, QuotaConfig{User: Limit{Bytes: 100}, Dir: Limit{Files: 5}}, cfg.Quota)
+
+	backend, err := cfg.Open()
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), "user", "alice")
+	require.NoError(t, backend.SaveData(ctx, "notes/todo.txt", strings.Repeat("a", 40)))
+	require.NoError(t, backend.SaveData(ctx, "notes/todo.txt", strings.Repeat("b", 40)))
+
+	report, err := backend.(UsageReporter).Usage("alice")
+	require.NoError(t, err)
+	require.Equal(t, Usage{Bytes: 80, Files: 2, Limit: Limit{Bytes: 100}}, report.Usage, "The kept version should be charged")
+	require.Equal(t, int64(2), report.Directories["notes"].Files)
+
+	err = backend.SaveData(ctx, "notes/todo.txt", strings.Repeat("c", 40))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	content, err := backend.ReadData(ctx, "notes/todo.txt")
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("b", 40), content, "A refused write must leave the file alone")
+
+	_, err = NewVersionedBackend(NewMemoryBackend(), 0).Usage("alice")
+	require.ErrorIs(t, err, ErrNoQuota)
+}
+
+func TestQuotaBackendWritesRunConcurrently(t *testing.T) {
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+	backend, err := NewQuotaBackend(context.Background(), root, QuotaConfig{User: Limit{Bytes: 100}})
+	require.NoError(t, err)
+	alice := context.WithValue(context.Background(), "user", "alice")
+	bob := context.WithValue(context.Background(), "user", "bob")
+
+	// Alice's upload stalls halfway through
+	body, upload := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := backend.SaveStream(alice, "big.txt", body)
+		done <- err
+	}()
+	_, err = upload.Write([]byte(strings.Repeat("x", 60)))
+	require.NoError(t, err)
+
+	require.NoError(t, backend.SaveData(bob, "other.txt", "not blocked"), "Other writes must not wait for a stalled upload")
+	require.Eventually(t, func() bool {
+		usage, err := backend.Usage("alice")
+		return err == nil && usage.Usage.Bytes == 60
+	}, time.Second, time.Millisecond, "Bytes written so far should be reserved")
+	err = backend.SaveData(alice, "small.txt", strings.Repeat("y", 50))
+	require.ErrorIs(t, err, ErrQuotaExceeded, "Reserved bytes should count against the quota")
+
+	_, err = upload.Write([]byte(strings.Repeat("x", 30)))
+	require.NoError(t, err)
+	require.NoError(t, upload.Close())
+	require.NoError(t, <-done)
+
+	usage, err := backend.Usage("alice")
+	require.NoError(t, err)
+	require.Equal(t, Usage{Bytes: 90, Files: 1, Limit: Limit{Bytes: 100}}, usage.Usage)
+
+	// A refused upload gives back what it reserved
+	_, err = backend.SaveStream(alice, "big.txt", strings.NewReader(strings.Repeat("z", 120)))
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	usage, err = backend.Usage("alice")
+	require.NoError(t, err)
+	require.Equal(t, int64(90), usage.Usage.Bytes)
+}
@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrInvalidPath is returned for empty paths, paths naming the root
+	// itself and paths containing NUL bytes.
+	ErrInvalidPath = errors.New("invalid path")
+	// ErrAbsolutePath is returned for absolute paths; paths are always
+	// relative to the root.
+	ErrAbsolutePath = errors.New("absolute paths are not allowed")
+	// ErrPathTraversal is returned for paths whose ".." elements climb out
+	// of the root.
+	ErrPathTraversal = errors.New("path escapes the storage root")
+	// ErrSymlinkEscape is returned for paths that leave the root through a
+	// symbolic link.
+	ErrSymlinkEscape = errors.New("path leaves the storage root through a symlink")
+	// ErrIsDirectory is returned for paths naming an existing directory
+	// where a file is expected.
+	ErrIsDirectory = errors.New("path is a directory")
+	// ErrReservedPath is returned for names the package keeps its own
+	// bookkeeping under. A Root reserves checksums, in-flight writes and
+	// quarantined files; the file versions and the quota index are written
+	// through the Root, so VersionedBackend and QuotaBackend reserve those.
+	ErrReservedPath = errors.New("path is reserved for internal use")
+)
+
+// PathError records a path rejected by a Root and the reason.
+type PathError struct {
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("storage path %q: %v", e.Path, e.Err)
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// Root is the local-disk Backend. It confines file operations to a single
+// directory: paths handed to its methods are slash-separated and relative to
+// the root, and anything that would resolve outside it, lexically or through
+// a symbolic link, is rejected with a *PathError.
+//
+// Symbolic links are checked when a path is resolved, so a link swapped in
+// by someone with write access to the root between the check and the file
+// operation is not caught. Roots should therefore not be shared with
+// untrusted local users.
+type Root struct {
+	dir string
+
+	// locks serialises writes to the same file so SaveIf can check and
+	// replace it atomically with respect to other writers in the process.
+	locks nameLocks
+	// sums caches checksums of unchanged files.
+	sums checksumCache
+}
+
+// NewRoot returns a Root for dir, creating the directory if needed. dir is
+// made absolute and its own symbolic links are resolved up front.
+func NewRoot(dir string) (*Root, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	return &Root{dir: resolved}, nil
+}
+
+// Dir returns the absolute directory the root confines operations to.
+func (r *Root) Dir() string {
+	return r.dir
+}
+
+// Resolve validates name and returns the path it refers to on disk.
+func (r *Root) Resolve(name string) (string, error) {
+	clean, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+
+	full := filepath.Join(r.dir, clean)
+	if err := r.checkSymlinks(full); err != nil {
+		if errors.Is(err, ErrSymlinkEscape) {
+			return "", &PathError{Path: name, Err: err}
+		}
+		return "", err
+	}
+	return full, nil
+}
+
+// cleanName applies the lexical checks shared by every Backend and returns
+// name cleaned and in the native separator form.
+func cleanName(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return "", &PathError{Path: name, Err: ErrInvalidPath}
+	}
+
+	native := filepath.FromSlash(name)
+	if filepath.IsAbs(native) || filepath.VolumeName(native) != "" || strings.HasPrefix(name, "/") {
+		return "", &PathError{Path: name, Err: ErrAbsolutePath}
+	}
+	if !filepath.IsLocal(native) {
+		return "", &PathError{Path: name, Err: ErrPathTraversal}
+	}
+	clean := filepath.Clean(native)
+	if clean == "." {
+		return "", &PathError{Path: name, Err: ErrInvalidPath}
+	}
+	if isInternalName(filepath.Base(clean)) {
+		return "", &PathError{Path: name, Err: ErrReservedPath}
+	}
+	return clean, nil
+}
+
+// canonicalName validates name and returns its canonical slash-separated form,
+// so "a/./b" and "a/b" refer to the same file.
+func canonicalName(name string) (string, error) {
+	clean, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(clean), nil
+}
+
+// checkSymlinks resolves the longest existing prefix of full and makes sure
+// it is still inside the root. Components that do not exist yet cannot be
+// links.
+func (r *Root) checkSymlinks(full string) error {
+	for p := full; ; p = filepath.Dir(p) {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			if !r.contains(resolved) {
+				return ErrSymlinkEscape
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if p == r.dir {
+			return nil
+		}
+	}
+}
+
+// contains reports whether the resolved path lies inside the root.
+func (r *Root) contains(resolved string) bool {
+	rel, err := filepath.Rel(r.dir, resolved)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// resolveFile resolves name like Resolve and additionally rejects names
+// that refer to an existing directory, which a Backend cannot store data in.
+func (r *Root) resolveFile(name string) (string, error) {
+	full, err := r.Resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(full); err == nil && info.IsDir() {
+		return "", &PathError{Path: name, Err: ErrIsDirectory}
+	}
+	return full, nil
+}
+
+// SaveData atomically replaces the file name inside the root with data,
+// creating missing parent directories.
+func (r *Root) SaveData(ctx context.Context, name string, data string) error {
+	full, err := r.resolveFile(name)
+	if err != nil {
+		return err
+	}
+	unlock := r.locks.lock(full)
+	defer unlock()
+
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+	if err := SaveData(ctx, full, data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(data))
+	_, err = r.remember(full, hex.EncodeToString(sum[:]))
+	return err
+}
+
+// ReadData reads the file name inside the root.
+func (r *Root) ReadData(ctx context.Context, name string) (string, error) {
+	full, err := r.resolveFile(name)
+	if err != nil {
+		return "", err
+	}
+	return ReadData(ctx, full)
+}
+
+// SaveStream atomically replaces the file name inside the root with the
+// content of r, creating missing parent directories.
+func (r *Root) SaveStream(ctx context.Context, name string, src io.Reader) (int64, error) {
+	info, err := r.SaveIf(ctx, name, Condition{}, src)
+	return info.Size, err
+}
+
+// SaveIf atomically replaces the file name inside the root with the content
+// of src if cond holds, and describes the new content. The check and the
+// replacement are atomic with respect to other writes through r; writers
+// outside the process are not coordinated with.
+func (r *Root) SaveIf(ctx context.Context, name string, cond Condition, src io.Reader) (FileInfo, error) {
+	full, err := r.resolveFile(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	unlock := r.locks.lock(full)
+	defer unlock()
+
+	current, err := r.Stat(ctx, name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return FileInfo{}, err
+	}
+	if err := cond.check(name, current, exists); err != nil {
+		return FileInfo{}, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return FileInfo{}, err
+	}
+	h := sha256.New()
+	if _, err := SaveStream(ctx, full, io.TeeReader(src, h), WriteOptions{Durability: DefaultDurability}); err != nil {
+		return FileInfo{}, err
+	}
+
+	info, err := r.remember(full, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info.Name, _ = canonicalName(name)
+	info.Created = !exists
+	return info, nil
+}
+
+// remember caches sum as the checksum of the file just written to full and
+// describes it.
+func (r *Root) remember(full, sum string) (FileInfo, error) {
+	stat, err := os.Stat(full)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	r.sums.put(full, stat.Size(), stat.ModTime(), sum)
+	return FileInfo{Size: stat.Size(), ModTime: stat.ModTime(), SHA256: sum}, nil
+}
+
+// OpenStream opens the range rng of the file name inside the root.
+func (r *Root) OpenStream(ctx context.Context, name string, rng ReadRange) (*Stream, error) {
+	full, err := r.resolveFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return OpenStream(ctx, full, rng)
+}
+
+// Stat returns the size, modification time and checksum of the file name
+// inside the root. Checksums of files that have not changed since they were
+// last written or checked through r are not recomputed.
+func (r *Root) Stat(ctx context.Context, name string) (FileInfo, error) {
+	full, err := r.resolveFile(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	clean, _ := canonicalName(name)
+
+	stat, err := os.Stat(full)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if sum, ok := r.sums.get(full, stat.Size(), stat.ModTime()); ok {
+		return FileInfo{Name: clean, Size: stat.Size(), ModTime: stat.ModTime(), SHA256: sum}, nil
+	}
+
+	info, err := Stat(ctx, full)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	r.sums.put(full, info.Size, info.ModTime, info.SHA256)
+	info.Name = clean
+	return info, nil
+}
+
+// Delete removes the file name inside the root. Directories are left alone,
+// even when empty.
+func (r *Root) Delete(ctx context.Context, name string) error {
+	full, err := r.resolveFile(name)
+	if err != nil {
+		return err
+	}
+	unlock := r.locks.lock(full)
+	defer unlock()
+
+	r.sums.forget(full)
+	return Delete(ctx, full)
+}
+
+// Fsck verifies every file inside the root against its recorded checksum.
+func (r *Root) Fsck(ctx context.Context, opts FsckOptions) (FsckReport, error) {
+	return Fsck(ctx, r.dir, opts)
+}
+
+// List returns the files inside the root that match opts.
+func (r *Root) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	return List(ctx, r.dir, opts)
+}
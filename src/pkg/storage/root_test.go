@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootResolve(t *testing.T) {
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644), "Setup failed")
+
+	root, err := NewRoot(filepath.Join(t.TempDir(), "root"))
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(root.Dir(), "docs"), 0755), "Setup failed")
+	require.NoError(t, os.Symlink(outside, filepath.Join(root.Dir(), "escape")), "Setup failed")
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root.Dir(), "secret-link")), "Setup failed")
+	require.NoError(t, os.Symlink(filepath.Join(root.Dir(), "docs"), filepath.Join(root.Dir(), "docs-link")), "Setup failed")
+
+	testCases := []struct {
+		name     string
+		path     string
+		expected error
+	}{
+		{name: "plain_file", path: "notes.txt"},
+		{name: "nested_new_file", path: "docs/2025/report.txt"},
+		{name: "dot_segments_inside_root", path: "docs/../notes.txt"},
+		{name: "symlink_inside_root", path: "docs-link/report.txt"},
+		{name: "empty", path: "", expected: ErrInvalidPath},
+		{name: "root_itself", path: ".", expected: ErrInvalidPath},
+		{name: "nul_byte", path: "notes\x00.txt", expected: ErrInvalidPath},
+		{name: "absolute", path: "/etc/passwd", expected: ErrAbsolutePath},
+		{name: "parent", path: "../messages.txt", expected: ErrPathTraversal},
+		{name: "deep_traversal", path: "../../etc/passwd", expected: ErrPathTraversal},
+		{name: "traversal_after_subdir", path: "docs/../../outside.txt", expected: ErrPathTraversal},
+		{name: "symlinked_directory", path: "escape/secret.txt", expected: ErrSymlinkEscape},
+		{name: "new_file_in_symlinked_directory", path: "escape/new.txt", expected: ErrSymlinkEscape},
+		{name: "symlinked_file", path: "secret-link", expected: ErrSymlinkEscape},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			full, err := root.Resolve(tc.path)
+			if tc.expected != nil {
+				require.ErrorIs(t, err, tc.expected)
+				var pathErr *PathError
+				require.ErrorAs(t, err, &pathErr, "Rejections should be typed")
+				require.Equal(t, tc.path, pathErr.Path)
+				return
+			}
+
+			require.NoError(t, err)
+			rel, err := filepath.Rel(root.Dir(), full)
+			require.NoError(t, err)
+			require.True(t, filepath.IsLocal(rel), "Resolved path %s should be inside the root", full)
+		})
+	}
+}
+
+func TestRootSaveAndReadData(t *testing.T) {
+	ctx := context.Background()
+	root, err := NewRoot(t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, root.SaveData(ctx, "reports/2025/q4.txt", "quarterly"), "Missing parents should be created")
+	content, err := root.ReadData(ctx, "reports/2025/q4.txt")
+	require.NoError(t, err)
+	require.Equal(t, "quarterly", content)
+
+	onDisk, err := os.ReadFile(filepath.Join(root.Dir(), "reports", "2025", "q4.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "quarterly", string(onDisk))
+
+	require.ErrorIs(t, root.SaveData(ctx, "../escaped.txt", "x"), ErrPathTraversal)
+	_, err = os.Stat(filepath.Join(filepath.Dir(root.Dir()), "escaped.txt"))
+	require.True(t, os.IsNotExist(err), "Rejected writes must not touch the disk")
+}
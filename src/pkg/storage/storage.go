@@ -2,28 +2,64 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"log/slog"
 	"os"
 )
 
+// WriteOptions controls how SaveDataWithOptions writes a file.
+type WriteOptions struct {
+	// Durability selects how much of the write is flushed to disk before
+	// it returns. The zero value is DurabilityFull.
+	Durability Durability
+	// Compress stores the content gzip-compressed. ReadData decompresses
+	// it again; the recorded checksum describes the compressed bytes.
+	Compress bool
+}
+
 // SaveData provides a simple interface for persisting data to files.
 // This function implements the complete write logic with comprehensive logging
-// to enable debugging of file operation failures. Uses atomic file replacement
-// to ensure consistent state and proper error propagation.
+// to enable debugging of file operation failures. The file is replaced
+// atomically with DefaultDurability: readers see either the old or the new
+// content, never a partial write. The SHA-256 of data is recorded next to
+// the file so ReadData can detect later corruption.
 func SaveData(ctx context.Context, filePath string, data string) error {
+	return SaveDataWithOptions(ctx, filePath, data, WriteOptions{Durability: DefaultDurability})
+}
+
+// SaveDataWithOptions atomically replaces the file at filePath with data.
+// The content is written to a temporary file in the same directory, flushed
+// according to opts.Durability and renamed over the target.
+func SaveDataWithOptions(ctx context.Context, filePath string, data string, opts WriteOptions) error {
 	traceID, _ := ctx.Value("traceID").(string)
 
+	stored := []byte(data)
+	if opts.Compress {
+		compressed, err := encodeCompressed(stored)
+		if err != nil {
+			return err
+		}
+		stored = compressed
+	}
 	metrics := FileMetrics{
 		ContentSize: len(data),
+		LogicalSize: int64(len(data)),
+		DiskSize:    int64(len(stored)),
 		Operation:   "write",
 	}
 
 	slog.InfoContext(ctx, "Starting file write operation",
 		"filePath", filePath,
+		"durability", opts.Durability.String(),
 		"traceID", traceID,
 		"metrics", metrics)
 
-	err := os.WriteFile(filePath, []byte(data), 0644)
+	_, err := writeChecked(filePath, opts.Durability, func(w io.Writer) (int64, error) {
+		n, err := w.Write(stored)
+		return int64(n), err
+	})
 	if err != nil {
 		slog.ErrorContext(ctx, "File write failed",
 			"error", err,
@@ -42,6 +78,9 @@ func SaveData(ctx context.Context, filePath string, data string) error {
 // This function implements the complete read logic with structured logging
 // for operational visibility into file access patterns. Loads entire file
 // into memory which is appropriate for configuration files and small datasets.
+// If a checksum was recorded when the file was saved and the content no
+// longer matches it, a *CorruptionError is returned. Files saved with
+// WriteOptions.Compress are decompressed.
 func ReadData(ctx context.Context, filePath string) (string, error) {
 	traceID, _ := ctx.Value("traceID").(string)
 
@@ -49,7 +88,19 @@ func ReadData(ctx context.Context, filePath string) (string, error) {
 		"filePath", filePath,
 		"traceID", traceID)
 
-	fileBytes, err := os.ReadFile(filePath)
+	var content, fileBytes []byte
+	actual, recorded, err := readConsistent(filePath, func(f *os.File) (string, error) {
+		var err error
+		fileBytes, err = io.ReadAll(f)
+		sum := sha256.Sum256(fileBytes)
+		return hex.EncodeToString(sum[:]), err
+	})
+	if err == nil {
+		err = matchChecksum(filePath, actual, recorded)
+	}
+	if err == nil {
+		content, err = decodeCompressed(filePath, fileBytes)
+	}
 	if err != nil {
 		slog.ErrorContext(ctx, "File read failed",
 			"error", err,
@@ -59,13 +110,15 @@ func ReadData(ctx context.Context, filePath string) (string, error) {
 	}
 
 	metrics := FileMetrics{
-		BytesRead: len(fileBytes),
-		Operation: "read",
+		BytesRead:   len(fileBytes),
+		LogicalSize: int64(len(content)),
+		DiskSize:    int64(len(fileBytes)),
+		Operation:   "read",
 	}
 
 	slog.InfoContext(ctx, "File read successfully",
 		"filePath", filePath,
 		"traceID", traceID,
 		"metrics", metrics)
-	return string(fileBytes), nil
+	return string(content), nil
 }
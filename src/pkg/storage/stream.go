@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// ErrInvalidRange is returned when a ReadRange starts outside the file.
+var ErrInvalidRange = errors.New("invalid read range")
+
+// ReadRange selects the part of a file returned by OpenStream. The zero
+// value selects the whole file.
+type ReadRange struct {
+	// Offset is the first byte to return.
+	Offset int64
+	// Length is the maximum number of bytes to return. Zero or less reads
+	// to the end of the file.
+	Length int64
+}
+
+// resolve clamps r to a file of size bytes and returns the offset and
+// length to read.
+func (r ReadRange) resolve(size int64) (offset, length int64, err error) {
+	if r.Offset < 0 || r.Offset > size {
+		return 0, 0, fmt.Errorf("%w: offset %d in a file of %d bytes", ErrInvalidRange, r.Offset, size)
+	}
+	length = size - r.Offset
+	if r.Length > 0 && r.Length < length {
+		length = r.Length
+	}
+	return r.Offset, length, nil
+}
+
+// Stream reads a range of a stored file. The context passed to OpenStream is
+// checked before every chunk, so a cancelled request stops reading at the
+// next Read call. Close logs the number of bytes streamed.
+type Stream struct {
+	// Size is the size of the whole file.
+	Size int64
+	// Offset is the position of the first byte returned.
+	Offset int64
+	// Length is the number of bytes the stream returns.
+	Length int64
+	// ModTime is when the file was last replaced.
+	ModTime time.Time
+
+	ctx      context.Context
+	name     string
+	r        io.Reader
+	closer   io.Closer
+	streamed int64
+	closed   bool
+
+	// recorded holds the checksums the content is verified against once
+	// fully read from file, using hash; they are unset for partial reads.
+	recorded []string
+	file     *os.File
+	hash     hash.Hash
+}
+
+// newStream wraps the range [offset, offset+length) of src, which must
+// already be positioned at offset.
+func newStream(ctx context.Context, name string, src io.Reader, closer io.Closer, modTime time.Time, size, offset, length int64) *Stream {
+	return &Stream{
+		Size:    size,
+		Offset:  offset,
+		Length:  length,
+		ModTime: modTime,
+		ctx:     ctx,
+		name:    name,
+		r:       io.LimitReader(&ctxReader{ctx: ctx, r: src}, length),
+		closer:  closer,
+	}
+}
+
+// Read implements io.Reader.
+func (s *Stream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.streamed += int64(n)
+	if s.hash != nil {
+		s.hash.Write(p[:n])
+		if err == io.EOF {
+			// A file replaced since it was opened was complete, but the
+			// record read may already describe its replacement
+			if mismatch := matchChecksum(s.name, hexSum(s.hash), s.recorded); mismatch != nil && !replacedSince(s.file, s.name) {
+				err = mismatch
+			}
+		}
+	}
+	return n, err
+}
+
+// Close releases the underlying file and logs the bytes streamed.
+func (s *Stream) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var err error
+	if s.closer != nil {
+		err = s.closer.Close()
+	}
+
+	traceID, _ := s.ctx.Value("traceID").(string)
+	metrics := FileMetrics{
+		BytesStreamed: s.streamed,
+		Operation:     "stream-read",
+	}
+	slog.InfoContext(s.ctx, "File stream closed",
+		"filePath", s.name,
+		"offset", s.Offset,
+		"length", s.Length,
+		"traceID", traceID,
+		"metrics", metrics)
+	return err
+}
+
+// ctxReader checks ctx before every read so long copies stop promptly once
+// the caller gives up.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// streamChunkSize is the buffer size used when copying streams, and so the
+// granularity at which cancellation is noticed.
+const streamChunkSize = 64 * 1024
+
+// SaveStream atomically replaces the file at filePath with everything read
+// from r, without holding the content in memory. ctx is checked between
+// chunks; if it is cancelled, or r fails, the previous content is left in
+// place. The SHA-256 of the content is recorded next to the file. It
+// returns the number of bytes written.
+func SaveStream(ctx context.Context, filePath string, r io.Reader, opts WriteOptions) (int64, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	slog.InfoContext(ctx, "Starting file stream write operation",
+		"filePath", filePath,
+		"durability", opts.Durability.String(),
+		"traceID", traceID)
+
+	written, err := writeChecked(filePath, opts.Durability, func(w io.Writer) (int64, error) {
+		return io.CopyBuffer(w, &ctxReader{ctx: ctx, r: r}, make([]byte, streamChunkSize))
+	})
+	metrics := FileMetrics{
+		BytesStreamed: written,
+		Operation:     "stream-write",
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "File stream write failed",
+			"error", err,
+			"filePath", filePath,
+			"traceID", traceID,
+			"metrics", metrics)
+		return written, err
+	}
+
+	slog.InfoContext(ctx, "File streamed successfully",
+		"filePath", filePath,
+		"traceID", traceID,
+		"metrics", metrics)
+	return written, nil
+}
+
+// OpenStream opens the range rng of the file at filePath for reading. The
+// caller must close the returned Stream. When the whole file is read and a
+// checksum was recorded for it, the final Read returns a *CorruptionError
+// instead of io.EOF if the content does not match.
+func OpenStream(ctx context.Context, filePath string, rng ReadRange) (*Stream, error) {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	slog.InfoContext(ctx, "Starting file stream read operation",
+		"filePath", filePath,
+		"offset", rng.Offset,
+		"length", rng.Length,
+		"traceID", traceID)
+
+	stream, err := openFileStream(ctx, filePath, rng)
+	if err != nil {
+		slog.ErrorContext(ctx, "File stream open failed",
+			"error", err,
+			"filePath", filePath,
+			"traceID", traceID)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func openFileStream(ctx context.Context, filePath string, rng ReadRange) (*Stream, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, &os.PathError{Op: "read", Path: filePath, Err: fmt.Errorf("is a directory")}
+	}
+
+	offset, length, err := rng.resolve(info.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	stream := newStream(ctx, filePath, f, f, info.ModTime(), info.Size(), offset, length)
+
+	if offset == 0 && length == info.Size() {
+		recorded, err := readChecksums(filePath)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if len(recorded) > 0 {
+			stream.recorded, stream.file, stream.hash = recorded, f, sha256.New()
+		}
+	}
+	return stream, nil
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// cancelAfter yields endless data and cancels the context once limit bytes
+// have been read, standing in for a client that disconnects mid-upload.
+type cancelAfter struct {
+	cancel context.CancelFunc
+	limit  int
+	read   int
+}
+
+func (c *cancelAfter) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	c.read += len(p)
+	if c.read >= c.limit {
+		c.cancel()
+	}
+	return len(p), nil
+}
+
+func TestOpenStreamRanges(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "digits.txt")
+	require.NoError(t, os.WriteFile(filePath, []byte("0123456789"), 0644), "Setup failed")
+
+	testCases := []struct {
+		name      string
+		rng       ReadRange
+		expected  string
+		expectErr error
+	}{
+		{name: "whole_file", expected: "0123456789"},
+		{name: "prefix", rng: ReadRange{Length: 4}, expected: "0123"},
+		{name: "middle", rng: ReadRange{Offset: 3, Length: 4}, expected: "3456"},
+		{name: "suffix", rng: ReadRange{Offset: 7}, expected: "789"},
+		{name: "length_past_end", rng: ReadRange{Offset: 8, Length: 100}, expected: "89"},
+		{name: "offset_at_end", rng: ReadRange{Offset: 10}, expected: ""},
+		{name: "offset_past_end", rng: ReadRange{Offset: 11}, expectErr: ErrInvalidRange},
+		{name: "negative_offset", rng: ReadRange{Offset: -1}, expectErr: ErrInvalidRange},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stream, err := OpenStream(ctx, filePath, tc.rng)
+			if tc.expectErr != nil {
+				require.ErrorIs(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			defer stream.Close()
+
+			content, err := io.ReadAll(stream)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, string(content))
+			require.Equal(t, int64(10), stream.Size)
+			require.Equal(t, int64(len(tc.expected)), stream.Length)
+		})
+	}
+}
+
+func TestSaveStreamWritesLargeContent(t *testing.T) {
+	ctx := context.Background()
+	filePath := filepath.Join(t.TempDir(), "artifact.bin")
+	size := int64(5*streamChunkSize + 123)
+
+	written, err := SaveStream(ctx, filePath, io.LimitReader(strings.NewReader(strings.Repeat("a", int(size))), size), WriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, size, written)
+
+	info, err := os.Stat(filePath)
+	require.NoError(t, err)
+	require.Equal(t, size, info.Size())
+}
+
+func TestSaveStreamCancelledKeepsOldContent(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "artifact.bin")
+	require.NoError(t, os.WriteFile(filePath, []byte("old"), 0644), "Setup failed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	src := &cancelAfter{cancel: cancel, limit: 3 * streamChunkSize}
+
+	_, err := SaveStream(ctx, filePath, src, WriteOptions{})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, src.read, 5*streamChunkSize, "Cancellation should be noticed at the next chunk")
+
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, "old", string(content), "A cancelled stream must not replace the file")
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "Temporary files should be cleaned up after a cancelled stream")
+}
+
+func TestOpenStreamStopsWhenCancelled(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "artifact.bin")
+	require.NoError(t, os.WriteFile(filePath, []byte(strings.Repeat("a", 4*streamChunkSize)), 0644), "Setup failed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := OpenStream(ctx, filePath, ReadRange{})
+	require.NoError(t, err)
+	defer stream.Close()
+
+	buf := make([]byte, streamChunkSize)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+
+	cancel()
+	_, err = stream.Read(buf)
+	require.ErrorIs(t, err, context.Canceled)
+}
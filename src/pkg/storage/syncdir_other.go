@@ -0,0 +1,9 @@
+//go:build !unix
+
+package storage
+
+// syncDir is a no-op on platforms that cannot fsync a directory; there the
+// rename is only as durable as the file system makes it.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package storage
+
+import "os"
+
+// syncDir flushes the directory entry changes of dir, such as a rename, to
+// disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -4,7 +4,12 @@ package storage
 // This type enables consistent performance monitoring and debugging across
 // all file operations by capturing essential operation characteristics.
 type FileMetrics struct {
-	ContentSize int    `json:"content_size"`
-	BytesRead   int    `json:"bytes_read"`
+	ContentSize   int   `json:"content_size"`
+	BytesRead     int   `json:"bytes_read"`
+	BytesStreamed int64 `json:"bytes_streamed,omitempty"`
+	// LogicalSize and DiskSize are the size of the content and the size it
+	// takes on disk; they differ for compressed files.
+	LogicalSize int64  `json:"logical_size,omitempty"`
+	DiskSize    int64  `json:"disk_size,omitempty"`
 	Operation   string `json:"operation"`
 }
@@ -0,0 +1,406 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// versionsDir is the directory, inside the wrapped Backend, that holds
+// previous revisions. Revision id of file name is stored at
+// versionsDir/name/id.
+const versionsDir = ".versions"
+
+var (
+	// ErrVersionNotFound is returned for version IDs that do not exist. It
+	// is always accompanied by fs.ErrNotExist.
+	ErrVersionNotFound = errors.New("version not found")
+)
+
+// Version describes a previous revision of a file.
+type Version struct {
+	// ID identifies the revision. IDs of the same file sort in the order
+	// the revisions were replaced.
+	ID string `json:"id"`
+	// Size is the length of the revision in bytes.
+	Size int64 `json:"size"`
+	// ReplacedAt is when the revision was superseded or deleted.
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// VersionedBackend wraps a Backend and keeps the previous content of a file
+// whenever it is overwritten, deleted or restored. Revisions are stored in
+// the wrapped Backend under .versions/, which is hidden from List and cannot
+// be addressed directly.
+type VersionedBackend struct {
+	inner       Backend
+	maxVersions int
+
+	// mu serialises snapshots with the writes that follow them, and
+	// guards lastID.
+	mu     sync.Mutex
+	lastID int64
+}
+
+// NewVersionedBackend returns a VersionedBackend over inner that keeps at
+// most maxVersions revisions per file, dropping the oldest first. Zero or
+// less keeps every revision.
+func NewVersionedBackend(inner Backend, maxVersions int) *VersionedBackend {
+	return &VersionedBackend{inner: inner, maxVersions: maxVersions}
+}
+
+// SaveData keeps the current content of name as a version and replaces it
+// with data.
+func (v *VersionedBackend) SaveData(ctx context.Context, name string, data string) error {
+	_, err := v.SaveStream(ctx, name, strings.NewReader(data))
+	return err
+}
+
+// ReadData returns the current content of name.
+func (v *VersionedBackend) ReadData(ctx context.Context, name string) (string, error) {
+	if err := checkNotReserved(name); err != nil {
+		return "", err
+	}
+	return v.inner.ReadData(ctx, name)
+}
+
+// SaveStream keeps the current content of name as a version and replaces it
+// with the content of r.
+func (v *VersionedBackend) SaveStream(ctx context.Context, name string, r io.Reader) (int64, error) {
+	info, err := v.SaveIf(ctx, name, Condition{}, r)
+	return info.Size, err
+}
+
+// SaveIf keeps the current content of name as a version and replaces it
+// with the content of r, provided cond holds. No version is kept when the
+// condition fails.
+func (v *VersionedBackend) SaveIf(ctx context.Context, name string, cond Condition, r io.Reader) (FileInfo, error) {
+	if err := checkNotReserved(name); err != nil {
+		return FileInfo{}, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if cond != (Condition{}) {
+		current, err := v.inner.Stat(ctx, name)
+		exists := err == nil
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return FileInfo{}, err
+		}
+		if err := cond.check(name, current, exists); err != nil {
+			return FileInfo{}, err
+		}
+	}
+
+	if err := v.snapshot(ctx, name); err != nil {
+		return FileInfo{}, err
+	}
+	info, err := v.inner.SaveIf(ctx, name, cond, r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return info, v.prune(ctx, name)
+}
+
+// OpenStream opens the range rng of the current content of name.
+func (v *VersionedBackend) OpenStream(ctx context.Context, name string, rng ReadRange) (*Stream, error) {
+	if err := checkNotReserved(name); err != nil {
+		return nil, err
+	}
+	return v.inner.OpenStream(ctx, name, rng)
+}
+
+// OpenGzip opens the gzip data of the current content of name, if the
+// wrapped Backend stores it compressed.
+func (v *VersionedBackend) OpenGzip(ctx context.Context, name string) (*Stream, error) {
+	if err := checkNotReserved(name); err != nil {
+		return nil, err
+	}
+	if gz, ok := v.inner.(GzipOpener); ok {
+		return gz.OpenGzip(ctx, name)
+	}
+	return nil, fmt.Errorf("%s: %w", name, ErrNotCompressed)
+}
+
+// Usage reports storage usage, if the wrapped Backend enforces quotas.
+// Versions count as part of the directory of their file.
+func (v *VersionedBackend) Usage(user string) (UsageReport, error) {
+	if r, ok := v.inner.(UsageReporter); ok {
+		return r.Usage(user)
+	}
+	return UsageReport{}, ErrNoQuota
+}
+
+// Stat describes the current content of name.
+func (v *VersionedBackend) Stat(ctx context.Context, name string) (FileInfo, error) {
+	if err := checkNotReserved(name); err != nil {
+		return FileInfo{}, err
+	}
+	return v.inner.Stat(ctx, name)
+}
+
+// Delete keeps the current content of name as a version and removes it. The
+// file can be brought back with Restore.
+func (v *VersionedBackend) Delete(ctx context.Context, name string) error {
+	if err := checkNotReserved(name); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.snapshot(ctx, name); err != nil {
+		return err
+	}
+	if err := v.inner.Delete(ctx, name); err != nil {
+		return err
+	}
+	return v.prune(ctx, name)
+}
+
+// List returns the current files matching opts. Stored versions are never
+// listed.
+func (v *VersionedBackend) List(ctx context.Context, opts ListOptions) (ListPage, error) {
+	limit := opts.limit()
+
+	var page ListPage
+	for {
+		inner, err := v.inner.List(ctx, opts)
+		if err != nil {
+			return ListPage{}, err
+		}
+		for _, file := range inner.Files {
+			if !isVersionName(file.Name) {
+				page.Files = append(page.Files, file)
+			}
+		}
+		if len(page.Files) >= limit || inner.NextCursor == "" {
+			if len(page.Files) > limit || (len(page.Files) == limit && inner.NextCursor != "") {
+				page.Files = page.Files[:limit]
+				page.NextCursor = page.Files[limit-1].Name
+			}
+			return page, nil
+		}
+		opts.Cursor = inner.NextCursor
+	}
+}
+
+// Versions returns the stored revisions of name, oldest first.
+func (v *VersionedBackend) Versions(ctx context.Context, name string) ([]Version, error) {
+	key, err := versionedName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := versionsDir + "/" + key + "/"
+	var versions []Version
+	opts := ListOptions{Prefix: prefix, Limit: MaxListLimit}
+	for {
+		page, err := v.inner.List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range page.Files {
+			id := strings.TrimPrefix(file.Name, prefix)
+			// Deeper entries are versions of files below name
+			if !validVersionID(id) {
+				continue
+			}
+			versions = append(versions, Version{ID: id, Size: file.Size, ReplacedAt: file.ModTime})
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID < versions[j].ID })
+	return versions, nil
+}
+
+// ReadVersion returns the content of revision id of name.
+func (v *VersionedBackend) ReadVersion(ctx context.Context, name, id string) (string, error) {
+	stream, err := v.OpenVersion(ctx, name, id, ReadRange{})
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	var buf strings.Builder
+	if _, err := io.Copy(&buf, stream); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// OpenVersion opens the range rng of revision id of name.
+func (v *VersionedBackend) OpenVersion(ctx context.Context, name, id string, rng ReadRange) (*Stream, error) {
+	versionName, err := versionPath(name, id)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := v.inner.OpenStream(ctx, versionName, rng)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, versionNotFound(name, id)
+	}
+	return stream, err
+}
+
+// Restore makes revision id the current content of name. The content being
+// replaced, if any, is kept as a new version, so a restore can be undone.
+func (v *VersionedBackend) Restore(ctx context.Context, name, id string) error {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	versionName, err := versionPath(name, id)
+	if err != nil {
+		return err
+	}
+	stream, err := v.inner.OpenStream(ctx, versionName, ReadRange{})
+	if errors.Is(err, fs.ErrNotExist) {
+		return versionNotFound(name, id)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := v.snapshot(ctx, name); err != nil {
+		return err
+	}
+	if _, err := v.inner.SaveStream(ctx, name, stream); err != nil {
+		return err
+	}
+	// Pruning only after the copy keeps the restored version readable
+	if err := v.prune(ctx, name); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "File version restored",
+		"name", name,
+		"versionID", id,
+		"traceID", traceID)
+	return nil
+}
+
+// snapshot copies the current content of name, if any, to a new version.
+// v.mu must be held.
+func (v *VersionedBackend) snapshot(ctx context.Context, name string) error {
+	traceID, _ := ctx.Value("traceID").(string)
+
+	current, err := v.inner.OpenStream(ctx, name, ReadRange{})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer current.Close()
+
+	id := v.nextID()
+	versionName, err := versionPath(name, id)
+	if err != nil {
+		return err
+	}
+	if _, err := v.inner.SaveStream(ctx, versionName, current); err != nil {
+		return fmt.Errorf("keep version of %s: %w", name, err)
+	}
+
+	slog.InfoContext(ctx, "File version kept",
+		"name", name,
+		"versionID", id,
+		"traceID", traceID)
+	return nil
+}
+
+// prune removes the oldest versions of name beyond maxVersions. v.mu must be
+// held.
+func (v *VersionedBackend) prune(ctx context.Context, name string) error {
+	if v.maxVersions <= 0 {
+		return nil
+	}
+	versions, err := v.Versions(ctx, name)
+	if err != nil {
+		return err
+	}
+	for len(versions) > v.maxVersions {
+		versionName, err := versionPath(name, versions[0].ID)
+		if err != nil {
+			return err
+		}
+		if err := v.inner.Delete(ctx, versionName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// nextID returns a version ID later than any handed out before. IDs are the
+// zero-padded replacement time in nanoseconds, so they sort as strings.
+// v.mu must be held.
+func (v *VersionedBackend) nextID() string {
+	id := max(time.Now().UnixNano(), v.lastID+1)
+	v.lastID = id
+	return fmt.Sprintf("%020d", id)
+}
+
+// versionedName validates name as a regular, non-reserved file name and
+// returns its canonical form.
+func versionedName(name string) (string, error) {
+	key, err := canonicalName(name)
+	if err != nil {
+		return "", err
+	}
+	if isVersionName(key) {
+		return "", &PathError{Path: name, Err: ErrReservedPath}
+	}
+	return key, nil
+}
+
+// versionPath returns where revision id of name is stored.
+func versionPath(name, id string) (string, error) {
+	key, err := versionedName(name)
+	if err != nil {
+		return "", err
+	}
+	if !validVersionID(id) {
+		return "", versionNotFound(name, id)
+	}
+	return versionsDir + "/" + key + "/" + id, nil
+}
+
+// checkNotReserved rejects names inside versionsDir.
+func checkNotReserved(name string) error {
+	_, err := versionedName(name)
+	return err
+}
+
+// isVersionName reports whether the canonical name lies in versionsDir.
+func isVersionName(key string) bool {
+	return key == versionsDir || strings.HasPrefix(key, versionsDir+"/")
+}
+
+// validVersionID reports whether id has the form nextID produces.
+func validVersionID(id string) bool {
+	if len(id) != 20 {
+		return false
+	}
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+func versionNotFound(name, id string) error {
+	return fmt.Errorf("%w: %s@%s: %w", ErrVersionNotFound, name, id, fs.ErrNotExist)
+}
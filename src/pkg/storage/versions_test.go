@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// versionedBackends returns a constructor per wrapped Backend.
+func versionedBackends() map[string]func(t *testing.T, maxVersions int) *VersionedBackend {
+	return map[string]func(t *testing.T, maxVersions int) *VersionedBackend{
+		"local": func(t *testing.T, maxVersions int) *VersionedBackend {
+			root, err := NewRoot(t.TempDir())
+			require.NoError(t, err)
+			return NewVersionedBackend(root, maxVersions)
+		},
+		"memory": func(t *testing.T, maxVersions int) *VersionedBackend {
+			return NewVersionedBackend(NewMemoryBackend(), maxVersions)
+		},
+	}
+}
+
+// versionContents reads every version of name, oldest first.
+func versionContents(t *testing.T, backend *VersionedBackend, name string) []string {
+	t.Helper()
+	ctx := context.Background()
+	versions, err := backend.Versions(ctx, name)
+	require.NoError(t, err)
+
+	contents := make([]string, len(versions))
+	for i, version := range versions {
+		contents[i], err = backend.ReadVersion(ctx, name, version.ID)
+		require.NoError(t, err)
+	}
+	return contents
+}
+
+func TestVersionedBackendKeepsHistory(t *testing.T) {
+	for name, newBackend := range versionedBackends() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newBackend(t, 0)
+
+			for _, content := range []string{"v1", "v2", "v3"} {
+				require.NoError(t, backend.SaveData(ctx, "docs/plan.txt", content))
+			}
+			current, err := backend.ReadData(ctx, "docs/plan.txt")
+			require.NoError(t, err)
+			require.Equal(t, "v3", current)
+			require.Equal(t, []string{"v1", "v2"}, versionContents(t, backend, "docs/plan.txt"))
+
+			versions, err := backend.Versions(ctx, "docs/plan.txt")
+			require.NoError(t, err)
+			require.NoError(t, backend.Restore(ctx, "docs/plan.txt", versions[0].ID))
+			current, err = backend.ReadData(ctx, "docs/plan.txt")
+			require.NoError(t, err)
+			require.Equal(t, "v1", current, "Restore should bring back the old content")
+			require.Equal(t, []string{"v1", "v2", "v3"}, versionContents(t, backend, "docs/plan.txt"), "The replaced content should be kept")
+
+			page, err := backend.List(ctx, ListOptions{})
+			require.NoError(t, err)
+			require.Equal(t, []string{"docs/plan.txt"}, listNames(page), "Versions must not be listed")
+		})
+	}
+}
+
+func TestVersionedBackendRetention(t *testing.T) {
+	for name, newBackend := range versionedBackends() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newBackend(t, 2)
+
+			for _, content := range []string{"v1", "v2", "v3", "v4", "v5"} {
+				require.NoError(t, backend.SaveData(ctx, "report.txt", content))
+			}
+			require.Equal(t, []string{"v3", "v4"}, versionContents(t, backend, "report.txt"), "Only the newest versions should be kept")
+
+			versions, err := backend.Versions(ctx, "report.txt")
+			require.NoError(t, err)
+			require.NoError(t, backend.Restore(ctx, "report.txt", versions[0].ID), "Restoring the oldest kept version should survive pruning")
+			current, err := backend.ReadData(ctx, "report.txt")
+			require.NoError(t, err)
+			require.Equal(t, "v3", current)
+			require.Equal(t, []string{"v4", "v5"}, versionContents(t, backend, "report.txt"))
+		})
+	}
+}
+
+func TestVersionedBackendDeleteCanBeRestored(t *testing.T) {
+	for name, newBackend := range versionedBackends() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newBackend(t, 0)
+
+			require.NoError(t, backend.SaveData(ctx, "notes.txt", "keep me"))
+			require.NoError(t, backend.Delete(ctx, "notes.txt"))
+			_, err := backend.ReadData(ctx, "notes.txt")
+			require.ErrorIs(t, err, fs.ErrNotExist)
+			require.ErrorIs(t, backend.Delete(ctx, "notes.txt"), fs.ErrNotExist)
+
+			versions, err := backend.Versions(ctx, "notes.txt")
+			require.NoError(t, err)
+			require.Len(t, versions, 1)
+			require.NoError(t, backend.Restore(ctx, "notes.txt", versions[0].ID))
+			content, err := backend.ReadData(ctx, "notes.txt")
+			require.NoError(t, err)
+			require.Equal(t, "keep me", content)
+		})
+	}
+}
+
+func TestVersionedBackendRejectsBadNames(t *testing.T) {
+	ctx := context.Background()
+	backend := NewVersionedBackend(NewMemoryBackend(), 0)
+	require.NoError(t, backend.SaveData(ctx, "a.txt", "one"))
+	require.NoError(t, backend.SaveData(ctx, "a.txt", "two"))
+
+	require.ErrorIs(t, backend.SaveData(ctx, ".versions/a.txt/00000000000000000001", "forged"), ErrReservedPath)
+	_, err := backend.ReadData(ctx, ".versions/a.txt")
+	require.ErrorIs(t, err, ErrReservedPath)
+
+	for _, id := range []string{"", "latest", "../../a.txt", "00000000000000000001"} {
+		_, err := backend.ReadVersion(ctx, "a.txt", id)
+		require.ErrorIs(t, err, ErrVersionNotFound, "Version %q", id)
+		require.ErrorIs(t, err, fs.ErrNotExist, "Version %q", id)
+	}
+}
@@ -4,6 +4,9 @@ go 1.22
 
 require (
 	cgi.com/goLangTraining/proto/message_service v0.0.0
+	cgi.com/goLangTraining/src/pkg/envelope v0.0.0-00010101000000-000000000000
+	cgi.com/goLangTraining/src/pkg/message v0.0.0-00010101000000-000000000000
+	cgi.com/goLangTraining/src/pkg/messagestore v0.0.0-00010101000000-000000000000
 	github.com/google/uuid v1.6.0
 	google.golang.org/grpc v1.76.0
 	google.golang.org/protobuf v1.36.10
@@ -13,6 +16,12 @@ replace cgi.com/goLangTraining/proto/message_service => ../proto/message_service
 
 replace cgi.com/goLangTraining/src/pkg/storage => ../src/pkg/storage
 
+replace cgi.com/goLangTraining/src/pkg/messagestore => ../src/pkg/messagestore
+
+replace cgi.com/goLangTraining/src/pkg/message => ../src/pkg/message
+
+replace cgi.com/goLangTraining/src/pkg/envelope => ../src/pkg/envelope
+
 require (
 	golang.org/x/net v0.42.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"log/slog"
@@ -11,6 +11,9 @@ import (
 	"time"
 
 	pb "cgi.com/goLangTraining/proto/message_service"
+	"cgi.com/goLangTraining/src/pkg/envelope"
+	"cgi.com/goLangTraining/src/pkg/message"
+	"cgi.com/goLangTraining/src/pkg/messagestore"
 	"github.com/google/uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/types/known/emptypb"
@@ -22,22 +25,15 @@ const (
 	messagesFileName = "messages.txt"
 )
 
-// Message represents a message in our system (matching main.go structure)
-type Message struct {
-	ID        int       `json:"id"`
-	User      string    `json:"user"`
-	Message   string    `json:"message"`
-	Timestamp time.Time `json:"timestamp"`
-	TraceID   string    `json:"trace_id,omitempty"`
-}
-
 // messageServer implements the MessageService gRPC service
 type messageServer struct {
 	pb.UnimplementedMessageServiceServer
+	store messagestore.MessageStore
+	index *messagestore.SearchIndex
 }
 
 // Save implements the Save RPC method
-func (s *messageServer) Save(ctx context.Context, req *pb.SaveMessageRequest) (*emptypb.Empty, error) {
+func (s *messageServer) Save(ctx context.Context, req *pb.SaveMessageRequest) (*pb.Message, error) {
 	traceID := uuid.New().String()
 	ctx = context.WithValue(ctx, "traceID", traceID)
 
@@ -51,8 +47,12 @@ func (s *messageServer) Save(ctx context.Context, req *pb.SaveMessageRequest) (*
 		return nil, fmt.Errorf("user and message are required")
 	}
 
-	// Save message using the same logic as main.go
-	err := saveMessage(ctx, req.User, req.Message)
+	// Save message through the same store implementation as main.go
+	saved, err := s.store.Append(ctx, message.Message{
+		User:      req.User,
+		Message:   req.Message,
+		Timestamp: time.Now(),
+	})
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to save message",
 			"error", err,
@@ -63,9 +63,10 @@ func (s *messageServer) Save(ctx context.Context, req *pb.SaveMessageRequest) (*
 
 	slog.InfoContext(ctx, "Message saved successfully",
 		"user", req.User,
+		"message_id", saved.ID,
 		"traceID", traceID)
 
-	return &emptypb.Empty{}, nil
+	return toProtoMessage(saved), nil
 }
 
 // GetLast10 implements the GetLast10 RPC method
@@ -75,8 +76,8 @@ func (s *messageServer) GetLast10(ctx context.Context, req *emptypb.Empty) (*pb.
 
 	slog.InfoContext(ctx, "Received GetLast10 request", "traceID", traceID)
 
-	// Read messages from file
-	messages, err := readLast10Messages(ctx)
+	// Read messages from the store
+	messages, err := s.store.Tail(ctx, 10)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to read messages",
 			"error", err,
@@ -87,14 +88,7 @@ func (s *messageServer) GetLast10(ctx context.Context, req *emptypb.Empty) (*pb.
 	// Convert to protobuf messages
 	var pbMessages []*pb.Message
 	for _, msg := range messages {
-		pbMsg := &pb.Message{
-			Id:        int32(msg.ID),
-			User:      msg.User,
-			Message:   msg.Message,
-			Timestamp: timestamppb.New(msg.Timestamp),
-			TraceId:   msg.TraceID,
-		}
-		pbMessages = append(pbMessages, pbMsg)
+		pbMessages = append(pbMessages, toProtoMessage(msg))
 	}
 
 	slog.InfoContext(ctx, "Returning messages",
@@ -106,126 +100,69 @@ func (s *messageServer) GetLast10(ctx context.Context, req *emptypb.Empty) (*pb.
 	}, nil
 }
 
-// saveMessage saves a message to the file (similar to main.go addMessage function)
-func saveMessage(ctx context.Context, user, message string) error {
-	traceID, _ := ctx.Value("traceID").(string)
-
-	f, err := os.OpenFile(messagesFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	line := fmt.Sprintf("[%s] %s: %s\n", timestamp, user, message)
-	_, err = f.WriteString(line)
-	if err != nil {
-		return err
-	}
+// Search implements the Search RPC method
+func (s *messageServer) Search(ctx context.Context, req *pb.SearchRequest) (*pb.SearchResponse, error) {
+	traceID := uuid.New().String()
+	ctx = context.WithValue(ctx, "traceID", traceID)
 
-	slog.InfoContext(ctx, "Message appended to file",
-		"user", user,
-		"message", message,
+	slog.InfoContext(ctx, "Received Search request",
+		"query", req.Query,
+		"cursor", req.Cursor,
 		"traceID", traceID)
 
-	return nil
-}
-
-// readLast10Messages reads the last 10 messages from the file
-func readLast10Messages(ctx context.Context) ([]Message, error) {
-	traceID, _ := ctx.Value("traceID").(string)
-
-	f, err := os.Open(messagesFileName)
-	if err != nil {
-		if os.IsNotExist(err) {
-			slog.InfoContext(ctx, "Messages file does not exist, returning empty list", "traceID", traceID)
-			return []Message{}, nil
-		}
-		return nil, err
-	}
-	defer f.Close()
-
-	var lines []string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	// Get last 10 lines
-	start := 0
-	if len(lines) > 10 {
-		start = len(lines) - 10
-	}
-
-	var messages []Message
-	for i, line := range lines[start:] {
-		if line != "" {
-			message := parseMessageLine(line, start+i+1, traceID)
-			if message != nil {
-				messages = append(messages, *message)
-			}
-		}
-	}
-
-	return messages, nil
-}
-
-// parseMessageLine parses a message line from the file (similar to main.go)
-func parseMessageLine(line string, id int, traceID string) *Message {
-	// Simple parsing for [timestamp] user: message format
-	if len(line) < 22 { // Minimum length for timestamp + user + message
-		return nil
+	if req.Limit < 0 {
+		return nil, fmt.Errorf("limit must not be negative")
 	}
-
-	// Find end of timestamp (look for "] ")
-	timestampEnd := -1
-	for i := 0; i < len(line)-1; i++ {
-		if line[i] == ']' && line[i+1] == ' ' {
-			timestampEnd = i
-			break
+	query := messagestore.SearchQuery{Text: req.Query, Limit: int(req.Limit)}
+	if req.Cursor != "" {
+		before, err := messagestore.ParseCursor(req.Cursor)
+		if err != nil {
+			return nil, err
 		}
+		query.Before = before
 	}
 
-	if timestampEnd == -1 {
-		return nil
+	page, err := s.index.Search(ctx, query)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to search messages",
+			"error", err,
+			"query", req.Query,
+			"traceID", traceID)
+		return nil, fmt.Errorf("failed to search messages: %w", err)
 	}
 
-	remaining := line[timestampEnd+2:] // Skip "] "
-
-	// Find ": " separator
-	colonIndex := -1
-	for i := 0; i < len(remaining)-1; i++ {
-		if remaining[i] == ':' && remaining[i+1] == ' ' {
-			colonIndex = i
-			break
+	hits := make([]*pb.SearchHit, len(page.Hits))
+	for i, hit := range page.Hits {
+		hits[i] = &pb.SearchHit{
+			Message: toProtoMessage(hit.Message),
+			Snippet: hit.Snippet,
 		}
 	}
 
-	if colonIndex == -1 {
-		return nil
-	}
+	slog.InfoContext(ctx, "Returning search hits",
+		"count", len(hits),
+		"traceID", traceID)
 
-	user := remaining[:colonIndex]
-	messageText := remaining[colonIndex+2:]
+	return &pb.SearchResponse{
+		Hits:       hits,
+		NextCursor: page.NextCursor,
+	}, nil
+}
 
-	// Parse timestamp
-	timestampStr := line[1:timestampEnd] // Remove [ and ]
-	timestamp, err := time.Parse("2006-01-02 15:04:05", timestampStr)
-	if err != nil {
-		timestamp = time.Now() // Fallback
+// toProtoMessage converts a stored message to its protobuf representation
+func toProtoMessage(msg message.Message) *pb.Message {
+	m := &pb.Message{
+		Id:        int32(msg.ID),
+		User:      msg.User,
+		Message:   msg.Message,
+		Timestamp: timestamppb.New(msg.Timestamp),
+		TraceId:   msg.TraceID,
+		Deleted:   msg.Deleted,
 	}
-
-	return &Message{
-		ID:        id,
-		User:      user,
-		Message:   messageText,
-		Timestamp: timestamp,
-		TraceID:   traceID,
+	if msg.EditedAt != nil {
+		m.EditedAt = timestamppb.New(*msg.EditedAt)
 	}
+	return m
 }
 
 func main() {
@@ -239,6 +176,27 @@ func main() {
 	)
 	slog.SetDefault(logger)
 
+	// Select the message store; the flags match those of the web service
+	storeConfig := messagestore.DefaultConfig(messagesFileName)
+	storeConfig.RegisterFlags(flag.CommandLine)
+	var keyConfig envelope.Config
+	keyConfig.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	keys, err := keyConfig.Load()
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+	storeConfig.Keys = keys
+
+	store, err := storeConfig.Open()
+	if err != nil {
+		log.Fatalf("Failed to create message store: %v", err)
+	}
+	if segments, ok := store.(*messagestore.SegmentStore); ok {
+		go segments.RunCompactor(context.Background(), storeConfig.CompactInterval)
+	}
+
 	// Create TCP listener
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
@@ -248,8 +206,13 @@ func main() {
 	// Create gRPC server
 	s := grpc.NewServer()
 
-	// Register message service
-	pb.RegisterMessageServiceServer(s, &messageServer{})
+	// Register message service; messages are saved through the search index
+	// so they are searchable at once
+	index := messagestore.NewSearchIndex(store)
+	pb.RegisterMessageServiceServer(s, &messageServer{
+		store: index,
+		index: index,
+	})
 
 	slog.Info("Starting gRPC Message Store Server",
 		"port", port,
@@ -257,11 +220,13 @@ func main() {
 
 	fmt.Printf("🚀 gRPC Message Store Server started on port %s\n", port)
 	fmt.Printf("📋 Available services:\n")
-	fmt.Printf("   - Save(SaveMessageRequest) -> Empty\n")
+	fmt.Printf("   - Save(SaveMessageRequest) -> Message\n")
 	fmt.Printf("   - GetLast10(Empty) -> GetLast10Response\n")
+	fmt.Printf("   - Search(SearchRequest) -> SearchResponse\n")
 	fmt.Printf("\n💡 Test with grpcurl:\n")
 	fmt.Printf("   grpcurl -plaintext -d '{\"user\":\"alice\",\"message\":\"Hello gRPC!\"}' localhost:50051 message_service.MessageService/Save\n")
 	fmt.Printf("   grpcurl -plaintext localhost:50051 message_service.MessageService/GetLast10\n")
+	fmt.Printf("   grpcurl -plaintext -d '{\"query\":\"hello\"}' localhost:50051 message_service.MessageService/Search\n")
 
 	// Start server
 	if err := s.Serve(lis); err != nil {